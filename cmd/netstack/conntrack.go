@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+)
+
+// flows seen by the stack, shared by the firewall (state matches) and NAT
+var conntracks = conntrack.NewTable(conntrack.DefaultMaxEntries)
+
+// forgets idle flows
+func expireConntrack() {
+	for now := range time.Tick(time.Second) {
+		for _, e := range conntracks.Expire(now) {
+			fmt.Printf(ColorGray+"[CT] Expired %s\n"+ColorReset, &e)
+		}
+	}
+}
+
+// runs a conntrack command, used by the console:
+//
+//	list | flush | delete [proto P] [src IP] [dst IP]
+func conntrackCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ct list|flush|delete ...")
+	}
+
+	switch args[0] {
+	case "list":
+		entries := conntracks.Entries()
+		fmt.Printf(ColorCyan+"%d tracked flows\n"+ColorReset, len(entries))
+		for _, e := range entries {
+			fmt.Printf(ColorCyan+"   %s\n"+ColorReset, &e)
+		}
+	case "flush":
+		n := conntracks.DeleteFunc(func(conntrack.Entry) bool { return true })
+		fmt.Printf(ColorCyan+"Deleted %d flows\n"+ColorReset, n)
+	case "delete":
+		match, err := parseFlowFilter(args[1:])
+		if err != nil {
+			return err
+		}
+		n := conntracks.DeleteFunc(match)
+		fmt.Printf(ColorCyan+"Deleted %d flows\n"+ColorReset, n)
+	default:
+		return fmt.Errorf("unknown ct command %q", args[0])
+	}
+	return nil
+}
+
+// parses "[proto P] [src IP] [dst IP]" into a matcher on the original direction
+func parseFlowFilter(args []string) (func(conntrack.Entry) bool, error) {
+	var proto string
+	var src, dst net.IP
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %q", args[i])
+		}
+		val := args[i+1]
+		switch args[i] {
+		case "proto":
+			proto = val
+		case "src", "dst":
+			ip := net.ParseIP(val).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", val)
+			}
+			if args[i] == "src" {
+				src = ip
+			} else {
+				dst = ip
+			}
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", args[i])
+		}
+	}
+
+	return func(e conntrack.Entry) bool {
+		return (proto == "" || conntrack.ProtocolName(e.Orig.Protocol) == proto) &&
+			(src == nil || src.Equal(e.Orig.Src[:])) &&
+			(dst == nil || dst.Equal(e.Orig.Dst[:]))
+	}, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// reads commands (one per line) so the stack can be reconfigured while it runs
+func console(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		var err error
+		switch args[0] {
+		case "fw":
+			err = firewallCommand(args[1:])
+		case "ct":
+			err = conntrackCommand(args[1:])
+		case "qdisc":
+			err = qdiscCommand(args[1:])
+		case "martians":
+			printMartians()
+		case "pmtu":
+			err = pmtuCommand(args[1:])
+		case "ipsec":
+			err = ipsecCommand(args[1:])
+		case "nd":
+			err = ndCommand(args[1:])
+		case "help":
+			fmt.Println("Commands:")
+			fmt.Println("   fw append|insert|delete|flush|policy|list ...   packet filter, e.g. fw append input proto tcp dport 22 drop")
+			fmt.Println("   ct list|flush|delete [proto P] [src IP] [dst IP]   connection tracking table")
+			fmt.Println("   qdisc show | qdisc replace DEV KIND ...   egress queueing, e.g. qdisc replace tap0 tbf rate 1mbit burst 10k")
+			fmt.Println("   martians   reverse path filter mode and spoofed packet drop counters")
+			fmt.Println("   pmtu show|flush|probe DST   path MTU cache, probe finds the path MTU with DF pings")
+			fmt.Println("   ipsec show   security associations, policies and ESP drop counters")
+			fmt.Println("   nd show   IPv6 addresses with their lifetimes, MLD groups, neighbor caches and IPv6 routes")
+		default:
+			err = fmt.Errorf("unknown command %q, try help", args[0])
+		}
+		if err != nil {
+			fmt.Printf(ColorRed+"Error: %v\n"+ColorReset, err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hexhaust/mini-netstack/pkg/socket"
+)
+
+// port of the UDP echo service (RFC 862), 0 when it's off
+var udpEchoPort uint16 = 7
+
+// binds the echo service to port on every address of both families,
+// unicast datagrams go back to their sender unchanged
+func startUDPEcho(port uint16) error {
+	s, err := udpSockets.Bind(nil, port, false, func(s *socket.UDPSocket, d *socket.Datagram) {
+		// answering broadcasts would make us an amplifier
+		if isBroadcastIP(d.DstIP) || d.DstIP.IsMulticast() {
+			return
+		}
+		// clients send from ephemeral ports. Port 0 is invalid and the system
+		// ports are other services (echo, chargen, ...): a datagram spoofed
+		// from one of those would start an endless loop between the two
+		if d.SrcPort < 1024 {
+			fmt.Printf(ColorRed+"   -> Not echoing to service port %d of %s\n"+ColorReset, d.SrcPort, d.SrcIP)
+			return
+		}
+		fmt.Printf(ColorBlue+"   -> Echoing %d bytes to %s\n"+ColorReset, len(d.Data), d.SrcIP)
+		if err := s.Reply(d, d.Data); err != nil {
+			log.Printf("UDP echo error: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf(ColorCyan+"UDP echo on %s\n"+ColorReset, s)
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/firewall"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// packet filter, configured with -fw and the fw console command
+var fw = firewall.New(logFiltered)
+
+// runs a packet through a hook, returns false if it must go no further
+// rejected packets we received are answered here, our own are just dropped
+func filterIPv4(hook firewall.Hook, in, out string, state conntrack.State, ipPacket *packets.IPv4Header) bool {
+	p := &firewall.Packet{
+		In: in, Out: out,
+		Src: ipPacket.SrcIP, Dst: ipPacket.DstIP, Protocol: ipPacket.Protocol,
+		Length: int(ipPacket.TotalLength), L4: ipPacket.Payload, Fragment: ipPacket.FragmentOffset != 0,
+		State: state,
+	}
+	verdict, rule := fw.Filter(hook, p)
+	switch verdict {
+	case firewall.Accept:
+		return true
+	case firewall.Reject:
+		if in != "" {
+			sendReject(ipPacket, rule.RejectWith)
+		}
+	}
+	return false
+}
+
+// answers a rejected packet with a TCP reset or an ICMP unreachable
+func sendReject(ipPacket *packets.IPv4Header, with firewall.RejectWith) {
+	if with != firewall.RejectTCPReset {
+		hdr, err := ipPacket.Bytes()
+		if err == nil {
+			sendICMPError(packets.NewICMPUnreachable(with.ICMPCode(), append(hdr, ipPacket.Payload...)))
+		}
+		return
+	}
+
+	if rst, ok := tcpReset(ipPacket.Payload); ok && !isBroadcastIP(ipPacket.DstIP) && !ipPacket.DstIP.IsMulticast() {
+		replyIPv4(ipPacket, packets.ProtocolTCP, rst.Bytes(4, ipPacket.DstIP, ipPacket.SrcIP))
+	}
+}
+
+// runs an IPv6 packet through a hook like filterIPv4, proto and l4 are the
+// transport protocol and header past the extension headers
+func filterIPv6(hook firewall.Hook, in, out string, state conntrack.State, ip *packets.IPv6Header, exts []packets.IPv6Extension, proto uint8, l4 []byte) bool {
+	p := &firewall.Packet{
+		In: in, Out: out,
+		Src: ip.SrcIP, Dst: ip.DstIP, Protocol: proto,
+		Length: packets.IPv6HeaderLen + len(ip.Payload), L4: l4,
+		State: state,
+	}
+	verdict, rule := fw.Filter(hook, p)
+	switch verdict {
+	case firewall.Accept:
+		return true
+	case firewall.Reject:
+		if n, ok := nics.Get(in); ok {
+			sendReject6(n, ip, exts, l4, rule.RejectWith)
+		}
+	}
+	return false
+}
+
+// answers a rejected IPv6 packet received on n with a TCP reset or an ICMPv6 error
+func sendReject6(n *nic.NIC, ip *packets.IPv6Header, exts []packets.IPv6Extension, l4 []byte, with firewall.RejectWith) {
+	pkt := append(ip.Bytes(), ip.Payload...)
+	switch with {
+	case firewall.RejectTCPReset:
+		if rst, ok := tcpReset(l4); ok && !ip.DstIP.IsMulticast() {
+			sendIPv6(n, ip.DstIP, ip.SrcIP, packets.ProtocolTCP, 0, rst.Bytes(6, ip.DstIP, ip.SrcIP))
+		}
+	case firewall.RejectProtoUnreachable:
+		// the Next Header field naming the protocol is the pointer, as in deliverIPv6
+		pointer := 6
+		if len(exts) > 0 {
+			pointer = exts[len(exts)-1].Offset
+		}
+		sendICMPv6Error(n, pkt, packets.ICMPv6ParamProblem, packets.IPv6ProblemNextHeader, uint32(pointer))
+	default:
+		sendICMPv6Error(n, pkt, packets.ICMPv6DestUnreachable, with.ICMPv6Code(), 0)
+	}
+}
+
+// builds the reset answering a TCP segment, false if it's a reset itself
+func tcpReset(segment []byte) (packets.TCPHeader, bool) {
+	tcpPacket, err := packets.ParseTCP(segment)
+	if err != nil || tcpPacket.Flags&packets.TCPFlagRST != 0 {
+		return packets.TCPHeader{}, false
+	}
+
+	// RFC 793 3.4: take the sequence number from the ACK if there is one,
+	// otherwise acknowledge everything the segment occupied
+	rst := packets.TCPHeader{SrcPort: tcpPacket.DstPort, DstPort: tcpPacket.SrcPort, Flags: packets.TCPFlagRST}
+	if tcpPacket.Flags&packets.TCPFlagACK != 0 {
+		rst.SeqNum = tcpPacket.AckNum
+	} else {
+		rst.Flags |= packets.TCPFlagACK
+		rst.AckNum = tcpPacket.SeqNum + uint32(len(tcpPacket.Data))
+		if tcpPacket.Flags&packets.TCPFlagSYN != 0 {
+			rst.AckNum++
+		}
+		if tcpPacket.Flags&packets.TCPFlagFIN != 0 {
+			rst.AckNum++
+		}
+	}
+	return rst, true
+}
+
+func logFiltered(hook firewall.Hook, r *firewall.Rule, p *firewall.Packet) {
+	fmt.Printf(ColorYellow+"[FW] %s%s IN=%s OUT=%s %s -> %s proto=%d len=%d state=%s\n"+ColorReset,
+		r.LogPrefix, strings.ToUpper(hook.String()), p.In, p.Out, p.Src, p.Dst, p.Protocol, p.Length, p.State)
+}
+
+// runs a firewall command, used by -fw and the console:
+//
+//	append HOOK RULE | insert HOOK POS RULE | delete HOOK POS
+//	flush HOOK | policy HOOK accept|drop | list [HOOK]
+func firewallCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: fw append|insert|delete|flush|policy|list ...")
+	}
+	if args[0] == "list" {
+		return listFirewall(args[1:])
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s needs a hook", args[0])
+	}
+	hook, err := firewall.ParseHook(args[1])
+	if err != nil {
+		return err
+	}
+	rest := args[2:]
+
+	switch args[0] {
+	case "append":
+		r, err := firewall.ParseRule(strings.Join(rest, " "))
+		if err != nil {
+			return err
+		}
+		fw.Append(hook, r)
+	case "insert", "delete":
+		if len(rest) == 0 {
+			return fmt.Errorf("%s needs a position", args[0])
+		}
+		pos, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return fmt.Errorf("invalid position %q", rest[0])
+		}
+		if args[0] == "delete" {
+			return fw.Delete(hook, pos)
+		}
+		r, err := firewall.ParseRule(strings.Join(rest[1:], " "))
+		if err != nil {
+			return err
+		}
+		return fw.Insert(hook, pos, r)
+	case "flush":
+		fw.Flush(hook)
+	case "policy":
+		if len(rest) != 1 || (rest[0] != "accept" && rest[0] != "drop") {
+			return fmt.Errorf("policy must be accept or drop")
+		}
+		policy := firewall.Accept
+		if rest[0] == "drop" {
+			policy = firewall.Drop
+		}
+		return fw.SetPolicy(hook, policy)
+	default:
+		return fmt.Errorf("unknown fw command %q", args[0])
+	}
+	return nil
+}
+
+// prints the chains with their counters
+func listFirewall(args []string) error {
+	hooks := []firewall.Hook{firewall.Prerouting, firewall.Input, firewall.Forward, firewall.Output, firewall.Postrouting}
+	if len(args) > 0 {
+		hook, err := firewall.ParseHook(args[0])
+		if err != nil {
+			return err
+		}
+		hooks = []firewall.Hook{hook}
+	}
+
+	for _, hook := range hooks {
+		policy, rules := fw.Chain(hook)
+		fmt.Printf(ColorCyan+"Chain %s (policy %s)\n"+ColorReset, hook, policy)
+		for i, r := range rules {
+			pkts, bytes := r.Counters()
+			fmt.Printf(ColorCyan+"   %d: %s [%d packets, %d bytes]\n"+ColorReset, i, r, pkts, bytes)
+		}
+	}
+	return nil
+}
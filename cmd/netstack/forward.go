@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/firewall"
+	"github.com/hexhaust/mini-netstack/pkg/fragment"
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+// set by -forward, turns the stack into a router between its NICs
+var forwarding bool
+
+// routes a packet that isn't addressed to us (RFC 1812 5.2)
+func forwardIPv4(in *nic.NIC, frame *frames.EthernetFrame, ipPacket *packets.IPv4Header, state conntrack.State) {
+	// only forward what was sent to our MAC, never link-layer or IP broadcasts
+	if frame.DstMAC != [6]byte(in.MAC) || ipPacket.DstIP.Equal(net.IPv4bcast) {
+		return
+	}
+
+	raw := frame.Payload[:ipPacket.TotalLength]
+
+	if ipPacket.TTL <= 1 {
+		fmt.Printf(ColorRed+"[FWD] TTL expired for %s -> %s\n"+ColorReset, ipPacket.SrcIP, ipPacket.DstIP)
+		sendICMPError(packets.NewICMPTimeExceeded(packets.ICMPCodeTTLExceeded, raw))
+		return
+	}
+
+	route, ok := routes.Lookup(ipPacket.DstIP)
+	if !ok {
+		fmt.Printf(ColorRed+"[FWD] No route to %s\n"+ColorReset, ipPacket.DstIP)
+		sendICMPError(packets.NewICMPUnreachable(packets.ICMPCodeNetUnreachable, raw))
+		return
+	}
+	out, ok := nics.Get(route.Interface)
+	if !ok {
+		return
+	}
+	if !filterIPv4(firewall.Forward, in.Name, out.Name, state, ipPacket) || !filterIPv4(firewall.Postrouting, in.Name, out.Name, state, ipPacket) {
+		return
+	}
+
+	// our own copy, the receive buffer is reused for the next frame
+	pkt := append([]byte(nil), raw...)
+	decrementTTL(pkt)
+
+	if protectForward(ipPacket, pkt) {
+		return
+	}
+	sendRedirect(in, out, raw, ipPacket, route.NextHop(ipPacket.DstIP))
+
+	fmt.Printf(ColorGray+"[FWD] %s -> %s via %s (%s -> %s)\n"+ColorReset,
+		ipPacket.SrcIP, ipPacket.DstIP, route.NextHop(ipPacket.DstIP), in.Name, out.Name)
+
+	if len(pkt) <= out.Dev.MTU {
+		outputIPv4(out, route.NextHop(ipPacket.DstIP), pkt)
+		return
+	}
+
+	// too big for the next link: fragment it ourselves, or tell the source if DF is set
+	fwdHeader, err := packets.ParseIPv4(pkt)
+	if err != nil {
+		return
+	}
+	pieces, err := fragment.SplitIPv4(fwdHeader, fwdHeader.Payload, out.Dev.MTU)
+	if errors.Is(err, fragment.ErrFragmentationNeeded) {
+		fmt.Printf(ColorRed+"[FWD] %d bytes don't fit MTU %d of %s and DF is set\n"+ColorReset, len(pkt), out.Dev.MTU, out.Dev.Name)
+		sendICMPError(packets.NewICMPFragNeeded(out.Dev.MTU, raw))
+		return
+	}
+	if err != nil {
+		return
+	}
+	for _, piece := range pieces {
+		outputIPv4(out, route.NextHop(ipPacket.DstIP), piece)
+	}
+}
+
+// tells the source about a better first hop when the packet leaves the way it
+// came and the source shares a subnet with the next hop (RFC 1812 5.2.7.2)
+// host redirects only, net ones are ambiguous with subnets (RFC 1812 4.3.3.2)
+func sendRedirect(in, out *nic.NIC, raw []byte, ipPacket *packets.IPv4Header, nextHop net.IP) {
+	if in != out || nextHop.Equal(ipPacket.SrcIP) || !in.OnLink(ipPacket.SrcIP) || !in.OnLink(nextHop) {
+		return
+	}
+	msg, err := packets.NewICMPRedirect(packets.ICMPCodeRedirectHost, nextHop, raw)
+	if err != nil {
+		return
+	}
+	fmt.Printf(ColorYellow+"[FWD] Redirecting %s to %s for %s\n"+ColorReset, ipPacket.SrcIP, nextHop, ipPacket.DstIP)
+	sendICMPError(msg)
+}
+
+// decrements the TTL of a serialized packet and patches the header checksum
+// incrementally (RFC 1624) instead of recomputing it
+func decrementTTL(pkt []byte) {
+	// TTL shares its 16-bit word with the protocol field
+	oldWord := binary.BigEndian.Uint16(pkt[8:10])
+	pkt[8]--
+	newWord := binary.BigEndian.Uint16(pkt[8:10])
+
+	csum := binary.BigEndian.Uint16(pkt[10:12])
+	binary.BigEndian.PutUint16(pkt[10:12], utils.UpdateChecksum(csum, oldWord, newWord))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+func handleICMPv6(n *nic.NIC, ipPacket *packets.IPv6Header, exts []packets.IPv6Extension, payload []byte) {
+	if !packets.VerifyICMPv6(payload, ipPacket.SrcIP, ipPacket.DstIP) {
+		fmt.Printf(ColorRed+"[ICMPv6] Bad checksum from %s\n"+ColorReset, ipPacket.SrcIP)
+		return
+	}
+	msg, err := packets.ParseICMPv6(payload)
+	if err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case packets.ICMPv6EchoRequest:
+		handleEchoRequest6(n, ipPacket, msg)
+	case packets.ICMPv6EchoReply:
+		id, seq, _ := msg.Echo()
+		fmt.Printf(ColorGreen+"[ICMPv6] Echo reply from %s (ID=%d Seq=%d)\n"+ColorReset, ipPacket.SrcIP, id, seq)
+	case packets.MLDListenerQuery, packets.MLDv1ListenerReport:
+		handleMLD(n, ipPacket, exts, msg)
+	case packets.ICMPv6RouterAdvertisement:
+		handleRouterAdvertisement(n, ipPacket, msg)
+	case packets.ICMPv6NeighborSolicitation:
+		handleNeighborSolicitation(n, ipPacket, msg)
+	case packets.ICMPv6NeighborAdvertisement:
+		handleNeighborAdvertisement(n, ipPacket, msg)
+	case packets.ICMPv6PacketTooBig:
+		handleICMPv6Error(ipPacket, msg)
+		handlePacketTooBig(msg)
+	case packets.ICMPv6DestUnreachable, packets.ICMPv6TimeExceeded, packets.ICMPv6ParamProblem:
+		handleICMPv6Error(ipPacket, msg)
+	}
+}
+
+// answers pings, multicast ones from one of our unicast addresses (RFC 4443 4.2)
+func handleEchoRequest6(n *nic.NIC, ipPacket *packets.IPv6Header, msg *packets.ICMPv6Message) {
+	fmt.Printf(ColorGreen+"[ICMPv6] Echo request from %s, sending reply...\n"+ColorReset, ipPacket.SrcIP)
+
+	var src net.IP
+	if !ipPacket.DstIP.IsMulticast() {
+		src = ipPacket.DstIP
+	}
+	id, seq, data := msg.Echo()
+	pong := packets.NewICMPv6Echo(packets.ICMPv6EchoReply, id, seq, data)
+	if err := sendICMPv6(n, src, ipPacket.SrcIP, 0, pong); err != nil {
+		fmt.Printf(ColorRed+"[ICMPv6] Error sending reply: %v\n"+ColorReset, err)
+	}
+}
+
+// reports errors about packets we sent
+func handleICMPv6Error(ipPacket *packets.IPv6Header, msg *packets.ICMPv6Message) {
+	// the quote may be cut short, only the addresses are needed
+	quote := msg.Quote()
+	about := "a truncated packet"
+	if len(quote) >= packets.IPv6HeaderLen {
+		about = fmt.Sprintf("%s -> %s", net.IP(quote[8:24]), net.IP(quote[24:40]))
+	}
+
+	detail := fmt.Sprintf("code %d", msg.Code)
+	switch msg.Type {
+	case packets.ICMPv6PacketTooBig:
+		detail = fmt.Sprintf("MTU %d", msg.Param())
+	case packets.ICMPv6ParamProblem:
+		detail = fmt.Sprintf("code %d at offset %d", msg.Code, msg.Param())
+	}
+	fmt.Printf(ColorRed+"%s from %s about %s (%s)\n"+ColorReset, msg, ipPacket.SrcIP, about, detail)
+}
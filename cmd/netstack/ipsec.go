@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/ipsec"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// SAs and policies from -ipsec-sa and -ipsec-sp
+var sadb = ipsec.NewDatabase()
+
+// packets dropped before any SA could count them
+var (
+	espNoSA           atomic.Uint64 // unknown SPI or addresses
+	espPolicyDrops    atomic.Uint64 // decrypted fine, but not what the SA may carry
+	cleartextDrops    atomic.Uint64 // arrived unprotected although policy requires ESP
+	discardedByPolicy atomic.Uint64
+)
+
+// applies the outbound policy to a packet we originate: transport mode turns
+// data into ESP and rewrites ipHeader to match, tunnel mode sends the
+// encapsulated packet itself and returns nil. Other traffic passes unchanged,
+// discarded traffic returns nil and an error
+func protectOutput(ipHeader *packets.IPv4Header, data []byte) ([]byte, error) {
+	// the ESP we produce must not be matched again
+	if !sadb.Active() || ipHeader.Protocol == packets.ProtocolESP {
+		return data, nil
+	}
+
+	policy, sa, ok := sadb.Lookup(ipsec.Out, ipHeader.SrcIP, ipHeader.DstIP, ipHeader.Protocol)
+	if !ok || policy.Action == ipsec.Bypass {
+		return data, nil
+	}
+	if policy.Action == ipsec.Discard {
+		discardedByPolicy.Add(1)
+		return nil, fmt.Errorf("%s -> %s: discarded by IPsec policy", ipHeader.SrcIP, ipHeader.DstIP)
+	}
+
+	if sa.Mode == ipsec.Tunnel {
+		inner := *ipHeader
+		inner.TotalLength = uint16(inner.HeaderLen() + len(data))
+		hdr, err := inner.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return nil, sendESPTunnel(sa, append(hdr, data...))
+	}
+
+	esp, err := sa.Seal(ipHeader.Protocol, data)
+	if err != nil {
+		return nil, err
+	}
+	ipHeader.Protocol = packets.ProtocolESP
+	return esp, nil
+}
+
+// applies the outbound policy to an IPv6 packet we originate, which is only
+// ever bypassed or discarded as SAs carry IPv4
+func discardOutput6(src, dst net.IP, protocol uint8) error {
+	if !sadb.Active() {
+		return nil
+	}
+	if policy, _, ok := sadb.Lookup(ipsec.Out, src, dst, protocol); ok && policy.Action == ipsec.Discard {
+		discardedByPolicy.Add(1)
+		return fmt.Errorf("%s -> %s: discarded by IPsec policy", src, dst)
+	}
+	return nil
+}
+
+// sends a forwarded packet through a tunnel mode SA if the outbound policy
+// says so (security gateway), returns false if the packet isn't for IPsec
+func protectForward(ipPacket *packets.IPv4Header, pkt []byte) bool {
+	if !sadb.Active() {
+		return false
+	}
+	policy, sa, ok := sadb.Lookup(ipsec.Out, ipPacket.SrcIP, ipPacket.DstIP, ipPacket.Protocol)
+	if !ok || policy.Action == ipsec.Bypass {
+		return false
+	}
+	if policy.Action == ipsec.Discard {
+		discardedByPolicy.Add(1)
+		return true
+	}
+	// transport mode only protects our own traffic
+	if sa.Mode != ipsec.Tunnel {
+		return false
+	}
+	if err := sendESPTunnel(sa, pkt); err != nil {
+		fmt.Printf(ColorRed+"[ESP] Error protecting %s -> %s: %v\n"+ColorReset, ipPacket.SrcIP, ipPacket.DstIP, err)
+	}
+	return true
+}
+
+// wraps a whole IPv4 packet in ESP towards the far tunnel endpoint
+func sendESPTunnel(sa *ipsec.SA, inner []byte) error {
+	esp, err := sa.Seal(packets.ProtocolIPIP, inner)
+	if err != nil {
+		return err
+	}
+	outer := newIPv4Header(sa.Dst, packets.ProtocolESP)
+	outer.SrcIP = sa.Src
+	outer.TOS = inner[1]
+	return sendIPv4Header(outer, esp)
+}
+
+// reports whether a packet from src to dst that didn't come out of ESP may be
+// processed, IPv4 or IPv6. Traffic a policy wants protected must not arrive in
+// the clear (RFC 4301 5.2)
+func ipsecInputAllowed(src, dst net.IP, protocol uint8) bool {
+	if !sadb.Active() || protocol == packets.ProtocolESP {
+		return true
+	}
+
+	policy, _, ok := sadb.Lookup(ipsec.In, src, dst, protocol)
+	if !ok || policy.Action == ipsec.Bypass {
+		return true
+	}
+	if policy.Action == ipsec.Discard {
+		discardedByPolicy.Add(1)
+	} else {
+		cleartextDrops.Add(1)
+	}
+	return false
+}
+
+// authenticates and decrypts ESP sent to us, then processes what it carried
+// as if it had arrived on n in the clear
+func handleESP(n *nic.NIC, ipPacket *packets.IPv4Header) {
+	spi, _ := ipsec.SPI(ipPacket.Payload)
+	sa, ok := sadb.SA(spi)
+	if !ok || !sa.Dst.Equal(ipPacket.DstIP) || !sa.Src.Equal(ipPacket.SrcIP) {
+		espNoSA.Add(1)
+		fmt.Printf(ColorGray+"[ESP] No SA for SPI 0x%x from %s\n"+ColorReset, spi, ipPacket.SrcIP)
+		return
+	}
+
+	nextHeader, payload, err := sa.Open(ipPacket.Payload)
+	if err != nil {
+		fmt.Printf(ColorRed+"[ESP] Dropping packet for SPI 0x%x from %s: %v\n"+ColorReset, spi, ipPacket.SrcIP, err)
+		return
+	}
+
+	var inner []byte
+	switch {
+	case sa.Mode == ipsec.Tunnel && nextHeader == packets.ProtocolIPIP:
+		inner = payload
+	case sa.Mode == ipsec.Transport && nextHeader != packets.ProtocolIPIP:
+		hdr := *ipPacket
+		hdr.Protocol = nextHeader
+		hdr.TotalLength = uint16(hdr.HeaderLen() + len(payload))
+		hdr.Flags, hdr.FragmentOffset = 0, 0
+		raw, err := hdr.Bytes()
+		if err != nil {
+			espPolicyDrops.Add(1)
+			return
+		}
+		inner = append(raw, payload...)
+	default:
+		espPolicyDrops.Add(1)
+		return
+	}
+
+	// the SA may only carry what an inbound policy assigns to it
+	innerPacket, err := packets.ParseIPv4(inner)
+	if err != nil {
+		espPolicyDrops.Add(1)
+		return
+	}
+	if policy, _, ok := sadb.Lookup(ipsec.In, innerPacket.SrcIP, innerPacket.DstIP, innerPacket.Protocol); !ok || policy.Action != ipsec.Protect || policy.SPI != sa.SPI {
+		espPolicyDrops.Add(1)
+		fmt.Printf(ColorRed+"[ESP] %s -> %s doesn't match the policy of SPI 0x%x\n"+ColorReset, innerPacket.SrcIP, innerPacket.DstIP, spi)
+		return
+	}
+
+	inputIPv4(n, &frames.EthernetFrame{DstMAC: [6]byte(n.MAC), EtherType: frames.EtherTypeIPv4, Payload: inner}, true)
+}
+
+// runs an ipsec command, used by the console:
+//
+//	show
+func ipsecCommand(args []string) error {
+	if len(args) != 1 || args[0] != "show" {
+		return fmt.Errorf("usage: ipsec show")
+	}
+
+	fmt.Printf(ColorCyan + "SAs:\n" + ColorReset)
+	for _, sa := range sadb.SAs() {
+		s := sa.Stats()
+		fmt.Printf(ColorCyan+"   %s\n      %d packets, %d bytes, %d auth failures, %d replayed\n"+ColorReset,
+			sa, s.Packets, s.Bytes, s.AuthFailures, s.ReplayDrops)
+	}
+	fmt.Printf(ColorCyan + "Policies:\n" + ColorReset)
+	for _, p := range sadb.Policies() {
+		fmt.Printf(ColorCyan+"   %s\n"+ColorReset, p)
+	}
+	fmt.Printf(ColorCyan+"Dropped: %d unknown SPI, %d policy mismatch, %d cleartext, %d discarded\n"+ColorReset,
+		espNoSA.Load(), espPolicyDrops.Load(), cleartextDrops.Load(), discardedByPolicy.Load())
+	return nil
+}
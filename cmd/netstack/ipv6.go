@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/firewall"
+	"github.com/hexhaust/mini-netstack/pkg/fragment"
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// processes an IPv6 packet received on n
+// we're an IPv6 host, packets for somebody else are dropped rather than forwarded
+func handleIPv6(n *nic.NIC, frame *frames.EthernetFrame) {
+	ip, err := packets.ParseIPv6(frame.Payload)
+	if err != nil {
+		return
+	}
+
+	// multicast is never a source and loopback never belongs on a link (RFC 4291 2.5.3, 2.7)
+	if ip.SrcIP.IsMulticast() || ip.SrcIP.IsLoopback() || ip.DstIP.IsLoopback() || ip.DstIP.IsUnspecified() {
+		fmt.Printf(ColorRed+"[IPv6] Dropping bogus packet %s -> %s\n"+ColorReset, ip.SrcIP, ip.DstIP)
+		return
+	}
+	// v4-mapped addresses only exist inside dual-stack APIs and would pass for
+	// our IPv4 ones further up (RFC 4291 2.5.5.2)
+	if ip.SrcIP.To4() != nil || ip.DstIP.To4() != nil {
+		fmt.Printf(ColorRed+"[IPv6] Dropping packet with v4-mapped address %s -> %s\n"+ColorReset, ip.SrcIP, ip.DstIP)
+		return
+	}
+	if !acceptsIPv6(n, ip.DstIP, ip.SrcIP) {
+		return
+	}
+
+	pkt := frame.Payload[:packets.IPv6HeaderLen+len(ip.Payload)]
+	exts, proto, payload, err := packets.ParseIPv6Extensions(ip)
+	if err == nil {
+		err = checkIPv6Extensions(ip, exts)
+	}
+	if errors.Is(err, errIPv6Fragment) {
+		// the headers after the fragment header are checked once the datagram is whole
+		var whole []byte
+		if whole, err = reassembleIPv6(n, ip, pkt, exts); err == nil && whole != nil {
+			reassembled := *frame
+			reassembled.Payload = whole
+			handleIPv6(n, &reassembled)
+			return
+		}
+	} else if err == nil {
+		err = deliverIPv6(n, ip, pkt, exts, proto, payload)
+	}
+	if err != nil {
+		dropIPv6(n, ip, pkt, err)
+	}
+}
+
+// queues a fragment, once the last hole is filled returns the whole packet
+// (nil, nil) means there's nothing to do yet or the fragments were discarded
+func reassembleIPv6(n *nic.NIC, ip *packets.IPv6Header, pkt []byte, exts []packets.IPv6Extension) ([]byte, error) {
+	ext, _ := packets.FindIPv6Extension(exts, packets.ProtocolFragment)
+	f := ext.Fragment()
+	frag := fragment.IPv6Fragment(pkt, ext)
+
+	// RFC 8200 4.5: only the last fragment may end off an 8 byte boundary,
+	// and none may end past the largest possible payload
+	if f.More && len(frag.Payload)%8 != 0 {
+		return nil, &packets.IPv6HeaderError{Code: packets.IPv6ProblemHeaderField, Pointer: 4, Reason: "fragment length is not a multiple of 8"}
+	}
+	if f.Offset+len(frag.Payload) > 65535 {
+		return nil, &packets.IPv6HeaderError{Code: packets.IPv6ProblemHeaderField, Pointer: ext.Offset + 2, Reason: "fragment ends past 65535 bytes"}
+	}
+
+	// overlaps (RFC 5722) and exhausted limits throw the whole datagram away, silently
+	dgram, err := reassembler6.Add(fragment.IPv6Key(ip, f, n.Name), frag)
+	if err != nil {
+		fmt.Printf(ColorRed+"[IPv6] Discarding fragments from %s (ID=%d): %v\n"+ColorReset, ip.SrcIP, f.Identification, err)
+		return nil, nil
+	}
+	if dgram == nil {
+		return nil, nil
+	}
+
+	whole, err := fragment.IPv6Datagram(dgram)
+	if err != nil {
+		fmt.Printf(ColorRed+"[IPv6] Discarding fragments from %s (ID=%d): %v\n"+ColorReset, ip.SrcIP, f.Identification, err)
+		return nil, nil
+	}
+	fmt.Printf(ColorGray+"[IPv6] Reassembled %d bytes from %s (ID=%d)\n"+ColorReset, len(whole)-packets.IPv6HeaderLen, ip.SrcIP, f.Identification)
+	return whole, nil
+}
+
+// reports a datagram whose fragments didn't all arrive in time with Time
+// Exceeded, quoting the first fragment (RFC 8200 4.5)
+func expireFragments6(d *fragment.Datagram) {
+	src := net.IP(d.Header[8:24])
+	fmt.Printf(ColorRed+"[IPv6] Reassembly timeout for datagram from %s\n"+ColorReset, src)
+
+	n, ok := nics.Get(d.Key.Zone)
+	if !ok {
+		return
+	}
+	quote := append(d.Header, d.Payload...)
+	binary.BigEndian.PutUint16(quote[4:6], uint16(len(quote)-packets.IPv6HeaderLen))
+	sendICMPv6Error(n, quote, packets.ICMPv6TimeExceeded, packets.ICMPv6CodeReassemblyExceeded, 0)
+}
+
+// unicast addresses configured on any NIC (weak host model) and the groups
+// joined on n, solicited-node ones included, whose filter lets src through
+func acceptsIPv6(n *nic.NIC, dst, src net.IP) bool {
+	if dst.IsMulticast() {
+		return n.MLD.Accepts(dst, src)
+	}
+	return isLocalIP(dst)
+}
+
+// errors that silently discard a packet, as opposed to *packets.IPv6HeaderError
+// which the sender should hear about
+var (
+	errIPv6Option   = errors.New("unrecognized option")
+	errIPv6AH       = errors.New("authentication header not supported")
+	errIPv6Fragment = errors.New("fragment") // not an error, reassembly takes over
+)
+
+// drops a packet we can't process, telling the sender with a Parameter Problem
+// or Port Unreachable when the error calls for one
+func dropIPv6(n *nic.NIC, ip *packets.IPv6Header, pkt []byte, err error) {
+	fmt.Printf(ColorRed+"[IPv6] Dropping packet %s -> %s: %v\n"+ColorReset, ip.SrcIP, ip.DstIP, err)
+
+	var hdrErr *packets.IPv6HeaderError
+	switch {
+	case errors.As(err, &hdrErr):
+		sendICMPv6Error(n, pkt, packets.ICMPv6ParamProblem, hdrErr.Code, uint32(hdrErr.Pointer))
+	case errors.Is(err, errPortUnreachable):
+		sendICMPv6Error(n, pkt, packets.ICMPv6DestUnreachable, packets.ICMPv6CodePortUnreachable, 0)
+	}
+}
+
+// processes the extension headers in order (RFC 8200 4)
+func checkIPv6Extensions(ip *packets.IPv6Header, exts []packets.IPv6Extension) error {
+	for _, ext := range exts {
+		switch ext.Type {
+		case packets.ProtocolHopByHop, packets.ProtocolDestOpts:
+			if err := checkIPv6Options(ext); err != nil {
+				return err
+			}
+
+		case packets.ProtocolRouting:
+			// the packet is at its final destination, nothing left to do with it
+			rh := ext.Routing()
+			if rh.SegmentsLeft == 0 {
+				continue
+			}
+			// we don't forward, so every routing type is one we can't process
+			// (and type 0 is deprecated anyway, RFC 5095)
+			return &packets.IPv6HeaderError{
+				Code:    packets.IPv6ProblemHeaderField,
+				Pointer: ext.Offset + 2,
+				Reason:  fmt.Sprintf("routing header type %d with %d segments left", rh.RoutingType, rh.SegmentsLeft),
+			}
+
+		case packets.ProtocolFragment:
+			// an atomic fragment is a whole packet and is processed as such,
+			// never mixed with fragments that share its ID (RFC 6946)
+			if !ext.Fragment().Atomic() {
+				return errIPv6Fragment
+			}
+
+		case packets.ProtocolAH:
+			return errIPv6AH
+		}
+	}
+	return nil
+}
+
+// goes through the options of a hop-by-hop or destination options header,
+// unknown ones are handled as their type's high bits say (RFC 8200 4.2)
+func checkIPv6Options(ext packets.IPv6Extension) error {
+	opts, err := ext.Options()
+	if err != nil {
+		return err
+	}
+
+	for _, opt := range opts {
+		if opt.Type == packets.IPv6OptionRouterAlert {
+			continue
+		}
+
+		switch opt.Action() {
+		case packets.IPv6OptionSkip:
+			continue
+		case packets.IPv6OptionDiscard:
+			return errIPv6Option
+		default:
+			return &packets.IPv6HeaderError{
+				Code:    packets.IPv6ProblemOption,
+				Pointer: opt.Offset,
+				Reason:  fmt.Sprintf("unrecognized option 0x%02x", opt.Type),
+			}
+		}
+	}
+	return nil
+}
+
+// hands the upper-layer payload of pkt to its protocol handler
+func deliverIPv6(n *nic.NIC, ip *packets.IPv6Header, pkt []byte, exts []packets.IPv6Extension, proto uint8, payload []byte) error {
+	// we don't forward IPv6, so prerouting runs here too, once the packet is
+	// whole and its extension headers are processed
+	state, _ := conntracks.Track(pkt)
+	if !filterIPv6(firewall.Prerouting, n.Name, "", state, ip, exts, proto, payload) ||
+		!ipsecInputAllowed(ip.SrcIP, ip.DstIP, proto) ||
+		!filterIPv6(firewall.Input, n.Name, "", state, ip, exts, proto, payload) {
+		return nil
+	}
+
+	switch proto {
+	case packets.ProtocolNoNext:
+		return nil
+	case packets.ProtocolICMPv6:
+		handleICMPv6(n, ip, exts, payload)
+		return nil
+	case packets.ProtocolUDP:
+		return handleUDP(n, 6, ip.SrcIP, ip.DstIP, payload)
+	case packets.ProtocolTCP:
+		handleTCP(n, 6, ip.SrcIP, ip.DstIP, payload)
+		return nil
+	}
+
+	// the Next Header field naming the unknown protocol is the pointer (RFC 8200 4)
+	pointer := 6
+	if len(exts) > 0 {
+		pointer = exts[len(exts)-1].Offset
+	}
+	return &packets.IPv6HeaderError{
+		Code:    packets.IPv6ProblemNextHeader,
+		Pointer: pointer,
+		Reason:  fmt.Sprintf("no handler for %s on %s", packets.IPv6ProtocolName(proto), n.Name),
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/hexhaust/mini-netstack/pkg/device"
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/routing"
+)
+
+// NICs we can send on, by name (what routes refer to)
+var nics = nic.NewRegistry()
+
+// opens a TAP device and registers it as a NIC with the given addresses
+func openNIC(name string, mac net.HardwareAddr, addrs []*net.IPNet) (*nic.NIC, error) {
+	fmt.Printf(ColorCyan+"Initializing interface %s...\n"+ColorReset, name)
+	dev, err := device.NewTAP(name)
+	if err != nil {
+		return nil, err
+	}
+	dev.MTU = MTU
+
+	n := nic.New(dev, mac)
+	if err := nics.Add(n); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	go n.Egress.Run()
+	for _, prefix := range addrs {
+		if err := addAddress(n, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Printf(ColorCyan+"Interface %s ready (MAC: %s, addrs: %v).\n"+ColorReset, name, mac, n.Addresses())
+	return n, nil
+}
+
+// configures an address and derives the connected route from it
+// only primary addresses get a route, secondaries share their subnet's
+func addAddress(n *nic.NIC, prefix *net.IPNet) error {
+	if prefix.IP.To4() == nil {
+		return addAddress6(n, nic.Address6{Prefix: prefix})
+	}
+	addr, err := n.AddAddress(prefix)
+	if err != nil {
+		return err
+	}
+	if !addr.Secondary {
+		routes.Add(routing.Connected(addr.Prefix, n.Name))
+	}
+	return nil
+}
+
+// configures an IPv6 address, which stays tentative until duplicate address
+// detection says it's unique. Link-local prefixes get no route since they
+// exist on every link, autoconfigured ones get theirs from the on-link flag
+// of the router advertisement
+func addAddress6(n *nic.NIC, addr nic.Address6) error {
+	addr, err := n.AddAddress6(addr)
+	if err != nil {
+		return err
+	}
+	if !addr.Autoconf && !addr.Prefix.IP.IsLinkLocalUnicast() {
+		routes6.Add(routing.Connected(addr.Prefix, n.Name))
+	}
+	joinSolicitedNode(n, addr.Prefix.IP)
+	startDAD(n, addr.Prefix.IP)
+	return nil
+}
+
+// parses the NAME[@MAC]=ADDR/PREFIX[,ADDR/PREFIX...] syntax of the -dev and -addr flags
+func parseNICSpec(spec string) (string, net.HardwareAddr, []*net.IPNet, error) {
+	name, list, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return "", nil, nil, fmt.Errorf("expected NAME[@MAC]=ADDR/PREFIX[,...], got %q", spec)
+	}
+
+	var mac net.HardwareAddr
+	if before, macStr, ok := strings.Cut(name, "@"); ok {
+		parsed, err := net.ParseMAC(macStr)
+		if err != nil || len(parsed) != 6 {
+			return "", nil, nil, fmt.Errorf("invalid MAC %q", macStr)
+		}
+		name, mac = before, parsed
+	}
+
+	var addrs []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("invalid address %q", cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+	return name, mac, addrs, nil
+}
+
+// derives the MAC of an extra NIC from its name and our MAC, so it stays the
+// same across restarts. It is locally administered unicast (RFC 7042 2.1)
+// and distinct from every MAC in use, which it is added to
+func deriveMAC(name string, used map[string]bool) net.HardwareAddr {
+	for i := 0; ; i++ {
+		sum := sha256.Sum256(fmt.Appendf(nil, "%s/%s/%d", MyMAC, name, i))
+		mac := append(net.HardwareAddr(nil), sum[:6]...)
+		mac[0] = mac[0]&^0x01 | 0x02
+		if !used[mac.String()] {
+			used[mac.String()] = true
+			return mac
+		}
+	}
+}
+
+// reports whether ip is one of our own addresses, on any NIC (weak host model)
+func isLocalIP(ip net.IP) bool {
+	_, ok := nics.Owner(ip)
+	return ok
+}
+
+// reports whether ip is the limited broadcast or the directed broadcast of any of our prefixes
+func isBroadcastIP(ip net.IP) bool {
+	return nics.IsBroadcast(ip)
+}
+
+// reads frames from the NIC until it's closed
+func receive(n *nic.NIC) {
+	buf := make([]byte, n.Dev.MTU+frames.EthernetHeaderSize)
+	for {
+		count, err := n.Dev.Read(buf)
+		if err != nil {
+			log.Printf("Read error on %s: %v", n.Name, err)
+			return
+		}
+
+		frame, err := frames.ParseEthernet(buf[:count])
+		if err != nil {
+			continue
+		}
+
+		// the TAP hands us everything on the bridge, keep what our MAC filter wants
+		if !n.Accepts(frame.DstMAC) {
+			continue
+		}
+
+		switch frame.EtherType {
+		case frames.EtherTypeARP:
+			handleARP(n, frame)
+		case frames.EtherTypeIPv4:
+			handleIPv4(n, frame)
+		case frames.EtherTypeIPv6:
+			handleIPv6(n, frame)
+		}
+	}
+}
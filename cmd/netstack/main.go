@@ -1,16 +1,32 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/hexhaust/mini-netstack/pkg/device"
+	"github.com/hexhaust/mini-netstack/pkg/firewall"
+	"github.com/hexhaust/mini-netstack/pkg/fragment"
 	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/ipsec"
+	"github.com/hexhaust/mini-netstack/pkg/nat"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
 	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/ratelimit"
+	"github.com/hexhaust/mini-netstack/pkg/routing"
+	"github.com/hexhaust/mini-netstack/pkg/slaac"
+	"github.com/hexhaust/mini-netstack/pkg/socket"
+	"github.com/hexhaust/mini-netstack/pkg/tunnel"
 )
 
 const (
@@ -30,125 +46,554 @@ const (
 	ColorGray   = "\033[90m"
 )
 
+// address and MAC of the primary NIC (DevName), more can be added with -dev/-addr
 var (
 	MyIP  = net.IPv4(192, 168, 1, 10)
+	MyNet = &net.IPNet{IP: MyIP, Mask: net.CIDRMask(24, 32)}
 	MyMAC = net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
 )
 
+var reassembler = fragment.NewReassembler(fragment.DefaultConfig())
+
+// IPv6 fragments get their own pool, so neither family can crowd out the other
+var reassembler6 = fragment.NewReassembler(fragment.DefaultConfig6())
+
+// bound UDP sockets, datagrams are demultiplexed by destination port
+var udpSockets = socket.NewUDPTable(sendUDP, setGroupFilter)
+
+// set by -icmp-echo-broadcast (off by default, like icmp_echo_ignore_broadcasts=1)
+var echoBroadcast bool
+
+// list flag that can be repeated (e.g. -route a -route b)
+type multiFlag []string
+
+func (m *multiFlag) String() string     { return fmt.Sprint(*m) }
+func (m *multiFlag) Set(v string) error { *m = append(*m, v); return nil }
+
 func main() {
-	fmt.Printf(ColorCyan+"Initializing interface %s...\n"+ColorReset, DevName)
-	iface, err := device.NewTAP(DevName)
+	gateway := flag.String("gw", "192.168.1.1", "default gateway (empty for none)")
+	flag.BoolVar(&forwarding, "forward", false, "forward packets between interfaces (router mode)")
+	flag.BoolVar(&echoBroadcast, "icmp-echo-broadcast", false, "answer pings sent to broadcast addresses")
+	flag.Func("rp-filter", "reverse path filtering: off, strict or loose (default loose)", func(s string) (err error) {
+		rpFilter, err = routing.ParseRPFilterMode(s)
+		return err
+	})
+	flag.Func("udp-echo", "port of the UDP echo service, 0 turns it off (default 7)", func(s string) error {
+		port, err := strconv.ParseUint(s, 10, 16)
+		udpEchoPort = uint16(port)
+		return err
+	})
+	flag.Func("icmp-ratelimit", "minimum gap between ICMP errors to one destination after a burst of 6, 0 turns limiting off (default 1s)", func(s string) error {
+		interval, err := time.ParseDuration(s)
+		icmpLimiter = ratelimit.New(interval, icmpRateBurst)
+		return err
+	})
+	flag.BoolVar(&logMartians, "log-martians", false, "log packets dropped as spoofed or bogus")
+	flag.BoolVar(&slaacEnabled, "slaac", true, "give devices IPv6 link-local addresses and autoconfigure from router advertisements")
+	flag.Func("addr-gen-mode", "IPv6 interface identifiers: eui64 or stable-privacy (default eui64)", func(s string) (err error) {
+		addrGenMode, err = slaac.ParseMode(s)
+		return err
+	})
+	flag.Func("stable-secret", "hex secret for stable-privacy identifiers, keeps them across restarts (random by default)", func(s string) (err error) {
+		stableSecret, err = hex.DecodeString(strings.TrimPrefix(s, "0x"))
+		return err
+	})
+	flag.BoolVar(&useTempAddr, "use-tempaddr", false, "also form temporary privacy addresses (RFC 8981) and prefer them as source")
+	var extraRoutes, extraNICs, extraAddrs, tunnels, natRules, fwCommands, qdiscs, ipsecSAs, ipsecSPs multiFlag
+	flag.Var(&extraRoutes, "route", "extra route, `ip route` syntax: \"10.0.0.0/8 via 192.168.1.254 metric 10\" (repeatable)")
+	flag.Var(&extraNICs, "dev", "extra TAP device as NAME[@MAC]=ADDR/PREFIX[,ADDR/PREFIX...], e.g. tap1=10.0.0.1/24 (repeatable)")
+	flag.Var(&tunnels, "tunnel", "tunnel interface, `ip tunnel` syntax: \"gre1 mode gre remote 192.168.1.20 key 42 seq\", \"ipip1 mode ipip remote 192.168.1.30\" (repeatable, give it addresses with -addr)")
+	flag.Var(&extraAddrs, "addr", "extra addresses for a device as NAME=ADDR/PREFIX[,...], e.g. tap0=192.168.1.11/24 or tap0=2001:db8::10/64 (repeatable)")
+	flag.Var(&natRules, "nat", "NAT rule for forwarded traffic: \"masquerade out tap1\", \"snat src 10.0.0.0/24 to 203.0.113.5\", \"dnat proto tcp in tap1 dport 8080 to 10.0.0.20:80\" (repeatable, needs -forward)")
+	flag.Var(&fwCommands, "fw", "firewall command, same as the fw console command: \"append input proto tcp dport 22 drop\", \"policy forward drop\" (repeatable)")
+	flag.Var(&qdiscs, "qdisc", "egress qdisc of a device, same as qdisc replace: \"tap0 tbf rate 1mbit burst 10k\", \"tap1 fq_codel\" (repeatable)")
+	flag.Var(&ipsecSAs, "ipsec-sa", "ESP security association with AES-GCM (key is the AES key followed by a 4 byte salt, in hex): \"spi 0x1001 src 192.168.1.10 dst 192.168.1.20 mode transport key 0x...\" (repeatable)")
+	flag.Var(&ipsecSPs, "ipsec-sp", "IPsec policy, checked in order: \"out dst 192.168.1.20/32 spi 0x1001\", \"in src 192.168.1.20/32 spi 0x2001\", \"in proto udp bypass\" (repeatable)")
+	flag.Parse()
+
+	primary, err := openNIC(DevName, MyMAC, []*net.IPNet{MyNet})
 	if err != nil {
 		log.Fatalf("Error creating TAP: %v", err)
 	}
-	defer iface.Close()
-	fmt.Printf(ColorCyan+"Interface %s ready.\n"+ColorReset, DevName)
-	fmt.Printf(ColorCyan+"I am %s (MAC: %s)\nWaiting for packets...\n"+ColorReset, MyIP, MyMAC)
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer primary.Dev.Close()
 
-	go func() {
-		buf := make([]byte, MTU)
-		for {
-			n, err := iface.Read(buf)
-			if err != nil {
-				log.Printf("Read error: %v", err)
-				return
+	// collect the explicit MACs first so a derived one can't take a MAC given later
+	type nicSpec struct {
+		name  string
+		mac   net.HardwareAddr
+		addrs []*net.IPNet
+	}
+	var specs []nicSpec
+	usedMACs := map[string]bool{MyMAC.String(): true}
+	for _, spec := range extraNICs {
+		name, mac, addrs, err := parseNICSpec(spec)
+		if err != nil {
+			log.Fatalf("Invalid device %q: %v", spec, err)
+		}
+		if mac != nil {
+			if usedMACs[mac.String()] {
+				log.Fatalf("MAC %s of %s is already in use", mac, name)
 			}
+			usedMACs[mac.String()] = true
+		}
+		specs = append(specs, nicSpec{name: name, mac: mac, addrs: addrs})
+	}
+	for _, spec := range specs {
+		if spec.mac == nil {
+			spec.mac = deriveMAC(spec.name, usedMACs)
+		}
+		n, err := openNIC(spec.name, spec.mac, spec.addrs)
+		if err != nil {
+			log.Fatalf("Error creating TAP %s: %v", spec.name, err)
+		}
+		defer n.Dev.Close()
+	}
 
-			frame, err := frames.ParseEthernet(buf[:n])
-			if err != nil {
-				continue
-			}
+	for _, spec := range tunnels {
+		t, err := tunnel.Parse(spec)
+		if err != nil {
+			log.Fatalf("Invalid tunnel %q: %v", spec, err)
+		}
+		if _, err := openTunnel(t); err != nil {
+			log.Fatalf("Error creating tunnel %s: %v", t.Name, err)
+		}
+	}
 
-			switch frame.EtherType {
-			case frames.EtherTypeARP:
-				handleARP(iface, frame)
-			case frames.EtherTypeIPv4:
-				handleIPv4(iface, frame)
+	for _, spec := range extraAddrs {
+		name, _, addrs, err := parseNICSpec(spec)
+		if err != nil {
+			log.Fatalf("Invalid address %q: %v", spec, err)
+		}
+		n, ok := nics.Get(name)
+		if !ok {
+			log.Fatalf("Unknown device %s", name)
+		}
+		for _, prefix := range addrs {
+			if err := addAddress(n, prefix); err != nil {
+				log.Fatalf("Error adding address: %v", err)
 			}
 		}
-	}()
+	}
+
+	if slaacEnabled {
+		configureSLAAC()
+	}
+
+	// connected routes come from the NIC addresses, the rest from flags
+	if *gateway != "" {
+		gw := net.ParseIP(*gateway).To4()
+		if gw == nil {
+			log.Fatalf("Invalid gateway: %s", *gateway)
+		}
+		routes.Add(routing.Default(gw, DevName))
+	}
+	for _, spec := range extraRoutes {
+		r, err := routing.ParseRoute(spec, DevName)
+		if err != nil {
+			log.Fatalf("Invalid route %q: %v", spec, err)
+		}
+		if err := routes.Add(r); err != nil {
+			log.Fatalf("Error adding route: %v", err)
+		}
+	}
+	printRoutes()
+
+	for _, spec := range natRules {
+		r, err := nat.ParseRule(spec)
+		if err != nil {
+			log.Fatalf("Invalid NAT rule %q: %v", spec, err)
+		}
+		natTable.Add(r)
+	}
+	printNATRules()
+
+	for _, spec := range qdiscs {
+		if err := qdiscCommand(append([]string{"replace"}, strings.Fields(spec)...)); err != nil {
+			log.Fatalf("Invalid qdisc %q: %v", spec, err)
+		}
+	}
+
+	for _, spec := range ipsecSAs {
+		sa, err := ipsec.ParseSA(spec)
+		if err == nil {
+			err = sadb.AddSA(sa)
+		}
+		if err != nil {
+			log.Fatalf("Invalid IPsec SA %q: %v", spec, err)
+		}
+	}
+	for _, spec := range ipsecSPs {
+		p, err := ipsec.ParsePolicy(spec)
+		if err == nil {
+			err = sadb.AddPolicy(p)
+		}
+		if err != nil {
+			log.Fatalf("Invalid IPsec policy %q: %v", spec, err)
+		}
+	}
+
+	for _, cmd := range fwCommands {
+		if err := firewallCommand(strings.Fields(cmd)); err != nil {
+			log.Fatalf("Invalid firewall command %q: %v", cmd, err)
+		}
+	}
+
+	if udpEchoPort != 0 {
+		if err := startUDPEcho(udpEchoPort); err != nil {
+			log.Fatalf("Error starting UDP echo: %v", err)
+		}
+	}
+
+	fmt.Printf(ColorCyan+"I am %s (MAC: %s)\n"+ColorReset, MyIP, MyMAC)
+	if forwarding {
+		fmt.Printf(ColorCyan + "Forwarding enabled.\n" + ColorReset)
+	}
+	fmt.Printf(ColorCyan + "Waiting for packets...\n" + ColorReset)
+
+	go expireFragments()
+	go neighborTimers()
+	go multicastTimers()
+	go expireConntrack()
+	go expirePMTU()
+	go slaacTimers()
+	go console(os.Stdin)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	// tunnels receive through the NIC their outer packets arrive on
+	for _, n := range nics.All() {
+		if n.Tunnel == nil {
+			go receive(n)
+		}
+	}
 
 	<-sigCh
 	fmt.Println("\nShutting down netstack...")
 }
 
-func handleARP(iface *device.Interface, frame *frames.EthernetFrame) {
+func handleARP(n *nic.NIC, frame *frames.EthernetFrame) {
 	arp, err := packets.ParseARP(frame.Payload)
 	if err != nil {
 		return
 	}
 
-	if arp.Operation == packets.ARPRequest && arp.DstIP.Equal(MyIP) {
-		fmt.Printf(ColorYellow+"[ARP] Who is %s? It's me! Sending reply...\n"+ColorReset, MyIP)
+	// we answer for any address configured on the NIC the request came in on
+	forUs := n.HasAddress(arp.DstIP)
 
-		replyPayload, _ := arp.ReplyAs(MyMAC, MyIP.To4())
-		ethReply := frames.EthernetFrame{
-			DstMAC:    [6]byte(arp.SrcMAC),
-			SrcMAC:    [6]byte(MyMAC),
-			EtherType: frames.EtherTypeARP,
-			Payload:   replyPayload,
+	// RFC 826 merge: refresh what we know about the sender, and only learn
+	// new neighbors from packets aimed at us
+	if !arp.SrcIP.Equal(net.IPv4zero) {
+		pending := n.ARP.Update(arp.SrcIP, arp.SrcMAC, forUs)
+		for _, pkt := range pending {
+			writeFrame(n, [6]byte(arp.SrcMAC), frames.EtherTypeIPv4, pkt)
 		}
-		iface.Write(ethReply.Bytes())
+	}
+
+	if arp.Operation == packets.ARPRequest && forUs {
+		fmt.Printf(ColorYellow+"[ARP] Who is %s? It's me! Sending reply...\n"+ColorReset, arp.DstIP)
+
+		replyPayload, _ := arp.ReplyAs(n.MAC, arp.DstIP.To4())
+		writeFrame(n, [6]byte(arp.SrcMAC), frames.EtherTypeARP, replyPayload)
 	}
 }
 
-func handleIPv4(iface *device.Interface, frame *frames.EthernetFrame) {
+func handleIPv4(n *nic.NIC, frame *frames.EthernetFrame) {
+	inputIPv4(n, frame, false)
+}
+
+// processes an IPv4 packet received on n, decrypted is set for packets that
+// came out of ESP (they already passed the inbound IPsec policy)
+func inputIPv4(n *nic.NIC, frame *frames.EthernetFrame, decrypted bool) {
 	ipPacket, err := packets.ParseIPv4(frame.Payload)
+	var hdrErr *packets.IPv4HeaderError
+	if errors.As(err, &hdrErr) {
+		sendParamProblem(n, frame.Payload, hdrErr)
+		return
+	}
 	if err != nil {
 		return
 	}
+	if !checkMartian(n, ipPacket) {
+		return
+	}
 
-	if !ipPacket.DstIP.Equal(MyIP) {
+	// source routing is a classic spoofing vector, we don't honour it (like accept_source_route=0)
+	_, lsrr := ipPacket.Option(packets.IPv4OptionLooseSourceRoute)
+	_, ssrr := ipPacket.Option(packets.IPv4OptionStrictSourceRoute)
+	if lsrr || ssrr {
+		fmt.Printf(ColorRed+"[IPv4] Dropping source routed packet from %s\n"+ColorReset, ipPacket.SrcIP)
+		return
+	}
+
+	// conntrack needs whole datagrams, so fragments are reassembled up front
+	// (the forwarding path fragments again if needed)
+	if ipPacket.IsFragment() {
+		if frame, ipPacket = defragment(frame, ipPacket); ipPacket == nil {
+			return
+		}
+	}
+	state, _ := conntracks.Track(frame.Payload)
+	// errors we send quote the datagram as it arrived
+	received := frame.Payload[:ipPacket.TotalLength]
+
+	if !filterIPv4(firewall.Prerouting, n.Name, "", state, ipPacket) {
+		return
+	}
+
+	// NAT rewrites addresses before the routing decision, so replies to
+	// masqueraded connections get forwarded instead of delivered
+	if natTable.Active() {
+		// NAT rewrites the frame in place
+		received = append([]byte(nil), received...)
+		if frame, ipPacket = translateIPv4(n, frame, ipPacket); ipPacket == nil {
+			return
+		}
+	}
+
+	if !decrypted && !ipsecInputAllowed(ipPacket.SrcIP, ipPacket.DstIP, ipPacket.Protocol) {
+		return
+	}
+
+	// multicast is only taken for groups joined on this NIC, and never forwarded
+	mcast := ipPacket.DstIP.IsMulticast()
+	if mcast && !n.IGMP.Accepts(ipPacket.DstIP, ipPacket.SrcIP) {
+		return
+	}
+
+	// limited and directed broadcasts are ours too, but never forwarded (RFC 2644)
+	if !mcast && !isLocalIP(ipPacket.DstIP) && !isBroadcastIP(ipPacket.DstIP) {
+		if forwarding {
+			forwardIPv4(n, frame, ipPacket, state)
+		}
+		return
+	}
+
+	if !filterIPv4(firewall.Input, n.Name, "", state, ipPacket) {
 		return
 	}
 
 	switch ipPacket.Protocol {
 	case packets.ProtocolICMP:
-		handleICMP(iface, frame, ipPacket)
+		handleICMP(n, frame, ipPacket)
+	case packets.ProtocolIGMP:
+		handleIGMP(n, ipPacket)
 	case packets.ProtocolUDP:
-		handleUDP(iface, frame, ipPacket)
+		if err := handleUDP(n, 4, ipPacket.SrcIP, ipPacket.DstIP, ipPacket.Payload); errors.Is(err, errPortUnreachable) {
+			sendICMPError(packets.NewICMPUnreachable(packets.ICMPCodePortUnreachable, received))
+		}
 	case packets.ProtocolTCP:
-		handleTCP(iface, frame, ipPacket)
+		handleTCP(n, 4, ipPacket.SrcIP, ipPacket.DstIP, ipPacket.Payload)
+	case packets.ProtocolIPIP, packets.ProtocolGRE:
+		handleTunnel(ipPacket)
+	case packets.ProtocolESP:
+		handleESP(n, ipPacket)
+	default:
+		// RFC 1122 3.2.2.1: a transport protocol we don't speak
+		fmt.Printf(ColorRed+"[IPv4] No handler for protocol %d from %s\n"+ColorReset, ipPacket.Protocol, ipPacket.SrcIP)
+		sendICMPError(packets.NewICMPUnreachable(packets.ICMPCodeProtocolUnreachable, received))
 	}
 }
 
-func handleICMP(iface *device.Interface, frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) {
-	icmpPacket, err := packets.ParseICMP(frame.Payload[20:])
+// answers a malformed header received on n with Parameter Problem code 0
+// pointing at the bad byte (RFC 1122 3.2.2.5), for packets we'd deliver or
+// forward. The header can't go through the filters, so martian sources get
+// nothing and neither does anyone while a chain the packet would have crossed
+// drops by default. The lengths were checked before the options, so the
+// datagram can be quoted as it arrived
+func sendParamProblem(n *nic.NIC, pkt []byte, hdrErr *packets.IPv4HeaderError) {
+	hdr := &packets.IPv4Header{Protocol: pkt[9], SrcIP: net.IP(pkt[12:16]), DstIP: net.IP(pkt[16:20])}
+	fmt.Printf(ColorRed+"[IPv4] Bad header from %s: %v\n"+ColorReset, hdr.SrcIP, hdrErr)
+
+	hook := firewall.Input
+	if !isLocalIP(hdr.DstIP) {
+		if !forwarding {
+			return
+		}
+		hook = firewall.Forward
+	}
+	if martianReason(n, hdr) != routing.NotMartian {
+		return
+	}
+	for _, h := range []firewall.Hook{firewall.Prerouting, hook} {
+		if policy, _ := fw.Chain(h); policy != firewall.Accept {
+			return
+		}
+	}
+	quote := pkt[:binary.BigEndian.Uint16(pkt[2:4])]
+	sendICMPError(packets.NewICMPParamProblem(uint8(hdrErr.Pointer), quote))
+}
+
+// queues a fragment, once the last hole is filled returns the whole datagram
+// in a frame of its own
+func defragment(frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) (*frames.EthernetFrame, *packets.IPv4Header) {
+	if ipPacket = reassemble(frame, ipPacket); ipPacket == nil {
+		return nil, nil
+	}
+	hdr, err := ipPacket.Bytes()
+	if err != nil {
+		return nil, nil
+	}
+	whole := *frame
+	whole.Payload = append(hdr, ipPacket.Payload...)
+	return &whole, ipPacket
+}
+
+// queues a fragment, returns the full datagram once the last hole is filled
+func reassemble(frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) *packets.IPv4Header {
+	frag := fragment.IPv4Fragment(ipPacket, frame.Payload)
+	dgram, err := reassembler.Add(fragment.IPv4Key(ipPacket), frag)
+	if err != nil {
+		fmt.Printf(ColorRed+"[IPv4] Discarding fragments from %s (ID=%d): %v\n"+ColorReset, ipPacket.SrcIP, ipPacket.Identification, err)
+		return nil
+	}
+	if dgram == nil {
+		return nil
+	}
+
+	full, err := fragment.IPv4Datagram(dgram)
+	if err != nil {
+		return nil
+	}
+	fmt.Printf(ColorGray+"[IPv4] Reassembled %d bytes from %s (ID=%d)\n"+ColorReset, len(full.Payload), full.SrcIP, full.Identification)
+	return full
+}
+
+// drops incomplete datagrams and reports them with ICMP Time Exceeded (code 1)
+func expireFragments() {
+	for now := range time.Tick(time.Second) {
+		for _, d := range reassembler.Expire(now) {
+			srcIP := net.IP(d.Header[12:16])
+			fmt.Printf(ColorRed+"[IPv4] Reassembly timeout for datagram from %s\n"+ColorReset, srcIP)
+
+			// the quote comes from the first fragment, the only one errors may be about
+			sendICMPError(packets.NewICMPTimeExceeded(packets.ICMPCodeReassemblyExceeded, append(d.Header, d.Payload...)))
+		}
+		for _, d := range reassembler6.Expire(now) {
+			expireFragments6(d)
+		}
+	}
+}
+
+func handleICMP(n *nic.NIC, frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) {
+	icmpPacket, err := packets.ParseICMP(ipPacket.Payload)
 	if err != nil {
 		return
 	}
-	if icmpPacket.Type == packets.ICMPEchoRequest {
+	switch icmpPacket.Type {
+	case packets.ICMPDestUnreachable:
+		if icmpPacket.Code == packets.ICMPCodeFragNeeded {
+			handleFragNeeded(icmpPacket)
+		}
+	case packets.ICMPSourceQuench, packets.ICMPRedirect:
+		// source quench is deprecated (RFC 6633) and redirects are an easy way to
+		// hijack our traffic, so neither changes anything (like accept_redirects=0)
+		fmt.Printf(ColorGray+"%s from %s, ignoring\n"+ColorReset, icmpPacket, ipPacket.SrcIP)
+	case packets.ICMPEchoReply:
+		handleProbeReply(icmpPacket)
+	case packets.ICMPEchoRequest:
+		// answering broadcast pings turns us into a smurf amplifier (RFC 1122 3.2.2.6 allows ignoring them)
+		// multicast pings are treated the same way
+		localIP := ipPacket.DstIP
+		if isBroadcastIP(ipPacket.DstIP) || ipPacket.DstIP.IsMulticast() {
+			if !echoBroadcast {
+				fmt.Printf(ColorGray+"[ICMP] Ignoring broadcast ping from %s\n"+ColorReset, ipPacket.SrcIP)
+				return
+			}
+			// replies always come from a unicast address
+			if localIP = sourceFor(ipPacket.SrcIP); localIP == nil {
+				return
+			}
+		}
+
 		fmt.Printf(ColorPurple+"[ICMP] Ping Request (ID=%d Seq=%d). Sending Pong!\n"+ColorReset, icmpPacket.ID, icmpPacket.Seq)
 		pong := packets.ICMPMessage{
 			Type: packets.ICMPEchoReply, Code: 0, ID: icmpPacket.ID, Seq: icmpPacket.Seq, Data: icmpPacket.Data,
 		}
-		sendIPv4(iface, frame.SrcMAC, ipPacket.SrcIP, packets.ProtocolICMP, pong.Bytes())
+		replyHeader := newIPv4Header(ipPacket.SrcIP, packets.ProtocolICMP)
+		replyHeader.SrcIP = localIP
+		replyHeader.Options = echoReplyOptions(ipPacket, localIP)
+		if err := sendIPv4Header(replyHeader, pong.Bytes()); err != nil {
+			log.Printf("Echo reply error: %v", err)
+		}
+	}
+}
+
+// RFC 1122 3.2.2.6: Record Route and Timestamp options from an echo request
+// are reflected in the reply, we add our own entry (localIP) on the way back
+func echoReplyOptions(ipPacket *packets.IPv4Header, localIP net.IP) []packets.IPv4Option {
+	var opts []packets.IPv4Option
+
+	if opt, ok := ipPacket.Option(packets.IPv4OptionRecordRoute); ok {
+		if rr, err := opt.Route(); err == nil {
+			rr.Record(localIP)
+			opts = append(opts, rr.Option())
+		}
+	}
+
+	if opt, ok := ipPacket.Option(packets.IPv4OptionTimestamp); ok {
+		if ts, err := opt.Timestamp(); err == nil {
+			ts.Record(localIP, timestampNow())
+			opts = append(opts, ts.Option())
+		}
 	}
+
+	return opts
 }
 
-func handleUDP(iface *device.Interface, frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) {
-	udpPacket, err := packets.ParseUDP(frame.Payload[20:])
+// milliseconds since midnight UT, as used by the IPv4 Timestamp option
+func timestampNow() uint32 {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(now.Sub(midnight).Milliseconds())
+}
+
+// a unicast datagram for a port nobody bound, the caller answers it with the
+// Port Unreachable of its IP version (RFC 1122 4.1.3.1)
+var errPortUnreachable = errors.New("port unreachable")
+
+// processes a UDP datagram from src to dst received on n, over IP version 4 or 6
+func handleUDP(n *nic.NIC, version int, src, dst net.IP, seg []byte) error {
+	udpPacket, err := packets.ParseUDP(seg)
 	if err != nil {
-		return
+		return nil
+	}
+	if !packets.VerifyUDP(version, seg, src, dst) {
+		fmt.Printf(ColorRed+"[UDP] Bad checksum from %s, dropping\n"+ColorReset, src)
+		return nil
 	}
 
 	fmt.Printf(ColorBlue+"[UDP] %d -> %d: %q\n"+ColorReset, udpPacket.SrcPort, udpPacket.DstPort, string(udpPacket.Data))
 
-	replyUDP := packets.UDPPacket{
-		SrcPort: udpPacket.DstPort, DstPort: udpPacket.SrcPort, Data: udpPacket.Data,
+	broadcast := isBroadcastIP(dst)
+	dgram := &socket.Datagram{
+		SrcIP: src, DstIP: dst, SrcPort: udpPacket.SrcPort, DstPort: udpPacket.DstPort,
+		NIC: n.Name, Data: append([]byte(nil), udpPacket.Data...),
+	}
+	if udpSockets.Deliver(dgram, broadcast) > 0 || broadcast || dst.IsMulticast() {
+		return nil
 	}
-	sendIPv4(iface, frame.SrcMAC, ipPacket.SrcIP, packets.ProtocolUDP, replyUDP.Bytes(MyIP, ipPacket.SrcIP))
+
+	fmt.Printf(ColorRed+"   -> Port %d closed. Sending Port Unreachable.\n"+ColorReset, udpPacket.DstPort)
+	return errPortUnreachable
 }
 
-func handleTCP(iface *device.Interface, frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) {
-	tcpPacket, err := packets.ParseTCP(frame.Payload[20:])
+// processes a TCP segment from src to dst received on n, over IP version 4 or 6
+func handleTCP(n *nic.NIC, version int, src, dst net.IP, seg []byte) {
+	tcpPacket, err := packets.ParseTCP(seg)
 	if err != nil {
 		log.Printf("TCP Error: %v", err)
 		return
 	}
+	if !packets.VerifyTCP(version, seg, src, dst) {
+		fmt.Printf(ColorRed+"[TCP] Bad checksum from %s, dropping\n"+ColorReset, src)
+		return
+	}
+
+	// TCP is point to point, a segment sent to a broadcast or multicast address is bogus
+	if isBroadcastIP(dst) || dst.IsMulticast() {
+		return
+	}
 
 	// logs raw TCP details in gray to reduce noise
 	fmt.Printf(ColorGray+"%s\n"+ColorReset, tcpPacket.String())
@@ -165,26 +610,31 @@ func handleTCP(iface *device.Interface, frame *frames.EthernetFrame, ipPacket *p
 			Flags:      packets.TCPFlagRST | packets.TCPFlagACK,
 			Window:     0,
 		}
-		sendIPv4(iface, frame.SrcMAC, ipPacket.SrcIP, packets.ProtocolTCP, rst.Bytes(MyIP, ipPacket.SrcIP))
+		replyIP(n, version, src, dst, packets.ProtocolTCP, rst.Bytes(version, dst, src))
 		return
 	}
 
 	// handshake step 1: client sends SYN
 	if (tcpPacket.Flags & packets.TCPFlagSYN) != 0 {
-		fmt.Printf(ColorGreen + "   -> Connection Request (SYN). Sending SYN-ACK...\n" + ColorReset)
+		// segments we send must fit both the peer's MSS and the path MTU, the MSS
+		// we advertise is what our own link can take
+		peerMSS, ok := tcpPacket.MSS()
+		sendMSS := tcpSendMSS(n, src, peerMSS, ok)
+		fmt.Printf(ColorGreen+"   -> Connection Request (SYN, send MSS %d). Sending SYN-ACK...\n"+ColorReset, sendMSS)
 
 		synAck := packets.TCPHeader{
 			SrcPort:    tcpPacket.DstPort,
 			DstPort:    tcpPacket.SrcPort,
 			SeqNum:     1000,
 			AckNum:     tcpPacket.SeqNum + 1,
-			DataOffset: 5,
+			DataOffset: 6,
 			Flags:      packets.TCPFlagSYN | packets.TCPFlagACK,
 			Window:     65535,
 			UrgentPtr:  0,
+			Options:    packets.NewTCPMSSOption(uint16(tcpAdvertisedMSS(n, src))),
 		}
 
-		sendIPv4(iface, frame.SrcMAC, ipPacket.SrcIP, packets.ProtocolTCP, synAck.Bytes(MyIP, ipPacket.SrcIP))
+		replyIP(n, version, src, dst, packets.ProtocolTCP, synAck.Bytes(version, dst, src))
 		return
 	}
 
@@ -204,7 +654,7 @@ func handleTCP(iface *device.Interface, frame *frames.EthernetFrame, ipPacket *p
 			Window:     65535,
 			UrgentPtr:  0,
 		}
-		sendIPv4(iface, frame.SrcMAC, ipPacket.SrcIP, packets.ProtocolTCP, finAck.Bytes(MyIP, ipPacket.SrcIP))
+		replyIP(n, version, src, dst, packets.ProtocolTCP, finAck.Bytes(version, dst, src))
 		return
 	}
 
@@ -215,13 +665,3 @@ func handleTCP(iface *device.Interface, frame *frames.EthernetFrame, ipPacket *p
 		}
 	}
 }
-
-func sendIPv4(iface *device.Interface, dstMAC [6]byte, dstIP net.IP, protocol uint8, data []byte) {
-	ipHeader := packets.IPv4Header{
-		Version: 4, IHL: 5, TotalLength: uint16(20 + len(data)), TTL: 64, Protocol: protocol, SrcIP: MyIP, DstIP: dstIP,
-	}
-	ethFrame := frames.EthernetFrame{
-		DstMAC: dstMAC, SrcMAC: [6]byte(MyMAC), EtherType: frames.EtherTypeIPv4, Payload: append(ipHeader.Bytes(), data...),
-	}
-	iface.Write(ethFrame.Bytes())
-}
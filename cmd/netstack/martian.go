@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/routing"
+)
+
+// set by -rp-filter and -log-martians
+var (
+	rpFilter    = routing.RPFilterLoose
+	logMartians bool
+)
+
+// packets dropped by checkMartian, per reason
+var martianDrops [routing.NumMartians]atomic.Uint64
+
+// local network control block (224.0.0.0/24), never forwarded
+var localMulticastNet = &net.IPNet{IP: net.IPv4(224, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}
+
+// drops spoofed and bogus packets before anything else looks at them,
+// returns false (and counts the reason) if the packet must go
+func checkMartian(n *nic.NIC, ipPacket *packets.IPv4Header) bool {
+	m := martianReason(n, ipPacket)
+	if m == routing.NotMartian {
+		return true
+	}
+
+	martianDrops[m].Add(1)
+	if logMartians {
+		fmt.Printf(ColorRed+"[IPv4] Martian packet (%s) %s -> %s on %s\n"+ColorReset, m, ipPacket.SrcIP, ipPacket.DstIP, n.Name)
+	}
+	return false
+}
+
+func martianReason(n *nic.NIC, ipPacket *packets.IPv4Header) routing.Martian {
+	src, dst := ipPacket.SrcIP, ipPacket.DstIP
+
+	if m := routing.MartianDestination(dst); m != routing.NotMartian {
+		return m
+	}
+
+	// hosts without an address yet use 0.0.0.0: DHCP to the limited broadcast,
+	// IGMP and other link-local multicast (RFC 3376 4.2.13)
+	if src.Equal(net.IPv4zero) {
+		if dst.Equal(net.IPv4bcast) || localMulticastNet.Contains(dst) || ipPacket.Protocol == packets.ProtocolIGMP {
+			return routing.NotMartian
+		}
+		return routing.MartianZeroNet
+	}
+
+	if m := routing.MartianSource(src); m != routing.NotMartian {
+		return m
+	}
+	if isLocalIP(src) {
+		return routing.MartianLocalSource
+	}
+	if isBroadcastIP(src) {
+		return routing.MartianBroadcast
+	}
+	if !routes.ValidSource(src, n.Name, rpFilter) {
+		return routing.MartianReversePath
+	}
+	return routing.NotMartian
+}
+
+// prints the drop counters, used by the console
+func printMartians() {
+	fmt.Printf(ColorCyan+"rp_filter %s, martians dropped:\n"+ColorReset, rpFilter)
+	for m := routing.NotMartian + 1; m < routing.NumMartians; m++ {
+		fmt.Printf(ColorCyan+"   %-12s %d\n"+ColorReset, m, martianDrops[m].Load())
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/multicast"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// the stack's own listener for the solicited-node group of an address, sockets
+// are the other kind of listener
+type solicitedNodeListener string
+
+// starts listening to the solicited-node group of a new address, reported with
+// MLD so snooping switches pass us the neighbor solicitations (RFC 4862 5.4.2)
+func joinSolicitedNode(n *nic.NIC, ip net.IP) {
+	sendMLD(n, n.MLD.SetFilter(solicitedNodeListener(ip.String()), packets.SolicitedNodeMulticast(ip), multicast.JoinAll()))
+}
+
+// stops listening for an address that went away or turned out to be a duplicate
+// the group stays joined while another address shares it
+func leaveSolicitedNode(n *nic.NIC, ip net.IP) {
+	sendMLD(n, n.MLD.SetFilter(solicitedNodeListener(ip.String()), packets.SolicitedNodeMulticast(ip), multicast.Filter{Mode: multicast.Include}))
+}
+
+func handleMLD(n *nic.NIC, ipPacket *packets.IPv6Header, exts []packets.IPv6Extension, msg *packets.ICMPv6Message) {
+	mld, err := packets.ParseMLD(msg)
+	if err != nil {
+		return
+	}
+
+	// RFC 3810 5.1.14: only link-local queriers, on the link (hop limit 1) and
+	// with a Router Alert, general queries to all-nodes (5.1.15)
+	switch mld.Type {
+	case packets.MLDListenerQuery:
+		if !ipPacket.SrcIP.IsLinkLocalUnicast() || ipPacket.HopLimit != 1 || !hasRouterAlert(exts) {
+			return
+		}
+		if mld.Group.IsUnspecified() && !ipPacket.DstIP.Equal(nic.IPv6AllNodes) {
+			return
+		}
+		fmt.Printf(ColorPurple+"%s from %s on %s\n"+ColorReset, mld, ipPacket.SrcIP, n.Name)
+		n.MLD.HandleQuery(mld)
+	case packets.MLDv1ListenerReport:
+		n.MLD.HandleReport(mld.Group)
+	}
+}
+
+// reports whether the hop-by-hop options carry a Router Alert
+func hasRouterAlert(exts []packets.IPv6Extension) bool {
+	hbh, ok := packets.FindIPv6Extension(exts, packets.ProtocolHopByHop)
+	if !ok {
+		return false
+	}
+	opts, err := hbh.Options()
+	if err != nil {
+		return false
+	}
+	for _, opt := range opts {
+		if _, err := opt.RouterAlert(); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sends MLD messages out of a NIC from its link-local address (the unspecified
+// address while it's still tentative, RFC 3810 5.2.13), with hop limit 1 and
+// a Router Alert
+func sendMLD(n *nic.NIC, msgs []multicast.Message) {
+	if n.Tunnel != nil {
+		return
+	}
+	for _, msg := range msgs {
+		src := n.SourceFor6(msg.Dst)
+		if src == nil || !src.IsLinkLocalUnicast() {
+			src = net.IPv6unspecified
+		}
+		icmp := packets.ICMPv6Message{Type: msg.Type, Body: msg.Data}
+		ipHeader := newIPv6Header(src, msg.Dst, packets.ProtocolHopByHop)
+		ipHeader.HopLimit = 1
+		payload := append(packets.NewIPv6RouterAlertHeader(packets.ProtocolICMPv6, packets.IPv6RouterAlertMLD), icmp.Bytes(src, msg.Dst)...)
+		if err := sendIPv6On(n, msg.Dst, ipHeader, payload); err != nil {
+			log.Printf("MLD send error on %s: %v", n.Name, err)
+		}
+	}
+}
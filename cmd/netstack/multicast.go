@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/multicast"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/socket"
+)
+
+// how often IGMP and MLD timers are checked, report delays are random within
+// Max Resp Time so they need a finer clock than the other timers
+const igmpTick = 100 * time.Millisecond
+
+// updates a socket's membership on a NIC and sends the resulting state change report
+func setGroupFilter(s *socket.UDPSocket, group net.IP, name string, f multicast.Filter) error {
+	n, ok := nics.Get(name)
+	if !ok {
+		return fmt.Errorf("unknown interface %s", name)
+	}
+	if group.To4() == nil {
+		fmt.Printf(ColorPurple+"[MLD] %s on %s: %s %s\n"+ColorReset, s, name, group, f)
+		sendMLD(n, n.MLD.SetFilter(s, group, f))
+		return nil
+	}
+	fmt.Printf(ColorPurple+"[IGMP] %s on %s: %s %s\n"+ColorReset, s, name, group, f)
+	sendIGMP(n, n.IGMP.SetFilter(s, group, f))
+	return nil
+}
+
+func handleIGMP(n *nic.NIC, ipPacket *packets.IPv4Header) {
+	msg, err := packets.ParseIGMP(ipPacket.Payload)
+	if err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case packets.IGMPMembershipQuery:
+		// RFC 3376 9.1: v3 queries without Router Alert may be spoofed from off-link,
+		// and general queries must go to all-hosts (4.1.12)
+		if _, ok := ipPacket.Option(packets.IPv4OptionRouterAlert); msg.Version == 3 && !ok {
+			return
+		}
+		if msg.Group.Equal(net.IPv4zero) && !ipPacket.DstIP.Equal(packets.IGMPAllHosts) {
+			return
+		}
+		fmt.Printf(ColorPurple+"[IGMP] %s from %s on %s\n"+ColorReset, msg, ipPacket.SrcIP, n.Name)
+		n.IGMP.HandleQuery(msg)
+	case packets.IGMPv1MembershipReport, packets.IGMPv2MembershipReport:
+		n.IGMP.HandleReport(msg.Group)
+	}
+}
+
+// sends IGMP messages out of a NIC, from its primary address (0.0.0.0 if it
+// has none yet, RFC 3376 4.2.13) with TTL 1 and Router Alert
+func sendIGMP(n *nic.NIC, msgs []multicast.Message) {
+	for _, msg := range msgs {
+		ipHeader := newIPv4Header(msg.Dst, packets.ProtocolIGMP)
+		ipHeader.TTL = 1
+		ipHeader.Options = []packets.IPv4Option{packets.NewRouterAlertOption(0)}
+		if ipHeader.SrcIP = n.SourceFor(msg.Dst); ipHeader.SrcIP == nil {
+			ipHeader.SrcIP = net.IPv4zero
+		}
+		if err := sendIPv4On(n, ipHeader, msg.Data); err != nil {
+			log.Printf("IGMP send error on %s: %v", n.Name, err)
+		}
+	}
+}
+
+// fires pending IGMP and MLD reports on every NIC
+func multicastTimers() {
+	for now := range time.Tick(igmpTick) {
+		for _, n := range nics.All() {
+			sendIGMP(n, n.IGMP.Tick(now))
+			sendMLD(n, n.MLD.Tick(now))
+		}
+	}
+}
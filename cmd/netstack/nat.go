@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/nat"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// NAT rules from -nat and the translations they created
+var natTable = nat.NewTable(conntracks, natRoute)
+
+// tells the NAT table where a translated packet would go
+func natRoute(dst net.IP) (string, net.IP, bool) {
+	if isLocalIP(dst) || isBroadcastIP(dst) || dst.IsMulticast() {
+		return "", nil, false
+	}
+	route, ok := routes.Lookup(dst)
+	if !ok {
+		return "", nil, false
+	}
+	n, ok := nics.Get(route.Interface)
+	if !ok {
+		return "", nil, false
+	}
+	return n.Name, selectSource(route, n, route.NextHop(dst)), true
+}
+
+// runs an incoming packet through NAT before we decide whether it's ours or
+// needs forwarding, returns the rewritten header, nil if the packet is dropped
+func translateIPv4(n *nic.NIC, frame *frames.EthernetFrame, ipPacket *packets.IPv4Header) (*frames.EthernetFrame, *packets.IPv4Header) {
+	changed, err := natTable.Translate(n.Name, frame.Payload)
+	if err != nil {
+		fmt.Printf(ColorRed+"[NAT] Dropping packet: %v\n"+ColorReset, err)
+		return nil, nil
+	}
+	if !changed {
+		return frame, ipPacket
+	}
+
+	translated, err := packets.ParseIPv4(frame.Payload)
+	if err != nil {
+		return nil, nil
+	}
+	fmt.Printf(ColorGray+"[NAT] %s -> %s became %s -> %s\n"+ColorReset, ipPacket.SrcIP, ipPacket.DstIP, translated.SrcIP, translated.DstIP)
+	return frame, translated
+}
+
+func printNATRules() {
+	rules := natTable.Rules()
+	if len(rules) == 0 {
+		return
+	}
+	fmt.Printf(ColorCyan + "NAT rules:\n" + ColorReset)
+	for _, r := range rules {
+		fmt.Printf(ColorCyan+"   %s\n"+ColorReset, r)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/neighbor"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// duplicate address detection settings (RFC 4862 5.1)
+const (
+	dadTransmits = 1           // DupAddrDetectTransmits
+	maxDADDelay  = time.Second // MAX_RTR_SOLICITATION_DELAY, spreads out nodes that boot together
+)
+
+// Neighbor Discovery messages are only valid if they come from the link itself,
+// which routers can't fake since they decrement the hop limit (RFC 4861 7.1)
+const ndHopLimit = 255
+
+// runs duplicate address detection for a new address (RFC 4862 5.4): it is
+// solicited from the unspecified address, and if nobody claims it within
+// RetransTime it becomes usable
+func startDAD(n *nic.NIC, ip net.IP) {
+	go func() {
+		time.Sleep(rand.N(maxDADDelay))
+		for range dadTransmits {
+			if addr, ok := n.Address6(ip); !ok || addr.State != nic.Tentative {
+				return
+			}
+			if err := sendNeighborSolicitation(n, ip, net.IPv6unspecified); err != nil {
+				fmt.Printf(ColorRed+"[DAD] Error probing %s on %s: %v\n"+ColorReset, ip, n.Name, err)
+			}
+			time.Sleep(neighbor.RetransTime)
+		}
+		if n.SetAddress6State(ip, nic.Tentative, nic.Preferred) {
+			fmt.Printf(ColorGreen+"[DAD] %s on %s is unique\n"+ColorReset, ip, n.Name)
+			dadSucceeded(n, ip)
+		}
+	}()
+}
+
+// gives up on a tentative address somebody else has
+func dadFailed(n *nic.NIC, ip net.IP, reason string) {
+	if n.SetAddress6State(ip, nic.Tentative, nic.Duplicate) {
+		fmt.Printf(ColorRed+"[DAD] %s on %s is a duplicate (%s), not using it\n"+ColorReset, ip, n.Name, reason)
+		leaveSolicitedNode(n, ip)
+		slaacDADFailed(n, ip)
+	}
+}
+
+// asks who has target. DAD probes come from the unspecified address and carry
+// no link-layer address, resolution uses src when it's ours (the source of the
+// packet waiting for it, RFC 4861 7.2.2). Entries being probed are asked
+// directly, everything else through the solicited-node group
+func sendNeighborSolicitation(n *nic.NIC, target, src net.IP) error {
+	ns := packets.NeighborSolicitation{Target: target}
+	dst := packets.SolicitedNodeMulticast(target)
+
+	if !src.IsUnspecified() {
+		if src == nil || !n.HasAddress(src) {
+			if src = n.SourceFor6(target); src == nil {
+				return fmt.Errorf("no address on %s to resolve %s from", n.Name, target)
+			}
+		}
+		ns.Options = []packets.NDPOption{packets.NewLinkAddrOption(packets.NDPOptionSourceLinkAddr, n.MAC)}
+		if _, ok := n.ND.Lookup(target); ok {
+			dst = target
+		}
+		fmt.Printf(ColorYellow+"[ND] Who has %s? Tell %s\n"+ColorReset, target, src)
+	}
+
+	msg := packets.ICMPv6Message{Type: packets.ICMPv6NeighborSolicitation, Body: ns.Bytes()}
+	return sendICMPv6(n, src, dst, ndHopLimit, &msg)
+}
+
+// sends the packets that were waiting for a neighbor to be resolved
+func flushPending6(n *nic.NIC, mac net.HardwareAddr, pending [][]byte) {
+	for _, pkt := range pending {
+		writeFrame(n, [6]byte(mac), frames.EtherTypeIPv6, pkt)
+	}
+}
+
+// answers solicitations for our addresses and learns the solicitor's MAC (RFC 4861 7.2.3)
+func handleNeighborSolicitation(n *nic.NIC, ipPacket *packets.IPv6Header, msg *packets.ICMPv6Message) {
+	if ipPacket.HopLimit != ndHopLimit || msg.Code != 0 {
+		return
+	}
+	ns, err := packets.ParseNeighborSolicitation(msg.Body)
+	if err != nil || ns.Target.IsMulticast() {
+		return
+	}
+
+	var mac net.HardwareAddr
+	if opt, ok := packets.FindNDPOption(ns.Options, packets.NDPOptionSourceLinkAddr); ok {
+		mac, _ = opt.LinkAddr()
+	}
+	// DAD probes go to the solicited-node group and can't carry a link-layer address
+	dad := ipPacket.SrcIP.IsUnspecified()
+	if dad && (!ipPacket.DstIP.Equal(packets.SolicitedNodeMulticast(ns.Target)) || mac != nil) {
+		return
+	}
+
+	addr, ok := n.Address6(ns.Target)
+	if !ok || addr.State == nic.Duplicate {
+		return
+	}
+	if addr.State == nic.Tentative {
+		// somebody else is trying to claim the address at the same time
+		if dad {
+			dadFailed(n, ns.Target, "another node is probing it")
+		}
+		return
+	}
+
+	if !dad && mac != nil {
+		flushPending6(n, mac, n.ND.Observe(ipPacket.SrcIP, mac, true))
+	}
+
+	fmt.Printf(ColorYellow+"[ND] Who has %s? It's me! Sending advertisement...\n"+ColorReset, ns.Target)
+
+	// a DAD probe has no address to answer to, so the whole link hears it
+	dst := ipPacket.SrcIP
+	if dad {
+		dst = nic.IPv6AllNodes
+	}
+	na := packets.NeighborAdvertisement{
+		Solicited: !dad,
+		Override:  true,
+		Target:    ns.Target,
+		Options:   []packets.NDPOption{packets.NewLinkAddrOption(packets.NDPOptionTargetLinkAddr, n.MAC)},
+	}
+	reply := packets.ICMPv6Message{Type: packets.ICMPv6NeighborAdvertisement, Body: na.Bytes()}
+	if err := sendICMPv6(n, ns.Target, dst, ndHopLimit, &reply); err != nil {
+		fmt.Printf(ColorRed+"[ND] Error answering %s: %v\n"+ColorReset, ipPacket.SrcIP, err)
+	}
+}
+
+// updates the ND cache from an advertisement (RFC 4861 7.2.5), or notices
+// that somebody else uses one of our addresses
+func handleNeighborAdvertisement(n *nic.NIC, ipPacket *packets.IPv6Header, msg *packets.ICMPv6Message) {
+	if ipPacket.HopLimit != ndHopLimit || msg.Code != 0 {
+		return
+	}
+	na, err := packets.ParseNeighborAdvertisement(msg.Body)
+	if err != nil || na.Target.IsMulticast() || (ipPacket.DstIP.IsMulticast() && na.Solicited) {
+		return
+	}
+
+	var mac net.HardwareAddr
+	if opt, ok := packets.FindNDPOption(na.Options, packets.NDPOptionTargetLinkAddr); ok {
+		mac, _ = opt.LinkAddr()
+	}
+
+	if addr, ok := n.Address6(na.Target); ok {
+		switch addr.State {
+		case nic.Tentative:
+			dadFailed(n, na.Target, fmt.Sprintf("%s answered for it", mac))
+		case nic.Preferred:
+			fmt.Printf(ColorRed+"[ND] %s on %s is also claimed by %s\n"+ColorReset, na.Target, n.Name, mac)
+		}
+		return
+	}
+
+	if pending := n.ND.Advertise(na.Target, mac, na.Solicited, na.Override); len(pending) > 0 {
+		fmt.Printf(ColorYellow+"[ND] %s is at %s\n"+ColorReset, na.Target, mac)
+		flushPending6(n, mac, pending)
+	}
+}
+
+// retransmits solicitations and gives up on neighbors that never answer
+// packets stuck behind a dead neighbor get Address Unreachable (RFC 4861 7.2.2)
+func ndTick(n *nic.NIC, now time.Time) {
+	retry, failed := n.ND.Tick(now)
+
+	for _, ip := range retry {
+		sendNeighborSolicitation(n, ip, nil)
+	}
+
+	for _, f := range failed {
+		fmt.Printf(ColorRed+"[ND] No answer from %s on %s, dropping %d queued packets\n"+ColorReset, f.IP, n.Name, len(f.Pending))
+		for _, pkt := range f.Pending {
+			if isLocalIP(net.IP(pkt[8:24])) {
+				continue
+			}
+			sendICMPv6Error(n, pkt, packets.ICMPv6DestUnreachable, packets.ICMPv6CodeAddressUnreachable, 0)
+		}
+	}
+}
+
+// runs an nd command, used by the console:
+//
+//	show
+func ndCommand(args []string) error {
+	if len(args) != 1 || args[0] != "show" {
+		return fmt.Errorf("usage: nd show")
+	}
+
+	now := time.Now()
+	for _, n := range nics.All() {
+		fmt.Printf(ColorCyan+"%s: hoplimit %d mtu %d\n"+ColorReset, n.Name, hopLimit6(n), linkMTU6(n))
+		for _, a := range n.Addresses6() {
+			fmt.Printf(ColorCyan+"   inet6 %s valid_lft %s preferred_lft %s\n"+ColorReset, a, lifetimeLeft(now, a.ValidUntil), lifetimeLeft(now, a.PreferredUntil))
+		}
+		for _, m := range n.MLD.Memberships() {
+			fmt.Printf(ColorCyan+"   group %s %s\n"+ColorReset, m.Group, m.Filter)
+		}
+		for _, e := range n.ND.Entries() {
+			fmt.Printf(ColorCyan+"   %s lladdr %s %s\n"+ColorReset, e.IP, e.MAC, e.State)
+		}
+	}
+	for _, r := range routes6.Routes() {
+		fmt.Printf(ColorCyan+"%s\n"+ColorReset, r)
+	}
+	return nil
+}
+
+// formats what's left of a lifetime like ip addr does
+func lifetimeLeft(now, until time.Time) string {
+	if until.IsZero() {
+		return "forever"
+	}
+	return fmt.Sprintf("%ds", max(0, int(until.Sub(now).Seconds())))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/firewall"
+	"github.com/hexhaust/mini-netstack/pkg/fragment"
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/ipid"
+	"github.com/hexhaust/mini-netstack/pkg/neighbor"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/ratelimit"
+	"github.com/hexhaust/mini-netstack/pkg/routing"
+)
+
+var routes = routing.NewTable()
+
+var broadcastMAC = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Identification values for the packets we originate
+var ipIDs = ipid.New()
+
+// ICMP and ICMPv6 errors we send, per destination: a burst of icmpRateBurst,
+// then one per interval (1s by default, like Linux icmp_ratelimit), set with -icmp-ratelimit
+var icmpLimiter = ratelimit.New(time.Second, icmpRateBurst)
+
+const icmpRateBurst = 6
+
+// sends an ICMP error (built with packets.NewICMP*) to the source of the packet
+// it quotes, from the address that packet was sent to when it's one of ours
+func sendICMPError(msg *packets.ICMPMessage) {
+	quote := msg.Quote()
+	if !icmpErrorAllowed(quote) {
+		return
+	}
+	dst := net.IP(append([]byte(nil), quote[12:16]...))
+
+	// path MTU discovery stalls when Fragmentation Needed gets lost, so it's never limited
+	pmtud := msg.Type == packets.ICMPDestUnreachable && msg.Code == packets.ICMPCodeFragNeeded
+	if !pmtud && !icmpLimiter.Allow(dst, time.Now()) {
+		fmt.Printf(ColorGray+"[ICMP] Rate limiting errors to %s\n"+ColorReset, dst)
+		return
+	}
+
+	ipHeader := newIPv4Header(dst, packets.ProtocolICMP)
+	if src := net.IP(quote[16:20]); isLocalIP(src) {
+		ipHeader.SrcIP = append(net.IP(nil), src...)
+	}
+	if err := sendIPv4Header(ipHeader, msg.Bytes()); err != nil {
+		fmt.Printf(ColorRed+"[ICMP] Error sending %s to %s: %v\n"+ColorReset, msg, dst, err)
+	}
+}
+
+// RFC 1812 4.3.2.7 (RFC 1122 3.2.2 for hosts): no ICMP errors about ICMP errors,
+// packets sent to a broadcast or multicast address, fragments but the first,
+// or packets from an address that isn't a single host (zero, loopback,
+// broadcast, multicast or class E)
+func icmpErrorAllowed(quote []byte) bool {
+	if len(quote) < 20 {
+		return false
+	}
+	src, dst := net.IP(quote[12:16]), net.IP(quote[16:20])
+	if isBroadcastIP(dst) || dst.IsMulticast() {
+		return false
+	}
+	if binary.BigEndian.Uint16(quote[6:8])&0x1FFF != 0 {
+		return false
+	}
+	if headerLen := int(quote[0]&0x0F) * 4; quote[9] == packets.ProtocolICMP && len(quote) > headerLen && packets.IsICMPError(quote[headerLen]) {
+		return false
+	}
+	return !(src[0] == 0 || src[0] >= 240 || src.IsLoopback() || isBroadcastIP(src) || src.IsMulticast())
+}
+
+// returns a default header for a packet we originate
+// SrcIP is left empty so the route can pick it
+func newIPv4Header(dstIP net.IP, protocol uint8) *packets.IPv4Header {
+	return &packets.IPv4Header{
+		Version: 4, IHL: 5, TTL: 64, Protocol: protocol, DstIP: dstIP,
+	}
+}
+
+// answers ipPacket from the address it was sent to
+func replyIPv4(ipPacket *packets.IPv4Header, protocol uint8, data []byte) error {
+	ipHeader := newIPv4Header(ipPacket.SrcIP, protocol)
+	ipHeader.SrcIP = ipPacket.DstIP
+	return sendIPv4Header(ipHeader, data)
+}
+
+// answers a packet src sent to dst over IP version 4 or 6, from the address it
+// was sent to. n is the NIC it came in on, where link-local sources are reached
+func replyIP(n *nic.NIC, version int, src, dst net.IP, protocol uint8, data []byte) error {
+	if version == 6 {
+		return sendIPv6(n, dst, src, protocol, 0, data)
+	}
+	ipHeader := newIPv4Header(src.To4(), protocol)
+	ipHeader.SrcIP = dst.To4()
+	return sendIPv4Header(ipHeader, data)
+}
+
+// sends data using a caller-built header (e.g. one carrying options)
+// the route decides the link and next hop. Unicast packets that fit the path
+// MTU get DF so routers tell us when it shrinks, bigger ones are fragmented
+// to it. Headers that already carry DF (probes) are only held to the link MTU
+func sendIPv4Header(ipHeader *packets.IPv4Header, data []byte) error {
+	route, ok := lookupRoute(ipHeader.SrcIP, ipHeader.DstIP)
+	if !ok {
+		return fmt.Errorf("no route to host %s", ipHeader.DstIP)
+	}
+	n, ok := nics.Get(route.Interface)
+	if !ok {
+		return fmt.Errorf("route %s uses unknown interface", route)
+	}
+
+	// multicast goes straight to the group's MAC, never through a gateway
+	nextHop := route.NextHop(ipHeader.DstIP)
+	if ipHeader.DstIP.IsMulticast() {
+		nextHop = ipHeader.DstIP
+	}
+	if ipHeader.SrcIP == nil {
+		if ipHeader.SrcIP = selectSource(route, n, nextHop); ipHeader.SrcIP == nil {
+			return fmt.Errorf("no source address on %s to reach %s", n.Name, ipHeader.DstIP)
+		}
+	}
+	ipHeader.Identification = ipIDs.Next(ipHeader.SrcIP, ipHeader.DstIP, ipHeader.Protocol)
+	if err := filterOutput(n, ipHeader, data); err != nil {
+		return err
+	}
+	data, err := protectOutput(ipHeader, data)
+	if data == nil {
+		return err
+	}
+
+	mtu := n.Dev.MTU
+	if ipHeader.Flags&packets.IPv4FlagDF == 0 {
+		var df bool
+		if mtu, df = pathMTU(n.Dev.MTU, ipHeader.DstIP); df && ipHeader.HeaderLen()+len(data) <= mtu {
+			ipHeader.Flags |= packets.IPv4FlagDF
+		}
+	}
+
+	pkts, err := fragment.SplitIPv4(ipHeader, data, mtu)
+	if err != nil {
+		return fmt.Errorf("sending %d bytes to %s on %s (MTU %d): %w", len(data), ipHeader.DstIP, n.Name, mtu, err)
+	}
+
+	for _, pkt := range pkts {
+		if err := outputIPv4(n, nextHop, pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sends a packet out of a given NIC without looking at the routing table,
+// for link-local traffic like IGMP (the caller sets SrcIP)
+func sendIPv4On(n *nic.NIC, ipHeader *packets.IPv4Header, data []byte) error {
+	ipHeader.Identification = ipIDs.Next(ipHeader.SrcIP, ipHeader.DstIP, ipHeader.Protocol)
+	if err := filterOutput(n, ipHeader, data); err != nil {
+		return err
+	}
+
+	pkts, err := fragment.SplitIPv4(ipHeader, data, n.Dev.MTU)
+	if err != nil {
+		return err
+	}
+	for _, pkt := range pkts {
+		if err := outputIPv4(n, ipHeader.DstIP, pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tracks a packet we originate and runs it through the output and postrouting hooks
+func filterOutput(n *nic.NIC, ipHeader *packets.IPv4Header, data []byte) error {
+	filtered := *ipHeader
+	filtered.TotalLength = uint16(ipHeader.HeaderLen() + len(data))
+	filtered.Payload = data
+	hdr, err := filtered.Bytes()
+	if err != nil {
+		return err
+	}
+	state, _ := conntracks.Track(append(hdr, data...))
+
+	if !filterIPv4(firewall.Output, "", n.Name, state, &filtered) || !filterIPv4(firewall.Postrouting, "", n.Name, state, &filtered) {
+		return fmt.Errorf("%s -> %s: rejected by firewall", ipHeader.SrcIP, ipHeader.DstIP)
+	}
+	return nil
+}
+
+// routes dst, the limited broadcast never leaves the link so it goes straight
+// out of the NIC owning src (the primary NIC if src isn't set)
+func lookupRoute(src, dst net.IP) (routing.Route, bool) {
+	if !dst.Equal(net.IPv4bcast) {
+		return routes.Lookup(dst)
+	}
+
+	name := DevName
+	if owner, ok := nics.Owner(src); ok {
+		name = owner.Name
+	}
+	return routing.Route{Dst: &net.IPNet{IP: dst, Mask: net.CIDRMask(32, 32)}, Interface: name}, true
+}
+
+// returns the source address we'd use to reach dst, nil if it's unreachable
+func sourceFor(dst net.IP) net.IP {
+	route, ok := lookupRoute(nil, dst)
+	if !ok {
+		return nil
+	}
+	n, ok := nics.Get(route.Interface)
+	if !ok {
+		return nil
+	}
+	return selectSource(route, n, route.NextHop(dst))
+}
+
+// sends a UDP datagram for a socket, picking the source address if it's unset
+// IPv4 destinations, v4-mapped ones included, go out as IPv4 and the zone only
+// matters to IPv6
+func sendUDP(src, dst net.IP, srcPort, dstPort uint16, zone string, data []byte) error {
+	if dst.To4() == nil {
+		return sendUDP6(src, dst, srcPort, dstPort, zone, data)
+	}
+	dst = dst.To4()
+	if src == nil {
+		if src = sourceFor(dst); src == nil {
+			return fmt.Errorf("no route to host %s", dst)
+		}
+	}
+
+	udp := packets.UDPPacket{SrcPort: srcPort, DstPort: dstPort, Data: data}
+	ipHeader := newIPv4Header(dst, packets.ProtocolUDP)
+	ipHeader.SrcIP = src
+	if dst.IsMulticast() {
+		ipHeader.TTL = 1 // IP_MULTICAST_TTL default, we don't route multicast
+	}
+	return sendIPv4Header(ipHeader, udp.Bytes(4, src, dst))
+}
+
+// source address selection: the route's src hint wins if it's still ours,
+// otherwise the egress NIC's primary address on the next hop's subnet
+func selectSource(route routing.Route, n *nic.NIC, nextHop net.IP) net.IP {
+	if route.Src != nil && isLocalIP(route.Src) {
+		return route.Src
+	}
+	return n.SourceFor(nextHop)
+}
+
+// hands a serialized IPv4 packet to the link, resolving the next hop MAC first
+// packets for unresolved neighbors wait in the ARP cache until the reply shows up
+func outputIPv4(n *nic.NIC, nextHop net.IP, pkt []byte) error {
+	// tunnels are point to point, there's no next hop to resolve
+	if n.Tunnel != nil {
+		return sendTunnel(n, pkt)
+	}
+
+	// broadcasts and multicasts need no resolution
+	if n.IsBroadcast(nextHop) {
+		return writeFrame(n, broadcastMAC, frames.EtherTypeIPv4, pkt)
+	}
+	if nextHop.IsMulticast() {
+		return writeFrame(n, frames.IPv4MulticastMAC(nextHop), frames.EtherTypeIPv4, pkt)
+	}
+
+	if mac, ok := n.ARP.Lookup(nextHop); ok {
+		return writeFrame(n, [6]byte(mac), frames.EtherTypeIPv4, pkt)
+	}
+
+	if n.ARP.Enqueue(nextHop, pkt) {
+		return sendARPRequest(n, nextHop)
+	}
+	return nil
+}
+
+func writeFrame(n *nic.NIC, dstMAC [6]byte, etherType uint16, payload []byte) error {
+	ethFrame := frames.EthernetFrame{
+		DstMAC: dstMAC, SrcMAC: [6]byte(n.MAC), EtherType: etherType, Payload: payload,
+	}
+	return n.Egress.Send(ethFrame.Bytes())
+}
+
+// broadcasts "who has ip?" on the NIC
+func sendARPRequest(n *nic.NIC, ip net.IP) error {
+	srcIP := n.SourceFor(ip)
+	fmt.Printf(ColorYellow+"[ARP] Who has %s? Tell %s\n"+ColorReset, ip, srcIP)
+
+	req, err := packets.NewARPRequest(n.MAC, srcIP, ip)
+	if err != nil {
+		return err
+	}
+	return writeFrame(n, broadcastMAC, frames.EtherTypeARP, req)
+}
+
+// retransmits ARP requests and neighbor solicitations, gives up on neighbors that never answer
+// forwarded packets stuck behind a dead neighbor get ICMP Host Unreachable (RFC 1812 4.3.3.1)
+func neighborTimers() {
+	for now := range time.Tick(neighbor.RetransTime) {
+		for _, n := range nics.All() {
+			retry, failed := n.ARP.Tick(now)
+
+			for _, ip := range retry {
+				sendARPRequest(n, ip)
+			}
+
+			for _, f := range failed {
+				fmt.Printf(ColorRed+"[ARP] No reply from %s on %s, dropping %d queued packets\n"+ColorReset, f.IP, n.Name, len(f.Pending))
+				for _, pkt := range f.Pending {
+					ipPacket, err := packets.ParseIPv4(pkt)
+					if err != nil || isLocalIP(ipPacket.SrcIP) {
+						continue
+					}
+					sendICMPError(packets.NewICMPUnreachable(packets.ICMPCodeHostUnreachable, pkt))
+				}
+			}
+
+			ndTick(n, now)
+		}
+	}
+}
+
+func printRoutes() {
+	fmt.Printf(ColorCyan + "Routing table:\n" + ColorReset)
+	for _, r := range routes.Routes() {
+		fmt.Printf(ColorCyan+"   %s\n"+ColorReset, r)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/firewall"
+	"github.com/hexhaust/mini-netstack/pkg/fragment"
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/routing"
+)
+
+// IPv6 routes: the prefixes of our global addresses (link-local ones belong to
+// a single link and are handled by routeIPv6)
+var routes6 = routing.NewTable()
+
+// hop limit of the packets we originate, unless a router advertised another
+const defaultHopLimit = 64
+
+func newIPv6Header(src, dst net.IP, next uint8) *packets.IPv6Header {
+	return &packets.IPv6Header{Version: 6, HopLimit: defaultHopLimit, NextHeader: next, SrcIP: src, DstIP: dst}
+}
+
+// picks the NIC and next hop for dst. Link-local and multicast destinations
+// only mean something on a given link, so they leave through zone
+func routeIPv6(zone *nic.NIC, dst net.IP) (*nic.NIC, net.IP, error) {
+	if dst.IsMulticast() || dst.IsLinkLocalUnicast() {
+		if zone == nil {
+			return nil, nil, fmt.Errorf("%s needs an interface", dst)
+		}
+		return zone, dst, nil
+	}
+
+	route, ok := routes6.Lookup(dst)
+	if !ok {
+		return nil, nil, fmt.Errorf("no route to host %s", dst)
+	}
+	n, ok := nics.Get(route.Interface)
+	if !ok {
+		return nil, nil, fmt.Errorf("route %s uses unknown interface", route)
+	}
+	return n, route.NextHop(dst), nil
+}
+
+// returns the source address we'd use to reach dst, zone as in routeIPv6
+func sourceFor6(zone *nic.NIC, dst net.IP) (net.IP, error) {
+	n, _, err := routeIPv6(zone, dst)
+	if err != nil {
+		return nil, err
+	}
+	if src := n.SourceFor6(dst); src != nil {
+		return src, nil
+	}
+	return nil, fmt.Errorf("no source address on %s to reach %s", n.Name, dst)
+}
+
+// sends an upper-layer payload from src to dst, a zero hop limit means the
+// link's default. The payload's checksum already covers src, so it's set
+func sendIPv6(zone *nic.NIC, src, dst net.IP, next, hopLimit uint8, payload []byte) error {
+	n, nextHop, err := routeIPv6(zone, dst)
+	if err != nil {
+		return err
+	}
+
+	ipHeader := newIPv6Header(src, dst, next)
+	ipHeader.HopLimit = hopLimit
+	if hopLimit == 0 {
+		ipHeader.HopLimit = hopLimit6(n)
+	}
+	return sendIPv6On(n, nextHop, ipHeader, payload)
+}
+
+// sends an ICMPv6 message, picking the source address if it's unset
+// a zero hop limit means the link's default
+func sendICMPv6(zone *nic.NIC, src, dst net.IP, hopLimit uint8, msg *packets.ICMPv6Message) error {
+	if src == nil {
+		var err error
+		if src, err = sourceFor6(zone, dst); err != nil {
+			return err
+		}
+	}
+	return sendIPv6(zone, src, dst, packets.ProtocolICMPv6, hopLimit, msg.Bytes(src, dst))
+}
+
+// sends a UDP datagram to an IPv6 destination for a socket, picking the source
+// address if it's unset. Multicast gets hop limit 1 (IPV6_MULTICAST_HOPS default)
+func sendUDP6(src, dst net.IP, srcPort, dstPort uint16, zone string, data []byte) error {
+	var z *nic.NIC
+	if zone != "" {
+		n, ok := nics.Get(zone)
+		if !ok {
+			return fmt.Errorf("unknown interface %s", zone)
+		}
+		z = n
+	} else if n, ok := nics.Owner(src); ok {
+		// a socket bound to a link-local address lives on that address's link
+		z = n
+	}
+
+	if src == nil {
+		var err error
+		if src, err = sourceFor6(z, dst); err != nil {
+			return err
+		}
+	}
+	var hopLimit uint8
+	if dst.IsMulticast() {
+		hopLimit = 1
+	}
+	udp := packets.UDPPacket{SrcPort: srcPort, DstPort: dstPort, Data: data}
+	return sendIPv6(z, src, dst, packets.ProtocolUDP, hopLimit, udp.Bytes(6, src, dst))
+}
+
+// sends a packet out of n towards nextHop, fragmenting it when it doesn't
+// fit the path MTU (only the source does that in IPv6)
+func sendIPv6On(n *nic.NIC, nextHop net.IP, ipHeader *packets.IPv6Header, payload []byte) error {
+	mtu := pathMTU6(n, ipHeader.DstIP)
+	var id uint32
+	if packets.IPv6HeaderLen+len(payload) > mtu {
+		id = ipIDs.Next6(ipHeader.SrcIP, ipHeader.DstIP)
+	}
+	pkts, err := fragment.SplitIPv6(ipHeader, payload, mtu, id)
+	if err != nil {
+		return fmt.Errorf("sending %d bytes to %s on %s (MTU %d): %w", len(payload), ipHeader.DstIP, n.Name, mtu, err)
+	}
+	if err := filterOutput6(n, ipHeader, payload); err != nil {
+		return err
+	}
+	for _, pkt := range pkts {
+		if err := outputIPv6(n, nextHop, pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tracks an IPv6 packet we originate, runs it through the output and
+// postrouting hooks and applies the outbound IPsec policy
+func filterOutput6(n *nic.NIC, ipHeader *packets.IPv6Header, payload []byte) error {
+	filtered := *ipHeader
+	filtered.PayloadLength = uint16(len(payload))
+	pkt := append(filtered.Bytes(), payload...)
+	ip, err := packets.ParseIPv6(pkt)
+	if err != nil {
+		return err
+	}
+	_, proto, l4, err := packets.ParseIPv6Extensions(ip)
+	if err != nil {
+		return err
+	}
+	state, _ := conntracks.Track(pkt)
+
+	if !filterIPv6(firewall.Output, "", n.Name, state, ip, nil, proto, l4) || !filterIPv6(firewall.Postrouting, "", n.Name, state, ip, nil, proto, l4) {
+		return fmt.Errorf("%s -> %s: rejected by firewall", ip.SrcIP, ip.DstIP)
+	}
+	return discardOutput6(ip.SrcIP, ip.DstIP, proto)
+}
+
+// returns the MTU to size packets to dst with: the path MTU learned from
+// Packet Too Big for unicast, the link's for multicast
+func pathMTU6(n *nic.NIC, dst net.IP) int {
+	if dst.IsMulticast() {
+		return linkMTU6(n)
+	}
+	mtu, _ := pmtus.Lookup(dst, linkMTU6(n))
+	return mtu
+}
+
+// hands a serialized IPv6 packet to the link, resolving the next hop MAC first
+// packets for unresolved neighbors wait in the ND cache until the advertisement shows up
+func outputIPv6(n *nic.NIC, nextHop net.IP, pkt []byte) error {
+	if n.Tunnel != nil {
+		return fmt.Errorf("%s: IPv6 isn't supported over tunnels", n.Name)
+	}
+
+	if nextHop.IsMulticast() {
+		return writeFrame(n, frames.IPv6MulticastMAC(nextHop), frames.EtherTypeIPv6, pkt)
+	}
+
+	if mac, ok := n.ND.Lookup(nextHop); ok {
+		return writeFrame(n, [6]byte(mac), frames.EtherTypeIPv6, pkt)
+	}
+
+	if n.ND.Enqueue(nextHop, pkt) {
+		return sendNeighborSolicitation(n, nextHop, net.IP(pkt[8:24]))
+	}
+	return nil
+}
+
+// sends an ICMPv6 error about pkt, a packet received on n, to its source
+func sendICMPv6Error(n *nic.NIC, pkt []byte, icmpType, code uint8, param uint32) {
+	if !icmpv6ErrorAllowed(pkt, icmpType, code, param) {
+		return
+	}
+	// RFC 4443 2.4 (f), Packet Too Big is spared for path MTU discovery's sake
+	dst := net.IP(append([]byte(nil), pkt[8:24]...))
+	if icmpType != packets.ICMPv6PacketTooBig && !icmpLimiter.Allow(dst, time.Now()) {
+		fmt.Printf(ColorGray+"[ICMPv6] Rate limiting errors to %s\n"+ColorReset, dst)
+		return
+	}
+
+	// answer from the address the packet was sent to when it's one of ours
+	src := net.IP(pkt[24:40])
+	if !isLocalIP(src) {
+		src = nil
+	}
+	msg := packets.NewICMPv6Error(icmpType, code, param, pkt)
+	if err := sendICMPv6(n, src, dst, 0, msg); err != nil {
+		fmt.Printf(ColorRed+"[ICMPv6] Error sending %s to %s: %v\n"+ColorReset, msg, dst, err)
+	}
+}
+
+// RFC 4443 2.4 (e): no errors about ICMPv6 errors or redirects, or about packets
+// from an address that isn't a single node. Packets sent to multicast only get
+// Packet Too Big, or Parameter Problem for options asking for it
+func icmpv6ErrorAllowed(pkt []byte, icmpType, code uint8, param uint32) bool {
+	ip, err := packets.ParseIPv6(pkt)
+	if err != nil || ip.SrcIP.IsUnspecified() || ip.SrcIP.IsMulticast() {
+		return false
+	}
+
+	if ip.DstIP.IsMulticast() {
+		option := icmpType == packets.ICMPv6ParamProblem && code == packets.IPv6ProblemOption &&
+			int(param) < len(pkt) && pkt[param]>>6 == packets.IPv6OptionDiscardICMP
+		if icmpType != packets.ICMPv6PacketTooBig && !option {
+			return false
+		}
+	}
+
+	_, proto, payload, err := packets.ParseIPv6Extensions(ip)
+	if err == nil && proto == packets.ProtocolICMPv6 && len(payload) > 0 {
+		return !packets.IsICMPv6Error(payload[0]) && payload[0] != packets.ICMPv6Redirect
+	}
+	return true
+}
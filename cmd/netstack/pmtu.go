@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/pmtu"
+)
+
+// path MTUs learned from Fragmentation Needed, Packet Too Big and probing (RFC 1191, RFC 8201)
+var pmtus = pmtu.NewCache(pmtu.DefaultTimeout)
+
+// how long a PMTU probe waits for its echo reply
+const probeTimeout = time.Second
+
+// returns the MTU to size packets to dst with and whether DF should be set
+// (Linux IP_PMTUDISC_WANT): unicast uses the path MTU, everything else the link's
+func pathMTU(linkMTU int, dst net.IP) (int, bool) {
+	if dst.IsMulticast() || isBroadcastIP(dst) {
+		return linkMTU, false
+	}
+	return pmtus.Lookup(dst, linkMTU)
+}
+
+// the MSS we use when sending to dst: what the peer accepts, capped by the
+// path MTU minus the IP and TCP headers (RFC 1191 6.1), 536 if the peer
+// didn't say (RFC 9293 3.7.1) or 1220 over IPv6 (RFC 8200 8.3)
+// n is the NIC the peer's segment came in on, for link-local peers
+func tcpSendMSS(n *nic.NIC, dst net.IP, peerMSS uint16, ok bool) int {
+	if dst.To4() == nil {
+		if !ok {
+			peerMSS = 1220
+		}
+		mtu := packets.IPv6MinMTU
+		if out, _, err := routeIPv6(n, dst); err == nil {
+			mtu = pathMTU6(out, dst)
+		}
+		return min(int(peerMSS), mtu-packets.IPv6HeaderLen-20)
+	}
+
+	if !ok {
+		peerMSS = 536
+	}
+	mtu := MTU
+	if route, found := routes.Lookup(dst); found {
+		if n, found := nics.Get(route.Interface); found {
+			mtu, _ = pathMTU(n.Dev.MTU, dst)
+		}
+	}
+	return min(int(peerMSS), mtu-40)
+}
+
+// the MSS we advertise to peer: what our own link can take in one segment
+func tcpAdvertisedMSS(n *nic.NIC, peer net.IP) int {
+	if peer.To4() == nil {
+		return linkMTU6(n) - packets.IPv6HeaderLen - 20
+	}
+	return n.Dev.MTU - 40
+}
+
+// learns a smaller path MTU from an ICMP Fragmentation Needed about a packet we sent
+func handleFragNeeded(icmpPacket *packets.ICMPMessage) {
+	quoted := icmpPacket.Quote()
+	if len(quoted) < 20 || quoted[0]>>4 != 4 || !isLocalIP(net.IP(quoted[12:16])) {
+		return
+	}
+	dst := net.IP(append([]byte(nil), quoted[16:20]...))
+	quotedLen := int(quoted[2])<<8 | int(quoted[3])
+
+	mtu := pmtu.FromFragNeeded(icmpPacket.NextHopMTU(), quotedLen)
+	if mtu, changed := pmtus.Reduce(dst, mtu, time.Now()); changed {
+		fmt.Printf(ColorYellow+"[PMTU] Path MTU to %s is now %d\n"+ColorReset, dst, mtu)
+	}
+}
+
+// learns a smaller path MTU from an ICMPv6 Packet Too Big about a packet we
+// sent (RFC 8201 4), later packets to that destination are fragmented to fit
+func handlePacketTooBig(msg *packets.ICMPv6Message) {
+	quoted := msg.Quote()
+	if len(quoted) < packets.IPv6HeaderLen || !isLocalIP(net.IP(quoted[8:24])) {
+		return
+	}
+	dst := net.IP(append([]byte(nil), quoted[24:40]...))
+	if dst.IsMulticast() {
+		return
+	}
+
+	if mtu, changed := pmtus.Reduce(dst, int(msg.Param()), time.Now()); changed {
+		fmt.Printf(ColorYellow+"[PMTU] Path MTU to %s is now %d\n"+ColorReset, dst, mtu)
+	}
+}
+
+// forgets aged path MTUs, so paths that got better are used again
+func expirePMTU() {
+	for now := range time.Tick(10 * time.Second) {
+		for _, e := range pmtus.Expire(now) {
+			fmt.Printf(ColorGray+"[PMTU] Forgot path MTU %d to %s\n"+ColorReset, e.MTU, e.Dst)
+		}
+	}
+}
+
+// the probe in flight: echo replies with its identifier are handed over
+var prober struct {
+	mu      sync.Mutex
+	id      uint16
+	replies chan uint16 // sequence numbers
+}
+
+// passes an echo reply to the running probe, false if it isn't one of ours
+func handleProbeReply(icmpPacket *packets.ICMPMessage) bool {
+	prober.mu.Lock()
+	defer prober.mu.Unlock()
+
+	if prober.replies == nil || icmpPacket.ID != prober.id {
+		return false
+	}
+	select {
+	case prober.replies <- icmpPacket.Seq:
+	default:
+	}
+	return true
+}
+
+// finds the path MTU to dst with DF echo requests of varying sizes (RFC 4821
+// with ICMP echo as the packetization layer), which works even when routers
+// on the way never send Fragmentation Needed
+func probePMTU(dst net.IP) error {
+	route, ok := routes.Lookup(dst)
+	if !ok {
+		return fmt.Errorf("no route to host %s", dst)
+	}
+	n, ok := nics.Get(route.Interface)
+	if !ok {
+		return fmt.Errorf("route %s uses unknown interface", route)
+	}
+
+	prober.mu.Lock()
+	if prober.replies != nil {
+		prober.mu.Unlock()
+		return fmt.Errorf("a probe is already running")
+	}
+	id := uint16(rand.N(1 << 16))
+	replies := make(chan uint16, 1)
+	prober.id, prober.replies = id, replies
+	prober.mu.Unlock()
+
+	defer func() {
+		prober.mu.Lock()
+		prober.replies = nil
+		prober.mu.Unlock()
+	}()
+
+	search := pmtu.NewSearch(pmtu.MinPMTU, n.Dev.MTU)
+	var seq uint16
+	for size, ok := search.Next(); ok; size, ok = search.Next() {
+		seq++
+		echo := packets.ICMPMessage{Type: packets.ICMPEchoRequest, ID: id, Seq: seq, Data: make([]byte, size-20-8)}
+		ipHeader := newIPv4Header(dst, packets.ProtocolICMP)
+		ipHeader.Flags = packets.IPv4FlagDF
+		if err := sendIPv4Header(ipHeader, echo.Bytes()); err != nil {
+			return err
+		}
+
+		search.Result(waitProbe(replies, seq))
+	}
+
+	mtu := search.PMTU()
+	pmtus.Set(dst, mtu, time.Now())
+	fmt.Printf(ColorYellow+"[PMTU] Probing found path MTU %d to %s\n"+ColorReset, mtu, dst)
+	return nil
+}
+
+// waits for the reply to probe seq, earlier probes' late replies don't count
+func waitProbe(replies chan uint16, seq uint16) bool {
+	timeout := time.After(probeTimeout)
+	for {
+		select {
+		case got := <-replies:
+			if got == seq {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// runs a pmtu command, used by the console:
+//
+//	show | flush | probe DST
+func pmtuCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: pmtu show|flush|probe DST")
+	}
+
+	switch args[0] {
+	case "show":
+		now := time.Now()
+		for _, e := range pmtus.Entries() {
+			var flags string
+			if e.Locked {
+				flags += " locked"
+			}
+			if e.Probed {
+				flags += " probed"
+			}
+			fmt.Printf(ColorCyan+"   %s mtu %d expires %s%s\n"+ColorReset, e.Dst, e.MTU, e.Expires.Sub(now).Round(time.Second), flags)
+		}
+	case "flush":
+		fmt.Printf(ColorCyan+"Forgot %d path MTUs\n"+ColorReset, pmtus.Flush())
+	case "probe":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: pmtu probe DST")
+		}
+		dst := net.ParseIP(args[1]).To4()
+		if dst == nil || dst.IsMulticast() || isBroadcastIP(dst) {
+			return fmt.Errorf("invalid unicast address %q", args[1])
+		}
+		// probing takes a while, keep the console responsive
+		go func() {
+			if err := probePMTU(dst); err != nil {
+				fmt.Printf(ColorRed+"[PMTU] Probe to %s failed: %v\n"+ColorReset, dst, err)
+			}
+		}()
+	default:
+		return fmt.Errorf("unknown pmtu command %q", args[0])
+	}
+	return nil
+}
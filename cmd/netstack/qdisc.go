@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hexhaust/mini-netstack/pkg/qdisc"
+)
+
+// runs a qdisc command, used by -qdisc and the console:
+//
+//	show | replace DEV pfifo|prio|tbf|fq_codel [PARAM VALUE]...
+func qdiscCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: qdisc show|replace ...")
+	}
+
+	switch args[0] {
+	case "show":
+		for _, n := range nics.All() {
+			if n.Egress == nil {
+				fmt.Printf(ColorCyan+"%s: noqueue\n"+ColorReset, n.Name)
+				continue
+			}
+			q, stats := n.Egress.Qdisc()
+			fmt.Printf(ColorCyan+"%s: %s\n   %s\n"+ColorReset, n.Name, q, stats)
+		}
+	case "replace":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: qdisc replace DEV KIND [PARAM VALUE]...")
+		}
+		n, ok := nics.Get(args[1])
+		if !ok {
+			return fmt.Errorf("unknown device %s", args[1])
+		}
+		if n.Egress == nil {
+			return fmt.Errorf("%s has no queue, tunnels send through the device of their remote end", n.Name)
+		}
+		q, err := qdisc.Parse(args[2:])
+		if err != nil {
+			return err
+		}
+		n.Egress.Replace(q)
+		fmt.Printf(ColorCyan+"%s: %s\n"+ColorReset, n.Name, q)
+	default:
+		return fmt.Errorf("unknown qdisc command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/routing"
+	"github.com/hexhaust/mini-netstack/pkg/slaac"
+)
+
+// stateless address autoconfiguration settings, from flags
+var (
+	slaacEnabled = true
+	addrGenMode  = slaac.EUI64
+	useTempAddr  bool
+	stableSecret []byte // RFC 7217 secret_key, random per run unless -stable-secret is set
+)
+
+// the all-routers link-local group routers listen to for solicitations
+var ipv6AllRouters = net.ParseIP("ff02::2")
+
+// what router advertisements told us about a link (RFC 4861 6.3.4)
+// expiry times of zero mean forever
+type raLink struct {
+	advertised  bool                 // a router answered, stop soliciting
+	routers     map[string]time.Time // default routers
+	prefixes    map[string]time.Time // on-link prefixes
+	dadCounters map[string]int       // DAD failures per prefix, for new identifiers
+	regenerated map[string]bool      // temporary addresses that already have a successor
+}
+
+var raLinks = struct {
+	mu    sync.Mutex
+	links map[string]*raLink
+}{links: make(map[string]*raLink)}
+
+// returns the state of n, raLinks.mu must be held
+func raLinkOf(n *nic.NIC) *raLink {
+	l, ok := raLinks.links[n.Name]
+	if !ok {
+		l = &raLink{
+			routers:     make(map[string]time.Time),
+			prefixes:    make(map[string]time.Time),
+			dadCounters: make(map[string]int),
+			regenerated: make(map[string]bool),
+		}
+		raLinks.links[n.Name] = l
+	}
+	return l
+}
+
+// returns the hop limit for packets leaving n, routers may override our default
+func hopLimit6(n *nic.NIC) uint8 {
+	if h := n.HopLimit6.Load(); h != 0 {
+		return uint8(h)
+	}
+	return defaultHopLimit
+}
+
+// returns the IPv6 MTU of n, routers may advertise a smaller one than the device's
+func linkMTU6(n *nic.NIC) int {
+	if mtu := n.MTU6.Load(); mtu != 0 {
+		return int(mtu)
+	}
+	return n.Dev.MTU
+}
+
+// returns the interface identifier for an address in prefix on n
+func interfaceID(n *nic.NIC, prefix *net.IPNet, dadCounter int) []byte {
+	if addrGenMode == slaac.StablePrivacy {
+		return slaac.StableID(prefix, n.Name, dadCounter, stableSecret)
+	}
+	return slaac.EUI64ID(n.MAC)
+}
+
+// gives every Ethernet NIC its link-local address, picking a secret for
+// stable-privacy identifiers if none was given
+func configureSLAAC() {
+	if stableSecret == nil {
+		stableSecret = make([]byte, 16)
+		crand.Read(stableSecret)
+	}
+	for _, n := range nics.All() {
+		if n.Tunnel != nil {
+			continue
+		}
+		if err := configureLinkLocal(n); err != nil {
+			log.Fatalf("Error adding link-local address to %s: %v", n.Name, err)
+		}
+	}
+}
+
+// gives the NIC its link-local address (RFC 4862 5.3), routers are solicited
+// once it passed DAD
+func configureLinkLocal(n *nic.NIC) error {
+	addr := slaac.Address(slaac.LinkLocalPrefix, interfaceID(n, slaac.LinkLocalPrefix, 0))
+	return addAddress6(n, nic.Address6{Prefix: addr})
+}
+
+// called when an address passed DAD
+func dadSucceeded(n *nic.NIC, ip net.IP) {
+	if slaacEnabled && ip.IsLinkLocalUnicast() {
+		go solicitRouters(n)
+	}
+}
+
+// stable-privacy and temporary addresses we formed get another identifier
+// after a DAD failure, EUI-64 ones can't and stay duplicated (RFC 4862 5.4.5)
+func slaacDADFailed(n *nic.NIC, ip net.IP) {
+	addr, ok := n.Address6(ip)
+	if !ok || !slaacEnabled || !(addr.Autoconf || addr.Temporary || ip.IsLinkLocalUnicast()) {
+		return
+	}
+	prefix := &net.IPNet{IP: ip.Mask(addr.Prefix.Mask), Mask: addr.Prefix.Mask}
+
+	var next []byte
+	raLinks.mu.Lock()
+	l := raLinkOf(n)
+	key := prefix.String()
+	if addr.Temporary {
+		key = "temporary " + key
+	}
+	counter := l.dadCounters[key]
+	if addr.Temporary {
+		next = slaac.TemporaryID()
+	} else if addrGenMode == slaac.StablePrivacy && slaac.Address(prefix, interfaceID(n, prefix, counter)).IP.Equal(ip) {
+		next = interfaceID(n, prefix, counter+1)
+	}
+	if counter < slaac.IDGenRetries {
+		l.dadCounters[key] = counter + 1
+	} else {
+		next = nil
+	}
+	raLinks.mu.Unlock()
+
+	if next == nil {
+		return
+	}
+	n.RemoveAddress6(ip)
+	addr.Prefix = slaac.Address(prefix, next)
+	fmt.Printf(ColorYellow+"[SLAAC] Trying %s on %s instead\n"+ColorReset, addr.Prefix.IP, n.Name)
+	if err := addAddress6(n, addr); err != nil {
+		fmt.Printf(ColorRed+"[SLAAC] Error adding %s: %v\n"+ColorReset, addr.Prefix.IP, err)
+	}
+}
+
+// asks routers to advertise themselves instead of waiting for their next
+// periodic advertisement (RFC 4861 6.3.7)
+func solicitRouters(n *nic.NIC) {
+	time.Sleep(rand.N(slaac.MaxRtrSolicitationDelay))
+	for range slaac.MaxRtrSolicitations {
+		raLinks.mu.Lock()
+		done := raLinkOf(n).advertised
+		raLinks.mu.Unlock()
+		if done {
+			return
+		}
+		if err := sendRouterSolicitation(n); err != nil {
+			fmt.Printf(ColorRed+"[SLAAC] Error soliciting routers on %s: %v\n"+ColorReset, n.Name, err)
+		}
+		time.Sleep(slaac.RtrSolicitationInterval)
+	}
+}
+
+// solicits routers from our link-local address, or from the unspecified
+// address (without our MAC) if there's none yet
+func sendRouterSolicitation(n *nic.NIC) error {
+	var rs packets.RouterSolicitation
+	src := n.SourceFor6(ipv6AllRouters)
+	if src == nil {
+		src = net.IPv6unspecified
+	} else {
+		rs.Options = []packets.NDPOption{packets.NewLinkAddrOption(packets.NDPOptionSourceLinkAddr, n.MAC)}
+	}
+
+	fmt.Printf(ColorYellow+"[SLAAC] Soliciting routers on %s\n"+ColorReset, n.Name)
+	msg := packets.ICMPv6Message{Type: packets.ICMPv6RouterSolicitation, Body: rs.Bytes()}
+	return sendICMPv6(n, src, ipv6AllRouters, ndHopLimit, &msg)
+}
+
+// learns the link parameters, default router and prefixes a router advertises
+func handleRouterAdvertisement(n *nic.NIC, ipPacket *packets.IPv6Header, msg *packets.ICMPv6Message) {
+	if !slaacEnabled || !ipPacket.SrcIP.IsLinkLocalUnicast() || ipPacket.HopLimit != ndHopLimit || msg.Code != 0 {
+		return
+	}
+	adv, err := packets.ParseRouterAdvertisement(msg.Body)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	router := append(net.IP(nil), ipPacket.SrcIP...)
+
+	fmt.Printf(ColorCyan+"[SLAAC] Router advertisement from %s on %s (lifetime %ds)\n"+ColorReset, router, n.Name, adv.RouterLifetime)
+
+	raLinks.mu.Lock()
+	raLinkOf(n).advertised = true
+	raLinks.mu.Unlock()
+
+	if adv.CurHopLimit != 0 {
+		n.HopLimit6.Store(uint32(adv.CurHopLimit))
+	}
+
+	for _, opt := range adv.Options {
+		switch opt.Type {
+		case packets.NDPOptionSourceLinkAddr:
+			if mac, ok := opt.LinkAddr(); ok {
+				flushPending6(n, mac, n.ND.Observe(router, mac, true))
+			}
+		case packets.NDPOptionMTU:
+			// only ever lowers the link MTU (RFC 4861 6.3.4)
+			mtu, err := opt.MTU()
+			if err == nil && mtu >= packets.IPv6MinMTU && int(mtu) <= n.Dev.MTU && n.MTU6.Swap(mtu) != mtu {
+				fmt.Printf(ColorCyan+"[SLAAC] IPv6 MTU of %s is %d\n"+ColorReset, n.Name, mtu)
+			}
+		case packets.NDPOptionPrefixInfo:
+			if pi, err := opt.PrefixInfo(); err == nil {
+				handlePrefixInfo(n, pi, now)
+			}
+		}
+	}
+
+	updateDefaultRouter(n, router, adv.RouterLifetime, now)
+}
+
+// adds, refreshes or (with a zero lifetime) drops a default router
+func updateDefaultRouter(n *nic.NIC, router net.IP, lifetime uint16, now time.Time) {
+	raLinks.mu.Lock()
+	defer raLinks.mu.Unlock()
+
+	routers := raLinkOf(n).routers
+	key := router.String()
+	_, known := routers[key]
+
+	if lifetime == 0 {
+		if known {
+			delete(routers, key)
+			routes6.Delete(defaultRoute6(router, n).Dst, router, n.Name)
+			fmt.Printf(ColorYellow+"[SLAAC] %s is no longer a default router\n"+ColorReset, router)
+		}
+		return
+	}
+
+	routers[key] = now.Add(time.Duration(lifetime) * time.Second)
+	if !known {
+		routes6.Add(defaultRoute6(router, n))
+		fmt.Printf(ColorGreen+"[SLAAC] Default router %s on %s\n"+ColorReset, router, n.Name)
+	}
+}
+
+func defaultRoute6(router net.IP, n *nic.NIC) routing.Route {
+	return routing.Route{Dst: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, Gateway: router, Interface: n.Name}
+}
+
+// processes a Prefix Information option: on-link prefixes become routes and
+// autonomous /64s addresses (RFC 4861 6.3.4, RFC 4862 5.5.3)
+func handlePrefixInfo(n *nic.NIC, pi packets.PrefixInfo, now time.Time) {
+	if pi.Prefix.IP.IsLinkLocalUnicast() {
+		return
+	}
+
+	if pi.OnLink {
+		updateOnLinkPrefix(n, pi.Prefix, pi.Valid, now)
+	}
+
+	ones, _ := pi.Prefix.Mask.Size()
+	if !pi.Autonomous || ones != slaac.PrefixLen || pi.Preferred > pi.Valid {
+		return
+	}
+
+	preferredUntil := slaac.Expiry(now, pi.Preferred)
+	public := false
+	for _, a := range n.Addresses6() {
+		if !a.Autoconf || !pi.Prefix.Contains(a.Prefix.IP) {
+			continue
+		}
+		if a.Temporary {
+			// temporary addresses never outlive what they were created with
+			n.SetLifetimes6(a.Prefix.IP, earliest(preferredUntil, a.PreferredUntil), earliest(slaac.Expiry(now, pi.Valid), a.ValidUntil))
+			continue
+		}
+		public = true
+		n.SetLifetimes6(a.Prefix.IP, preferredUntil, slaac.ValidExpiry(now, a.ValidUntil, pi.Valid))
+	}
+	if public || pi.Valid == 0 {
+		return
+	}
+
+	raLinks.mu.Lock()
+	counter := raLinkOf(n).dadCounters[pi.Prefix.String()]
+	raLinks.mu.Unlock()
+
+	addr := nic.Address6{
+		Prefix:         slaac.Address(pi.Prefix, interfaceID(n, pi.Prefix, counter)),
+		Autoconf:       true,
+		PreferredUntil: preferredUntil,
+		ValidUntil:     slaac.Expiry(now, pi.Valid),
+	}
+	fmt.Printf(ColorGreen+"[SLAAC] Forming %s on %s\n"+ColorReset, addr.Prefix, n.Name)
+	if err := addAddress6(n, addr); err != nil {
+		fmt.Printf(ColorRed+"[SLAAC] Error adding %s: %v\n"+ColorReset, addr.Prefix.IP, err)
+		return
+	}
+	if useTempAddr {
+		addTemporaryAddress(n, pi.Prefix, addr.PreferredUntil, addr.ValidUntil, now)
+	}
+}
+
+// tracks an on-link prefix, a zero valid lifetime takes it off the link
+func updateOnLinkPrefix(n *nic.NIC, prefix *net.IPNet, valid uint32, now time.Time) {
+	raLinks.mu.Lock()
+	defer raLinks.mu.Unlock()
+
+	prefixes := raLinkOf(n).prefixes
+	key := prefix.String()
+	_, known := prefixes[key]
+
+	if valid == 0 {
+		if known {
+			delete(prefixes, key)
+			routes6.Delete(prefix, nil, n.Name)
+		}
+		return
+	}
+
+	prefixes[key] = slaac.Expiry(now, valid)
+	if !known {
+		routes6.Add(routing.Route{Dst: prefix, Interface: n.Name})
+	}
+}
+
+// forms a random privacy address in prefix (RFC 8981 3.4), its lifetimes are
+// capped by the public address's and by the temporary address limits
+func addTemporaryAddress(n *nic.NIC, prefix *net.IPNet, preferredUntil, validUntil time.Time, now time.Time) {
+	desync := rand.N(slaac.MaxDesyncFactor)
+	preferredUntil = earliest(preferredUntil, now.Add(slaac.TempPreferredLifetime-desync))
+	validUntil = earliest(validUntil, now.Add(slaac.TempValidLifetime))
+	if preferredUntil.Sub(now) <= slaac.RegenAdvance {
+		return
+	}
+
+	addr := nic.Address6{
+		Prefix:         slaac.Address(prefix, slaac.TemporaryID()),
+		Autoconf:       true,
+		Temporary:      true,
+		PreferredUntil: preferredUntil,
+		ValidUntil:     validUntil,
+	}
+	fmt.Printf(ColorGreen+"[SLAAC] Forming temporary %s on %s\n"+ColorReset, addr.Prefix, n.Name)
+	if err := addAddress6(n, addr); err != nil {
+		fmt.Printf(ColorRed+"[SLAAC] Error adding %s: %v\n"+ColorReset, addr.Prefix.IP, err)
+	}
+}
+
+// returns the earlier of two expiry times, zero meaning forever
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// ages autoconfigured addresses, routers and prefixes, and replaces temporary
+// addresses shortly before they get deprecated
+func slaacTimers() {
+	for now := range time.Tick(time.Second) {
+		for _, n := range nics.All() {
+			deprecated, expired := n.ExpireAddresses6(now)
+			for _, a := range deprecated {
+				fmt.Printf(ColorGray+"[SLAAC] %s on %s is deprecated\n"+ColorReset, a.Prefix.IP, n.Name)
+			}
+			for _, a := range expired {
+				fmt.Printf(ColorYellow+"[SLAAC] %s on %s expired\n"+ColorReset, a.Prefix.IP, n.Name)
+				leaveSolicitedNode(n, a.Prefix.IP)
+			}
+
+			if useTempAddr {
+				regenerateTemporary(n, now)
+			}
+			expireRAState(n, now)
+		}
+	}
+}
+
+// makes a successor for temporary addresses about to be deprecated, as long
+// as their prefix still has a preferred public address
+func regenerateTemporary(n *nic.NIC, now time.Time) {
+	addrs := n.Addresses6()
+	for _, temp := range addrs {
+		if !temp.Temporary || temp.State != nic.Preferred || temp.PreferredUntil.Sub(now) > slaac.RegenAdvance {
+			continue
+		}
+
+		raLinks.mu.Lock()
+		l := raLinkOf(n)
+		done := l.regenerated[temp.Prefix.IP.String()]
+		l.regenerated[temp.Prefix.IP.String()] = true
+		raLinks.mu.Unlock()
+		if done {
+			continue
+		}
+
+		for _, public := range addrs {
+			if public.Autoconf && !public.Temporary && public.State == nic.Preferred && temp.Prefix.Contains(public.Prefix.IP) {
+				prefix := &net.IPNet{IP: public.Prefix.IP.Mask(public.Prefix.Mask), Mask: public.Prefix.Mask}
+				addTemporaryAddress(n, prefix, public.PreferredUntil, public.ValidUntil, now)
+				break
+			}
+		}
+	}
+}
+
+// forgets default routers and on-link prefixes whose lifetime ran out
+func expireRAState(n *nic.NIC, now time.Time) {
+	raLinks.mu.Lock()
+	defer raLinks.mu.Unlock()
+
+	l := raLinkOf(n)
+	for key, expires := range l.routers {
+		if now.Before(expires) {
+			continue
+		}
+		router := net.ParseIP(key)
+		delete(l.routers, key)
+		routes6.Delete(defaultRoute6(router, n).Dst, router, n.Name)
+		fmt.Printf(ColorYellow+"[SLAAC] Default router %s on %s timed out\n"+ColorReset, router, n.Name)
+	}
+	for key, expires := range l.prefixes {
+		if expires.IsZero() || now.Before(expires) {
+			continue
+		}
+		_, prefix, _ := net.ParseCIDR(key)
+		delete(l.prefixes, key)
+		routes6.Delete(prefix, nil, n.Name)
+	}
+
+	// successors are only looked for while the address is around
+	for key := range l.regenerated {
+		if _, ok := n.Address6(net.ParseIP(key)); !ok {
+			delete(l.regenerated, key)
+		}
+	}
+}
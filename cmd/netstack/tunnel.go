@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/nic"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/tunnel"
+)
+
+// registers a tunnel as a NIC, its MTU leaves room for the encapsulation
+func openTunnel(t *tunnel.Tunnel) (*nic.NIC, error) {
+	n := nic.NewTunnel(t, MTU-t.Overhead())
+	if err := nics.Add(n); err != nil {
+		return nil, err
+	}
+	fmt.Printf(ColorCyan+"Tunnel %s ready (MTU %d).\n"+ColorReset, t, n.Dev.MTU)
+	return n, nil
+}
+
+// encapsulates a packet routed to a tunnel and sends it to the remote end,
+// the outer header copies the inner TOS (and TTL unless the tunnel sets one)
+func sendTunnel(n *nic.NIC, pkt []byte) error {
+	t := n.Tunnel
+	if route, ok := routes.Lookup(t.Remote); ok && route.Interface == n.Name {
+		return fmt.Errorf("tunnel %s reaches its remote %s through itself", n.Name, t.Remote)
+	}
+
+	outer := newIPv4Header(t.Remote, t.Mode.Protocol())
+	outer.SrcIP = t.Local
+	outer.TOS = pkt[1]
+	if outer.TTL = t.TTL; outer.TTL == 0 {
+		outer.TTL = pkt[8]
+	}
+	return sendIPv4Header(outer, t.Encapsulate(pkt))
+}
+
+// unwraps tunnel traffic and hands the inner packet back to handleIPv4 as if
+// it arrived on the tunnel interface. GRE tunnels to the same remote are told
+// apart by their key (RFC 2890 2.1)
+func handleTunnel(ipPacket *packets.IPv4Header) {
+	for _, n := range nics.All() {
+		t := n.Tunnel
+		if t == nil || !t.Matches(ipPacket.Protocol, ipPacket.SrcIP, ipPacket.DstIP) {
+			continue
+		}
+
+		inner, err := t.Decapsulate(ipPacket.Payload)
+		if errors.Is(err, tunnel.ErrKeyMismatch) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf(ColorGray+"[TUN] Dropping packet from %s on %s: %v\n"+ColorReset, ipPacket.SrcIP, n.Name, err)
+			return
+		}
+		handleIPv4(n, &frames.EthernetFrame{DstMAC: [6]byte(n.MAC), EtherType: frames.EtherTypeIPv4, Payload: inner})
+		return
+	}
+	fmt.Printf(ColorGray+"[TUN] No tunnel for %s packet from %s\n"+ColorReset, tunnelProtocolName(ipPacket.Protocol), ipPacket.SrcIP)
+}
+
+func tunnelProtocolName(p uint8) string {
+	if p == packets.ProtocolGRE {
+		return "GRE"
+	}
+	return "IPIP"
+}
@@ -0,0 +1,355 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+var (
+	ErrTableFull = errors.New("conntrack table full")
+	ErrExists    = errors.New("tuple already tracked")
+	ErrNotFound  = errors.New("no such entry")
+)
+
+// how a packet relates to the tracked flows (what firewall rules match on)
+type State int
+
+const (
+	Invalid     State = iota // doesn't fit any flow and can't start one
+	New                      // first packet of a flow
+	Established              // belongs to a flow that has seen traffic
+	Related                  // an ICMP error about a tracked flow
+	Untracked                // a protocol we don't track
+)
+
+func (s State) String() string {
+	switch s {
+	case Invalid:
+		return "invalid"
+	case New:
+		return "new"
+	case Established:
+		return "established"
+	case Related:
+		return "related"
+	case Untracked:
+		return "untracked"
+	}
+	return "unknown"
+}
+
+// which way a packet goes relative to the flow's first packet
+type Direction int
+
+const (
+	Original Direction = iota
+	Reply
+)
+
+// timeouts of non-TCP flows (TCP ones depend on the connection state)
+const (
+	UDPTimeout       = 30 * time.Second  // one-way traffic
+	UDPStreamTimeout = 180 * time.Second // once the other side answered
+	ICMPTimeout      = 30 * time.Second
+)
+
+// default size limit
+const DefaultMaxEntries = 65536
+
+// a tracked flow
+type Entry struct {
+	Orig     Tuple // first packet of the flow
+	Reply    Tuple // what replies look like on the wire (differs from Orig.Reverse() under NAT)
+	TCPState TCPState
+	Assured  bool // saw traffic both ways, never evicted to make room
+	NAT      bool // Reply was rewritten by NAT
+	Created  time.Time
+	LastSeen time.Time
+	Packets  [2]uint64 // per Direction
+	Bytes    [2]uint64
+
+	finDir Direction
+}
+
+// returns the idle timeout of the entry
+func (e *Entry) Timeout() time.Duration {
+	switch e.Orig.Protocol {
+	case packets.ProtocolTCP:
+		return tcpTimeouts[e.TCPState]
+	case packets.ProtocolUDP:
+		if e.Packets[Reply] > 0 {
+			return UDPStreamTimeout
+		}
+		return UDPTimeout
+	}
+	return ICMPTimeout
+}
+
+func (e *Entry) String() string {
+	s := fmt.Sprintf("%s | reply %s | %d/%d packets", e.Orig, e.Reply, e.Packets[Original], e.Packets[Reply])
+	if e.Orig.Protocol == packets.ProtocolTCP {
+		s += " | " + e.TCPState.String()
+	}
+	if e.Assured {
+		s += " | assured"
+	}
+	if e.NAT {
+		s += " | nat"
+	}
+	return s
+}
+
+// the connection tracking table, safe for concurrent use
+// entries are indexed by both their original and reply tuple
+type Table struct {
+	mu         sync.Mutex
+	entries    map[Tuple]*Entry
+	count      int
+	maxEntries int
+}
+
+func NewTable(maxEntries int) *Table {
+	return &Table{entries: make(map[Tuple]*Entry), maxEntries: maxEntries}
+}
+
+// classifies a serialized IPv4 or IPv6 packet and updates the flow it belongs
+// to, creating one for new flows. Fragments must be reassembled first
+func (t *Table) Track(pkt []byte) (State, Direction) {
+	proto, l4, total, ok := transport(pkt)
+	if !ok {
+		return Invalid, Original
+	}
+
+	if len(l4) >= 8 && isICMPError(proto, l4[0]) {
+		return t.related(l4), Original
+	}
+
+	tuple, ok := tupleOf(proto, pkt, l4)
+	if !ok {
+		// neighbor discovery and MLD aren't flows, like in Linux they go untracked
+		if proto == packets.ProtocolICMP || proto == packets.ProtocolICMPv6 && len(l4) < 8 {
+			return Invalid, Original // truncated or an ICMP type we can't make sense of
+		}
+		return Untracked, Original
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	e, ok := t.entries[tuple]
+	if !ok {
+		return t.create(tuple, l4, total, now)
+	}
+
+	dir := Original
+	if tuple == e.Reply && tuple != e.Orig {
+		dir = Reply
+	}
+	if tuple.Protocol == packets.ProtocolTCP && len(l4) >= 14 && !e.tcpUpdate(dir, l4[13]) {
+		return Invalid, dir
+	}
+	if dir == Reply && tuple.Protocol != packets.ProtocolTCP {
+		e.Assured = true
+	}
+	e.LastSeen = now
+	e.Packets[dir]++
+	e.Bytes[dir] += uint64(total)
+
+	// a reopened TCP flow is new again
+	if tuple.Protocol == packets.ProtocolTCP && e.TCPState == TCPSynSent && dir == Original {
+		return New, dir
+	}
+	if e.Packets[Reply] == 0 {
+		return New, dir // still one-way (e.g. a retransmitted SYN)
+	}
+	return Established, dir
+}
+
+// starts tracking a flow, caller holds the lock
+func (t *Table) create(tuple Tuple, l4 []byte, size int, now time.Time) (State, Direction) {
+	e := &Entry{Orig: tuple, Reply: tuple.Reverse(), Created: now, LastSeen: now}
+
+	switch tuple.Protocol {
+	case packets.ProtocolTCP:
+		if len(l4) < 14 {
+			return Invalid, Original
+		}
+		state, ok := tcpFirst(l4[13])
+		if !ok {
+			return Invalid, Original
+		}
+		e.TCPState = state
+	case packets.ProtocolICMP, packets.ProtocolICMPv6:
+		// only a request can start an echo session
+		if tuple.SrcPort == 0 && tuple.DstPort != 0 {
+			return Invalid, Original
+		}
+	}
+
+	if t.count >= t.maxEntries && !t.evict() {
+		return Invalid, Original
+	}
+	if _, taken := t.entries[e.Reply]; taken {
+		return Invalid, Original
+	}
+
+	e.Packets[Original] = 1
+	e.Bytes[Original] = uint64(size)
+	t.entries[e.Orig] = e
+	t.entries[e.Reply] = e
+	t.count++
+	return New, Original
+}
+
+// makes room by dropping the oldest flow that never got a reply (like Linux
+// early_drop), caller holds the lock. Returns false if every flow is assured
+func (t *Table) evict() bool {
+	var oldest *Entry
+	for key, e := range t.entries {
+		if key != e.Orig || e.Assured {
+			continue
+		}
+		if oldest == nil || e.LastSeen.Before(oldest.LastSeen) {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	t.remove(oldest)
+	return true
+}
+
+// caller holds the lock
+func (t *Table) remove(e *Entry) {
+	delete(t.entries, e.Orig)
+	delete(t.entries, e.Reply)
+	t.count--
+}
+
+// matches an ICMP error with the flow of the packet it quotes
+func (t *Table) related(icmp []byte) State {
+	pkt, l4, ok := QuotedPacket(icmp)
+	if !ok {
+		return Invalid
+	}
+	quoted, ok := TupleOf(pkt, l4)
+	if !ok {
+		return Invalid
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the quoted packet went the opposite way to the error, so the error's
+	// flow is found through the reverse of the quoted tuple
+	if _, ok := t.entries[quoted.Reverse()]; ok {
+		return Related
+	}
+	return Invalid
+}
+
+// returns a copy of the entry tuple belongs to and the direction it goes in
+func (t *Table) Lookup(tuple Tuple) (Entry, Direction, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[tuple]
+	if !ok {
+		return Entry{}, Original, false
+	}
+	if tuple == e.Reply && tuple != e.Orig {
+		return *e, Reply, true
+	}
+	return *e, Original, true
+}
+
+// changes what replies to a flow look like, used by NAT on the first packet
+// fails with ErrExists if another flow already uses the reply tuple
+func (t *Table) SetReply(orig, reply Tuple) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[orig]
+	if !ok || e.Orig != orig {
+		return ErrNotFound
+	}
+	if other, taken := t.entries[reply]; taken && other != e {
+		return ErrExists
+	}
+
+	delete(t.entries, e.Reply)
+	e.Reply = reply
+	e.NAT = true
+	t.entries[reply] = e
+	return nil
+}
+
+// stops tracking the flow tuple belongs to (either direction)
+func (t *Table) Delete(tuple Tuple) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[tuple]
+	if ok {
+		t.remove(e)
+	}
+	return ok
+}
+
+// stops tracking every flow match returns true for, returns how many went away
+func (t *Table) DeleteFunc(match func(Entry) bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deleted := 0
+	for key, e := range t.entries {
+		if key == e.Orig && match(*e) {
+			t.remove(e)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// drops idle flows and returns them, must be called periodically
+func (t *Table) Expire(now time.Time) []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var expired []Entry
+	for key, e := range t.entries {
+		if key == e.Orig && now.Sub(e.LastSeen) >= e.Timeout() {
+			t.remove(e)
+			expired = append(expired, *e)
+		}
+	}
+	return expired
+}
+
+// returns a snapshot of every tracked flow
+func (t *Table) Entries() []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]Entry, 0, t.count)
+	for key, e := range t.entries {
+		if key == e.Orig {
+			list = append(list, *e)
+		}
+	}
+	return list
+}
+
+// returns how many flows are tracked
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.count
+}
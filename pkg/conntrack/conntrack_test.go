@@ -0,0 +1,218 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+var (
+	client = net.IPv4(10, 0, 0, 2).To4()
+	server = net.IPv4(192, 0, 2, 1).To4()
+)
+
+// builds a serialized IPv4 packet around a transport header
+func ipPacket(proto uint8, src, dst net.IP, l4 []byte) []byte {
+	ip := packets.IPv4Header{Version: 4, TTL: 64, Protocol: proto, SrcIP: src, DstIP: dst, TotalLength: uint16(20 + len(l4))}
+	hdr, _ := ip.Bytes() // no options, can't fail
+	return append(hdr, l4...)
+}
+
+func udp(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	u := packets.UDPPacket{SrcPort: srcPort, DstPort: dstPort, Data: []byte("hi")}
+	return ipPacket(packets.ProtocolUDP, src, dst, u.Bytes(4, src, dst))
+}
+
+func tcp(src, dst net.IP, srcPort, dstPort uint16, flags uint8) []byte {
+	t := packets.TCPHeader{SrcPort: srcPort, DstPort: dstPort, DataOffset: 5, Flags: flags, Window: 1024}
+	return ipPacket(packets.ProtocolTCP, src, dst, t.Bytes(4, src, dst))
+}
+
+func echo(src, dst net.IP, icmpType uint8, id uint16) []byte {
+	m := packets.ICMPMessage{Type: icmpType, ID: id, Seq: 1}
+	return ipPacket(packets.ProtocolICMP, src, dst, m.Bytes())
+}
+
+func TestTupleOf(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  []byte
+		want Tuple
+		ok   bool
+	}{
+		{"udp", udp(client, server, 1234, 53), Tuple{packets.ProtocolUDP, Addr(client), Addr(server), 1234, 53}, true},
+		{"tcp", tcp(client, server, 40000, 80, packets.TCPFlagSYN), Tuple{packets.ProtocolTCP, Addr(client), Addr(server), 40000, 80}, true},
+		{"echo request", echo(client, server, packets.ICMPEchoRequest, 7), Tuple{packets.ProtocolICMP, Addr(client), Addr(server), 7, 0}, true},
+		{"echo reply", echo(server, client, packets.ICMPEchoReply, 7), Tuple{packets.ProtocolICMP, Addr(server), Addr(client), 0, 7}, true},
+		{"icmp error", ipPacket(packets.ProtocolICMP, server, client, packets.NewICMPUnreachable(packets.ICMPCodePortUnreachable, udp(client, server, 1, 2)).Bytes()), Tuple{}, false},
+		{"short udp", ipPacket(packets.ProtocolUDP, client, server, []byte{1, 2}), Tuple{}, false},
+		{"gre", ipPacket(packets.ProtocolGRE, client, server, make([]byte, 8)), Tuple{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := TupleOf(tt.pkt, tt.pkt[20:])
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("TupleOf = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	// an echo reply's tuple is the reverse of its request's
+	reqPkt := echo(client, server, packets.ICMPEchoRequest, 7)
+	repPkt := echo(server, client, packets.ICMPEchoReply, 7)
+	req, _ := TupleOf(reqPkt, reqPkt[20:])
+	rep, _ := TupleOf(repPkt, repPkt[20:])
+	if req.Reverse() != rep {
+		t.Fatalf("reply %v is not the reverse of request %v", rep, req)
+	}
+}
+
+func TestTrackTCP(t *testing.T) {
+	const (
+		syn = packets.TCPFlagSYN
+		ack = packets.TCPFlagACK
+		fin = packets.TCPFlagFIN
+		rst = packets.TCPFlagRST
+	)
+	steps := []struct {
+		reply bool
+		flags uint8
+		state State
+		tcp   TCPState
+	}{
+		{false, syn, New, TCPSynSent},
+		{false, syn, New, TCPSynSent}, // retransmission
+		{true, syn | ack, Established, TCPSynRecv},
+		{false, ack, Established, TCPEstablished},
+		{true, syn, Invalid, TCPEstablished}, // SYN mid-stream
+		{false, fin | ack, Established, TCPFinWait},
+		{true, fin | ack, Established, TCPLastAck},
+		{false, ack, Established, TCPTimeWait},
+		{false, syn, New, TCPSynSent}, // port reuse
+		{true, rst, Established, TCPClose},
+	}
+
+	ct := NewTable(DefaultMaxEntries)
+	orig := Tuple{packets.ProtocolTCP, Addr(client), Addr(server), 40000, 80}
+	for i, s := range steps {
+		pkt := tcp(client, server, 40000, 80, s.flags)
+		wantDir := Original
+		if s.reply {
+			pkt = tcp(server, client, 80, 40000, s.flags)
+			wantDir = Reply
+		}
+		state, dir := ct.Track(pkt)
+		e, _, _ := ct.Lookup(orig)
+		if state != s.state || dir != wantDir || e.TCPState != s.tcp {
+			t.Fatalf("step %d: got %s %d %s, want %s %d %s", i, state, dir, e.TCPState, s.state, wantDir, s.tcp)
+		}
+	}
+
+	// only a SYN or a mid-stream ACK may start a flow
+	for _, flags := range []uint8{syn | ack, rst, fin} {
+		if state, _ := NewTable(DefaultMaxEntries).Track(tcp(client, server, 1, 2, flags)); state != Invalid {
+			t.Fatalf("flags %#x started a flow: %s", flags, state)
+		}
+	}
+}
+
+func TestTrackUDPAndRelated(t *testing.T) {
+	ct := NewTable(DefaultMaxEntries)
+	out := udp(client, server, 1234, 53)
+
+	if state, _ := ct.Track(out); state != New {
+		t.Fatalf("first packet: %s", state)
+	}
+	if state, _ := ct.Track(out); state != New {
+		t.Fatalf("one-way flow: %s", state)
+	}
+	if state, dir := ct.Track(udp(server, client, 53, 1234)); state != Established || dir != Reply {
+		t.Fatalf("reply: %s %d", state, dir)
+	}
+	if e, _, _ := ct.Lookup(Tuple{packets.ProtocolUDP, Addr(client), Addr(server), 1234, 53}); !e.Assured || e.Packets != [2]uint64{2, 1} {
+		t.Fatalf("entry after reply: %+v", e)
+	}
+
+	// an error quoting a tracked packet is related, one quoting anything else isn't
+	icmp := func(quoted []byte) []byte {
+		return ipPacket(packets.ProtocolICMP, server, client, packets.NewICMPUnreachable(packets.ICMPCodePortUnreachable, quoted).Bytes())
+	}
+	if state, _ := ct.Track(icmp(out)); state != Related {
+		t.Fatalf("error about the flow: %s", state)
+	}
+	if state, _ := ct.Track(icmp(udp(client, server, 1234, 54))); state != Invalid {
+		t.Fatalf("error about another flow: %s", state)
+	}
+
+	if state, _ := ct.Track(ipPacket(packets.ProtocolGRE, client, server, make([]byte, 8))); state != Untracked {
+		t.Fatalf("gre: %s", state)
+	}
+}
+
+func TestTrackFull(t *testing.T) {
+	ct := NewTable(1)
+	ct.Track(udp(client, server, 1, 53))
+
+	// the unanswered flow makes room for a new one...
+	if state, _ := ct.Track(udp(client, server, 2, 53)); state != New || ct.Len() != 1 {
+		t.Fatalf("evicting an unanswered flow: %s, %d entries", state, ct.Len())
+	}
+	// ...but an assured one stays
+	ct.Track(udp(server, client, 53, 2))
+	if state, _ := ct.Track(udp(client, server, 3, 53)); state != Invalid {
+		t.Fatalf("table full of assured flows: %s", state)
+	}
+}
+
+var (
+	client6 = net.ParseIP("2001:db8::2")
+	server6 = net.ParseIP("2001:db8:1::1")
+)
+
+// builds a serialized IPv6 packet, next is the type of the first header in payload
+func ipv6Packet(next uint8, src, dst net.IP, payload []byte) []byte {
+	ip := packets.IPv6Header{NextHeader: next, HopLimit: 64, SrcIP: src, DstIP: dst, PayloadLength: uint16(len(payload))}
+	return append(ip.Bytes(), payload...)
+}
+
+func TestTrackIPv6(t *testing.T) {
+	ct := NewTable(DefaultMaxEntries)
+	echo6 := func(src, dst net.IP, icmpType uint8) []byte {
+		return ipv6Packet(packets.ProtocolICMPv6, src, dst, packets.NewICMPv6Echo(icmpType, 7, 1, nil).Bytes(src, dst))
+	}
+	if state, _ := ct.Track(echo6(client6, server6, packets.ICMPv6EchoRequest)); state != New {
+		t.Fatalf("echo request: %s", state)
+	}
+	if state, dir := ct.Track(echo6(server6, client6, packets.ICMPv6EchoReply)); state != Established || dir != Reply {
+		t.Fatalf("echo reply: %s %d", state, dir)
+	}
+	// neighbor discovery isn't a flow
+	if state, _ := ct.Track(echo6(client6, server6, packets.ICMPv6RouterSolicitation)); state != Untracked {
+		t.Fatalf("router solicitation: %s", state)
+	}
+
+	// the transport header is found past extension headers
+	u := packets.UDPPacket{SrcPort: 1234, DstPort: 53, Data: []byte("hi")}
+	out := ipv6Packet(packets.ProtocolHopByHop, client6, server6, append(packets.NewIPv6RouterAlertHeader(packets.ProtocolUDP, 0), u.Bytes(6, client6, server6)...))
+	if state, _ := ct.Track(out); state != New {
+		t.Fatalf("udp behind hop-by-hop: %s", state)
+	}
+	want := Tuple{packets.ProtocolUDP, Addr(client6), Addr(server6), 1234, 53}
+	if _, dir, ok := ct.Lookup(want); !ok || dir != Original {
+		t.Fatalf("no entry for %s", want)
+	}
+
+	// an error quoting a packet of the flow is related
+	quoted := ipv6Packet(packets.ProtocolUDP, client6, server6, u.Bytes(6, client6, server6))
+	msg := packets.NewICMPv6Error(packets.ICMPv6DestUnreachable, packets.ICMPv6CodePortUnreachable, 0, quoted)
+	if state, _ := ct.Track(ipv6Packet(packets.ProtocolICMPv6, server6, client6, msg.Bytes(server6, client6))); state != Related {
+		t.Fatalf("error about the flow: %s", state)
+	}
+
+	// the families don't mix: the same ports between IPv4 addresses are another flow
+	if state, _ := ct.Track(udp(client, server, 1234, 53)); state != New || ct.Len() != 3 {
+		t.Fatalf("ipv4 flow: %s, %d entries", state, ct.Len())
+	}
+}
@@ -0,0 +1,124 @@
+package conntrack
+
+import (
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// TCP connection state as seen from the middle of the path
+type TCPState int
+
+const (
+	TCPNone        TCPState = iota
+	TCPSynSent              // SYN seen
+	TCPSynRecv              // SYN-ACK seen
+	TCPEstablished          // handshake done
+	TCPFinWait              // one side sent FIN
+	TCPCloseWait            // FIN acknowledged, other side still open
+	TCPLastAck              // both sides sent FIN
+	TCPTimeWait             // last FIN acknowledged
+	TCPClose                // RST seen
+)
+
+var tcpStateNames = []string{"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT", "CLOSE_WAIT", "LAST_ACK", "TIME_WAIT", "CLOSE"}
+
+func (s TCPState) String() string {
+	if int(s) < len(tcpStateNames) {
+		return tcpStateNames[s]
+	}
+	return "UNKNOWN"
+}
+
+// per-state idle timeouts (the Linux nf_conntrack_tcp_timeout_* defaults)
+var tcpTimeouts = map[TCPState]time.Duration{
+	TCPSynSent:     2 * time.Minute,
+	TCPSynRecv:     time.Minute,
+	TCPEstablished: 5 * 24 * time.Hour,
+	TCPFinWait:     2 * time.Minute,
+	TCPCloseWait:   time.Minute,
+	TCPLastAck:     30 * time.Second,
+	TCPTimeWait:    2 * time.Minute,
+	TCPClose:       10 * time.Second,
+}
+
+// state of a new flow from its first segment, flows seen mid-stream are picked
+// up as established (like nf_conntrack_tcp_loose), false if the segment can't
+// start one
+func tcpFirst(flags uint8) (TCPState, bool) {
+	switch {
+	case flags&packets.TCPFlagRST != 0:
+		return TCPNone, false
+	case flags&packets.TCPFlagSYN != 0 && flags&packets.TCPFlagACK == 0:
+		return TCPSynSent, true
+	case flags&packets.TCPFlagSYN != 0:
+		return TCPNone, false // a SYN-ACK out of nowhere
+	case flags&packets.TCPFlagACK != 0:
+		return TCPEstablished, true
+	}
+	return TCPNone, false
+}
+
+// moves an entry along on a segment going in dir, returns false for segments
+// that make no sense in the current state
+func (e *Entry) tcpUpdate(dir Direction, flags uint8) bool {
+	syn := flags&packets.TCPFlagSYN != 0
+	ack := flags&packets.TCPFlagACK != 0
+	fin := flags&packets.TCPFlagFIN != 0
+
+	if flags&packets.TCPFlagRST != 0 {
+		e.TCPState = TCPClose
+		return true
+	}
+
+	switch e.TCPState {
+	case TCPSynSent:
+		switch {
+		case dir == Reply && syn && ack:
+			e.TCPState = TCPSynRecv
+		case dir == Original && syn && !ack:
+			// retransmitted SYN
+		default:
+			return false
+		}
+	case TCPSynRecv:
+		switch {
+		case dir == Original && ack && !syn:
+			e.TCPState = TCPEstablished
+		case syn:
+			// retransmitted SYN or SYN-ACK
+		default:
+			return false
+		}
+	case TCPEstablished:
+		if syn {
+			return false
+		}
+		if fin {
+			e.TCPState = TCPFinWait
+			e.finDir = dir
+		}
+	case TCPFinWait, TCPCloseWait:
+		switch {
+		case dir != e.finDir && fin:
+			e.TCPState = TCPLastAck
+		case dir != e.finDir && ack:
+			e.TCPState = TCPCloseWait
+		}
+	case TCPLastAck:
+		if dir == e.finDir && ack {
+			e.TCPState = TCPTimeWait
+		}
+	case TCPTimeWait, TCPClose:
+		// a new SYN reopens the flow (port reuse)
+		if dir == Original && syn && !ack {
+			e.TCPState = TCPSynSent
+			e.Assured = false
+		}
+	}
+
+	if e.TCPState == TCPEstablished {
+		e.Assured = true
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// addresses and ports of a packet as seen on the wire, IPv4 addresses in their
+// v4-mapped form so both families share a table
+// for ICMP and ICMPv6 echo the identifier stands in for the ports: SrcPort in
+// requests, DstPort in replies, so a reply's tuple is the reverse of its request's
+type Tuple struct {
+	Protocol uint8
+	Src, Dst [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// returns ip as a tuple address
+func Addr(ip net.IP) [16]byte {
+	return [16]byte(ip.To16())
+}
+
+// returns the tuple of a packet going the other way
+func (t Tuple) Reverse() Tuple {
+	return Tuple{Protocol: t.Protocol, Src: t.Dst, Dst: t.Src, SrcPort: t.DstPort, DstPort: t.SrcPort}
+}
+
+func (t Tuple) String() string {
+	return fmt.Sprintf("%s %s:%d -> %s:%d", ProtocolName(t.Protocol), net.IP(t.Src[:]), t.SrcPort, net.IP(t.Dst[:]), t.DstPort)
+}
+
+func ProtocolName(p uint8) string {
+	switch p {
+	case packets.ProtocolTCP:
+		return "tcp"
+	case packets.ProtocolUDP:
+		return "udp"
+	case packets.ProtocolICMP:
+		return "icmp"
+	case packets.ProtocolICMPv6:
+		return "icmpv6"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// reads the tuple of a serialized IPv4 or IPv6 packet whose transport header is l4
+// (which may be truncated to 8 bytes, like in ICMP errors). In IPv6 the transport
+// header must follow the fixed header, as it does in the packets we quote or NAT
+// only TCP, UDP and ICMP echo have one
+func TupleOf(pkt, l4 []byte) (Tuple, bool) {
+	if pkt[0]>>4 == 6 {
+		return tupleOf(pkt[6], pkt, l4)
+	}
+	return tupleOf(pkt[9], pkt, l4)
+}
+
+// the tuple of a packet carrying proto, past any IPv6 extension headers
+func tupleOf(proto uint8, pkt, l4 []byte) (Tuple, bool) {
+	t := Tuple{Protocol: proto}
+	if pkt[0]>>4 == 6 {
+		t.Src, t.Dst = [16]byte(pkt[8:24]), [16]byte(pkt[24:40])
+	} else {
+		t.Src, t.Dst = Addr(pkt[12:16]), Addr(pkt[16:20])
+	}
+
+	switch t.Protocol {
+	case packets.ProtocolTCP, packets.ProtocolUDP:
+		if len(l4) < 4 {
+			return Tuple{}, false
+		}
+		t.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		t.DstPort = binary.BigEndian.Uint16(l4[2:4])
+	case packets.ProtocolICMP, packets.ProtocolICMPv6:
+		if len(l4) < 8 {
+			return Tuple{}, false
+		}
+		request, reply := echoTypes(t.Protocol)
+		switch l4[0] {
+		case request:
+			t.SrcPort = binary.BigEndian.Uint16(l4[4:6])
+		case reply:
+			t.DstPort = binary.BigEndian.Uint16(l4[4:6])
+		default:
+			return Tuple{}, false
+		}
+	default:
+		return Tuple{}, false
+	}
+	return t, true
+}
+
+// the echo request and reply types of ICMP or ICMPv6
+func echoTypes(proto uint8) (request, reply uint8) {
+	if proto == packets.ProtocolICMPv6 {
+		return packets.ICMPv6EchoRequest, packets.ICMPv6EchoReply
+	}
+	return packets.ICMPEchoRequest, packets.ICMPEchoReply
+}
+
+// reports whether an ICMP or ICMPv6 message of type icmpType is an error
+func isICMPError(proto, icmpType uint8) bool {
+	switch proto {
+	case packets.ProtocolICMP:
+		return packets.IsICMPError(icmpType)
+	case packets.ProtocolICMPv6:
+		return packets.IsICMPv6Error(icmpType)
+	}
+	return false
+}
+
+// returns the packet quoted by an ICMP or ICMPv6 error and its transport header
+func QuotedPacket(icmp []byte) (pkt, l4 []byte, ok bool) {
+	if len(icmp) < 8+20 {
+		return nil, nil, false
+	}
+	pkt = icmp[8:]
+	headerLen := int(pkt[0]&0x0F) * 4
+	if pkt[0]>>4 == 6 {
+		headerLen = packets.IPv6HeaderLen
+	}
+	if headerLen < 20 || len(pkt) < headerLen {
+		return nil, nil, false
+	}
+	return pkt, pkt[headerLen:], true
+}
+
+// returns the transport protocol and header of a serialized IPv4 or IPv6 packet,
+// past any extension headers, and the packet's length
+func transport(pkt []byte) (proto uint8, l4 []byte, total int, ok bool) {
+	if pkt[0]>>4 == 6 {
+		ip, err := packets.ParseIPv6(pkt)
+		if err != nil {
+			return 0, nil, 0, false
+		}
+		_, proto, payload, err := packets.ParseIPv6Extensions(ip)
+		if err != nil {
+			return 0, nil, 0, false
+		}
+		return proto, payload, packets.IPv6HeaderLen + len(ip.Payload), true
+	}
+
+	ihl := int(pkt[0]&0x0F) * 4
+	total = int(binary.BigEndian.Uint16(pkt[2:4]))
+	return pkt[9], pkt[ihl:total], total, true
+}
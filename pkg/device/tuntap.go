@@ -15,6 +15,9 @@ const (
 	SysCallIoctl = 16 // ioctl syscall ID for linux amd64
 )
 
+// default MTU for Ethernet links
+const DefaultMTU = 1500
+
 // struct used to pass parameters via ioctl (man netdevice)
 type ifReq struct {
 	Name  [16]byte
@@ -26,6 +29,7 @@ type ifReq struct {
 type Interface struct {
 	File *os.File
 	Name string
+	MTU  int // largest L3 packet we may write (excluding the Ethernet header)
 }
 
 // opens or creates a TAP interface
@@ -56,6 +60,7 @@ func NewTAP(devName string) (*Interface, error) {
 	return &Interface{
 		File: file,
 		Name: devName,
+		MTU:  DefaultMTU,
 	}, nil
 }
 
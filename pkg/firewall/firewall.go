@@ -0,0 +1,166 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+)
+
+// points of the packet path where chains run (same as netfilter)
+type Hook int
+
+const (
+	Prerouting  Hook = iota // every incoming packet, before the routing decision
+	Input                   // packets addressed to us
+	Forward                 // packets routed between interfaces
+	Output                  // packets we originate
+	Postrouting             // every outgoing packet, forwarded or ours
+	numHooks
+)
+
+var hookNames = [numHooks]string{"prerouting", "input", "forward", "output", "postrouting"}
+
+func (h Hook) String() string {
+	if h < 0 || h >= numHooks {
+		return "unknown"
+	}
+	return hookNames[h]
+}
+
+func ParseHook(s string) (Hook, error) {
+	for h, name := range hookNames {
+		if name == s {
+			return Hook(h), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hook %q", s)
+}
+
+// a packet going through a hook, IPv4 or IPv6
+type Packet struct {
+	In       string // incoming interface, empty for packets we originate
+	Out      string // outgoing interface, empty before the routing decision
+	Src, Dst net.IP
+	Protocol uint8  // transport protocol, past any IPv6 extension headers
+	Length   int    // bytes on the wire, IP header included
+	L4       []byte // transport header and data
+	Fragment bool   // a non-first fragment, L4 has no transport header
+	State    conntrack.State
+}
+
+// called for packets hitting a Log rule
+type LogFunc func(hook Hook, r *Rule, p *Packet)
+
+// an ordered list of rules and the verdict when none of them decides
+type chain struct {
+	policy Action // Accept or Drop
+	rules  []*Rule
+}
+
+// the packet filter: one chain per hook, safe for concurrent use and meant
+// to be changed while packets flow
+type Firewall struct {
+	mu     sync.RWMutex
+	chains [numHooks]chain
+	log    LogFunc
+}
+
+// returns a firewall with empty chains accepting everything
+func New(log LogFunc) *Firewall {
+	return &Firewall{log: log}
+}
+
+// runs a packet through the chain of a hook and returns the verdict
+// (Accept, Drop or Reject) and the rule that decided, nil for the policy
+func (f *Firewall) Filter(hook Hook, p *Packet) (Action, *Rule) {
+	f.mu.RLock()
+	c := f.chains[hook]
+	f.mu.RUnlock()
+
+	for _, r := range c.rules {
+		if !r.matches(p) {
+			continue
+		}
+		r.packets.Add(1)
+		r.bytes.Add(uint64(p.Length))
+
+		switch r.Action {
+		case Log:
+			if f.log != nil {
+				f.log(hook, r, p)
+			}
+		case Counter:
+		default:
+			return r.Action, r
+		}
+	}
+	return c.policy, nil
+}
+
+// adds a rule at the end of a chain
+func (f *Firewall) Append(hook Hook, r *Rule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// chains are copied on write so Filter can run without holding the lock
+	f.chains[hook].rules = append(slices.Clip(f.chains[hook].rules), r)
+}
+
+// adds a rule before position pos (0 is the head of the chain)
+func (f *Firewall) Insert(hook Hook, pos int, r *Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules := f.chains[hook].rules
+	if pos < 0 || pos > len(rules) {
+		return fmt.Errorf("%s has no position %d", hook, pos)
+	}
+	f.chains[hook].rules = slices.Insert(slices.Clone(rules), pos, r)
+	return nil
+}
+
+// removes the rule at position pos
+func (f *Firewall) Delete(hook Hook, pos int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules := f.chains[hook].rules
+	if pos < 0 || pos >= len(rules) {
+		return fmt.Errorf("%s has no rule %d", hook, pos)
+	}
+	f.chains[hook].rules = slices.Delete(slices.Clone(rules), pos, pos+1)
+	return nil
+}
+
+// removes every rule of a chain, the policy stays
+func (f *Firewall) Flush(hook Hook) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.chains[hook].rules = nil
+}
+
+// sets what happens to packets no rule decided on, Accept or Drop
+func (f *Firewall) SetPolicy(hook Hook, policy Action) error {
+	if policy != Accept && policy != Drop {
+		return fmt.Errorf("policy must be accept or drop, not %s", policy)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.chains[hook].policy = policy
+	return nil
+}
+
+// returns the policy and rules of a chain
+func (f *Firewall) Chain(hook Hook) (Action, []*Rule) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	c := f.chains[hook]
+	return c.policy, slices.Clone(c.rules)
+}
@@ -0,0 +1,516 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// what happens to a packet matching a rule
+// Log and Counter don't end the chain, the next rules still run
+type Action int
+
+const (
+	Accept Action = iota
+	Drop
+	Reject
+	Log
+	Counter
+)
+
+func (a Action) String() string {
+	switch a {
+	case Accept:
+		return "accept"
+	case Drop:
+		return "drop"
+	case Reject:
+		return "reject"
+	case Log:
+		return "log"
+	case Counter:
+		return "counter"
+	}
+	return "unknown"
+}
+
+// how a rejected packet is answered
+type RejectWith int
+
+const (
+	RejectPortUnreachable  RejectWith = iota // ICMP port unreachable (the iptables default)
+	RejectHostUnreachable                    // ICMP host unreachable
+	RejectNetUnreachable                     // ICMP net unreachable
+	RejectAdminProhibited                    // ICMP communication administratively prohibited
+	RejectProtoUnreachable                   // ICMP protocol unreachable
+	RejectNetProhibited                      // ICMP network administratively prohibited
+	RejectHostProhibited                     // ICMP host administratively prohibited
+	RejectTCPReset                           // TCP RST, only valid for TCP rules
+)
+
+var rejectNames = map[RejectWith]string{
+	RejectPortUnreachable:  "icmp-port-unreachable",
+	RejectHostUnreachable:  "icmp-host-unreachable",
+	RejectNetUnreachable:   "icmp-net-unreachable",
+	RejectAdminProhibited:  "icmp-admin-prohibited",
+	RejectProtoUnreachable: "icmp-proto-unreachable",
+	RejectNetProhibited:    "icmp-net-prohibited",
+	RejectHostProhibited:   "icmp-host-prohibited",
+	RejectTCPReset:         "tcp-reset",
+}
+
+func (r RejectWith) String() string {
+	return rejectNames[r]
+}
+
+// returns the ICMP Destination Unreachable code of an ICMP rejection
+func (r RejectWith) ICMPCode() uint8 {
+	switch r {
+	case RejectHostUnreachable:
+		return packets.ICMPCodeHostUnreachable
+	case RejectNetUnreachable:
+		return packets.ICMPCodeNetUnreachable
+	case RejectAdminProhibited:
+		return packets.ICMPCodeAdminProhibited
+	case RejectProtoUnreachable:
+		return packets.ICMPCodeProtocolUnreachable
+	case RejectNetProhibited:
+		return packets.ICMPCodeNetProhibited
+	case RejectHostProhibited:
+		return packets.ICMPCodeHostProhibited
+	}
+	return packets.ICMPCodePortUnreachable
+}
+
+// returns the ICMPv6 Destination Unreachable code closest to an ICMP rejection
+// ICMPv6 has no protocol unreachable, it answers with a Parameter Problem instead
+func (r RejectWith) ICMPv6Code() uint8 {
+	switch r {
+	case RejectHostUnreachable:
+		return packets.ICMPv6CodeAddressUnreachable
+	case RejectNetUnreachable:
+		return packets.ICMPv6CodeNoRoute
+	case RejectAdminProhibited, RejectNetProhibited, RejectHostProhibited:
+		return packets.ICMPv6CodeAdminProhibited
+	}
+	return packets.ICMPv6CodePortUnreachable
+}
+
+// inclusive port range, the zero value matches any port
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (p PortRange) Any() bool {
+	return p.Min == 0 && p.Max == 0
+}
+
+func (p PortRange) Contains(port uint16) bool {
+	return p.Any() || port >= p.Min && port <= p.Max
+}
+
+func (p PortRange) String() string {
+	if p.Min == p.Max {
+		return strconv.Itoa(int(p.Min))
+	}
+	return fmt.Sprintf("%d-%d", p.Min, p.Max)
+}
+
+// a filtering rule, zero valued match fields match anything
+type Rule struct {
+	In       string     // incoming interface
+	Out      string     // outgoing interface
+	Src      *net.IPNet // source prefix
+	Dst      *net.IPNet // destination prefix
+	Protocol uint8
+	SrcPorts PortRange // TCP/UDP only
+	DstPorts PortRange
+	// TCP flags: the rule matches when flags&FlagsMask == Flags
+	Flags     uint8
+	FlagsMask uint8
+	ICMPType  int // -1 matches any type
+	// conntrack states, bit 1<<State set for each accepted state, 0 matches any
+	States uint8
+
+	Action     Action
+	RejectWith RejectWith // for Reject
+	LogPrefix  string     // for Log
+
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// a rule that matches everything and accepts it
+func NewRule() *Rule {
+	return &Rule{ICMPType: -1}
+}
+
+// returns how many packets and bytes matched the rule
+func (r *Rule) Counters() (pkts, bytes uint64) {
+	return r.packets.Load(), r.bytes.Load()
+}
+
+func (r *Rule) matches(p *Packet) bool {
+	if r.In != "" && r.In != p.In {
+		return false
+	}
+	if r.Out != "" && r.Out != p.Out {
+		return false
+	}
+	// a prefix of the other family never matches
+	if r.Src != nil && !r.Src.Contains(p.Src) {
+		return false
+	}
+	if r.Dst != nil && !r.Dst.Contains(p.Dst) {
+		return false
+	}
+	if r.Protocol != 0 && r.Protocol != p.Protocol {
+		return false
+	}
+	if r.States != 0 && r.States&(1<<p.State) == 0 {
+		return false
+	}
+
+	// transport matches need the transport header, which only the first fragment has
+	needL4 := !r.SrcPorts.Any() || !r.DstPorts.Any() || r.FlagsMask != 0 || r.ICMPType >= 0
+	if !needL4 {
+		return true
+	}
+	l4 := p.L4
+	if p.Fragment {
+		return false
+	}
+
+	switch p.Protocol {
+	case packets.ProtocolTCP, packets.ProtocolUDP:
+		if len(l4) < 4 || r.ICMPType >= 0 {
+			return false
+		}
+		if !r.SrcPorts.Contains(uint16(l4[0])<<8|uint16(l4[1])) || !r.DstPorts.Contains(uint16(l4[2])<<8|uint16(l4[3])) {
+			return false
+		}
+		if r.FlagsMask != 0 {
+			return p.Protocol == packets.ProtocolTCP && len(l4) >= 14 && l4[13]&r.FlagsMask == r.Flags
+		}
+		return true
+	case packets.ProtocolICMP, packets.ProtocolICMPv6:
+		return len(l4) >= 1 && r.SrcPorts.Any() && r.DstPorts.Any() && r.FlagsMask == 0 && int(l4[0]) == r.ICMPType
+	}
+	return false
+}
+
+func (r *Rule) String() string {
+	var parts []string
+	if r.In != "" {
+		parts = append(parts, "in", r.In)
+	}
+	if r.Out != "" {
+		parts = append(parts, "out", r.Out)
+	}
+	if r.Src != nil {
+		parts = append(parts, "src", r.Src.String())
+	}
+	if r.Dst != nil {
+		parts = append(parts, "dst", r.Dst.String())
+	}
+	if r.Protocol != 0 {
+		parts = append(parts, "proto", protocolName(r.Protocol))
+	}
+	if !r.SrcPorts.Any() {
+		parts = append(parts, "sport", r.SrcPorts.String())
+	}
+	if !r.DstPorts.Any() {
+		parts = append(parts, "dport", r.DstPorts.String())
+	}
+	if r.FlagsMask != 0 {
+		parts = append(parts, "flags", flagNames(r.Flags)+"/"+flagNames(r.FlagsMask))
+	}
+	if r.ICMPType >= 0 {
+		parts = append(parts, "icmp-type", strconv.Itoa(r.ICMPType))
+	}
+	if r.States != 0 {
+		var states []string
+		for s := conntrack.Invalid; s <= conntrack.Untracked; s++ {
+			if r.States&(1<<s) != 0 {
+				states = append(states, s.String())
+			}
+		}
+		parts = append(parts, "state", strings.Join(states, ","))
+	}
+
+	parts = append(parts, r.Action.String())
+	switch r.Action {
+	case Reject:
+		parts = append(parts, "with", r.RejectWith.String())
+	case Log:
+		if r.LogPrefix != "" {
+			parts = append(parts, "prefix", r.LogPrefix)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func protocolName(p uint8) string {
+	switch p {
+	case packets.ProtocolTCP:
+		return "tcp"
+	case packets.ProtocolUDP:
+		return "udp"
+	case packets.ProtocolICMP:
+		return "icmp"
+	case packets.ProtocolIGMP:
+		return "igmp"
+	case packets.ProtocolICMPv6:
+		return "icmpv6"
+	}
+	return strconv.Itoa(int(p))
+}
+
+var tcpFlags = []struct {
+	name string
+	bit  uint8
+}{
+	{"FIN", packets.TCPFlagFIN}, {"SYN", packets.TCPFlagSYN}, {"RST", packets.TCPFlagRST},
+	{"PSH", packets.TCPFlagPSH}, {"ACK", packets.TCPFlagACK}, {"URG", packets.TCPFlagURG},
+}
+
+func flagNames(flags uint8) string {
+	var names []string
+	for _, f := range tcpFlags {
+		if flags&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, ",")
+}
+
+func parseFlags(s string) (uint8, error) {
+	var flags uint8
+	if s == "NONE" {
+		return 0, nil
+	}
+	for _, name := range strings.Split(strings.ToUpper(s), ",") {
+		found := false
+		for _, f := range tcpFlags {
+			if f.name == name {
+				flags |= f.bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown TCP flag %q", name)
+		}
+	}
+	return flags, nil
+}
+
+func parsePorts(s string) (PortRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	min, err1 := strconv.ParseUint(lo, 10, 16)
+	max, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	// the zero range means any port, so it can't be asked for
+	if max == 0 {
+		return PortRange{}, fmt.Errorf("port 0 is not a valid match")
+	}
+	return PortRange{Min: uint16(min), Max: uint16(max)}, nil
+}
+
+// accepts an IPv4 or IPv6 CIDR, or a single address
+func parsePrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %q", s)
+	}
+	return prefix, nil
+}
+
+var icmpTypes = map[string]int{
+	"echo-reply":        packets.ICMPEchoReply,
+	"dest-unreachable":  packets.ICMPDestUnreachable,
+	"source-quench":     packets.ICMPSourceQuench,
+	"redirect":          packets.ICMPRedirect,
+	"echo-request":      packets.ICMPEchoRequest,
+	"time-exceeded":     packets.ICMPTimeExceeded,
+	"parameter-problem": packets.ICMPParamProblem,
+}
+
+var icmpv6Types = map[string]int{
+	"dest-unreachable":       packets.ICMPv6DestUnreachable,
+	"packet-too-big":         packets.ICMPv6PacketTooBig,
+	"time-exceeded":          packets.ICMPv6TimeExceeded,
+	"parameter-problem":      packets.ICMPv6ParamProblem,
+	"echo-request":           packets.ICMPv6EchoRequest,
+	"echo-reply":             packets.ICMPv6EchoReply,
+	"router-solicitation":    packets.ICMPv6RouterSolicitation,
+	"router-advertisement":   packets.ICMPv6RouterAdvertisement,
+	"neighbor-solicitation":  packets.ICMPv6NeighborSolicitation,
+	"neighbor-advertisement": packets.ICMPv6NeighborAdvertisement,
+	"redirect":               packets.ICMPv6Redirect,
+}
+
+// parses a rule written like the output of Rule.String:
+// "in tap1 proto tcp dport 22 flags SYN/SYN,ACK drop", "src 10.0.0.0/8 log prefix lan"
+// or "proto udp dport 53 reject with icmp-admin-prohibited"
+// match keywords: in, out, src, dst, proto, sport, dport, flags VALUE/MASK, icmp-type
+// (named after the types of proto icmp or icmpv6), state (conntrack states, e.g.
+// established,related)
+// the action (accept, drop, reject [with ...], log [prefix ...], counter) comes last
+func ParseRule(s string) (*Rule, error) {
+	fields := strings.Fields(s)
+	r := NewRule()
+	hasAction := false
+	var icmpType string
+	var with, prefix bool
+
+	for i := 0; i < len(fields); i++ {
+		key := fields[i]
+		switch key {
+		case "accept", "drop", "reject", "log", "counter":
+			if hasAction {
+				return nil, fmt.Errorf("more than one action")
+			}
+			hasAction = true
+			r.Action = map[string]Action{"accept": Accept, "drop": Drop, "reject": Reject, "log": Log, "counter": Counter}[key]
+			continue
+		}
+
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("missing value for %q", key)
+		}
+		i++
+		val := fields[i]
+
+		var err error
+		switch key {
+		case "in":
+			r.In = val
+		case "out":
+			r.Out = val
+		case "src":
+			r.Src, err = parsePrefix(val)
+		case "dst":
+			r.Dst, err = parsePrefix(val)
+		case "proto":
+			switch val {
+			case "tcp":
+				r.Protocol = packets.ProtocolTCP
+			case "udp":
+				r.Protocol = packets.ProtocolUDP
+			case "icmp":
+				r.Protocol = packets.ProtocolICMP
+			case "igmp":
+				r.Protocol = packets.ProtocolIGMP
+			case "icmpv6":
+				r.Protocol = packets.ProtocolICMPv6
+			default:
+				var p uint64
+				p, err = strconv.ParseUint(val, 10, 8)
+				r.Protocol = uint8(p)
+			}
+		case "sport":
+			r.SrcPorts, err = parsePorts(val)
+		case "dport":
+			r.DstPorts, err = parsePorts(val)
+		case "flags":
+			value, mask, ok := strings.Cut(val, "/")
+			if !ok {
+				return nil, fmt.Errorf("flags need VALUE/MASK, got %q", val)
+			}
+			if r.Flags, err = parseFlags(value); err == nil {
+				r.FlagsMask, err = parseFlags(mask)
+			}
+		case "icmp-type":
+			// names depend on the protocol, which may come later
+			icmpType = val
+		case "state":
+			for _, name := range strings.Split(val, ",") {
+				found := false
+				for s := conntrack.Invalid; s <= conntrack.Untracked; s++ {
+					if s.String() == name {
+						r.States |= 1 << s
+						found = true
+					}
+				}
+				if !found {
+					err = fmt.Errorf("unknown state %q", name)
+				}
+			}
+		case "with":
+			with = true
+			found := false
+			for w, name := range rejectNames {
+				if name == val {
+					r.RejectWith, found = w, true
+				}
+			}
+			if !found {
+				err = fmt.Errorf("unknown reject type %q", val)
+			}
+		case "prefix":
+			prefix = true
+			r.LogPrefix = val
+		default:
+			return nil, fmt.Errorf("unknown rule keyword %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", key, val, err)
+		}
+	}
+
+	if icmpType != "" {
+		names := icmpTypes
+		if r.Protocol == packets.ProtocolICMPv6 {
+			names = icmpv6Types
+		}
+		t, ok := names[icmpType]
+		if !ok {
+			n, err := strconv.ParseUint(icmpType, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("icmp-type %s: %w", icmpType, err)
+			}
+			t = int(n)
+		}
+		r.ICMPType = t
+	}
+
+	switch {
+	case !hasAction:
+		return nil, fmt.Errorf("missing action")
+	case with && r.Action != Reject:
+		return nil, fmt.Errorf("with needs the reject action")
+	case prefix && r.Action != Log:
+		return nil, fmt.Errorf("prefix needs the log action")
+	case (!r.SrcPorts.Any() || !r.DstPorts.Any()) && r.Protocol != packets.ProtocolTCP && r.Protocol != packets.ProtocolUDP:
+		return nil, fmt.Errorf("ports need proto tcp or udp")
+	case r.FlagsMask != 0 && r.Protocol != packets.ProtocolTCP:
+		return nil, fmt.Errorf("flags need proto tcp")
+	case r.Flags&^r.FlagsMask != 0:
+		return nil, fmt.Errorf("flags outside the mask never match")
+	case r.ICMPType >= 0 && r.Protocol != packets.ProtocolICMP && r.Protocol != packets.ProtocolICMPv6:
+		return nil, fmt.Errorf("icmp-type needs proto icmp or icmpv6")
+	case r.RejectWith == RejectTCPReset && r.Protocol != packets.ProtocolTCP:
+		return nil, fmt.Errorf("tcp-reset needs proto tcp")
+	}
+	return r, nil
+}
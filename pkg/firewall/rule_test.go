@@ -0,0 +1,201 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+func TestParseRuleRoundTrip(t *testing.T) {
+	rules := []string{
+		"accept",
+		"in tap1 proto tcp dport 22 flags SYN/SYN,ACK drop",
+		"out tap0 src 10.0.0.0/8 dst 192.168.1.1/32 log prefix lan",
+		"src 2001:db8::/32 dst 2001:db8::1/128 proto udp sport 1024-65535 dport 53 accept",
+		"proto udp dport 53 reject with icmp-admin-prohibited",
+		"proto tcp dport 80-81 reject with tcp-reset",
+		"proto icmp icmp-type 8 counter",
+		"proto icmpv6 icmp-type 128 drop",
+		"proto 47 accept",
+		"state invalid,new drop",
+		"state established,related accept",
+	}
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if got := r.String(); got != s {
+			t.Errorf("%q reads back as %q", s, got)
+		}
+	}
+}
+
+func TestParseRuleNormalizes(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"drop src 10.0.0.1", "src 10.0.0.1/32 drop"},
+		{"src 2001:db8::1 drop", "src 2001:db8::1/128 drop"},
+		{"icmp-type echo-request proto icmp accept", "proto icmp icmp-type 8 accept"},
+		{"proto icmpv6 icmp-type neighbor-solicitation accept", "proto icmpv6 icmp-type 135 accept"},
+		{"proto tcp flags syn/syn,ack drop", "proto tcp flags SYN/SYN,ACK drop"},
+		{"reject", "reject with icmp-port-unreachable"},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if got := r.String(); got != tt.want {
+			t.Errorf("%q reads back as %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	rules := []string{
+		"",
+		"proto tcp",
+		"accept drop",
+		"dport 22 drop",
+		"proto tcp dport 0 drop",
+		"proto udp sport 0 drop",
+		"proto tcp dport 23-22 drop",
+		"proto udp flags SYN/SYN drop",
+		"proto tcp flags SYN,ACK/SYN drop",
+		"icmp-type 8 drop",
+		"proto icmp icmp-type pong drop",
+		"proto udp reject with tcp-reset",
+		"accept with icmp-admin-prohibited",
+		"drop prefix lan",
+		"reject prefix lan",
+		"log with icmp-port-unreachable",
+		"state sleepy drop",
+		"src 10.0.0.300 drop",
+		"in",
+		"color blue drop",
+	}
+	for _, s := range rules {
+		if r, err := ParseRule(s); err == nil {
+			t.Errorf("%q parsed as %q", s, r)
+		}
+	}
+}
+
+// the transport header of a TCP or UDP segment
+func ports(src, dst uint16, flags uint8) []byte {
+	l4 := make([]byte, 20)
+	l4[0], l4[1] = byte(src>>8), byte(src)
+	l4[2], l4[3] = byte(dst>>8), byte(dst)
+	l4[13] = flags
+	return l4
+}
+
+func TestRuleMatches(t *testing.T) {
+	v4 := func(proto uint8, l4 []byte) *Packet {
+		return &Packet{
+			In: "tap0", Src: net.IPv4(10, 0, 0, 2).To4(), Dst: net.IPv4(192, 168, 1, 1).To4(),
+			Protocol: proto, Length: 20 + len(l4), L4: l4, State: conntrack.New,
+		}
+	}
+	v6 := func(proto uint8, l4 []byte) *Packet {
+		return &Packet{
+			In: "tap0", Src: net.ParseIP("2001:db8::2"), Dst: net.ParseIP("2001:db8::1"),
+			Protocol: proto, Length: 40 + len(l4), L4: l4, State: conntrack.New,
+		}
+	}
+	fragment := func(p *Packet) *Packet {
+		p.Fragment = true
+		return p
+	}
+	established := func(p *Packet) *Packet {
+		p.State = conntrack.Established
+		return p
+	}
+
+	tests := []struct {
+		rule string
+		p    *Packet
+		want bool
+	}{
+		{"in tap0 accept", v4(packets.ProtocolUDP, ports(1, 2, 0)), true},
+		{"in tap1 accept", v4(packets.ProtocolUDP, ports(1, 2, 0)), false},
+		{"out tap0 accept", v4(packets.ProtocolUDP, ports(1, 2, 0)), false},
+
+		{"src 10.0.0.0/8 accept", v4(packets.ProtocolTCP, ports(1, 2, 0)), true},
+		{"src 10.0.0.0/8 accept", v6(packets.ProtocolTCP, ports(1, 2, 0)), false},
+		{"dst 2001:db8::/64 accept", v6(packets.ProtocolTCP, ports(1, 2, 0)), true},
+		{"dst 2001:db8::/64 accept", v4(packets.ProtocolTCP, ports(1, 2, 0)), false},
+
+		{"proto tcp dport 22 accept", v4(packets.ProtocolTCP, ports(40000, 22, 0)), true},
+		{"proto tcp dport 22 accept", v6(packets.ProtocolTCP, ports(40000, 22, 0)), true},
+		{"proto tcp dport 22 accept", v4(packets.ProtocolTCP, ports(40000, 23, 0)), false},
+		{"proto tcp dport 22 accept", v4(packets.ProtocolUDP, ports(40000, 22, 0)), false},
+		{"proto udp sport 1024-2047 accept", v4(packets.ProtocolUDP, ports(1024, 53, 0)), true},
+		{"proto udp sport 1024-2047 accept", v4(packets.ProtocolUDP, ports(2047, 53, 0)), true},
+		{"proto udp sport 1024-2047 accept", v4(packets.ProtocolUDP, ports(2048, 53, 0)), false},
+		{"proto udp dport 53 accept", v4(packets.ProtocolUDP, []byte{0, 1}), false},
+
+		{"proto tcp flags SYN/SYN,ACK accept", v4(packets.ProtocolTCP, ports(1, 2, packets.TCPFlagSYN)), true},
+		{"proto tcp flags SYN/SYN,ACK accept", v4(packets.ProtocolTCP, ports(1, 2, packets.TCPFlagSYN|packets.TCPFlagACK)), false},
+		{"proto tcp flags SYN/SYN,ACK accept", v4(packets.ProtocolTCP, ports(1, 2, packets.TCPFlagACK)), false},
+		{"proto tcp flags NONE/RST accept", v4(packets.ProtocolTCP, ports(1, 2, packets.TCPFlagACK)), true},
+
+		{"proto icmp icmp-type echo-request accept", v4(packets.ProtocolICMP, []byte{packets.ICMPEchoRequest, 0, 0, 0}), true},
+		{"proto icmp icmp-type echo-request accept", v4(packets.ProtocolICMP, []byte{packets.ICMPEchoReply, 0, 0, 0}), false},
+		{"proto icmp icmp-type echo-request accept", v6(packets.ProtocolICMPv6, []byte{packets.ICMPv6EchoRequest, 0, 0, 0}), false},
+		{"proto icmpv6 icmp-type echo-request accept", v6(packets.ProtocolICMPv6, []byte{packets.ICMPv6EchoRequest, 0, 0, 0}), true},
+
+		{"state new accept", v4(packets.ProtocolUDP, ports(1, 2, 0)), true},
+		{"state established,related accept", v4(packets.ProtocolUDP, ports(1, 2, 0)), false},
+		{"state established,related accept", established(v4(packets.ProtocolUDP, ports(1, 2, 0))), true},
+
+		// a non-first fragment has no transport header to match on,
+		// but the network layer still matches
+		{"proto udp dport 2 accept", fragment(v4(packets.ProtocolUDP, ports(1, 2, 0))), false},
+		{"proto tcp flags SYN/SYN accept", fragment(v4(packets.ProtocolTCP, ports(1, 2, packets.TCPFlagSYN))), false},
+		{"proto icmp icmp-type 8 accept", fragment(v4(packets.ProtocolICMP, []byte{8, 0, 0, 0})), false},
+		{"proto udp src 10.0.0.2 accept", fragment(v4(packets.ProtocolUDP, ports(1, 2, 0))), true},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.rule, err)
+		}
+		if got := r.matches(tt.p); got != tt.want {
+			t.Errorf("%q matching %s -> %s proto %d: got %v, want %v", tt.rule, tt.p.Src, tt.p.Dst, tt.p.Protocol, got, tt.want)
+		}
+	}
+}
+
+func TestFilterCounters(t *testing.T) {
+	var logged int
+	f := New(func(Hook, *Rule, *Packet) { logged++ })
+	for _, s := range []string{"log prefix seen", "proto tcp dport 22 drop"} {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Append(Input, r)
+	}
+
+	ssh := &Packet{Protocol: packets.ProtocolTCP, Length: 60, L4: ports(40000, 22, 0)}
+	if verdict, r := f.Filter(Input, ssh); verdict != Drop || r == nil {
+		t.Fatalf("ssh got %s", verdict)
+	}
+	web := &Packet{Protocol: packets.ProtocolTCP, Length: 40, L4: ports(40000, 80, 0)}
+	if verdict, r := f.Filter(Input, web); verdict != Accept || r != nil {
+		t.Fatalf("web got %s by %v", verdict, r)
+	}
+
+	_, rules := f.Chain(Input)
+	if pkts, bytes := rules[0].Counters(); pkts != 2 || bytes != 100 || logged != 2 {
+		t.Fatalf("log rule counted %d packets, %d bytes, logged %d", pkts, bytes, logged)
+	}
+	if pkts, bytes := rules[1].Counters(); pkts != 1 || bytes != 60 {
+		t.Fatalf("drop rule counted %d packets, %d bytes", pkts, bytes)
+	}
+}
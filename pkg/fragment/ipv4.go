@@ -0,0 +1,49 @@
+package fragment
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+// builds the reassembly key of an IPv4 fragment
+func IPv4Key(ip *packets.IPv4Header) Key {
+	var k Key
+	copy(k.Src[:], ip.SrcIP.To16())
+	copy(k.Dst[:], ip.DstIP.To16())
+	k.Protocol = ip.Protocol
+	k.ID = uint32(ip.Identification)
+	return k
+}
+
+// converts a parsed IPv4 fragment, raw is the whole packet the header was parsed from
+func IPv4Fragment(ip *packets.IPv4Header, raw []byte) Fragment {
+	return Fragment{
+		Offset:  int(ip.FragmentOffset) * 8,
+		More:    ip.Flags&packets.IPv4FlagMF != 0,
+		Payload: ip.Payload,
+		Header:  raw[:int(ip.IHL)*4],
+	}
+}
+
+// turns a reassembled datagram back into a regular unfragmented packet
+func IPv4Datagram(d *Datagram) (*packets.IPv4Header, error) {
+	if size := len(d.Header) + len(d.Payload); size > 0xffff {
+		return nil, fmt.Errorf("reassembled datagram of %d bytes exceeds 65535", size)
+	}
+
+	buf := make([]byte, len(d.Header)+len(d.Payload))
+	copy(buf, d.Header)
+	copy(buf[len(d.Header):], d.Payload)
+
+	// patch the length and clear MF/offset, keep DF as sent
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	buf[6] &= packets.IPv4FlagDF << 5
+	buf[7] = 0
+	binary.BigEndian.PutUint16(buf[10:12], 0)
+	binary.BigEndian.PutUint16(buf[10:12], utils.Checksum(buf[:len(d.Header)]))
+
+	return packets.ParseIPv4(buf)
+}
@@ -0,0 +1,62 @@
+package fragment
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// builds the reassembly key of an IPv6 fragment: addresses and Identification
+// (RFC 8200 4.5), on the link it was received on
+func IPv6Key(ip *packets.IPv6Header, f packets.IPv6Fragment, zone string) Key {
+	var k Key
+	copy(k.Src[:], ip.SrcIP.To16())
+	copy(k.Dst[:], ip.DstIP.To16())
+	k.Protocol = packets.ProtocolFragment
+	k.ID = f.Identification
+	k.Zone = zone
+	return k
+}
+
+// converts an IPv6 fragment, raw is the whole packet and ext its fragment header
+// the kept header is everything up to and including the fragment header, so
+// a timed out first fragment can be quoted as received
+func IPv6Fragment(raw []byte, ext packets.IPv6Extension) Fragment {
+	f := ext.Fragment()
+	end := ext.Offset + len(ext.Data)
+	return Fragment{
+		Offset:  f.Offset,
+		More:    f.More,
+		Payload: raw[end:],
+		Header:  raw[:end],
+	}
+}
+
+// turns a reassembled datagram back into a regular unfragmented packet: the
+// fragment header is dropped and the Next Header field that pointed to it
+// takes over its value
+func IPv6Datagram(d *Datagram) ([]byte, error) {
+	h := d.Header
+	unfragmentable := len(h) - 8
+	if len(h) < packets.IPv6HeaderLen+8 {
+		return nil, fmt.Errorf("short fragment header")
+	}
+	if size := unfragmentable - packets.IPv6HeaderLen + len(d.Payload); size > 65535 {
+		return nil, fmt.Errorf("reassembled payload of %d bytes exceeds 65535", size)
+	}
+
+	// only hop-by-hop, routing and destination options come before the
+	// fragment header, their lengths are in units of 8 bytes
+	nextField := 6
+	for off := packets.IPv6HeaderLen; off < unfragmentable; off += (int(h[off+1]) + 1) * 8 {
+		nextField = off
+	}
+
+	buf := make([]byte, unfragmentable+len(d.Payload))
+	copy(buf, h[:unfragmentable])
+	copy(buf[unfragmentable:], d.Payload)
+	buf[nextField] = h[unfragmentable]
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(buf)-packets.IPv6HeaderLen))
+	return buf, nil
+}
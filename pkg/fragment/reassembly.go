@@ -0,0 +1,308 @@
+package fragment
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errors reported by Add, the whole datagram is discarded on any of them
+var (
+	ErrOverlap      = errors.New("overlapping fragment")
+	ErrBadLength    = errors.New("non-final fragment length is not a multiple of 8")
+	ErrTooBig       = errors.New("reassembled datagram exceeds maximum size")
+	ErrTooMany      = errors.New("too many fragments for datagram")
+	ErrInconsistent = errors.New("fragment beyond end of datagram")
+)
+
+// identifies the datagram a fragment belongs to (RFC 791: src, dst, protocol, ID)
+// addresses are stored in 16-byte form so the same key fits IPv4 and IPv6
+type Key struct {
+	Src      [16]byte
+	Dst      [16]byte
+	Protocol uint8
+	ID       uint32
+	Zone     string // link the fragments came in on, IPv6 only (link-local addresses are per link)
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%x -> %x proto=%d id=%d", k.Src, k.Dst, k.Protocol, k.ID)
+}
+
+// a single received fragment
+type Fragment struct {
+	Offset  int    // payload offset in bytes
+	More    bool   // more fragments follow (MF flag)
+	Payload []byte // data carried by this fragment
+	Header  []byte // network header, only kept for the fragment at offset 0
+}
+
+// a reassembled datagram, or the remains of one that timed out
+type Datagram struct {
+	Key     Key
+	Header  []byte // header of the first fragment
+	Payload []byte // full payload (on timeout: only what the first fragment carried)
+}
+
+// tuning knobs, see DefaultConfig
+type Config struct {
+	Timeout      time.Duration // how long an incomplete datagram is kept
+	MaxSize      int           // max reassembled payload size in bytes
+	MaxFragments int           // max fragments accepted per datagram
+	HighThresh   int           // memory (bytes) above which old datagrams are evicted...
+	LowThresh    int           // ...until usage falls below this value
+}
+
+// mirrors the Linux defaults (ipfrag_time, ipfrag_high_thresh, ipfrag_low_thresh)
+func DefaultConfig() Config {
+	return Config{
+		Timeout:      30 * time.Second,
+		MaxSize:      65535 - 20,
+		MaxFragments: 64,
+		HighThresh:   4 * 1024 * 1024,
+		LowThresh:    3 * 1024 * 1024,
+	}
+}
+
+// the IPv6 flavor (ip6frag_time, ip6frag_high_thresh, ip6frag_low_thresh),
+// fragment offsets count from the end of the unfragmentable headers
+func DefaultConfig6() Config {
+	cfg := DefaultConfig()
+	cfg.Timeout = 60 * time.Second
+	cfg.MaxSize = 65535
+	return cfg
+}
+
+// counters exposed for debugging
+type Stats struct {
+	Reassembled uint64
+	Timeouts    uint64
+	Errors      uint64
+	Evicted     uint64
+	Pending     int
+	Memory      int
+}
+
+// [first, last] range of bytes not received yet (RFC 815)
+type hole struct {
+	first, last int
+}
+
+type piece struct {
+	offset int
+	data   []byte
+}
+
+type datagram struct {
+	key      Key
+	deadline time.Time
+	holes    []hole
+	pieces   []piece
+	size     int // total payload length, -1 until the last fragment arrives
+	mem      int
+	header   []byte
+	first    []byte
+	elem     *list.Element
+}
+
+// tracks in-flight datagrams, safe for concurrent use
+type Reassembler struct {
+	mu        sync.Mutex
+	cfg       Config
+	datagrams map[Key]*datagram
+	age       *list.List // oldest first, used for eviction
+	mem       int
+	stats     Stats
+}
+
+func NewReassembler(cfg Config) *Reassembler {
+	return &Reassembler{
+		cfg:       cfg,
+		datagrams: make(map[Key]*datagram),
+		age:       list.New(),
+	}
+}
+
+// inserts a fragment, returns the datagram once every hole has been filled
+// (nil, nil) means the fragment was queued or was an exact duplicate
+func (r *Reassembler) Add(key Key, f Fragment) (*Datagram, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.datagrams[key]
+	if !ok {
+		d = &datagram{
+			key:      key,
+			deadline: time.Now().Add(r.cfg.Timeout),
+			holes:    []hole{{first: 0, last: r.cfg.MaxSize}},
+			size:     -1,
+		}
+		d.elem = r.age.PushBack(d)
+		r.datagrams[key] = d
+	}
+
+	if err := r.insert(d, f); err != nil {
+		// RFC 5722 style: any overlap or inconsistency poisons the whole datagram
+		r.drop(d)
+		r.stats.Errors++
+		return nil, err
+	}
+
+	// still incomplete: it stays queued, so it may be the one that gets evicted
+	if d.size < 0 || len(d.holes) > 0 {
+		r.evict()
+		return nil, nil
+	}
+
+	r.drop(d)
+	r.stats.Reassembled++
+
+	payload := make([]byte, d.size)
+	for _, p := range d.pieces {
+		copy(payload[p.offset:], p.data)
+	}
+	return &Datagram{Key: key, Header: d.header, Payload: payload}, nil
+}
+
+func (r *Reassembler) insert(d *datagram, f Fragment) error {
+	first := f.Offset
+	last := f.Offset + len(f.Payload) - 1
+
+	if f.More && len(f.Payload)%8 != 0 {
+		return ErrBadLength
+	}
+	if last >= r.cfg.MaxSize {
+		return ErrTooBig
+	}
+
+	for _, p := range d.pieces {
+		pLast := p.offset + len(p.data) - 1
+		if first > pLast || last < p.offset {
+			continue
+		}
+		// identical retransmissions are harmless, anything else is an overlap
+		if first == p.offset && last == pLast {
+			return nil
+		}
+		return ErrOverlap
+	}
+
+	if len(d.pieces) >= r.cfg.MaxFragments {
+		return ErrTooMany
+	}
+
+	if !f.More {
+		// the last fragment fixes the datagram size, nothing may exist past it
+		if d.size >= 0 && d.size != last+1 {
+			return ErrInconsistent
+		}
+		d.size = last + 1
+		for _, p := range d.pieces {
+			if p.offset+len(p.data) > d.size {
+				return ErrInconsistent
+			}
+		}
+	} else if d.size >= 0 && last >= d.size {
+		return ErrInconsistent
+	}
+
+	// RFC 815 hole filling, since overlaps are rejected the fragment sits inside holes
+	var holes []hole
+	for _, h := range d.holes {
+		if first > h.last || last < h.first {
+			holes = append(holes, h)
+			continue
+		}
+		if first > h.first {
+			holes = append(holes, hole{first: h.first, last: first - 1})
+		}
+		if last < h.last && f.More {
+			holes = append(holes, hole{first: last + 1, last: h.last})
+		}
+	}
+	if d.size >= 0 {
+		// drop the open-ended tail once the size is known
+		var trimmed []hole
+		for _, h := range holes {
+			if h.first >= d.size {
+				continue
+			}
+			h.last = min(h.last, d.size-1)
+			trimmed = append(trimmed, h)
+		}
+		holes = trimmed
+	}
+	d.holes = holes
+
+	// keep our own copy, the receive buffer is reused for the next frame
+	data := append([]byte(nil), f.Payload...)
+	d.pieces = append(d.pieces, piece{offset: first, data: data})
+	d.mem += len(data)
+	r.mem += len(data)
+
+	if first == 0 {
+		d.header = append([]byte(nil), f.Header...)
+		d.first = data
+	}
+
+	return nil
+}
+
+// removes a datagram, caller holds the lock. Dropping it twice is a no-op
+func (r *Reassembler) drop(d *datagram) {
+	if d.elem == nil {
+		return
+	}
+	delete(r.datagrams, d.key)
+	r.age.Remove(d.elem)
+	d.elem = nil
+	r.mem -= d.mem
+}
+
+// evicts the oldest datagrams while memory use is above the high threshold
+func (r *Reassembler) evict() {
+	if r.mem <= r.cfg.HighThresh {
+		return
+	}
+	for r.mem > r.cfg.LowThresh && r.age.Len() > 0 {
+		r.drop(r.age.Front().Value.(*datagram))
+		r.stats.Evicted++
+	}
+}
+
+// removes datagrams whose timer ran out
+// only the ones whose first fragment arrived are returned, since that's
+// the condition for sending ICMP Time Exceeded (RFC 792, RFC 1122 3.3.2)
+func (r *Reassembler) Expire(now time.Time) []*Datagram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var expired []*Datagram
+	for e := r.age.Front(); e != nil; {
+		d := e.Value.(*datagram)
+		e = e.Next()
+		if now.Before(d.deadline) {
+			continue
+		}
+
+		r.drop(d)
+		r.stats.Timeouts++
+		if d.header != nil {
+			expired = append(expired, &Datagram{Key: d.key, Header: d.header, Payload: d.first})
+		}
+	}
+
+	return expired
+}
+
+func (r *Reassembler) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stats
+	s.Pending = len(r.datagrams)
+	s.Memory = r.mem
+	return s
+}
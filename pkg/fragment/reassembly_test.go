@@ -0,0 +1,119 @@
+package fragment
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+func key(id uint32) Key {
+	return Key{Protocol: packets.ProtocolUDP, ID: id}
+}
+
+func frag(offset int, more bool, size int) Fragment {
+	return Fragment{Offset: offset, More: more, Payload: bytes.Repeat([]byte{byte(offset / 8)}, size), Header: []byte{0x45}}
+}
+
+func TestReassemblerAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		frags []Fragment
+		size  int // reassembled payload size, 0 if nothing completes
+		err   error
+	}{
+		{"in order", []Fragment{frag(0, true, 16), frag(16, false, 8)}, 24, nil},
+		{"reversed", []Fragment{frag(16, false, 8), frag(8, true, 8), frag(0, true, 8)}, 24, nil},
+		{"exact duplicate", []Fragment{frag(0, true, 16), frag(0, true, 16), frag(16, false, 4)}, 20, nil},
+		{"missing middle", []Fragment{frag(0, true, 8), frag(16, false, 8)}, 0, nil},
+		{"overlap", []Fragment{frag(0, true, 16), frag(8, true, 16)}, 0, ErrOverlap},
+		{"odd length", []Fragment{frag(0, true, 12)}, 0, ErrBadLength},
+		{"past the end", []Fragment{frag(8, false, 8), frag(16, true, 8)}, 0, ErrInconsistent},
+		{"oversize", []Fragment{frag(65512, false, 16)}, 0, ErrTooBig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(DefaultConfig())
+			var got *Datagram
+			var err error
+			for _, f := range tt.frags {
+				if got, err = r.Add(key(1), f); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.size == 0 {
+				if got != nil {
+					t.Fatalf("got a datagram of %d bytes, want none", len(got.Payload))
+				}
+			} else if got == nil || len(got.Payload) != tt.size {
+				t.Fatalf("got %v, want %d bytes", got, tt.size)
+			}
+
+			// finished or failed datagrams must give their memory back
+			if s := r.Stats(); got != nil || err != nil {
+				if s.Pending != 0 || s.Memory != 0 {
+					t.Fatalf("pending=%d memory=%d after completion", s.Pending, s.Memory)
+				}
+			}
+		})
+	}
+}
+
+func TestReassemblerEvict(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HighThresh = 64
+	cfg.LowThresh = 48
+	r := NewReassembler(cfg)
+
+	// two incomplete datagrams push memory over the high threshold, the oldest goes
+	r.Add(key(1), frag(0, true, 40))
+	r.Add(key(2), frag(0, true, 40))
+	if s := r.Stats(); s.Pending != 1 || s.Evicted != 1 || s.Memory != 40 {
+		t.Fatalf("after eviction: %+v", s)
+	}
+	if d, _ := r.Add(key(1), frag(40, false, 8)); d != nil {
+		t.Fatal("evicted datagram completed")
+	}
+
+	// a fragment that completes a datagram above the threshold is returned,
+	// not evicted and then dropped a second time
+	r = NewReassembler(cfg)
+	r.Add(key(3), frag(0, true, 56))
+	d, err := r.Add(key(3), frag(56, false, 16))
+	if err != nil || d == nil || len(d.Payload) != 72 {
+		t.Fatalf("completing datagram: %v, %v", d, err)
+	}
+	if s := r.Stats(); s.Memory != 0 || s.Pending != 0 || s.Evicted != 0 {
+		t.Fatalf("after completion: %+v", s)
+	}
+}
+
+func TestReassemblerExpire(t *testing.T) {
+	r := NewReassembler(DefaultConfig())
+	r.Add(key(1), frag(0, true, 8))
+	r.Add(key(2), frag(8, false, 8))
+
+	// both go, only the one holding the first fragment can be quoted
+	expired := r.Expire(time.Now().Add(time.Minute))
+	if len(expired) != 1 || expired[0].Key != key(1) {
+		t.Fatalf("expired %v", expired)
+	}
+	if s := r.Stats(); s.Pending != 0 || s.Memory != 0 || s.Timeouts != 2 {
+		t.Fatalf("after expiry: %+v", s)
+	}
+}
+
+func TestIPv4DatagramTooBig(t *testing.T) {
+	header := make([]byte, 60)
+	header[0] = 0x4f
+	d := &Datagram{Header: header, Payload: make([]byte, DefaultConfig().MaxSize)}
+	if _, err := IPv4Datagram(d); err == nil {
+		t.Fatal("65575 byte datagram accepted")
+	}
+}
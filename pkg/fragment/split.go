@@ -0,0 +1,108 @@
+package fragment
+
+import (
+	"errors"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// returned when a packet doesn't fit the MTU but DF forbids fragmenting it
+var ErrFragmentationNeeded = errors.New("packet exceeds MTU and DF is set")
+
+// serializes ip+payload into one or more packets that fit in mtu (RFC 791 3.2)
+// a packet that is already a fragment (e.g. being forwarded) is split relative
+// to its own offset, and only "copied" options are repeated after the first piece
+func SplitIPv4(ip *packets.IPv4Header, payload []byte, mtu int) ([][]byte, error) {
+	if ip.HeaderLen()+len(payload) <= mtu {
+		ip.TotalLength = uint16(ip.HeaderLen() + len(payload))
+		hdr, err := ip.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{append(hdr, payload...)}, nil
+	}
+
+	if ip.Flags&packets.IPv4FlagDF != 0 {
+		return nil, ErrFragmentationNeeded
+	}
+
+	var copied []packets.IPv4Option
+	for _, o := range ip.Options {
+		if o.Copied() {
+			copied = append(copied, o)
+		}
+	}
+
+	baseOffset := int(ip.FragmentOffset) * 8
+	moreAfter := ip.Flags&packets.IPv4FlagMF != 0
+
+	var pkts [][]byte
+	for off := 0; off < len(payload); {
+		frag := *ip
+		if off > 0 {
+			frag.Options = copied
+		}
+
+		headerLen := frag.HeaderLen()
+		// every fragment but the last must carry a multiple of 8 bytes
+		maxData := (mtu - headerLen) &^ 7
+		if maxData <= 0 {
+			return nil, errors.New("MTU too small to fragment")
+		}
+
+		n := min(maxData, len(payload)-off)
+		last := off+n == len(payload)
+
+		frag.FragmentOffset = uint16((baseOffset + off) / 8)
+		frag.Flags &^= packets.IPv4FlagMF
+		if !last || moreAfter {
+			frag.Flags |= packets.IPv4FlagMF
+		}
+		frag.TotalLength = uint16(headerLen + n)
+
+		hdr, err := frag.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		pkts = append(pkts, append(hdr, payload[off:off+n]...))
+		off += n
+	}
+
+	return pkts, nil
+}
+
+// serializes ip+payload into one or more packets that fit in mtu (RFC 8200 4.5)
+// only the source fragments in IPv6, every piece gets a fragment header with
+// id. The payload is treated as fragmentable as a whole, so ip must not carry
+// extension headers of its own
+func SplitIPv6(ip *packets.IPv6Header, payload []byte, mtu int, id uint32) ([][]byte, error) {
+	if packets.IPv6HeaderLen+len(payload) <= mtu {
+		ip.PayloadLength = uint16(len(payload))
+		return [][]byte{append(ip.Bytes(), payload...)}, nil
+	}
+
+	maxData := (mtu - packets.IPv6HeaderLen - 8) &^ 7
+	if maxData <= 0 {
+		return nil, errors.New("MTU too small to fragment")
+	}
+	if len(payload) > 65535 {
+		return nil, errors.New("payload exceeds 65535 bytes")
+	}
+
+	next := ip.NextHeader
+	var pkts [][]byte
+	for off := 0; off < len(payload); {
+		n := min(maxData, len(payload)-off)
+
+		frag := *ip
+		frag.NextHeader = packets.ProtocolFragment
+		frag.PayloadLength = uint16(8 + n)
+		f := packets.IPv6Fragment{Offset: off, More: off+n < len(payload), Identification: id}
+
+		pkt := append(frag.Bytes(), f.Bytes(next)...)
+		pkts = append(pkts, append(pkt, payload[off:off+n]...))
+		off += n
+	}
+
+	return pkts, nil
+}
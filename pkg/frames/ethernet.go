@@ -3,6 +3,7 @@ package frames
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 )
 
 // common EtherTypes (Big Endian)
@@ -76,3 +77,20 @@ func (e *EthernetFrame) Bytes() []byte {
 
 	return buf
 }
+
+// maps an IPv4 multicast group to its Ethernet address: 01:00:5e + low 23 bits (RFC 1112 6.4)
+func IPv4MulticastMAC(ip net.IP) [6]byte {
+	ip4 := ip.To4()
+	return [6]byte{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+}
+
+// reports whether the group bit is set (multicast or broadcast destination)
+func IsMulticastMAC(mac [6]byte) bool {
+	return mac[0]&0x01 != 0
+}
+
+// maps an IPv6 multicast address to its Ethernet address: 33:33 + low 32 bits (RFC 2464 7)
+func IPv6MulticastMAC(ip net.IP) [6]byte {
+	ip6 := ip.To16()
+	return [6]byte{0x33, 0x33, ip6[12], ip6[13], ip6[14], ip6[15]}
+}
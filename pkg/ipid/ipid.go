@@ -0,0 +1,55 @@
+package ipid
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+)
+
+// number of counters, a power of two like the Linux ip_idents table
+const buckets = 2048
+
+// hands out IPv4 and IPv6 fragment Identification values, safe for concurrent use
+//
+// a single global counter leaks how much traffic we send to everybody and
+// lets an observer link our packets together. Instead (like modern kernels)
+// (src, dst, protocol) is hashed with a secret seed to pick one of many
+// counters, each starting at a random value. A given destination sees a
+// plain incrementing sequence, which is all reassembly needs (RFC 6864)
+type Generator struct {
+	seed     maphash.Seed // the secret, random per generator
+	counters [buckets]atomic.Uint32
+}
+
+func New() *Generator {
+	g := &Generator{seed: maphash.MakeSeed()}
+	for i := range g.counters {
+		g.counters[i].Store(rand.Uint32())
+	}
+	return g
+}
+
+// returns the next Identification for a packet from src to dst
+func (g *Generator) Next(src, dst net.IP, protocol uint8) uint16 {
+	var h maphash.Hash
+	h.SetSeed(g.seed)
+	h.Write(src.To16())
+	h.Write(dst.To16())
+	h.WriteByte(protocol)
+
+	bucket := h.Sum64() % buckets
+	return uint16(g.counters[bucket].Add(1))
+}
+
+// returns the next Fragment Identification for an IPv6 packet from src to dst,
+// the full 32 bits of the same counters (RFC 7739 5.1)
+func (g *Generator) Next6(src, dst net.IP) uint32 {
+	var h maphash.Hash
+	h.SetSeed(g.seed)
+	h.Write(src.To16())
+	h.Write(dst.To16())
+
+	bucket := h.Sum64() % buckets
+	return g.counters[bucket].Add(1)
+}
@@ -0,0 +1,323 @@
+package ipsec
+
+import (
+	"cmp"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// which traffic a policy applies to
+type Direction int
+
+const (
+	In Direction = iota
+	Out
+)
+
+func (d Direction) String() string {
+	if d == Out {
+		return "out"
+	}
+	return "in"
+}
+
+// what a policy does with matching traffic (RFC 4301 4.4.1)
+type Action int
+
+const (
+	Protect Action = iota // must go through the policy's SA
+	Bypass                // goes in the clear
+	Discard
+)
+
+var actionNames = []string{"protect", "bypass", "discard"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return "unknown"
+	}
+	return actionNames[a]
+}
+
+// a security policy: packets matching the selectors are protected, let
+// through or dropped. Like with ip xfrm a policy covers a single address
+// family, that of its prefixes or IPv4 when it has none; SAs carry IPv4, so
+// IPv6 policies can only bypass or discard
+type Policy struct {
+	Dir      Direction
+	Src      *net.IPNet // nil matches anything
+	Dst      *net.IPNet
+	Protocol uint8 // 0 matches any
+	Action   Action
+	SPI      uint32 // SA used by Protect
+}
+
+func (p *Policy) Matches(src, dst net.IP, protocol uint8) bool {
+	return p.IPv6() == (src.To4() == nil) &&
+		(p.Src == nil || p.Src.Contains(src)) &&
+		(p.Dst == nil || p.Dst.Contains(dst)) &&
+		(p.Protocol == 0 || p.Protocol == protocol)
+}
+
+// reports whether the policy applies to IPv6 rather than IPv4
+func (p *Policy) IPv6() bool {
+	return p.Src != nil && p.Src.IP.To4() == nil || p.Dst != nil && p.Dst.IP.To4() == nil
+}
+
+func (p *Policy) String() string {
+	s := p.Dir.String()
+	if p.Src != nil {
+		s += " src " + p.Src.String()
+	}
+	if p.Dst != nil {
+		s += " dst " + p.Dst.String()
+	}
+	if p.Protocol != 0 {
+		s += fmt.Sprintf(" proto %d", p.Protocol)
+	}
+	if p.Action == Protect {
+		return s + fmt.Sprintf(" spi 0x%x", p.SPI)
+	}
+	return s + " " + p.Action.String()
+}
+
+// the security association and security policy databases, safe for concurrent use
+// manual keying keeps SPIs unique, so SAs are found by SPI alone
+type Database struct {
+	mu       sync.RWMutex
+	sas      map[uint32]*SA
+	policies []*Policy // in lookup order
+}
+
+func NewDatabase() *Database {
+	return &Database{sas: make(map[uint32]*SA)}
+}
+
+func (d *Database) AddSA(sa *SA) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.sas[sa.SPI]; ok {
+		return fmt.Errorf("SPI 0x%x already in use", sa.SPI)
+	}
+	d.sas[sa.SPI] = sa
+	return nil
+}
+
+// appends a policy, the SA of a Protect policy must exist already
+func (d *Database) AddPolicy(p *Policy) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p.Action == Protect {
+		if _, ok := d.sas[p.SPI]; !ok {
+			return fmt.Errorf("no SA with SPI 0x%x", p.SPI)
+		}
+	}
+	d.policies = append(d.policies, p)
+	return nil
+}
+
+func (d *Database) SA(spi uint32) (*SA, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	sa, ok := d.sas[spi]
+	return sa, ok
+}
+
+// returns the first policy of a direction matching a packet, and its SA for Protect
+func (d *Database) Lookup(dir Direction, src, dst net.IP, protocol uint8) (*Policy, *SA, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, p := range d.policies {
+		if p.Dir == dir && p.Matches(src, dst, protocol) {
+			return p, d.sas[p.SPI], true
+		}
+	}
+	return nil, nil, false
+}
+
+// reports whether any policy is configured, so traffic can skip lookups otherwise
+func (d *Database) Active() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return len(d.policies) > 0
+}
+
+// returns every SA, sorted by SPI
+func (d *Database) SAs() []*SA {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	list := make([]*SA, 0, len(d.sas))
+	for _, sa := range d.sas {
+		list = append(list, sa)
+	}
+	slices.SortFunc(list, func(a, b *SA) int { return cmp.Compare(a.SPI, b.SPI) })
+	return list
+}
+
+func (d *Database) Policies() []*Policy {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return slices.Clone(d.policies)
+}
+
+// parses an SA in `ip xfrm state` spirit:
+// spi SPI src ADDR dst ADDR [mode transport|tunnel] key HEX
+func ParseSA(s string) (*SA, error) {
+	var spi uint32
+	var src, dst net.IP
+	var key []byte
+	mode := Transport
+
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("missing value for %q", fields[i])
+		}
+		val := fields[i+1]
+		switch fields[i] {
+		case "spi":
+			n, err := strconv.ParseUint(val, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid spi %q", val)
+			}
+			spi = uint32(n)
+		case "src", "dst":
+			ip := net.ParseIP(val).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", val)
+			}
+			if fields[i] == "src" {
+				src = ip
+			} else {
+				dst = ip
+			}
+		case "mode":
+			switch val {
+			case "transport":
+				mode = Transport
+			case "tunnel":
+				mode = Tunnel
+			default:
+				return nil, fmt.Errorf("unknown mode %q", val)
+			}
+		case "key":
+			k, err := hex.DecodeString(strings.TrimPrefix(val, "0x"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid key: %v", err)
+			}
+			key = k
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", fields[i])
+		}
+	}
+
+	if src == nil || dst == nil || key == nil {
+		return nil, fmt.Errorf("an SA needs spi, src, dst and key")
+	}
+	return NewSA(spi, src, dst, mode, key)
+}
+
+// parses a policy in `ip xfrm policy` spirit:
+// in|out [src PREFIX] [dst PREFIX] [proto tcp|udp|icmp|N] spi SPI|bypass|discard
+func ParsePolicy(s string) (*Policy, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected in|out, selectors and spi N, bypass or discard")
+	}
+
+	p := &Policy{}
+	switch fields[0] {
+	case "in":
+		p.Dir = In
+	case "out":
+		p.Dir = Out
+	default:
+		return nil, fmt.Errorf("unknown direction %q", fields[0])
+	}
+
+	switch last := fields[len(fields)-1]; last {
+	case "bypass":
+		p.Action = Bypass
+		fields = fields[:len(fields)-1]
+	case "discard":
+		p.Action = Discard
+		fields = fields[:len(fields)-1]
+	}
+
+	hasSPI := false
+	for i := 1; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("missing value for %q", fields[i])
+		}
+		val := fields[i+1]
+		switch fields[i] {
+		case "src", "dst":
+			_, prefix, err := net.ParseCIDR(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix %q", val)
+			}
+			if fields[i] == "src" {
+				p.Src = prefix
+			} else {
+				p.Dst = prefix
+			}
+		case "proto":
+			proto, err := parseProtocol(val)
+			if err != nil {
+				return nil, err
+			}
+			p.Protocol = proto
+		case "spi":
+			n, err := strconv.ParseUint(val, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid spi %q", val)
+			}
+			p.SPI, hasSPI = uint32(n), true
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", fields[i])
+		}
+	}
+
+	if hasSPI == (p.Action != Protect) {
+		return nil, fmt.Errorf("a policy needs either spi N, bypass or discard")
+	}
+	if p.Src != nil && p.Dst != nil && (p.Src.IP.To4() == nil) != (p.Dst.IP.To4() == nil) {
+		return nil, fmt.Errorf("src and dst must be of the same address family")
+	}
+	if p.Action == Protect && p.IPv6() {
+		return nil, fmt.Errorf("SAs only carry IPv4, IPv6 traffic can be bypassed or discarded")
+	}
+	return p, nil
+}
+
+func parseProtocol(s string) (uint8, error) {
+	switch s {
+	case "any":
+		return 0, nil
+	case "icmp":
+		return packets.ProtocolICMP, nil
+	case "tcp":
+		return packets.ProtocolTCP, nil
+	case "udp":
+		return packets.ProtocolUDP, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %q", s)
+	}
+	return uint8(n), nil
+}
@@ -0,0 +1,44 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+func TestPolicyFamily(t *testing.T) {
+	v6Src, v6Dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	tests := []struct {
+		policy   string
+		src, dst net.IP
+		want     bool
+	}{
+		// a policy without prefixes is IPv4's, so it leaves neighbor discovery alone
+		{"in discard", local, peer, true},
+		{"in discard", v6Src, v6Dst, false},
+		{"in src 0.0.0.0/0 discard", v6Src, v6Dst, false},
+		{"in src ::/0 discard", v6Src, v6Dst, true},
+		{"in src ::/0 discard", local, peer, false},
+		{"in dst 2001:db8::/64 proto tcp discard", v6Src, v6Dst, true},
+		{"in dst 2001:db8:1::/64 proto tcp discard", v6Src, v6Dst, false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.policy, err)
+		}
+		if got := p.Matches(tt.src, tt.dst, packets.ProtocolTCP); got != tt.want {
+			t.Errorf("%q matching %s -> %s: got %v", tt.policy, tt.src, tt.dst, got)
+		}
+	}
+
+	for _, s := range []string{
+		"out dst 2001:db8::/64 spi 0x1001",
+		"out src 192.0.2.0/24 dst 2001:db8::/64 bypass",
+	} {
+		if _, err := ParsePolicy(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package multicast
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// source filter mode (RFC 3376 3.1)
+type FilterMode int
+
+const (
+	Include FilterMode = iota // only traffic from the listed sources
+	Exclude                   // traffic from everybody but the listed sources
+)
+
+func (m FilterMode) String() string {
+	if m == Exclude {
+		return "EXCLUDE"
+	}
+	return "INCLUDE"
+}
+
+// per-listener or per-interface reception state for a group
+// Include with no sources means "not a member", Exclude with no sources is a
+// plain any-source join (what IP_ADD_MEMBERSHIP does)
+type Filter struct {
+	Mode    FilterMode
+	Sources []net.IP
+}
+
+// any-source membership
+func JoinAll() Filter {
+	return Filter{Mode: Exclude}
+}
+
+// reports whether the filter receives anything at all
+func (f Filter) Member() bool {
+	return f.Mode == Exclude || len(f.Sources) > 0
+}
+
+// reports whether traffic from src passes the filter
+func (f Filter) Allows(src net.IP) bool {
+	if f.Mode == Include {
+		return contains(f.Sources, src)
+	}
+	return !contains(f.Sources, src)
+}
+
+func (f Filter) Equal(other Filter) bool {
+	if f.Mode != other.Mode || len(f.Sources) != len(other.Sources) {
+		return false
+	}
+	for _, src := range f.Sources {
+		if !contains(other.Sources, src) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Filter) String() string {
+	return fmt.Sprintf("%s %v", f.Mode, f.Sources)
+}
+
+// merges the filters of every listener into the interface state (RFC 3376 3.2):
+// if anybody excludes, the result excludes what all excluders agree on minus
+// what anybody includes, otherwise it includes the union of everything
+func Merge(filters []Filter) Filter {
+	var excludes []Filter
+	var included []net.IP
+	for _, f := range filters {
+		if f.Mode == Exclude {
+			excludes = append(excludes, f)
+		} else {
+			included = union(included, f.Sources)
+		}
+	}
+
+	if len(excludes) == 0 {
+		return Filter{Mode: Include, Sources: included}
+	}
+
+	excluded := slices.Clone(excludes[0].Sources)
+	for _, f := range excludes[1:] {
+		excluded = intersect(excluded, f.Sources)
+	}
+	return Filter{Mode: Exclude, Sources: diff(excluded, included)}
+}
+
+func contains(list []net.IP, ip net.IP) bool {
+	return slices.ContainsFunc(list, ip.Equal)
+}
+
+func union(a, b []net.IP) []net.IP {
+	out := slices.Clone(a)
+	for _, ip := range b {
+		if !contains(out, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+func intersect(a, b []net.IP) []net.IP {
+	var out []net.IP
+	for _, ip := range a {
+		if contains(b, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// a - b
+func diff(a, b []net.IP) []net.IP {
+	var out []net.IP
+	for _, ip := range a {
+		if !contains(b, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
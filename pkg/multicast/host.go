@@ -0,0 +1,366 @@
+package multicast
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// protocol defaults, the same for IGMPv3 (RFC 3376 8) and MLDv2 (RFC 3810 9)
+const (
+	Robustness                = 2
+	QueryInterval             = 125 * time.Second
+	QueryResponseInterval     = 10 * time.Second
+	UnsolicitedReportInterval = time.Second
+	// how long we stay in compatibility mode (IGMPv2, MLDv1) after hearing an older query
+	OlderQuerierTimeout = Robustness*QueryInterval + QueryResponseInterval
+)
+
+// a group record of a report, before it is encoded for IGMP or MLD
+type Record struct {
+	Type    uint8 // packets.ModeIsInclude ... packets.BlockOldSources
+	Group   net.IP
+	Sources []net.IP
+}
+
+// a message the stack must send on the interface, see IGMPHost and MLDHost
+// for how (addresses, TTL, Router Alert)
+type Message struct {
+	Dst  net.IP
+	Data []byte
+	Type uint8 // ICMPv6 type of MLD messages, whose Data is the ICMPv6 body
+}
+
+// interface state of a group, for listing
+type Membership struct {
+	Group  net.IP
+	Filter Filter
+}
+
+// the messages of one protocol, everything else is shared
+type protocol interface {
+	report(records []Record) Message // current state or state change report
+	oldReport(group net.IP) Message  // IGMPv2 / MLDv1 report
+	oldLeave(group net.IP) Message   // IGMPv2 leave / MLDv1 done
+	silent(group net.IP) bool        // groups that are never reported
+}
+
+type group struct {
+	addr      net.IP
+	listeners map[any]Filter
+	state     Filter // merged interface state
+
+	// pending answer to a group specific query (zero time = none)
+	reportAt     time.Time
+	querySources []net.IP // for group-and-source specific queries, nil = whole group
+
+	// state change report retransmissions (RFC 3376 5.1)
+	change     []Record
+	changeLeft int
+	changeAt   time.Time
+}
+
+// host side of IGMPv3/MLDv2 for one interface, safe for concurrent use
+// it merges the filters of every listener, answers queries and emits reports;
+// sending is up to the caller, which gets Messages back from every method
+type host struct {
+	mu     sync.Mutex
+	proto  protocol
+	groups map[string]*group
+
+	oldUntil  time.Time // compatibility mode while an older querier is around
+	generalAt time.Time // pending answer to a general query
+
+	// called when the interface joins or leaves a group, to update the MAC filter
+	onChange func(group net.IP, member bool)
+}
+
+func newHost(proto protocol, onChange func(group net.IP, member bool)) host {
+	return host{proto: proto, groups: make(map[string]*group), onChange: onChange}
+}
+
+func groupKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// IPv4 groups are kept in 4 byte form
+func groupAddr(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// random delay in [0, max)
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+func (h *host) compatOld(now time.Time) bool {
+	return now.Before(h.oldUntil)
+}
+
+// sets the filter of one listener (e.g. a socket) for a group
+// Include with no sources removes the listener
+func (h *host) SetFilter(listener any, addr net.IP, f Filter) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	key := groupKey(addr)
+	g, ok := h.groups[key]
+	if !ok {
+		if !f.Member() {
+			return nil
+		}
+		g = &group{addr: groupAddr(addr), listeners: make(map[any]Filter)}
+		h.groups[key] = g
+	}
+
+	if f.Member() {
+		g.listeners[listener] = f
+	} else {
+		delete(g.listeners, listener)
+	}
+
+	var filters []Filter
+	for _, lf := range g.listeners {
+		filters = append(filters, lf)
+	}
+	old := g.state
+	g.state = Merge(filters)
+	if old.Equal(g.state) {
+		return nil
+	}
+
+	if !old.Member() && g.state.Member() && h.onChange != nil {
+		h.onChange(g.addr, true)
+	}
+	if old.Member() && !g.state.Member() && h.onChange != nil {
+		h.onChange(g.addr, false)
+	}
+
+	if h.proto.silent(g.addr) {
+		return nil
+	}
+
+	if h.compatOld(now) {
+		return h.changeOld(g, old, now)
+	}
+
+	// state change report now, then Robustness-1 retransmissions
+	g.change = changeRecords(g.addr, old, g.state)
+	if len(g.change) == 0 {
+		return nil
+	}
+	g.changeLeft = Robustness - 1
+	g.changeAt = now.Add(randomDelay(UnsolicitedReportInterval))
+	return []Message{h.proto.report(g.change)}
+}
+
+// older hosts only know joins and leaves, source lists are ignored
+func (h *host) changeOld(g *group, old Filter, now time.Time) []Message {
+	switch {
+	case !old.Member() && g.state.Member():
+		g.change = nil
+		g.changeLeft = Robustness - 1
+		g.changeAt = now.Add(randomDelay(UnsolicitedReportInterval))
+		return []Message{h.proto.oldReport(g.addr)}
+	case old.Member() && !g.state.Member():
+		g.changeLeft = 0
+		return []Message{h.proto.oldLeave(g.addr)}
+	}
+	return nil
+}
+
+// records describing the move from old to new interface state (RFC 3376 5.1)
+func changeRecords(addr net.IP, old, new Filter) []Record {
+	if old.Mode != new.Mode {
+		recType := uint8(packets.ChangeToInclude)
+		if new.Mode == Exclude {
+			recType = packets.ChangeToExclude
+		}
+		return []Record{{Type: recType, Group: addr, Sources: new.Sources}}
+	}
+
+	allow, block := diff(new.Sources, old.Sources), diff(old.Sources, new.Sources)
+	if new.Mode == Exclude {
+		allow, block = block, allow
+	}
+
+	var records []Record
+	if len(allow) > 0 {
+		records = append(records, Record{Type: packets.AllowNewSources, Group: addr, Sources: allow})
+	}
+	if len(block) > 0 {
+		records = append(records, Record{Type: packets.BlockOldSources, Group: addr, Sources: block})
+	}
+	return records
+}
+
+// current state record of a group, optionally narrowed to the sources a query asked about
+func currentRecord(g *group, querySources []net.IP) (Record, bool) {
+	if querySources == nil {
+		recType := uint8(packets.ModeIsInclude)
+		if g.state.Mode == Exclude {
+			recType = packets.ModeIsExclude
+		}
+		return Record{Type: recType, Group: g.addr, Sources: g.state.Sources}, true
+	}
+
+	// RFC 3376 5.2: report which of the queried sources we still want
+	var wanted []net.IP
+	if g.state.Mode == Include {
+		wanted = intersect(g.state.Sources, querySources)
+	} else {
+		wanted = diff(querySources, g.state.Sources)
+	}
+	if len(wanted) == 0 {
+		return Record{}, false
+	}
+	return Record{Type: packets.ModeIsInclude, Group: g.addr, Sources: wanted}, true
+}
+
+// schedules the answer to a query for addr (unspecified for a general query)
+// sent by an older querier when old is set
+func (h *host) handleQuery(addr net.IP, sources []net.IP, maxResp time.Duration, old bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if old {
+		h.oldUntil = now.Add(OlderQuerierTimeout)
+		h.generalAt = time.Time{}
+	}
+	at := now.Add(randomDelay(maxResp))
+	general := addr.IsUnspecified()
+
+	// v3/v2 general queries get a single report covering every group
+	if general && !h.compatOld(now) {
+		if h.generalAt.IsZero() || at.Before(h.generalAt) {
+			h.generalAt = at
+		}
+		return
+	}
+
+	for _, g := range h.groups {
+		if !g.state.Member() || h.proto.silent(g.addr) {
+			continue
+		}
+		if !general && !g.addr.Equal(addr) {
+			continue
+		}
+
+		pendingWholeGroup := !g.reportAt.IsZero() && g.querySources == nil
+		switch {
+		case len(sources) == 0 || h.compatOld(now):
+			g.querySources = nil
+		case g.reportAt.IsZero():
+			g.querySources = append([]net.IP(nil), sources...)
+		case !pendingWholeGroup:
+			g.querySources = union(g.querySources, sources)
+		}
+		if g.reportAt.IsZero() || at.Before(g.reportAt) {
+			g.reportAt = at
+		}
+	}
+}
+
+// another host reported the group: in compatibility mode our own report is
+// suppressed (RFC 2236 3, RFC 2710 4)
+func (h *host) HandleReport(addr net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.compatOld(time.Now()) {
+		return
+	}
+	if g, ok := h.groups[groupKey(addr)]; ok {
+		g.reportAt = time.Time{}
+	}
+}
+
+// fires pending reports, must be called periodically (e.g. every 100ms)
+func (h *host) Tick(now time.Time) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var msgs []Message
+	old := h.compatOld(now)
+
+	if !h.generalAt.IsZero() && !now.Before(h.generalAt) {
+		h.generalAt = time.Time{}
+		var records []Record
+		for _, g := range h.groups {
+			if g.state.Member() && !h.proto.silent(g.addr) {
+				rec, _ := currentRecord(g, nil)
+				records = append(records, rec)
+			}
+		}
+		if len(records) > 0 {
+			msgs = append(msgs, h.proto.report(records))
+		}
+	}
+
+	var records []Record
+	for key, g := range h.groups {
+		if !g.reportAt.IsZero() && !now.Before(g.reportAt) {
+			g.reportAt = time.Time{}
+			if old {
+				msgs = append(msgs, h.proto.oldReport(g.addr))
+			} else if rec, ok := currentRecord(g, g.querySources); ok {
+				records = append(records, rec)
+			}
+			g.querySources = nil
+		}
+
+		if g.changeLeft > 0 && !now.Before(g.changeAt) {
+			g.changeLeft--
+			g.changeAt = now.Add(randomDelay(UnsolicitedReportInterval))
+			if old {
+				msgs = append(msgs, h.proto.oldReport(g.addr))
+			} else {
+				msgs = append(msgs, h.proto.report(g.change))
+			}
+		}
+
+		// forget groups we left once their last retransmission went out
+		if !g.state.Member() && g.changeLeft == 0 {
+			delete(h.groups, key)
+		}
+	}
+	if len(records) > 0 {
+		msgs = append(msgs, h.proto.report(records))
+	}
+
+	return msgs
+}
+
+// reports whether traffic from src to addr is wanted on this interface
+func (h *host) member(addr, src net.IP) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	g, ok := h.groups[groupKey(addr)]
+	return ok && g.state.Member() && g.state.Allows(src)
+}
+
+// returns the interface state of every joined group
+func (h *host) Memberships() []Membership {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var list []Membership
+	for _, g := range h.groups {
+		if g.state.Member() {
+			list = append(list, Membership{Group: g.addr, Filter: g.state})
+		}
+	}
+	return list
+}
@@ -0,0 +1,58 @@
+package multicast
+
+import (
+	"net"
+	"time"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// IGMP host side for one interface (RFC 2236, RFC 3376), safe for concurrent use
+// its Messages are sent with IP TTL 1 and Router Alert, from the NIC's address
+type IGMPHost struct {
+	host
+}
+
+func NewIGMPHost(onChange func(group net.IP, member bool)) *IGMPHost {
+	return &IGMPHost{host: newHost(igmp{}, onChange)}
+}
+
+// schedules the answer to a membership query
+func (h *IGMPHost) HandleQuery(q *packets.IGMPMessage) {
+	group := q.Group
+	if group.Equal(net.IPv4zero) {
+		group = net.IPv6unspecified
+	}
+	h.handleQuery(group, q.Sources, time.Duration(q.MaxRespTime())*100*time.Millisecond, q.Version < 3)
+}
+
+// reports whether traffic from src to addr is wanted on this interface
+// the all-hosts group is always joined (RFC 1112)
+func (h *IGMPHost) Accepts(addr, src net.IP) bool {
+	return addr.Equal(packets.IGMPAllHosts) || h.member(addr, src)
+}
+
+type igmp struct{}
+
+func (igmp) report(records []Record) Message {
+	report := packets.IGMPv3Report{}
+	for _, r := range records {
+		report.Records = append(report.Records, packets.IGMPv3GroupRecord{Type: r.Type, Group: r.Group, Sources: r.Sources})
+	}
+	return Message{Dst: packets.IGMPv3Routers, Data: report.Bytes()}
+}
+
+func (igmp) oldReport(group net.IP) Message {
+	msg := packets.IGMPMessage{Type: packets.IGMPv2MembershipReport, Group: group}
+	return Message{Dst: group, Data: msg.Bytes()}
+}
+
+func (igmp) oldLeave(group net.IP) Message {
+	msg := packets.IGMPMessage{Type: packets.IGMPv2LeaveGroup, Group: group}
+	return Message{Dst: packets.IGMPAllRouters, Data: msg.Bytes()}
+}
+
+// the all-hosts group is never reported (RFC 3376 5)
+func (igmp) silent(group net.IP) bool {
+	return group.Equal(packets.IGMPAllHosts)
+}
@@ -0,0 +1,56 @@
+package multicast
+
+import (
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// MLD host side for one interface (RFC 2710, RFC 3810), safe for concurrent use
+// its Messages are ICMPv6 bodies, sent with hop limit 1 and a Router Alert
+// from the NIC's link-local address
+type MLDHost struct {
+	host
+}
+
+func NewMLDHost(onChange func(group net.IP, member bool)) *MLDHost {
+	return &MLDHost{host: newHost(mld{}, onChange)}
+}
+
+// schedules the answer to a query
+func (h *MLDHost) HandleQuery(q *packets.MLDMessage) {
+	h.handleQuery(q.Group, q.Sources, q.MaxRespDelay(), q.Version < 2)
+}
+
+// reports whether traffic from src to addr is wanted on this interface
+// the link-scope all-nodes group is always joined (RFC 4291 2.7.1)
+func (h *MLDHost) Accepts(addr, src net.IP) bool {
+	return addr.Equal(net.IPv6linklocalallnodes) || h.member(addr, src)
+}
+
+type mld struct{}
+
+func (mld) report(records []Record) Message {
+	report := packets.MLDv2Report{}
+	for _, r := range records {
+		report.Records = append(report.Records, packets.MLDv2Record{Type: r.Type, Group: r.Group, Sources: r.Sources})
+	}
+	return Message{Dst: packets.MLDv2Routers, Data: report.Bytes(), Type: packets.MLDv2ListenerReport}
+}
+
+func (mld) oldReport(group net.IP) Message {
+	msg := packets.MLDMessage{Type: packets.MLDv1ListenerReport, Group: group}
+	return Message{Dst: group, Data: msg.Bytes(), Type: msg.Type}
+}
+
+func (mld) oldLeave(group net.IP) Message {
+	msg := packets.MLDMessage{Type: packets.MLDListenerDone, Group: group}
+	return Message{Dst: packets.MLDAllRouters, Data: msg.Bytes(), Type: msg.Type}
+}
+
+// the all-nodes group and groups of reserved or interface-local scope are
+// never reported (RFC 3810 6)
+func (mld) silent(group net.IP) bool {
+	scope := group[1] & 0x0f
+	return group.Equal(net.IPv6linklocalallnodes) || scope <= 1
+}
@@ -0,0 +1,229 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+// what a rule does to the first packet of a connection
+type Action int
+
+const (
+	SNAT       Action = iota // rewrite the source to a fixed address
+	Masquerade               // rewrite the source to the outgoing interface's address
+	DNAT                     // rewrite the destination (port forwarding)
+)
+
+func (a Action) String() string {
+	switch a {
+	case SNAT:
+		return "snat"
+	case Masquerade:
+		return "masquerade"
+	case DNAT:
+		return "dnat"
+	}
+	return "unknown"
+}
+
+// default source port range for SNAT and masquerade
+const (
+	PortMin = 1024
+	PortMax = 65535
+)
+
+// a translation rule, rules are matched in order and the first one wins
+// SNAT/Masquerade are matched after routing (like POSTROUTING), DNAT before it
+type Rule struct {
+	Action   Action
+	Protocol uint8      // 0 matches TCP, UDP and ICMP echo
+	Src      *net.IPNet // nil matches any source
+	Dst      *net.IPNet // nil matches any destination
+	DstPort  uint16     // 0 matches any port
+	In       string     // DNAT: incoming interface, empty matches any
+	Out      string     // SNAT/Masquerade: outgoing interface, empty matches any
+	To       net.IP     // new source (SNAT) or destination (DNAT)
+	ToPort   uint16     // DNAT: new destination port, 0 keeps it
+	PortMin  uint16     // SNAT/Masquerade: source port range, 0 for PortMin-PortMax
+	PortMax  uint16
+}
+
+// reports whether the rule applies to a new connection
+func (r Rule) matches(in, out string, t conntrack.Tuple) bool {
+	if r.Protocol != 0 && r.Protocol != t.Protocol {
+		return false
+	}
+	if r.Src != nil && !r.Src.Contains(t.Src[:]) {
+		return false
+	}
+	if r.Dst != nil && !r.Dst.Contains(t.Dst[:]) {
+		return false
+	}
+	if r.DstPort != 0 && (t.Protocol == packets.ProtocolICMP || r.DstPort != t.DstPort) {
+		return false
+	}
+	if r.Action == DNAT {
+		return r.In == "" || r.In == in
+	}
+	return r.Out == "" || r.Out == out
+}
+
+// returns the source port range of a SNAT/Masquerade rule
+func (r Rule) ports() (uint16, uint16) {
+	if r.PortMin == 0 {
+		return PortMin, PortMax
+	}
+	return r.PortMin, r.PortMax
+}
+
+func (r Rule) String() string {
+	parts := []string{r.Action.String()}
+	if r.Protocol != 0 {
+		parts = append(parts, "proto", conntrack.ProtocolName(r.Protocol))
+	}
+	if r.Src != nil {
+		parts = append(parts, "src", r.Src.String())
+	}
+	if r.Dst != nil {
+		parts = append(parts, "dst", r.Dst.String())
+	}
+	if r.DstPort != 0 {
+		parts = append(parts, "dport", strconv.Itoa(int(r.DstPort)))
+	}
+	if r.In != "" {
+		parts = append(parts, "in", r.In)
+	}
+	if r.Out != "" {
+		parts = append(parts, "out", r.Out)
+	}
+	if r.To != nil {
+		to := r.To.String()
+		if r.ToPort != 0 {
+			to = net.JoinHostPort(to, strconv.Itoa(int(r.ToPort)))
+		}
+		parts = append(parts, "to", to)
+	}
+	if r.PortMin != 0 {
+		parts = append(parts, "ports", fmt.Sprintf("%d-%d", r.PortMin, r.PortMax))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parses a rule written like "masquerade out tap1", "snat src 192.168.1.0/24 to 203.0.113.5"
+// or "dnat proto tcp in tap1 dport 8080 to 192.168.1.20:80"
+// keywords: proto, src, dst, dport, in, out, to, ports MIN-MAX
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Rule{}, fmt.Errorf("empty rule")
+	}
+
+	var r Rule
+	switch fields[0] {
+	case "snat":
+		r.Action = SNAT
+	case "masquerade":
+		r.Action = Masquerade
+	case "dnat":
+		r.Action = DNAT
+	default:
+		return Rule{}, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	for i := 1; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return Rule{}, fmt.Errorf("missing value for %q", fields[i])
+		}
+		val := fields[i+1]
+
+		switch fields[i] {
+		case "proto":
+			switch val {
+			case "tcp":
+				r.Protocol = packets.ProtocolTCP
+			case "udp":
+				r.Protocol = packets.ProtocolUDP
+			case "icmp":
+				r.Protocol = packets.ProtocolICMP
+			default:
+				return Rule{}, fmt.Errorf("unsupported protocol %q", val)
+			}
+		case "src", "dst":
+			prefix, err := parsePrefix(val)
+			if err != nil {
+				return Rule{}, err
+			}
+			if fields[i] == "src" {
+				r.Src = prefix
+			} else {
+				r.Dst = prefix
+			}
+		case "dport":
+			port, err := strconv.ParseUint(val, 10, 16)
+			if err != nil || port == 0 {
+				return Rule{}, fmt.Errorf("invalid port %q", val)
+			}
+			r.DstPort = uint16(port)
+		case "in":
+			r.In = val
+		case "out":
+			r.Out = val
+		case "to":
+			host, portStr := val, ""
+			if h, p, err := net.SplitHostPort(val); err == nil {
+				host, portStr = h, p
+			}
+			if r.To = net.ParseIP(host).To4(); r.To == nil {
+				return Rule{}, fmt.Errorf("invalid address %q", host)
+			}
+			if portStr != "" {
+				port, err := strconv.ParseUint(portStr, 10, 16)
+				if err != nil || port == 0 {
+					return Rule{}, fmt.Errorf("invalid port %q", portStr)
+				}
+				r.ToPort = uint16(port)
+			}
+		case "ports":
+			minStr, maxStr, _ := strings.Cut(val, "-")
+			lo, err1 := strconv.ParseUint(minStr, 10, 16)
+			hi, err2 := strconv.ParseUint(maxStr, 10, 16)
+			if err1 != nil || err2 != nil || lo == 0 || lo > hi {
+				return Rule{}, fmt.Errorf("invalid port range %q", val)
+			}
+			r.PortMin, r.PortMax = uint16(lo), uint16(hi)
+		default:
+			return Rule{}, fmt.Errorf("unknown rule keyword %q", fields[i])
+		}
+	}
+
+	switch {
+	case r.Action != Masquerade && r.To == nil:
+		return Rule{}, fmt.Errorf("%s needs a \"to\" address", r.Action)
+	case r.Action == Masquerade && r.Out == "":
+		return Rule{}, fmt.Errorf("masquerade needs an \"out\" interface")
+	case r.Action == DNAT && (r.DstPort != 0 || r.ToPort != 0) && r.Protocol != packets.ProtocolTCP && r.Protocol != packets.ProtocolUDP:
+		return Rule{}, fmt.Errorf("ports need proto tcp or udp")
+	case r.Action != DNAT && (r.In != "" || r.ToPort != 0):
+		return Rule{}, fmt.Errorf("%s matches on the outgoing interface and can't change ports", r.Action)
+	case r.Action == DNAT && (r.Out != "" || r.PortMin != 0):
+		return Rule{}, fmt.Errorf("dnat matches on the incoming interface and has no port range")
+	}
+	return r, nil
+}
+
+// accepts a CIDR or a single address
+func parsePrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		s += "/32"
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 prefix %q", s)
+	}
+	return prefix, nil
+}
@@ -0,0 +1,240 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+var ErrNoPorts = errors.New("no free NAT ports")
+
+// looks up the next hop for dst, provided by the stack
+// returns the outgoing interface and the source address it would use,
+// ok is false when dst is unreachable or one of our own addresses
+// (SNAT only applies to forwarded traffic)
+type RouteFunc func(dst net.IP) (out string, src net.IP, ok bool)
+
+// NAT rules, safe for concurrent use
+// translations live in the conntrack entries of the flows: the first packet of
+// a flow picks a rule and NAT rewrites the entry's reply tuple, so packets in
+// either direction are translated with a single lookup and expire with the flow
+type Table struct {
+	mu    sync.Mutex
+	rules []Rule
+	ct    *conntrack.Table
+	route RouteFunc
+}
+
+func NewTable(ct *conntrack.Table, route RouteFunc) *Table {
+	return &Table{ct: ct, route: route}
+}
+
+// appends a rule
+func (t *Table) Add(r Rule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rules = append(t.rules, r)
+}
+
+func (t *Table) Rules() []Rule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Rule(nil), t.rules...)
+}
+
+// reports whether there is anything to translate
+func (t *Table) Active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.rules) > 0
+}
+
+// rewrites a serialized IPv4 packet that arrived on in, before the routing decision
+// the packet must have been tracked already. The first packet of a flow is
+// matched against the rules, later ones follow the flow's translation in both
+// directions; ICMP errors have the packet they quote translated too
+// fragments must be reassembled first. Returns whether pkt changed
+func (t *Table) Translate(in string, pkt []byte) (bool, error) {
+	ihl := int(pkt[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if binary.BigEndian.Uint16(pkt[6:8])&0x3FFF != 0 {
+		return false, nil
+	}
+	l4 := pkt[ihl:total]
+
+	if pkt[9] == packets.ProtocolICMP && len(l4) >= 8 && packets.IsICMPError(l4[0]) {
+		return t.translateICMPError(pkt, l4), nil
+	}
+
+	tuple, ok := conntrack.TupleOf(pkt, l4)
+	if !ok {
+		return false, nil
+	}
+	e, dir, ok := t.ct.Lookup(tuple)
+	if !ok {
+		return false, nil
+	}
+
+	reply := e.Reply
+	if !e.NAT {
+		if dir != conntrack.Original || e.Packets[conntrack.Original] != 1 {
+			return false, nil
+		}
+		// the first packet of the flow, bind records the translation in conntrack
+		var translated bool
+		var err error
+		if reply, translated, err = t.bind(in, e.Orig); err != nil || !translated {
+			return false, err
+		}
+	}
+
+	want := reply.Reverse()
+	if dir == conntrack.Reply {
+		want = e.Orig.Reverse()
+	}
+	rewrite(pkt, l4, want)
+	return true, nil
+}
+
+// applies the first matching rules to a new flow and records the reply tuple
+// in conntrack, translated is false if no rule matched
+func (t *Table) bind(in string, orig conntrack.Tuple) (conntrack.Tuple, bool, error) {
+	rules := t.Rules()
+	reply := orig.Reverse()
+	translated := false
+
+	for _, r := range rules {
+		if r.Action == DNAT && r.matches(in, "", orig) {
+			reply.Src = conntrack.Addr(r.To)
+			if r.ToPort != 0 {
+				reply.SrcPort = r.ToPort
+			}
+			translated = true
+			break
+		}
+	}
+
+	// source rules see the destination after DNAT, like POSTROUTING
+	out, src, routed := t.route(net.IP(reply.Src[:]))
+	post := orig
+	post.Dst, post.DstPort = reply.Src, reply.SrcPort
+	for _, r := range rules {
+		if r.Action == DNAT || !routed || !r.matches(in, out, post) {
+			continue
+		}
+		newSrc := r.To.To4()
+		if r.Action == Masquerade {
+			newSrc = src.To4()
+		}
+		if newSrc == nil {
+			break
+		}
+		reply.Dst = conntrack.Addr(newSrc)
+		lo, hi := r.ports()
+		return t.allocPort(orig, reply, lo, hi)
+	}
+
+	if !translated {
+		return reply, false, nil
+	}
+	if err := t.ct.SetReply(orig, reply); err != nil {
+		return reply, false, fmt.Errorf("%s: %w", orig, err)
+	}
+	return reply, true, nil
+}
+
+// picks the port replies will come back to and records it, keeping the original
+// one when it's free and in range (RFC 4787 REQ-3 port preservation)
+func (t *Table) allocPort(orig, reply conntrack.Tuple, lo, hi uint16) (conntrack.Tuple, bool, error) {
+	if reply.DstPort >= lo && reply.DstPort <= hi && t.ct.SetReply(orig, reply) == nil {
+		return reply, true, nil
+	}
+
+	n := int(hi-lo) + 1
+	start := rand.IntN(n)
+	for i := range n {
+		reply.DstPort = lo + uint16((start+i)%n)
+		err := t.ct.SetReply(orig, reply)
+		if err == nil {
+			return reply, true, nil
+		}
+		if !errors.Is(err, conntrack.ErrExists) {
+			return reply, false, fmt.Errorf("%s: %w", orig, err)
+		}
+	}
+	return reply, false, fmt.Errorf("%s: %w", orig, ErrNoPorts)
+}
+
+// rewrites addresses and ports of a packet (or the header quoted in an ICMP error)
+// to match want, fixing every checksum that covers them
+func rewrite(pkt, l4 []byte, want conntrack.Tuple) {
+	oldSrc := append(net.IP(nil), pkt[12:16]...)
+	oldDst := append(net.IP(nil), pkt[16:20]...)
+	newSrc, newDst := net.IP(want.Src[:]).To4(), net.IP(want.Dst[:]).To4()
+
+	packets.RewriteIPv4Addrs(pkt, newSrc, newDst)
+	switch want.Protocol {
+	case packets.ProtocolTCP:
+		packets.RewriteTCP(l4, oldSrc, oldDst, newSrc, newDst, want.SrcPort, want.DstPort)
+	case packets.ProtocolUDP:
+		packets.RewriteUDP(l4, oldSrc, oldDst, newSrc, newDst, want.SrcPort, want.DstPort)
+	case packets.ProtocolICMP:
+		id := want.SrcPort
+		if l4[0] == packets.ICMPEchoReply {
+			id = want.DstPort
+		}
+		packets.RewriteICMPID(l4, id)
+	}
+}
+
+// translates an ICMP error about a translated packet (RFC 5508 REQ-4): the quoted
+// packet gets the reverse of the translation it went through, the outer header
+// the same translation as any packet flowing in the error's direction
+func (t *Table) translateICMPError(pkt, l4 []byte) bool {
+	inner, innerL4, ok := conntrack.QuotedPacket(l4)
+	if !ok {
+		return false
+	}
+	quoted, ok := conntrack.TupleOf(inner, innerL4)
+	if !ok {
+		return false
+	}
+	c, _, ok := t.ct.Lookup(quoted.Reverse())
+	if !ok || !c.NAT {
+		return false
+	}
+
+	// the quoted packet flowed opposite to the error
+	var wantQuoted, from, to conntrack.Tuple
+	if quoted.Reverse() == c.Reply {
+		// error about a packet we sent on the initiator's behalf, heading back to it
+		wantQuoted, from, to = c.Orig, c.Reply, c.Orig.Reverse()
+	} else {
+		// error from the initiator about a reply, heading to the responder
+		wantQuoted, from, to = c.Reply, c.Orig, c.Reply.Reverse()
+	}
+	rewrite(inner, innerL4, wantQuoted)
+
+	// the error may come from the far end itself or from a router in between,
+	// only the endpoint addresses are translated
+	outerSrc := append(net.IP(nil), pkt[12:16]...)
+	if outerSrc.Equal(net.IP(from.Src[:])) {
+		outerSrc = net.IP(to.Src[:])
+	}
+	packets.RewriteIPv4Addrs(pkt, outerSrc, net.IP(to.Dst[:]))
+
+	// the quote changed, so the ICMP checksum is recomputed over the whole message
+	binary.BigEndian.PutUint16(l4[2:4], 0)
+	binary.BigEndian.PutUint16(l4[2:4], utils.Checksum(l4))
+	return true
+}
@@ -0,0 +1,199 @@
+package nat
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/conntrack"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+var (
+	inside  = net.IPv4(10, 0, 0, 2).To4()
+	inside2 = net.IPv4(10, 0, 0, 3).To4()
+	server  = net.IPv4(10, 0, 0, 20).To4()
+	public  = net.IPv4(203, 0, 113, 5).To4()
+	remote  = net.IPv4(198, 51, 100, 7).To4()
+)
+
+// tap0 is the inside network 10.0.0.0/24, everything else is out tap1
+func route(dst net.IP) (string, net.IP, bool) {
+	if dst.Mask(net.CIDRMask(24, 32)).Equal(net.IPv4(10, 0, 0, 0)) {
+		return "tap0", net.IPv4(10, 0, 0, 1).To4(), true
+	}
+	return "tap1", public, true
+}
+
+func tuple(proto uint8, src net.IP, srcPort uint16, dst net.IP, dstPort uint16) conntrack.Tuple {
+	return conntrack.Tuple{Protocol: proto, Src: conntrack.Addr(src), Dst: conntrack.Addr(dst), SrcPort: srcPort, DstPort: dstPort}
+}
+
+// serializes a UDP or TCP packet of the flow ft as it is on the wire, flags
+// are the TCP flags
+func packet(ft conntrack.Tuple, flags uint8) []byte {
+	src, dst := net.IP(ft.Src[:]), net.IP(ft.Dst[:])
+	var l4 []byte
+	if ft.Protocol == packets.ProtocolTCP {
+		h := packets.TCPHeader{SrcPort: ft.SrcPort, DstPort: ft.DstPort, DataOffset: 5, Flags: flags, Window: 1024}
+		l4 = h.Bytes(4, src, dst)
+	} else {
+		u := packets.UDPPacket{SrcPort: ft.SrcPort, DstPort: ft.DstPort, Data: []byte("query")}
+		l4 = u.Bytes(4, src, dst)
+	}
+	return ipv4(ft.Protocol, src, dst, l4)
+}
+
+func ipv4(proto uint8, src, dst net.IP, l4 []byte) []byte {
+	ip := packets.IPv4Header{Version: 4, TTL: 64, Protocol: proto, SrcIP: src, DstIP: dst, TotalLength: uint16(20 + len(l4))}
+	hdr, _ := ip.Bytes() // no options, can't fail
+	return append(hdr, l4...)
+}
+
+func newTable(t *testing.T, rules ...string) (*Table, *conntrack.Table) {
+	ct := conntrack.NewTable(conntrack.DefaultMaxEntries)
+	nt := NewTable(ct, route)
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nt.Add(r)
+	}
+	return nt, ct
+}
+
+// tracks and translates a packet like the stack does on arrival, and checks
+// that every checksum still holds
+func translate(t *testing.T, nt *Table, ct *conntrack.Table, in string, pkt []byte) conntrack.Tuple {
+	t.Helper()
+	ct.Track(pkt)
+	if _, err := nt.Translate(in, pkt); err != nil {
+		t.Fatal(err)
+	}
+	if utils.Checksum(pkt[:20]) != 0 {
+		t.Fatal("bad IPv4 header checksum")
+	}
+	src, dst := net.IP(pkt[12:16]), net.IP(pkt[16:20])
+	switch pkt[9] {
+	case packets.ProtocolUDP:
+		if !packets.VerifyUDP(4, pkt[20:], src, dst) {
+			t.Fatal("bad UDP checksum")
+		}
+	case packets.ProtocolTCP:
+		if !packets.VerifyTCP(4, pkt[20:], src, dst) {
+			t.Fatal("bad TCP checksum")
+		}
+	case packets.ProtocolICMP:
+		if utils.Checksum(pkt[20:]) != 0 {
+			t.Fatal("bad ICMP checksum")
+		}
+	}
+	tuple, _ := conntrack.TupleOf(pkt, pkt[20:])
+	return tuple
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		ok   bool
+	}{
+		{"masquerade out tap1", true},
+		{"snat src 10.0.0.0/24 to 203.0.113.5 ports 2000-3000", true},
+		{"dnat proto tcp in tap1 dport 8080 to 10.0.0.20:80", true},
+		{"dnat proto icmp to 10.0.0.20", true},
+		{"masquerade", false},                   // no out interface
+		{"snat src 10.0.0.0/24", false},         // no to
+		{"dnat dport 8080 to 10.0.0.20", false}, // ports without tcp/udp
+		{"snat to 203.0.113.5:80", false},       // snat can't change ports
+		{"dnat to 10.0.0.20 ports 1-2", false},  // dnat has no port range
+		{"snat to 203.0.113.5 ports 3000-2000", false},
+		{"snat to 2001:db8::1", false},
+		{"redirect to 10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRule(tt.rule)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseRule(%q) error = %v, want ok %v", tt.rule, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// a rule prints back to something that parses to the same rule
+		again, err := ParseRule(r.String())
+		if err != nil || again.String() != r.String() {
+			t.Errorf("ParseRule(%q).String() = %q does not round-trip: %v", tt.rule, r, err)
+		}
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	nt, ct := newTable(t, "masquerade out tap1")
+
+	// the source port is kept when it's free...
+	got := translate(t, nt, ct, "tap0", packet(tuple(packets.ProtocolUDP, inside, 1234, remote, 53), 0))
+	if want := tuple(packets.ProtocolUDP, public, 1234, remote, 53); got != want {
+		t.Fatalf("first flow went out as %v, want %v", got, want)
+	}
+	// ...and another one is picked when it isn't
+	second := translate(t, nt, ct, "tap0", packet(tuple(packets.ProtocolUDP, inside2, 1234, remote, 53), 0))
+	if second.Src != conntrack.Addr(public) || second.SrcPort == 1234 || second.SrcPort < PortMin {
+		t.Fatalf("second flow went out as %v", second)
+	}
+
+	// replies find their way back to the right host
+	got = translate(t, nt, ct, "tap1", packet(tuple(packets.ProtocolUDP, remote, 53, public, 1234), 0))
+	if want := tuple(packets.ProtocolUDP, remote, 53, inside, 1234); got != want {
+		t.Fatalf("reply came in as %v, want %v", got, want)
+	}
+	got = translate(t, nt, ct, "tap1", packet(tuple(packets.ProtocolUDP, remote, 53, public, second.SrcPort), 0))
+	if want := tuple(packets.ProtocolUDP, remote, 53, inside2, 1234); got != want {
+		t.Fatalf("second reply came in as %v, want %v", got, want)
+	}
+
+	// traffic staying inside isn't touched
+	local := tuple(packets.ProtocolUDP, inside, 1000, server, 53)
+	if got := translate(t, nt, ct, "tap0", packet(local, 0)); got != local {
+		t.Fatalf("inside flow translated to %v", got)
+	}
+}
+
+func TestDNAT(t *testing.T) {
+	nt, ct := newTable(t, "dnat proto tcp in tap1 dport 8080 to 10.0.0.20:80", "masquerade out tap1")
+
+	got := translate(t, nt, ct, "tap1", packet(tuple(packets.ProtocolTCP, remote, 5555, public, 8080), packets.TCPFlagSYN))
+	if want := tuple(packets.ProtocolTCP, remote, 5555, server, 80); got != want {
+		t.Fatalf("SYN forwarded as %v, want %v", got, want)
+	}
+	got = translate(t, nt, ct, "tap0", packet(tuple(packets.ProtocolTCP, server, 80, remote, 5555), packets.TCPFlagSYN|packets.TCPFlagACK))
+	if want := tuple(packets.ProtocolTCP, public, 8080, remote, 5555); got != want {
+		t.Fatalf("SYN-ACK went out as %v, want %v", got, want)
+	}
+
+	// other ports and interfaces don't match
+	if got := translate(t, nt, ct, "tap1", packet(tuple(packets.ProtocolTCP, remote, 5556, public, 8081), packets.TCPFlagSYN)); got.Dst != conntrack.Addr(public) {
+		t.Fatalf("port 8081 forwarded to %v", got)
+	}
+}
+
+func TestICMPErrorTranslation(t *testing.T) {
+	nt, ct := newTable(t, "masquerade out tap1")
+	flow := tuple(packets.ProtocolUDP, inside, 1234, remote, 53)
+	out := packet(flow, 0)
+	translate(t, nt, ct, "tap0", out)
+
+	// the remote end answers the translated packet with an error
+	msg := packets.NewICMPUnreachable(packets.ICMPCodePortUnreachable, out)
+	got := ipv4(packets.ProtocolICMP, remote, public, msg.Bytes())
+	translate(t, nt, ct, "tap1", got)
+
+	if dst := net.IP(got[16:20]); !dst.Equal(inside) {
+		t.Fatalf("error delivered to %s, want %s", dst, inside)
+	}
+	quoted, l4, _ := conntrack.QuotedPacket(got[20:])
+	if q, _ := conntrack.TupleOf(quoted, l4); q != flow {
+		t.Fatalf("quoted packet translated to %v", q)
+	}
+}
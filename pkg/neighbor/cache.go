@@ -0,0 +1,304 @@
+package neighbor
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// resolution state of an entry
+type State int
+
+const (
+	Incomplete State = iota // request sent, waiting for a reply
+	Reachable               // mapping is known and fresh
+	Stale                   // mapping is old, still used until traffic refreshes it or it ages out
+	Delay                   // stale mapping in use, waiting a bit for upper layers to confirm it
+	Probe                   // unconfirmed, checking the mapping with unicast requests
+)
+
+func (s State) String() string {
+	switch s {
+	case Incomplete:
+		return "INCOMPLETE"
+	case Reachable:
+		return "REACHABLE"
+	case Stale:
+		return "STALE"
+	case Delay:
+		return "DELAY"
+	case Probe:
+		return "PROBE"
+	}
+	return "UNKNOWN"
+}
+
+// cache timers and limits
+const (
+	ReachableTime  = 30 * time.Second // how long a mapping is considered fresh
+	StaleTime      = 10 * time.Minute // stale entries are forgotten after this
+	RetransTime    = time.Second      // delay between resolution requests
+	MaxProbes      = 3                // requests sent before giving up
+	DelayTime      = 5 * time.Second  // DELAY_FIRST_PROBE_TIME (RFC 4861 10)
+	MaxPendingPkts = 3                // packets queued per unresolved address (RFC 1122 asks for at least 1)
+)
+
+// copy of an entry, for listing
+type Entry struct {
+	IP      net.IP
+	MAC     net.HardwareAddr
+	State   State
+	Updated time.Time
+}
+
+type entry struct {
+	mac     net.HardwareAddr
+	state   State
+	updated time.Time
+	probes  int
+	pending [][]byte
+}
+
+// a lookup that gave up, along with the packets that were waiting on it
+type Failure struct {
+	IP      net.IP
+	Pending [][]byte
+}
+
+// maps protocol addresses to link addresses for a single link, safe for concurrent use
+// the cache only tracks state, sending requests is up to the caller
+// entries follow the Neighbor Unreachability Detection states of RFC 4861 7.3.2:
+// a stale mapping that gets used is probed again after DelayTime
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func NewCache() *Cache {
+	return &Cache{entries: make(map[string]*entry)}
+}
+
+func key(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// returns the link address of ip if it has been resolved
+// the caller is about to send to it, so a stale mapping starts being verified
+func (c *Cache) Lookup(ip net.IP) (net.HardwareAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key(ip)]
+	if !ok || e.state == Incomplete {
+		return nil, false
+	}
+	if e.state == Stale {
+		e.state = Delay
+		e.updated = time.Now()
+	}
+	return e.mac, true
+}
+
+// queues pkt until ip is resolved
+// returns true when the caller should send a request (first packet for ip)
+func (c *Cache) Enqueue(ip net.IP, pkt []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key(ip)]
+	if !ok {
+		e = &entry{state: Incomplete, updated: time.Now(), probes: 1}
+		c.entries[key(ip)] = e
+	}
+
+	// keep the newest packets, like Linux does with unres_qlen
+	e.pending = append(e.pending, append([]byte(nil), pkt...))
+	if len(e.pending) > MaxPendingPkts {
+		e.pending = e.pending[1:]
+	}
+
+	return !ok
+}
+
+// records a mapping learned from the wire and returns packets that were waiting for it
+// when create is false only existing entries are refreshed (RFC 826 merge flag)
+func (c *Cache) Update(ip net.IP, mac net.HardwareAddr, create bool) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key(ip)]
+	if !ok {
+		if !create {
+			return nil
+		}
+		e = &entry{}
+		c.entries[key(ip)] = e
+	}
+
+	e.mac = append(net.HardwareAddr(nil), mac...)
+	e.state = Reachable
+	e.updated = time.Now()
+	e.probes = 0
+
+	pending := e.pending
+	e.pending = nil
+	return pending
+}
+
+// records a link address learned from a neighbor's solicitation (RFC 4861 7.2.3):
+// new or changed mappings become stale, an unchanged one keeps its state
+// returns packets that were waiting for it
+func (c *Cache) Observe(ip net.IP, mac net.HardwareAddr, create bool) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key(ip)]
+	if !ok {
+		if !create {
+			return nil
+		}
+		e = &entry{}
+		c.entries[key(ip)] = e
+	}
+	if e.state != Incomplete && slices.Equal(e.mac, mac) {
+		return nil
+	}
+
+	e.mac = append(net.HardwareAddr(nil), mac...)
+	e.state = Stale
+	e.updated = time.Now()
+	e.probes = 0
+
+	pending := e.pending
+	e.pending = nil
+	return pending
+}
+
+// processes a neighbor advertisement for ip (RFC 4861 7.2.5), mac may be nil
+// if it didn't carry one. Solicited answers confirm reachability, unsolicited
+// ones only update the mapping, and without override a different address is
+// not taken over a known one. Returns packets that were waiting for it
+func (c *Cache) Advertise(ip net.IP, mac net.HardwareAddr, solicited, override bool) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key(ip)]
+	if !ok {
+		return nil
+	}
+
+	if e.state == Incomplete {
+		if mac == nil {
+			return nil
+		}
+		e.mac = append(net.HardwareAddr(nil), mac...)
+		e.state = Stale
+		if solicited {
+			e.state = Reachable
+		}
+		e.updated = time.Now()
+		e.probes = 0
+
+		pending := e.pending
+		e.pending = nil
+		return pending
+	}
+
+	changed := mac != nil && !slices.Equal(e.mac, mac)
+	if changed && !override {
+		// keep using the address we know, but make sure it still works
+		if e.state == Reachable {
+			e.state = Stale
+			e.updated = time.Now()
+		}
+		return nil
+	}
+
+	if changed {
+		e.mac = append(net.HardwareAddr(nil), mac...)
+	}
+	if solicited {
+		e.state = Reachable
+		e.updated = time.Now()
+		e.probes = 0
+	} else if changed {
+		e.state = Stale
+		e.updated = time.Now()
+	}
+	return nil
+}
+
+// removes the mapping for ip
+func (c *Cache) Delete(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key(ip))
+}
+
+// ages entries, must be called periodically (every RetransTime)
+// returns addresses that need another request and lookups that failed
+func (c *Cache) Tick(now time.Time) (retry []net.IP, failed []Failure) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		ip := net.IP(k)
+		age := now.Sub(e.updated)
+
+		switch e.state {
+		case Incomplete:
+			if age < time.Duration(e.probes)*RetransTime {
+				continue
+			}
+			if e.probes >= MaxProbes {
+				failed = append(failed, Failure{IP: ip, Pending: e.pending})
+				delete(c.entries, k)
+				continue
+			}
+			e.probes++
+			retry = append(retry, ip)
+		case Reachable:
+			if age >= ReachableTime {
+				e.state = Stale
+			}
+		case Delay:
+			if age >= DelayTime {
+				e.state = Probe
+				e.updated = now
+				e.probes = 1
+				retry = append(retry, ip)
+			}
+		case Probe:
+			if age < time.Duration(e.probes)*RetransTime {
+				continue
+			}
+			if e.probes >= MaxProbes {
+				failed = append(failed, Failure{IP: ip})
+				delete(c.entries, k)
+				continue
+			}
+			e.probes++
+			retry = append(retry, ip)
+		case Stale:
+			if age >= StaleTime {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	return retry, failed
+}
+
+// returns a snapshot of the cache
+func (c *Cache) Entries() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var list []Entry
+	for k, e := range c.entries {
+		list = append(list, Entry{IP: net.IP(k), MAC: e.mac, State: e.state, Updated: e.updated})
+	}
+	return list
+}
@@ -0,0 +1,215 @@
+package nic
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// the all-nodes link-local group every IPv6 node listens to (RFC 4291 2.7.1)
+var IPv6AllNodes = net.ParseIP("ff02::1")
+
+// duplicate address detection state of an IPv6 address (RFC 4862 5.4)
+type AddrState int
+
+const (
+	Tentative  AddrState = iota // being checked for duplicates, only DAD messages use it
+	Preferred                   // unique, usable for any traffic
+	Deprecated                  // preferred lifetime is over, kept for existing traffic only
+	Duplicate                   // somebody else on the link has it, never used
+)
+
+// an IPv6 address configured on a NIC, along with its prefix
+// lifetimes only apply to autoconfigured addresses, a zero time means forever
+type Address6 struct {
+	Prefix         *net.IPNet // IP is the host address, Mask the on-link prefix
+	State          AddrState
+	Autoconf       bool // formed from a router advertisement (RFC 4862)
+	Temporary      bool // random privacy address (RFC 8981)
+	PreferredUntil time.Time
+	ValidUntil     time.Time
+}
+
+// usable as a source or destination
+func (a Address6) Usable() bool {
+	return a.State == Preferred || a.State == Deprecated
+}
+
+// same flags as `ip -6 addr`
+func (a Address6) String() string {
+	str := a.Prefix.String()
+	switch a.State {
+	case Tentative:
+		str += " tentative"
+	case Deprecated:
+		str += " deprecated"
+	case Duplicate:
+		str += " dadfailed"
+	}
+	if a.Temporary {
+		str += " temporary"
+	}
+	if a.Autoconf {
+		str += " dynamic"
+	}
+	return str
+}
+
+// adds an IPv6 address, tentative until duplicate address detection is done
+// joining its solicited-node group is up to the caller, through MLD
+func (n *NIC) AddAddress6(addr Address6) (Address6, error) {
+	if addr.Prefix.IP.To4() != nil || len(addr.Prefix.IP) != net.IPv6len {
+		return Address6{}, fmt.Errorf("not an IPv6 address: %s", addr.Prefix.IP)
+	}
+	addr.State = Tentative
+
+	n.mu.Lock()
+	for _, a := range n.addrs6 {
+		if a.Prefix.IP.Equal(addr.Prefix.IP) {
+			n.mu.Unlock()
+			return Address6{}, fmt.Errorf("%s already configured on %s", addr.Prefix.IP, n.Name)
+		}
+	}
+	n.addrs6 = append(n.addrs6, addr)
+	n.mu.Unlock()
+
+	return addr, nil
+}
+
+// moves ip from one DAD state to another, false if it isn't in state from
+func (n *NIC) SetAddress6State(ip net.IP, from, to AddrState) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i := slices.IndexFunc(n.addrs6, func(a Address6) bool { return a.Prefix.IP.Equal(ip) })
+	if i < 0 || n.addrs6[i].State != from {
+		return false
+	}
+	n.addrs6[i].State = to
+	return true
+}
+
+// refreshes the lifetimes of an autoconfigured address, a deprecated one that
+// got a new preferred lifetime is preferred again
+func (n *NIC) SetLifetimes6(ip net.IP, preferredUntil, validUntil time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i := slices.IndexFunc(n.addrs6, func(a Address6) bool { return a.Prefix.IP.Equal(ip) })
+	if i < 0 {
+		return false
+	}
+	a := &n.addrs6[i]
+	a.PreferredUntil, a.ValidUntil = preferredUntil, validUntil
+	if a.State == Deprecated && (preferredUntil.IsZero() || preferredUntil.After(time.Now())) {
+		a.State = Preferred
+	}
+	return true
+}
+
+// removes an IPv6 address
+func (n *NIC) RemoveAddress6(ip net.IP) (Address6, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i := slices.IndexFunc(n.addrs6, func(a Address6) bool { return a.Prefix.IP.Equal(ip) })
+	if i < 0 {
+		return Address6{}, fmt.Errorf("%s is not configured on %s", ip, n.Name)
+	}
+	removed := n.addrs6[i]
+	n.addrs6 = slices.Delete(n.addrs6, i, i+1)
+	return removed, nil
+}
+
+// deprecates addresses whose preferred lifetime ran out and removes the ones
+// whose valid lifetime did, must be called periodically
+func (n *NIC) ExpireAddresses6(now time.Time) (deprecated, expired []Address6) {
+	n.mu.Lock()
+	for i := range n.addrs6 {
+		a := &n.addrs6[i]
+		if a.State == Preferred && !a.PreferredUntil.IsZero() && !now.Before(a.PreferredUntil) {
+			a.State = Deprecated
+			deprecated = append(deprecated, *a)
+		}
+		if !a.ValidUntil.IsZero() && !now.Before(a.ValidUntil) {
+			expired = append(expired, *a)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, a := range expired {
+		n.RemoveAddress6(a.Prefix.IP)
+	}
+	return deprecated, expired
+}
+
+// returns a copy of the configured IPv6 addresses
+func (n *NIC) Addresses6() []Address6 {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return slices.Clone(n.addrs6)
+}
+
+// returns the IPv6 address ip, whatever its state
+func (n *NIC) Address6(ip net.IP) (Address6, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, a := range n.addrs6 {
+		if a.Prefix.IP.Equal(ip) {
+			return a, true
+		}
+	}
+	return Address6{}, false
+}
+
+// picks the source address for a packet to dst leaving through this NIC, a
+// simplified RFC 6724 going through its rules in order: an address of the same
+// scope as dst, one that isn't deprecated, a temporary one, then the longest
+// matching prefix. Returns nil if there's no usable address
+func (n *NIC) SourceFor6(dst net.IP) net.IP {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	linkLocal := dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast()
+
+	var best net.IP
+	bestScore := -1
+	for _, a := range n.addrs6 {
+		if !a.Usable() {
+			continue
+		}
+		score := commonPrefixLen(a.Prefix.IP, dst)
+		if a.Prefix.IP.IsLinkLocalUnicast() == linkLocal {
+			score += 1024
+		}
+		if a.State == Preferred {
+			score += 512
+		}
+		if a.Temporary {
+			score += 256
+		}
+		if score > bestScore {
+			best, bestScore = a.Prefix.IP, score
+		}
+	}
+	return best
+}
+
+// number of leading bits a and b share
+func commonPrefixLen(a, b net.IP) int {
+	a, b = a.To16(), b.To16()
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return len(a) * 8
+}
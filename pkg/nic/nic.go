@@ -0,0 +1,354 @@
+package nic
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hexhaust/mini-netstack/pkg/device"
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/multicast"
+	"github.com/hexhaust/mini-netstack/pkg/neighbor"
+	"github.com/hexhaust/mini-netstack/pkg/qdisc"
+	"github.com/hexhaust/mini-netstack/pkg/tunnel"
+)
+
+// an IPv4 address configured on a NIC, along with its prefix
+// the first address of a subnet is primary, later ones in the same subnet are
+// secondary (same semantics as `ip addr`)
+type Address struct {
+	Prefix    *net.IPNet // IP is the host address, Mask the subnet mask
+	Secondary bool
+}
+
+func (a Address) String() string {
+	if a.Secondary {
+		return a.Prefix.String() + " secondary"
+	}
+	return a.Prefix.String()
+}
+
+// a network interface card: a link endpoint with its own MAC, addresses, ARP and
+// ND caches, multicast memberships and egress queue
+type NIC struct {
+	Name   string
+	MAC    net.HardwareAddr
+	Dev    *device.Interface
+	ARP    *neighbor.Cache
+	ND     *neighbor.Cache // IPv6 neighbors, resolved with Neighbor Discovery
+	IGMP   *multicast.IGMPHost
+	MLD    *multicast.MLDHost
+	Egress *qdisc.Scheduler // frames go out through here, Egress.Run must be running
+	Tunnel *tunnel.Tunnel   // set for tunnel interfaces, which have no link layer
+
+	// IPv6 link parameters from router advertisements, 0 until a router sets them
+	HopLimit6 atomic.Uint32
+	MTU6      atomic.Uint32
+
+	mu     sync.RWMutex
+	addrs  []Address
+	addrs6 []Address6
+	mcast  map[[6]byte]int // multicast MAC filter, refcounted since groups can share a MAC
+}
+
+func New(dev *device.Interface, mac net.HardwareAddr) *NIC {
+	n := &NIC{
+		Name:  dev.Name,
+		MAC:   mac,
+		Dev:   dev,
+		ARP:   neighbor.NewCache(),
+		ND:    neighbor.NewCache(),
+		mcast: make(map[[6]byte]int),
+	}
+	n.Egress = qdisc.NewScheduler(qdisc.Default(), func(frame []byte) error {
+		_, err := dev.Write(frame)
+		return err
+	})
+	n.IGMP = multicast.NewIGMPHost(func(group net.IP, member bool) {
+		if member {
+			n.JoinMAC(frames.IPv4MulticastMAC(group))
+		} else {
+			n.LeaveMAC(frames.IPv4MulticastMAC(group))
+		}
+	})
+	n.MLD = multicast.NewMLDHost(func(group net.IP, member bool) {
+		if member {
+			n.JoinMAC(frames.IPv6MulticastMAC(group))
+		} else {
+			n.LeaveMAC(frames.IPv6MulticastMAC(group))
+		}
+	})
+	return n
+}
+
+// creates the interface of a tunnel: packets routed to it are encapsulated
+// instead of framed, so it has no device file, a zero MAC and no egress queue
+// (noqueue, like Linux virtual devices)
+func NewTunnel(t *tunnel.Tunnel, mtu int) *NIC {
+	n := &NIC{
+		Name:   t.Name,
+		MAC:    make(net.HardwareAddr, 6),
+		Dev:    &device.Interface{Name: t.Name, MTU: mtu},
+		ARP:    neighbor.NewCache(),
+		ND:     neighbor.NewCache(),
+		Tunnel: t,
+		mcast:  make(map[[6]byte]int),
+	}
+	n.IGMP = multicast.NewIGMPHost(func(net.IP, bool) {})
+	n.MLD = multicast.NewMLDHost(func(net.IP, bool) {})
+	return n
+}
+
+// adds a multicast MAC to the receive filter
+func (n *NIC) JoinMAC(mac [6]byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.mcast[mac]++
+}
+
+// drops a multicast MAC from the receive filter once nobody uses it
+func (n *NIC) LeaveMAC(mac [6]byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.mcast[mac]--; n.mcast[mac] <= 0 {
+		delete(n.mcast, mac)
+	}
+}
+
+// reports whether a frame sent to dst is for this NIC: our own MAC, broadcast,
+// the all-hosts and all-nodes groups or a multicast MAC we joined
+func (n *NIC) Accepts(dst [6]byte) bool {
+	if dst == [6]byte(n.MAC) || dst == [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff} {
+		return true
+	}
+	if !frames.IsMulticastMAC(dst) {
+		return false
+	}
+	if dst == frames.IPv4MulticastMAC(net.IPv4allsys) || dst == frames.IPv6MulticastMAC(IPv6AllNodes) {
+		return true
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.mcast[dst] > 0
+}
+
+func sameSubnet(a, b *net.IPNet) bool {
+	return a.IP.Mask(a.Mask).Equal(b.IP.Mask(b.Mask)) && slices.Equal(a.Mask, b.Mask)
+}
+
+// adds an address, returns it with its primary/secondary role decided
+func (n *NIC) AddAddress(prefix *net.IPNet) (Address, error) {
+	ip := prefix.IP.To4()
+	if ip == nil {
+		return Address{}, fmt.Errorf("not an IPv4 address: %s", prefix.IP)
+	}
+	addr := Address{Prefix: &net.IPNet{IP: ip, Mask: prefix.Mask}}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, a := range n.addrs {
+		if a.Prefix.IP.Equal(ip) {
+			return Address{}, fmt.Errorf("%s already configured on %s", ip, n.Name)
+		}
+		if sameSubnet(a.Prefix, addr.Prefix) {
+			addr.Secondary = true
+		}
+	}
+
+	n.addrs = append(n.addrs, addr)
+	return addr, nil
+}
+
+// removes an address, the first secondary of the same subnet is promoted
+// when a primary goes away (like net.ipv4.conf.all.promote_secondaries)
+func (n *NIC) RemoveAddress(ip net.IP) (Address, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i := slices.IndexFunc(n.addrs, func(a Address) bool { return a.Prefix.IP.Equal(ip) })
+	if i < 0 {
+		return Address{}, fmt.Errorf("%s is not configured on %s", ip, n.Name)
+	}
+	removed := n.addrs[i]
+	n.addrs = slices.Delete(n.addrs, i, i+1)
+
+	if !removed.Secondary {
+		for j := range n.addrs {
+			if n.addrs[j].Secondary && sameSubnet(n.addrs[j].Prefix, removed.Prefix) {
+				n.addrs[j].Secondary = false
+				break
+			}
+		}
+	}
+	return removed, nil
+}
+
+// returns a copy of the configured addresses
+func (n *NIC) Addresses() []Address {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return slices.Clone(n.addrs)
+}
+
+// reports whether ip (IPv4 or IPv6) is configured on this NIC, IPv6 addresses
+// only count once they passed duplicate address detection
+func (n *NIC) HasAddress(ip net.IP) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, a := range n.addrs {
+		if a.Prefix.IP.Equal(ip) {
+			return true
+		}
+	}
+	for _, a := range n.addrs6 {
+		if a.Usable() && a.Prefix.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether ip is inside one of the IPv4 prefixes configured on this NIC
+func (n *NIC) OnLink(ip net.IP) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, a := range n.addrs {
+		if a.Prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the directed broadcast address of an IPv4 prefix (host bits all set)
+// /31 and /32 prefixes have none (RFC 3021)
+func BroadcastAddr(prefix *net.IPNet) net.IP {
+	if ones, bits := prefix.Mask.Size(); bits-ones < 2 {
+		return nil
+	}
+	ip := prefix.IP.To4()
+	bcast := make(net.IP, 4)
+	for i := range bcast {
+		bcast[i] = ip[i] | ^prefix.Mask[i]
+	}
+	return bcast
+}
+
+// reports whether ip is the limited broadcast or the directed broadcast of
+// one of the prefixes configured on this NIC
+func (n *NIC) IsBroadcast(ip net.IP) bool {
+	if ip.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, a := range n.addrs {
+		if bcast := BroadcastAddr(a.Prefix); bcast != nil && bcast.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// picks the source address for a packet leaving through this NIC towards nextHop:
+// the primary address of the subnet nextHop lives in, otherwise the first primary
+// returns nil if the NIC has no addresses
+func (n *NIC) SourceFor(nextHop net.IP) net.IP {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var fallback net.IP
+	for _, a := range n.addrs {
+		if a.Secondary {
+			continue
+		}
+		if a.Prefix.Contains(nextHop) {
+			return a.Prefix.IP
+		}
+		if fallback == nil {
+			fallback = a.Prefix.IP
+		}
+	}
+	return fallback
+}
+
+// NICs attached to the stack by name, safe for concurrent use
+type Registry struct {
+	mu   sync.RWMutex
+	nics []*NIC
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Add(n *NIC) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.nics {
+		if existing.Name == n.Name {
+			return fmt.Errorf("NIC %s already registered", n.Name)
+		}
+	}
+	r.nics = append(r.nics, n)
+	return nil
+}
+
+func (r *Registry) Get(name string) (*NIC, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, n := range r.nics {
+		if n.Name == name {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// returns every NIC, in registration order
+func (r *Registry) All() []*NIC {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return slices.Clone(r.nics)
+}
+
+// reports whether ip is a broadcast address for any of the NICs
+func (r *Registry) IsBroadcast(ip net.IP) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, n := range r.nics {
+		if n.IsBroadcast(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the NIC ip is configured on
+func (r *Registry) Owner(ip net.IP) (*NIC, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, n := range r.nics {
+		if n.HasAddress(ip) {
+			return n, true
+		}
+	}
+	return nil, false
+}
@@ -95,3 +95,26 @@ func (a *ARPHeader) ReplyAs(myMAC net.HardwareAddr, myIP net.IP) ([]byte, error)
 
 	return reply, nil
 }
+
+// creates a byte slice representing an ARP request asking who has targetIP
+func NewARPRequest(myMAC net.HardwareAddr, myIP, targetIP net.IP) ([]byte, error) {
+	myIP, targetIP = myIP.To4(), targetIP.To4()
+	if len(myMAC) != 6 || myIP == nil || targetIP == nil {
+		return nil, fmt.Errorf("invalid MAC or IP length")
+	}
+
+	req := make([]byte, 28)
+
+	binary.BigEndian.PutUint16(req[0:2], 1)
+	binary.BigEndian.PutUint16(req[2:4], 0x0800)
+	req[4] = 6
+	req[5] = 4
+	binary.BigEndian.PutUint16(req[6:8], ARPRequest)
+
+	copy(req[8:14], myMAC)
+	copy(req[14:18], myIP)
+	// target MAC is what we're asking for, left zeroed
+	copy(req[24:28], targetIP)
+
+	return req, nil
+}
@@ -0,0 +1,114 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+// GRE flag bits of the first header word (RFC 2784, RFC 2890)
+const (
+	GREFlagChecksum = 0x8000
+	GREFlagKey      = 0x2000
+	GREFlagSeq      = 0x1000
+)
+
+// GRE header, the optional fields are present when their flag is set
+// structure: [Flags+Version(2)][Protocol(2)][Checksum(2)+Reserved(2)][Key(4)][Seq(4)]
+type GREHeader struct {
+	Checksum bool
+	HasKey   bool
+	HasSeq   bool
+	Protocol uint16 // EtherType of the payload
+	Key      uint32
+	Seq      uint32
+	Payload  []byte
+}
+
+func ParseGRE(data []byte) (*GREHeader, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("packet too short for GRE: %d bytes", len(data))
+	}
+	flags := binary.BigEndian.Uint16(data[0:2])
+	if version := flags & 0x7; version != 0 {
+		return nil, fmt.Errorf("unsupported GRE version %d", version)
+	}
+
+	g := &GREHeader{
+		Checksum: flags&GREFlagChecksum != 0,
+		HasKey:   flags&GREFlagKey != 0,
+		HasSeq:   flags&GREFlagSeq != 0,
+		Protocol: binary.BigEndian.Uint16(data[2:4]),
+	}
+	if len(data) < g.HeaderLen() {
+		return nil, fmt.Errorf("packet too short for GRE header len: %d", g.HeaderLen())
+	}
+
+	off := 4
+	if g.Checksum {
+		if utils.Checksum(data) != 0 {
+			return nil, fmt.Errorf("bad GRE checksum")
+		}
+		off += 4
+	}
+	if g.HasKey {
+		g.Key = binary.BigEndian.Uint32(data[off : off+4])
+		off += 4
+	}
+	if g.HasSeq {
+		g.Seq = binary.BigEndian.Uint32(data[off : off+4])
+		off += 4
+	}
+	g.Payload = data[off:]
+	return g, nil
+}
+
+// returns the header size for the fields present
+func (g *GREHeader) HeaderLen() int {
+	n := 4
+	for _, present := range []bool{g.Checksum, g.HasKey, g.HasSeq} {
+		if present {
+			n += 4
+		}
+	}
+	return n
+}
+
+// serializes the header and payload, computing the checksum if it's enabled
+func (g *GREHeader) Bytes() []byte {
+	buf := make([]byte, g.HeaderLen()+len(g.Payload))
+
+	var flags uint16
+	if g.Checksum {
+		flags |= GREFlagChecksum
+	}
+	if g.HasKey {
+		flags |= GREFlagKey
+	}
+	if g.HasSeq {
+		flags |= GREFlagSeq
+	}
+	binary.BigEndian.PutUint16(buf[0:2], flags)
+	binary.BigEndian.PutUint16(buf[2:4], g.Protocol)
+
+	off := 4
+	if g.Checksum {
+		off += 4 // filled in last
+	}
+	if g.HasKey {
+		binary.BigEndian.PutUint32(buf[off:off+4], g.Key)
+		off += 4
+	}
+	if g.HasSeq {
+		binary.BigEndian.PutUint32(buf[off:off+4], g.Seq)
+		off += 4
+	}
+	copy(buf[off:], g.Payload)
+
+	// covers the GRE header and payload
+	if g.Checksum {
+		binary.BigEndian.PutUint16(buf[4:6], utils.Checksum(buf))
+	}
+	return buf
+}
@@ -3,17 +3,70 @@ package packets
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 
 	"github.com/hexhaust/mini-netstack/pkg/utils"
 )
 
 const (
-	ICMPEchoReply   = 0
-	ICMPEchoRequest = 8
+	ICMPEchoReply       = 0
+	ICMPDestUnreachable = 3
+	ICMPSourceQuench    = 4 // deprecated, hosts ignore it (RFC 6633)
+	ICMPRedirect        = 5
+	ICMPEchoRequest     = 8
+	ICMPTimeExceeded    = 11
+	ICMPParamProblem    = 12
 )
 
+// ICMP Destination Unreachable codes (RFC 792, RFC 1122 3.2.2.1, RFC 1812 5.2.7.1)
+const (
+	ICMPCodeNetUnreachable      = 0
+	ICMPCodeHostUnreachable     = 1
+	ICMPCodeProtocolUnreachable = 2
+	ICMPCodePortUnreachable     = 3
+	ICMPCodeFragNeeded          = 4 // next-hop MTU goes in the low 16 bits of the unused word (RFC 1191)
+	ICMPCodeSourceRouteFailed   = 5
+	ICMPCodeNetUnknown          = 6
+	ICMPCodeHostUnknown         = 7
+	ICMPCodeHostIsolated        = 8
+	ICMPCodeNetProhibited       = 9
+	ICMPCodeHostProhibited      = 10
+	ICMPCodeNetTOS              = 11
+	ICMPCodeHostTOS             = 12
+	ICMPCodeAdminProhibited     = 13 // filtered (RFC 1812 5.2.7.1)
+	ICMPCodeHostPrecedence      = 14
+	ICMPCodePrecedenceCutoff    = 15
+)
+
+// ICMP Redirect codes
+const (
+	ICMPCodeRedirectNet     = 0
+	ICMPCodeRedirectHost    = 1
+	ICMPCodeRedirectTOSNet  = 2
+	ICMPCodeRedirectTOSHost = 3
+)
+
+// ICMP Time Exceeded codes
+const (
+	ICMPCodeTTLExceeded        = 0
+	ICMPCodeReassemblyExceeded = 1
+)
+
+// ICMP Parameter Problem codes (RFC 1812 5.2.7.3)
+const (
+	ICMPCodePointer       = 0 // the pointer says which byte is wrong
+	ICMPCodeMissingOption = 1
+	ICMPCodeBadLength     = 2
+)
+
+// errors quote as much of the invoking packet as fits in a 576 byte datagram
+// (RFC 1812 4.3.2.3), RFC 792 only asked for the header and 8 bytes of data
+const ICMPMaxErrorLen = 576
+
 // represents the header + payload
 // structure: [Type(1)][Code(1)][Checksum(2)][ID(2)][Seq(2)][Data...]
+// ID and Seq only mean something to echo messages, errors use that word for
+// their parameter (see Param) and quote the invoking packet in Data
 type ICMPMessage struct {
 	Type     uint8
 	Code     uint8
@@ -59,13 +112,111 @@ func (i *ICMPMessage) Bytes() []byte {
 	return buf
 }
 
-func (i *ICMPMessage) String() string {
-	typeStr := "Unknown"
-	if i.Type == ICMPEchoRequest {
-		typeStr = "Echo Request"
-	} else if i.Type == ICMPEchoReply {
-		typeStr = "Echo Reply"
+// builds an error message about invoking, quoting its header and data up to
+// ICMPMaxErrorLen. param is the word after the checksum: unused (zero), the
+// next-hop MTU, the pointer or the gateway depending on the type
+func NewICMPError(icmpType, code uint8, param uint32, invoking []byte) *ICMPMessage {
+	quoted := min(len(invoking), ICMPMaxErrorLen-20-8) // our IP and ICMP headers come first
+	return &ICMPMessage{
+		Type: icmpType,
+		Code: code,
+		ID:   uint16(param >> 16),
+		Seq:  uint16(param),
+		Data: append([]byte(nil), invoking[:quoted]...),
+	}
+}
+
+// builds a Destination Unreachable with any of the ICMPCode*Unreachable/Prohibited codes
+// Fragmentation Needed has its own builder since it carries the MTU
+func NewICMPUnreachable(code uint8, invoking []byte) *ICMPMessage {
+	return NewICMPError(ICMPDestUnreachable, code, 0, invoking)
+}
+
+// builds a Fragmentation Needed telling the source the MTU of the next hop (RFC 1191)
+func NewICMPFragNeeded(mtu int, invoking []byte) *ICMPMessage {
+	return NewICMPError(ICMPDestUnreachable, ICMPCodeFragNeeded, uint32(uint16(mtu)), invoking)
+}
+
+func NewICMPTimeExceeded(code uint8, invoking []byte) *ICMPMessage {
+	return NewICMPError(ICMPTimeExceeded, code, 0, invoking)
+}
+
+// builds a Parameter Problem pointing at the offending byte of the invoking header
+func NewICMPParamProblem(pointer uint8, invoking []byte) *ICMPMessage {
+	return NewICMPError(ICMPParamProblem, ICMPCodePointer, uint32(pointer)<<24, invoking)
+}
+
+// builds a Redirect telling the source to use gateway for the invoking packet's destination
+func NewICMPRedirect(code uint8, gateway net.IP, invoking []byte) (*ICMPMessage, error) {
+	gw := gateway.To4()
+	if gw == nil {
+		return nil, fmt.Errorf("redirect gateway %s is not an IPv4 address", gateway)
+	}
+	return NewICMPError(ICMPRedirect, code, binary.BigEndian.Uint32(gw), invoking), nil
+}
+
+// the word after the checksum, as errors use it
+func (i *ICMPMessage) Param() uint32 {
+	return uint32(i.ID)<<16 | uint32(i.Seq)
+}
+
+// the next-hop MTU of a Fragmentation Needed, 0 from routers that predate RFC 1191
+func (i *ICMPMessage) NextHopMTU() int {
+	return int(i.Seq)
+}
+
+// the offset of the byte a Parameter Problem is about
+func (i *ICMPMessage) Pointer() uint8 {
+	return uint8(i.ID >> 8)
+}
+
+// the gateway a Redirect points to
+func (i *ICMPMessage) Gateway() net.IP {
+	return net.IPv4(byte(i.ID>>8), byte(i.ID), byte(i.Seq>>8), byte(i.Seq)).To4()
+}
+
+// the invoking packet quoted by an error message
+func (i *ICMPMessage) Quote() []byte {
+	return i.Data
+}
+
+// rewrites the identifier of a serialized echo request/reply in place and
+// patches the checksum (RFC 1624), used by NAT
+func RewriteICMPID(msg []byte, id uint16) {
+	old := binary.BigEndian.Uint16(msg[4:6])
+	csum := binary.BigEndian.Uint16(msg[2:4])
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[2:4], utils.UpdateChecksum(csum, old, id))
+}
+
+// reports whether the message is an error quoting the packet that caused it
+func IsICMPError(icmpType uint8) bool {
+	switch icmpType {
+	case ICMPDestUnreachable, ICMPSourceQuench, ICMPRedirect, ICMPTimeExceeded, ICMPParamProblem:
+		return true
 	}
+	return false
+}
 
-	return fmt.Sprintf("[ICMP] Type=%d (%s) | ID=%d Seq=%d", i.Type, typeStr, i.ID, i.Seq)
+func (i *ICMPMessage) String() string {
+	switch i.Type {
+	case ICMPEchoRequest:
+		return fmt.Sprintf("[ICMP] Type=%d (Echo Request) | ID=%d Seq=%d", i.Type, i.ID, i.Seq)
+	case ICMPEchoReply:
+		return fmt.Sprintf("[ICMP] Type=%d (Echo Reply) | ID=%d Seq=%d", i.Type, i.ID, i.Seq)
+	case ICMPDestUnreachable:
+		if i.Code == ICMPCodeFragNeeded {
+			return fmt.Sprintf("[ICMP] Type=%d (Fragmentation Needed) | MTU=%d", i.Type, i.NextHopMTU())
+		}
+		return fmt.Sprintf("[ICMP] Type=%d (Destination Unreachable) Code=%d", i.Type, i.Code)
+	case ICMPSourceQuench:
+		return fmt.Sprintf("[ICMP] Type=%d (Source Quench)", i.Type)
+	case ICMPRedirect:
+		return fmt.Sprintf("[ICMP] Type=%d (Redirect) Code=%d | Gateway=%s", i.Type, i.Code, i.Gateway())
+	case ICMPTimeExceeded:
+		return fmt.Sprintf("[ICMP] Type=%d (Time Exceeded) Code=%d", i.Type, i.Code)
+	case ICMPParamProblem:
+		return fmt.Sprintf("[ICMP] Type=%d (Parameter Problem) Code=%d | Pointer=%d", i.Type, i.Code, i.Pointer())
+	}
+	return fmt.Sprintf("[ICMP] Type=%d (Unknown) Code=%d", i.Type, i.Code)
 }
@@ -0,0 +1,158 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+// ICMPv6 message types (RFC 4443, RFC 4861)
+// errors have the high bit clear, informational messages have it set
+const (
+	ICMPv6DestUnreachable       = 1
+	ICMPv6PacketTooBig          = 2
+	ICMPv6TimeExceeded          = 3
+	ICMPv6ParamProblem          = 4
+	ICMPv6EchoRequest           = 128
+	ICMPv6EchoReply             = 129
+	ICMPv6RouterSolicitation    = 133
+	ICMPv6RouterAdvertisement   = 134
+	ICMPv6NeighborSolicitation  = 135
+	ICMPv6NeighborAdvertisement = 136
+	ICMPv6Redirect              = 137
+)
+
+// ICMPv6 Destination Unreachable codes
+const (
+	ICMPv6CodeNoRoute            = 0
+	ICMPv6CodeAdminProhibited    = 1
+	ICMPv6CodeBeyondScope        = 2
+	ICMPv6CodeAddressUnreachable = 3
+	ICMPv6CodePortUnreachable    = 4
+)
+
+// ICMPv6 Time Exceeded codes
+const (
+	ICMPv6CodeHopLimitExceeded   = 0
+	ICMPv6CodeReassemblyExceeded = 1
+)
+
+// represents the header + body
+// structure: [Type(1)][Code(1)][Checksum(2)][Body...]
+// errors start the body with a 32-bit parameter (unused, MTU or pointer) followed
+// by the invoking packet, echo messages with the ID and sequence number
+type ICMPv6Message struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Body     []byte
+}
+
+func ParseICMPv6(data []byte) (*ICMPv6Message, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("packet too short for ICMPv6: %d bytes", len(data))
+	}
+
+	return &ICMPv6Message{
+		Type:     data[0],
+		Code:     data[1],
+		Checksum: binary.BigEndian.Uint16(data[2:4]),
+		Body:     data[4:],
+	}, nil
+}
+
+// serializes the message, the checksum covers the IPv6 pseudo header so the
+// addresses it will be sent with are needed
+func (m *ICMPv6Message) Bytes(srcIP, dstIP net.IP) []byte {
+	buf := make([]byte, 4+len(m.Body))
+	buf[0] = m.Type
+	buf[1] = m.Code
+	copy(buf[4:], m.Body)
+
+	chkBuf := append(IPv6PseudoHeader(srcIP, dstIP, ProtocolICMPv6, len(buf)), buf...)
+	binary.BigEndian.PutUint16(buf[2:4], utils.Checksum(chkBuf))
+
+	return buf
+}
+
+// reports whether a received message has a valid checksum
+func VerifyICMPv6(data []byte, srcIP, dstIP net.IP) bool {
+	return utils.Checksum(append(IPv6PseudoHeader(srcIP, dstIP, ProtocolICMPv6, len(data)), data...)) == 0
+}
+
+// builds an Echo Request or Reply
+func NewICMPv6Echo(icmpType uint8, id, seq uint16, data []byte) *ICMPv6Message {
+	body := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint16(body[0:2], id)
+	binary.BigEndian.PutUint16(body[2:4], seq)
+	copy(body[4:], data)
+	return &ICMPv6Message{Type: icmpType, Body: body}
+}
+
+// returns the identifier, sequence number and data of an echo message
+func (m *ICMPv6Message) Echo() (id, seq uint16, data []byte) {
+	return binary.BigEndian.Uint16(m.Body[0:2]), binary.BigEndian.Uint16(m.Body[2:4]), m.Body[4:]
+}
+
+// builds an error message quoting the invoking packet, cut so the error fits
+// the minimum IPv6 MTU (RFC 4443 2.4 (c))
+func NewICMPv6Error(icmpType, code uint8, param uint32, invoking []byte) *ICMPv6Message {
+	quoted := min(len(invoking), IPv6MinMTU-IPv6HeaderLen-8)
+	body := make([]byte, 4+quoted)
+	binary.BigEndian.PutUint32(body[0:4], param)
+	copy(body[4:], invoking[:quoted])
+	return &ICMPv6Message{Type: icmpType, Code: code, Body: body}
+}
+
+// the parameter word of an error: the MTU of Packet Too Big, the pointer of
+// Parameter Problem, unused otherwise
+func (m *ICMPv6Message) Param() uint32 {
+	return binary.BigEndian.Uint32(m.Body[0:4])
+}
+
+// the invoking packet quoted by an error message
+func (m *ICMPv6Message) Quote() []byte {
+	return m.Body[4:]
+}
+
+// reports whether the message is an error quoting the packet that caused it
+func IsICMPv6Error(icmpType uint8) bool {
+	return icmpType < 128
+}
+
+func (m *ICMPv6Message) String() string {
+	typeStr := "Unknown"
+	switch m.Type {
+	case ICMPv6DestUnreachable:
+		typeStr = "Destination Unreachable"
+	case ICMPv6PacketTooBig:
+		typeStr = "Packet Too Big"
+	case ICMPv6TimeExceeded:
+		typeStr = "Time Exceeded"
+	case ICMPv6ParamProblem:
+		typeStr = "Parameter Problem"
+	case ICMPv6EchoRequest:
+		typeStr = "Echo Request"
+	case ICMPv6EchoReply:
+		typeStr = "Echo Reply"
+	case MLDListenerQuery:
+		typeStr = "MLD Query"
+	case MLDv1ListenerReport, MLDv2ListenerReport:
+		typeStr = "MLD Report"
+	case MLDListenerDone:
+		typeStr = "MLD Done"
+	case ICMPv6RouterSolicitation:
+		typeStr = "Router Solicitation"
+	case ICMPv6RouterAdvertisement:
+		typeStr = "Router Advertisement"
+	case ICMPv6NeighborSolicitation:
+		typeStr = "Neighbor Solicitation"
+	case ICMPv6NeighborAdvertisement:
+		typeStr = "Neighbor Advertisement"
+	case ICMPv6Redirect:
+		typeStr = "Redirect"
+	}
+	return fmt.Sprintf("[ICMPv6] Type=%d (%s) Code=%d", m.Type, typeStr, m.Code)
+}
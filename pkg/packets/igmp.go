@@ -0,0 +1,230 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+// IGMP message types (RFC 2236, RFC 3376)
+const (
+	IGMPMembershipQuery    = 0x11
+	IGMPv1MembershipReport = 0x12
+	IGMPv2MembershipReport = 0x16
+	IGMPv2LeaveGroup       = 0x17
+	IGMPv3MembershipReport = 0x22
+)
+
+// group record types of IGMPv3 reports (RFC 3376 4.2.12), MLDv2 reports use
+// the same values (RFC 3810 5.2.12)
+const (
+	ModeIsInclude   = 1 // current state
+	ModeIsExclude   = 2
+	ChangeToInclude = 3 // filter mode change
+	ChangeToExclude = 4
+	AllowNewSources = 5 // source list change
+	BlockOldSources = 6
+)
+
+// well known groups
+var (
+	IGMPAllHosts   = net.IPv4(224, 0, 0, 1).To4()
+	IGMPAllRouters = net.IPv4(224, 0, 0, 2).To4()
+	IGMPv3Routers  = net.IPv4(224, 0, 0, 22).To4()
+)
+
+// IGMPMessage covers v1/v2 messages and v3 queries
+// v1/v2 structure: [Type(1)][MaxResp(1)][Checksum(2)][Group(4)]
+// v3 query adds:   [Resv(4 bits)|S(1 bit)|QRV(3 bits)][QQIC(1)][NumSources(2)][Source(4)...]
+type IGMPMessage struct {
+	Type         uint8
+	MaxRespCode  uint8
+	Checksum     uint16
+	Group        net.IP
+	Version      int // 1, 2 or 3, derived from the message (RFC 3376 7.1)
+	SuppressFlag bool
+	QRV          uint8
+	QQIC         uint8
+	Sources      []net.IP
+}
+
+func ParseIGMP(data []byte) (*IGMPMessage, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("packet too short for IGMP: %d bytes", len(data))
+	}
+	if utils.Checksum(data) != 0 {
+		return nil, fmt.Errorf("bad IGMP checksum")
+	}
+
+	msg := &IGMPMessage{
+		Type:        data[0],
+		MaxRespCode: data[1],
+		Checksum:    binary.BigEndian.Uint16(data[2:4]),
+		Group:       net.IP(data[4:8]),
+		Version:     2,
+	}
+
+	switch msg.Type {
+	case IGMPv1MembershipReport:
+		msg.Version = 1
+	case IGMPMembershipQuery:
+		// query version is told apart by length and Max Resp Code
+		switch {
+		case len(data) >= 12:
+			msg.Version = 3
+			msg.SuppressFlag = data[8]&0x08 != 0
+			msg.QRV = data[8] & 0x07
+			msg.QQIC = data[9]
+			n := int(binary.BigEndian.Uint16(data[10:12]))
+			if len(data) < 12+4*n {
+				return nil, fmt.Errorf("IGMPv3 query truncated: %d sources", n)
+			}
+			for i := range n {
+				msg.Sources = append(msg.Sources, net.IP(data[12+4*i:16+4*i]))
+			}
+		case msg.MaxRespCode == 0:
+			msg.Version = 1
+		}
+	case IGMPv3MembershipReport:
+		msg.Version = 3
+	}
+
+	return msg, nil
+}
+
+// decodes the Max Resp Code into tenths of a second
+// v3 codes >= 128 use a floating point format (RFC 3376 4.1.1)
+func (m *IGMPMessage) MaxRespTime() int {
+	if m.Version == 1 {
+		return 100 // v1 queries have no max resp, 10s is implied
+	}
+	return decodeIGMPCode(m.MaxRespCode)
+}
+
+func decodeIGMPCode(code uint8) int {
+	if code < 128 {
+		return int(code)
+	}
+	mant := int(code & 0x0F)
+	exp := int((code >> 4) & 0x07)
+	return (mant | 0x10) << (exp + 3)
+}
+
+// serializes a v1/v2 message or a v3 query
+func (m *IGMPMessage) Bytes() []byte {
+	length := 8
+	if m.Version == 3 && m.Type == IGMPMembershipQuery {
+		length = 12 + 4*len(m.Sources)
+	}
+	buf := make([]byte, length)
+
+	buf[0] = m.Type
+	buf[1] = m.MaxRespCode
+	copy(buf[4:8], m.Group.To4())
+
+	if length > 8 {
+		buf[8] = m.QRV & 0x07
+		if m.SuppressFlag {
+			buf[8] |= 0x08
+		}
+		buf[9] = m.QQIC
+		binary.BigEndian.PutUint16(buf[10:12], uint16(len(m.Sources)))
+		for i, src := range m.Sources {
+			copy(buf[12+4*i:], src.To4())
+		}
+	}
+
+	binary.BigEndian.PutUint16(buf[2:4], utils.Checksum(buf))
+	return buf
+}
+
+func (m *IGMPMessage) String() string {
+	typeStr := "Unknown"
+	switch m.Type {
+	case IGMPMembershipQuery:
+		typeStr = fmt.Sprintf("v%d Query", m.Version)
+	case IGMPv1MembershipReport:
+		typeStr = "v1 Report"
+	case IGMPv2MembershipReport:
+		typeStr = "v2 Report"
+	case IGMPv2LeaveGroup:
+		typeStr = "Leave"
+	case IGMPv3MembershipReport:
+		typeStr = "v3 Report"
+	}
+	return fmt.Sprintf("[IGMP] %s | Group: %s | Sources: %v", typeStr, m.Group, m.Sources)
+}
+
+// a single group record of an IGMPv3 report
+// structure: [RecordType(1)][AuxDataLen(1)][NumSources(2)][Group(4)][Source(4)...][AuxData...]
+type IGMPv3GroupRecord struct {
+	Type    uint8 // ModeIsInclude ... BlockOldSources
+	Group   net.IP
+	Sources []net.IP
+}
+
+// IGMPv3 membership report
+// structure: [Type(1)][Reserved(1)][Checksum(2)][Reserved(2)][NumRecords(2)][Records...]
+type IGMPv3Report struct {
+	Records []IGMPv3GroupRecord
+}
+
+func ParseIGMPv3Report(data []byte) (*IGMPv3Report, error) {
+	if len(data) < 8 || data[0] != IGMPv3MembershipReport {
+		return nil, fmt.Errorf("not an IGMPv3 report")
+	}
+	if utils.Checksum(data) != 0 {
+		return nil, fmt.Errorf("bad IGMP checksum")
+	}
+
+	report := &IGMPv3Report{}
+	n := int(binary.BigEndian.Uint16(data[6:8]))
+	off := 8
+	for range n {
+		if len(data) < off+8 {
+			return nil, fmt.Errorf("IGMPv3 report truncated")
+		}
+		rec := IGMPv3GroupRecord{Type: data[off], Group: net.IP(data[off+4 : off+8])}
+		auxLen := int(data[off+1]) * 4
+		numSources := int(binary.BigEndian.Uint16(data[off+2 : off+4]))
+		off += 8
+		if len(data) < off+4*numSources+auxLen {
+			return nil, fmt.Errorf("IGMPv3 record truncated")
+		}
+		for i := range numSources {
+			rec.Sources = append(rec.Sources, net.IP(data[off+4*i:off+4*i+4]))
+		}
+		off += 4*numSources + auxLen
+		report.Records = append(report.Records, rec)
+	}
+
+	return report, nil
+}
+
+func (r *IGMPv3Report) Bytes() []byte {
+	length := 8
+	for _, rec := range r.Records {
+		length += 8 + 4*len(rec.Sources)
+	}
+	buf := make([]byte, length)
+
+	buf[0] = IGMPv3MembershipReport
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(r.Records)))
+
+	off := 8
+	for _, rec := range r.Records {
+		buf[off] = rec.Type
+		binary.BigEndian.PutUint16(buf[off+2:off+4], uint16(len(rec.Sources)))
+		copy(buf[off+4:off+8], rec.Group.To4())
+		off += 8
+		for _, src := range rec.Sources {
+			copy(buf[off:off+4], src.To4())
+			off += 4
+		}
+	}
+
+	binary.BigEndian.PutUint16(buf[2:4], utils.Checksum(buf))
+	return buf
+}
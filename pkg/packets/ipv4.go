@@ -2,6 +2,7 @@ package packets
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 
@@ -11,11 +12,21 @@ import (
 // IP protocols
 const (
 	ProtocolICMP = 1
+	ProtocolIGMP = 2
+	ProtocolIPIP = 4 // IPv4 in IPv4 (RFC 2003)
 	ProtocolTCP  = 6
 	ProtocolUDP  = 17
+	ProtocolGRE  = 47
+	ProtocolESP  = 50 // IPsec Encapsulating Security Payload (RFC 4303)
 )
 
-// IPv4Header assuming no Options
+// IPv4 flags (3 bits: [Reserved][DF][MF])
+const (
+	IPv4FlagMF = 0x1 // more fragments
+	IPv4FlagDF = 0x2 // don't fragment
+)
+
+// IPv4Header structure (20 bytes min, up to 60 with options)
 type IPv4Header struct {
 	Version        uint8
 	IHL            uint8
@@ -29,6 +40,19 @@ type IPv4Header struct {
 	Checksum       uint16
 	SrcIP          net.IP
 	DstIP          net.IP
+	Options        []IPv4Option
+	Payload        []byte // L4 data, trimmed to TotalLength
+}
+
+// a malformed header the sender should be told about with a Parameter Problem
+// (RFC 792), as opposed to the plain errors of packets that are just dropped
+type IPv4HeaderError struct {
+	Pointer int // offset of the offending byte from the start of the IPv4 header
+	Reason  string
+}
+
+func (e *IPv4HeaderError) Error() string {
+	return fmt.Sprintf("%s (offset %d)", e.Reason, e.Pointer)
 }
 
 func ParseIPv4(data []byte) (*IPv4Header, error) {
@@ -36,9 +60,42 @@ func ParseIPv4(data []byte) (*IPv4Header, error) {
 		return nil, fmt.Errorf("packet too short for IPv4: %d bytes", len(data))
 	}
 
+	if version := data[0] >> 4; version != 4 {
+		return nil, fmt.Errorf("invalid IPv4 version: %d", version)
+	}
+
+	// IHL is the header size in 32-bit words (min 5)
+	ihl := data[0] & 0x0F
+	headerLen := int(ihl) * 4
+	if ihl < 5 || len(data) < headerLen {
+		return nil, fmt.Errorf("invalid IPv4 header length: %d", headerLen)
+	}
+
+	// a header corrupted in transit must not be delivered, rewritten or
+	// forwarded (RFC 1812 5.2.2)
+	if utils.Checksum(data[:headerLen]) != 0 {
+		return nil, fmt.Errorf("bad IPv4 header checksum 0x%04x", binary.BigEndian.Uint16(data[10:12]))
+	}
+
+	// frames may carry Ethernet padding after the datagram, so trust TotalLength
+	totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+	if totalLen < headerLen || totalLen > len(data) {
+		return nil, fmt.Errorf("invalid IPv4 total length: %d (have %d bytes)", totalLen, len(data))
+	}
+
+	opts, err := ParseIPv4Options(data[20:headerLen])
+	if err != nil {
+		// pointers count from the start of the header, not of the options
+		var hdrErr *IPv4HeaderError
+		if errors.As(err, &hdrErr) {
+			hdrErr.Pointer += 20
+		}
+		return nil, err
+	}
+
 	return &IPv4Header{
 		Version:        data[0] >> 4,
-		IHL:            data[0] & 0x0F,
+		IHL:            ihl,
 		TOS:            data[1],
 		TotalLength:    binary.BigEndian.Uint16(data[2:4]),
 		Identification: binary.BigEndian.Uint16(data[4:6]),
@@ -49,13 +106,46 @@ func ParseIPv4(data []byte) (*IPv4Header, error) {
 		Checksum:       binary.BigEndian.Uint16(data[10:12]),
 		SrcIP:          net.IP(data[12:16]),
 		DstIP:          net.IP(data[16:20]),
+		Options:        opts,
+		Payload:        data[headerLen:totalLen],
 	}, nil
 }
 
+// returns the header size in bytes including padded options
+func (ip *IPv4Header) HeaderLen() int {
+	length := 0
+	for _, o := range ip.Options {
+		length += o.Len()
+	}
+	return 20 + (length+3)&^3
+}
+
+// reports whether the packet is a fragment of a larger datagram
+func (ip *IPv4Header) IsFragment() bool {
+	return ip.Flags&IPv4FlagMF != 0 || ip.FragmentOffset != 0
+}
+
+// returns the first option of the given type, if present
+func (ip *IPv4Header) Option(optType uint8) (IPv4Option, bool) {
+	for _, o := range ip.Options {
+		if o.Type == optType {
+			return o, true
+		}
+	}
+	return IPv4Option{}, false
+}
+
 // encodes IPv4 header and calculates the checksum
-func (ip *IPv4Header) Bytes() []byte {
-	// standard header size = 20 bytes (no options)
-	buf := make([]byte, 20)
+// IHL is derived from the options, which must fit the header: they're never
+// dropped, since HeaderLen (and so TotalLength) counts them
+func (ip *IPv4Header) Bytes() ([]byte, error) {
+	opts, err := SerializeIPv4Options(ip.Options)
+	if err != nil {
+		return nil, err
+	}
+	ip.IHL = uint8(5 + len(opts)/4)
+
+	buf := make([]byte, 20+len(opts))
 
 	buf[0] = (ip.Version << 4) | (ip.IHL & 0x0F)
 	buf[1] = ip.TOS
@@ -73,24 +163,85 @@ func (ip *IPv4Header) Bytes() []byte {
 
 	copy(buf[12:16], ip.SrcIP.To4())
 	copy(buf[16:20], ip.DstIP.To4())
+	copy(buf[20:], opts)
 
 	// calculate header checksum
 	csum := utils.Checksum(buf)
 	binary.BigEndian.PutUint16(buf[10:12], csum)
 
+	return buf, nil
+}
+
+// rewrites the addresses of a serialized packet in place, patching the header
+// checksum incrementally (used by NAT, transport checksums are up to the caller)
+func RewriteIPv4Addrs(pkt []byte, src, dst net.IP) {
+	csum := binary.BigEndian.Uint16(pkt[10:12])
+	csum = utils.UpdateChecksumBytes(csum, pkt[12:16], src.To4())
+	csum = utils.UpdateChecksumBytes(csum, pkt[16:20], dst.To4())
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	binary.BigEndian.PutUint16(pkt[10:12], csum)
+}
+
+// patches a transport checksum at csumOff after the ports (first 4 bytes) and the
+// pseudo header addresses changed, seg may be truncated (e.g. quoted in an ICMP
+// error) in which case only what's there is rewritten
+func rewriteTransport(seg []byte, csumOff int, oldSrc, oldDst, newSrc, newDst net.IP, srcPort, dstPort uint16) (uint16, bool) {
+	if len(seg) < 4 {
+		return 0, false
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+
+	if len(seg) < csumOff+2 {
+		copy(seg[0:4], ports[:])
+		return 0, false
+	}
+	csum := binary.BigEndian.Uint16(seg[csumOff : csumOff+2])
+	csum = utils.UpdateChecksumBytes(csum, seg[0:4], ports[:])
+	csum = utils.UpdateChecksumBytes(csum, oldSrc.To4(), newSrc.To4())
+	csum = utils.UpdateChecksumBytes(csum, oldDst.To4(), newDst.To4())
+	copy(seg[0:4], ports[:])
+	return csum, true
+}
+
+// builds the pseudo header TCP and UDP checksums cover (RFC 9293 3.1)
+// structure: [Src(4)][Dst(4)][Zero(1)][Protocol(1)][Length(2)]
+func IPv4PseudoHeader(src, dst net.IP, proto uint8, length int) []byte {
+	buf := make([]byte, 12)
+	copy(buf[0:4], src.To4())
+	copy(buf[4:8], dst.To4())
+	buf[9] = proto
+	binary.BigEndian.PutUint16(buf[10:12], uint16(length))
 	return buf
 }
 
+// builds the pseudo header of an IP version, 4 or 6. The version is never
+// guessed from the addresses, a v4-mapped one is still an IPv6 address
+func PseudoHeader(version int, src, dst net.IP, proto uint8, length int) []byte {
+	if version == 4 {
+		return IPv4PseudoHeader(src, dst, proto, length)
+	}
+	return IPv6PseudoHeader(src, dst, proto, length)
+}
+
 func (ip *IPv4Header) String() string {
 	proto := "Unknown"
 	switch ip.Protocol {
 	case ProtocolICMP:
 		proto = "ICMP"
+	case ProtocolIGMP:
+		proto = "IGMP"
 	case ProtocolTCP:
 		proto = "TCP"
 	case ProtocolUDP:
 		proto = "UDP"
 	}
-	return fmt.Sprintf("[IPv4] %s -> %s | Proto: %s | Len: %d | TTL: %d",
+	str := fmt.Sprintf("[IPv4] %s -> %s | Proto: %s | Len: %d | TTL: %d",
 		ip.SrcIP, ip.DstIP, proto, ip.TotalLength, ip.TTL)
+	if len(ip.Options) > 0 {
+		str += fmt.Sprintf(" | Opts: %v", ip.Options)
+	}
+	return str
 }
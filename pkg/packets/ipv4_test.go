@@ -0,0 +1,128 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/utils"
+)
+
+// a header with the given options area, followed by 8 bytes of UDP
+func ipv4WithOptions(opts []byte) []byte {
+	h := &IPv4Header{
+		Version: 4, TTL: 64, Protocol: ProtocolUDP,
+		SrcIP: net.IPv4(192, 0, 2, 1).To4(), DstIP: net.IPv4(192, 0, 2, 2).To4(),
+		TotalLength: uint16(20 + len(opts) + 8),
+	}
+	hdr, _ := h.Bytes() // no options, can't fail
+	pkt := append(append(hdr, opts...), make([]byte, 8)...)
+	pkt[0] = 4<<4 | byte(5+len(opts)/4)
+	binary.BigEndian.PutUint16(pkt[10:12], 0)
+	binary.BigEndian.PutUint16(pkt[10:12], utils.Checksum(pkt[:20+len(opts)]))
+	return pkt
+}
+
+// a router must not process headers corrupted in transit (RFC 1812 5.2.2)
+func TestParseIPv4Corrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(pkt []byte)
+	}{
+		{"flipped address bit", func(pkt []byte) { pkt[15] ^= 1 }},
+		{"zero checksum", func(pkt []byte) { pkt[10], pkt[11] = 0, 0 }},
+		{"version 6", func(pkt []byte) {
+			// with a checksum that matches, so only the version is wrong
+			pkt[0] = 6<<4 | pkt[0]&0x0F
+			binary.BigEndian.PutUint16(pkt[10:12], 0)
+			binary.BigEndian.PutUint16(pkt[10:12], utils.Checksum(pkt[:20]))
+		}},
+	}
+	for _, tt := range tests {
+		pkt := ipv4WithOptions(nil)
+		if _, err := ParseIPv4(pkt); err != nil {
+			t.Fatalf("intact packet: %v", err)
+		}
+		tt.corrupt(pkt)
+		if _, err := ParseIPv4(pkt); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestParseIPv4BadOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []byte
+		pointer int
+	}{
+		{"length below 2", []byte{IPv4OptionRecordRoute, 1, 0, 0}, 21},
+		{"length past the options", []byte{IPv4OptionNOP, IPv4OptionRecordRoute, 7, 4}, 22},
+		{"type without length", []byte{IPv4OptionNOP, IPv4OptionNOP, IPv4OptionNOP, IPv4OptionTimestamp}, 23},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := ipv4WithOptions(tt.opts)
+			_, err := ParseIPv4(pkt)
+			var hdrErr *IPv4HeaderError
+			if !errors.As(err, &hdrErr) {
+				t.Fatalf("err = %v, want an IPv4HeaderError", err)
+			}
+			if hdrErr.Pointer != tt.pointer {
+				t.Fatalf("pointer = %d, want %d", hdrErr.Pointer, tt.pointer)
+			}
+
+			// the Parameter Problem built from it says which byte is wrong
+			msg, err := ParseICMP(NewICMPParamProblem(uint8(hdrErr.Pointer), pkt).Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != ICMPParamProblem || msg.Code != ICMPCodePointer || int(msg.Pointer()) != tt.pointer {
+				t.Fatalf("got %s", msg)
+			}
+			if string(msg.Quote()) != string(pkt) {
+				t.Fatalf("quote %x, want %x", msg.Quote(), pkt)
+			}
+		})
+	}
+
+	// well formed options still parse
+	if _, err := ParseIPv4(ipv4WithOptions([]byte{IPv4OptionRouterAlert, 4, 0, 0})); err != nil {
+		t.Fatalf("router alert: %v", err)
+	}
+}
+
+func TestICMPRedirect(t *testing.T) {
+	invoking := ipv4WithOptions(nil)
+	msg, err := NewICMPRedirect(ICMPCodeRedirectHost, net.IPv4(192, 0, 2, 254), invoking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseICMP(msg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Code != ICMPCodeRedirectHost || !parsed.Gateway().Equal(net.IPv4(192, 0, 2, 254)) {
+		t.Fatalf("got %s", parsed)
+	}
+
+	if _, err := NewICMPRedirect(ICMPCodeRedirectHost, net.ParseIP("2001:db8::1"), invoking); err == nil {
+		t.Fatal("IPv6 gateway accepted")
+	}
+}
+
+// HeaderLen counts every option, so Bytes must refuse rather than drop them
+func TestIPv4BytesOptionsTooLong(t *testing.T) {
+	h := &IPv4Header{Version: 4, TTL: 64, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(192, 0, 2, 2)}
+	h.Options = []IPv4Option{{Type: IPv4OptionRecordRoute, Data: make([]byte, 39)}}
+	if _, err := h.Bytes(); err == nil {
+		t.Fatalf("%d bytes of options serialized", h.HeaderLen()-20)
+	}
+
+	h.Options = []IPv4Option{NewRouterAlertOption(0)}
+	buf, err := h.Bytes()
+	if err != nil || len(buf) != h.HeaderLen() {
+		t.Fatalf("got %d bytes (%v), HeaderLen %d", len(buf), err, h.HeaderLen())
+	}
+}
@@ -0,0 +1,337 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IPv4 option types (RFC 791, RFC 2113)
+// the type byte packs [Copied(1)][Class(2)][Number(5)]
+const (
+	IPv4OptionEOL               = 0
+	IPv4OptionNOP               = 1
+	IPv4OptionRecordRoute       = 7
+	IPv4OptionTimestamp         = 68
+	IPv4OptionLooseSourceRoute  = 131
+	IPv4OptionStrictSourceRoute = 137
+	IPv4OptionRouterAlert       = 148
+)
+
+// timestamp option flags (RFC 791)
+const (
+	TimestampOnly        = 0
+	TimestampWithAddr    = 1
+	TimestampPrespecific = 3
+)
+
+// max bytes available for options (IHL max 15 words - 5 words of fixed header)
+const IPv4MaxOptionsLen = 40
+
+// IPv4Option is a single raw option
+// structure: [Type(1)][Length(1)][Data...] (EOL and NOP are a single Type byte)
+type IPv4Option struct {
+	Type uint8
+	Data []byte // option body, without the type and length bytes
+}
+
+// Copied reports whether the option must be copied into every fragment
+func (o IPv4Option) Copied() bool {
+	return o.Type&0x80 != 0
+}
+
+// wire length of the option
+func (o IPv4Option) Len() int {
+	if o.Type == IPv4OptionEOL || o.Type == IPv4OptionNOP {
+		return 1
+	}
+	return 2 + len(o.Data)
+}
+
+func (o IPv4Option) String() string {
+	switch o.Type {
+	case IPv4OptionEOL:
+		return "EOL"
+	case IPv4OptionNOP:
+		return "NOP"
+	case IPv4OptionRecordRoute, IPv4OptionLooseSourceRoute, IPv4OptionStrictSourceRoute:
+		if r, err := o.Route(); err == nil {
+			return r.String()
+		}
+	case IPv4OptionTimestamp:
+		if ts, err := o.Timestamp(); err == nil {
+			return ts.String()
+		}
+	case IPv4OptionRouterAlert:
+		if v, err := o.RouterAlert(); err == nil {
+			return fmt.Sprintf("RA(%d)", v)
+		}
+	}
+	return fmt.Sprintf("Opt(%d, %d bytes)", o.Type, len(o.Data))
+}
+
+// splits the options area of an IPv4 header into single options
+// a malformed option gives an *IPv4HeaderError pointing into data
+func ParseIPv4Options(data []byte) ([]IPv4Option, error) {
+	var opts []IPv4Option
+
+	for i := 0; i < len(data); {
+		optType := data[i]
+
+		switch optType {
+		case IPv4OptionEOL:
+			// everything after EOL is padding
+			return opts, nil
+		case IPv4OptionNOP:
+			opts = append(opts, IPv4Option{Type: optType})
+			i++
+			continue
+		}
+
+		if i+1 >= len(data) {
+			return nil, &IPv4HeaderError{Pointer: i, Reason: fmt.Sprintf("truncated IPv4 option %d", optType)}
+		}
+		optLen := int(data[i+1])
+		if optLen < 2 || i+optLen > len(data) {
+			return nil, &IPv4HeaderError{Pointer: i + 1, Reason: fmt.Sprintf("invalid length %d for IPv4 option %d", optLen, optType)}
+		}
+
+		opts = append(opts, IPv4Option{Type: optType, Data: data[i+2 : i+optLen]})
+		i += optLen
+	}
+
+	return opts, nil
+}
+
+// encodes options padded with EOL to a multiple of 4 bytes
+func SerializeIPv4Options(opts []IPv4Option) ([]byte, error) {
+	length := 0
+	for _, o := range opts {
+		length += o.Len()
+	}
+	padded := (length + 3) &^ 3
+	if padded > IPv4MaxOptionsLen {
+		return nil, fmt.Errorf("IPv4 options too long: %d bytes (max %d)", padded, IPv4MaxOptionsLen)
+	}
+
+	// zeroed buffer, so the padding is already EOL
+	buf := make([]byte, padded)
+	i := 0
+	for _, o := range opts {
+		buf[i] = o.Type
+		if o.Len() > 1 {
+			buf[i+1] = uint8(o.Len())
+			copy(buf[i+2:], o.Data)
+		}
+		i += o.Len()
+	}
+
+	return buf, nil
+}
+
+// RouteOption is the typed view of Record Route, Loose and Strict Source Route
+// structure: [Type(1)][Length(1)][Pointer(1)][Addr(4)...]
+type RouteOption struct {
+	Type    uint8
+	Pointer uint8 // 1-based offset of the next free slot (min 4)
+	Addrs   []net.IP
+}
+
+// creates an empty Record Route option with room for n addresses
+func NewRecordRouteOption(n int) *RouteOption {
+	r := &RouteOption{Type: IPv4OptionRecordRoute, Pointer: 4}
+	for range n {
+		r.Addrs = append(r.Addrs, net.IPv4zero.To4())
+	}
+	return r
+}
+
+// decodes a route option
+func (o IPv4Option) Route() (*RouteOption, error) {
+	switch o.Type {
+	case IPv4OptionRecordRoute, IPv4OptionLooseSourceRoute, IPv4OptionStrictSourceRoute:
+	default:
+		return nil, fmt.Errorf("option %d is not a route option", o.Type)
+	}
+	if len(o.Data) < 1 || (len(o.Data)-1)%4 != 0 {
+		return nil, fmt.Errorf("malformed route option: %d bytes", len(o.Data))
+	}
+
+	r := &RouteOption{Type: o.Type, Pointer: o.Data[0]}
+	if r.Pointer < 4 {
+		return nil, fmt.Errorf("invalid route option pointer: %d", r.Pointer)
+	}
+	for i := 1; i < len(o.Data); i += 4 {
+		r.Addrs = append(r.Addrs, net.IP(o.Data[i:i+4]))
+	}
+
+	return r, nil
+}
+
+// Full reports whether every address slot has been used
+func (r *RouteOption) Full() bool {
+	return int(r.Pointer) > 3+len(r.Addrs)*4
+}
+
+// stores ip in the next free slot, returns false if there's no room
+func (r *RouteOption) Record(ip net.IP) bool {
+	if r.Full() {
+		return false
+	}
+	slot := (int(r.Pointer) - 4) / 4
+	r.Addrs[slot] = ip.To4()
+	r.Pointer += 4
+	return true
+}
+
+// encodes back to a raw option
+func (r *RouteOption) Option() IPv4Option {
+	data := make([]byte, 1+4*len(r.Addrs))
+	data[0] = r.Pointer
+	for i, a := range r.Addrs {
+		copy(data[1+4*i:], a.To4())
+	}
+	return IPv4Option{Type: r.Type, Data: data}
+}
+
+func (r *RouteOption) String() string {
+	name := "RR"
+	switch r.Type {
+	case IPv4OptionLooseSourceRoute:
+		name = "LSRR"
+	case IPv4OptionStrictSourceRoute:
+		name = "SSRR"
+	}
+	used := (int(r.Pointer) - 4) / 4
+	return fmt.Sprintf("%s(%d/%d) %v", name, min(used, len(r.Addrs)), len(r.Addrs), r.Addrs[:min(used, len(r.Addrs))])
+}
+
+// single timestamp slot, Addr is nil for TimestampOnly
+type TimestampEntry struct {
+	Addr net.IP
+	Time uint32 // milliseconds since midnight UT
+}
+
+// TimestampOption is the typed view of the Internet Timestamp option
+// structure: [Type(1)][Length(1)][Pointer(1)][Overflow(4 bits)|Flag(4 bits)][Entries...]
+type TimestampOption struct {
+	Pointer  uint8
+	Overflow uint8 // hops that couldn't record due to lack of space
+	Flag     uint8
+	Entries  []TimestampEntry
+}
+
+// decodes a timestamp option
+func (o IPv4Option) Timestamp() (*TimestampOption, error) {
+	if o.Type != IPv4OptionTimestamp {
+		return nil, fmt.Errorf("option %d is not a timestamp option", o.Type)
+	}
+	if len(o.Data) < 2 {
+		return nil, fmt.Errorf("malformed timestamp option: %d bytes", len(o.Data))
+	}
+
+	ts := &TimestampOption{
+		Pointer:  o.Data[0],
+		Overflow: o.Data[1] >> 4,
+		Flag:     o.Data[1] & 0x0F,
+	}
+	if ts.Pointer < 5 {
+		return nil, fmt.Errorf("invalid timestamp pointer: %d", ts.Pointer)
+	}
+
+	body := o.Data[2:]
+	switch ts.Flag {
+	case TimestampOnly:
+		if len(body)%4 != 0 {
+			return nil, fmt.Errorf("malformed timestamp option: %d bytes", len(o.Data))
+		}
+		for i := 0; i < len(body); i += 4 {
+			ts.Entries = append(ts.Entries, TimestampEntry{Time: binary.BigEndian.Uint32(body[i : i+4])})
+		}
+	case TimestampWithAddr, TimestampPrespecific:
+		if len(body)%8 != 0 {
+			return nil, fmt.Errorf("malformed timestamp option: %d bytes", len(o.Data))
+		}
+		for i := 0; i < len(body); i += 8 {
+			ts.Entries = append(ts.Entries, TimestampEntry{
+				Addr: net.IP(body[i : i+4]),
+				Time: binary.BigEndian.Uint32(body[i+4 : i+8]),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown timestamp flag: %d", ts.Flag)
+	}
+
+	return ts, nil
+}
+
+// size in bytes of a single entry
+func (t *TimestampOption) entrySize() int {
+	if t.Flag == TimestampOnly {
+		return 4
+	}
+	return 8
+}
+
+// stores a timestamp taken at ip
+// when the option is full the overflow counter is bumped instead (RFC 791)
+func (t *TimestampOption) Record(ip net.IP, ms uint32) {
+	slot := (int(t.Pointer) - 5) / t.entrySize()
+	if slot >= len(t.Entries) {
+		if t.Overflow < 15 {
+			t.Overflow++
+		}
+		return
+	}
+
+	switch t.Flag {
+	case TimestampOnly:
+		t.Entries[slot].Time = ms
+	case TimestampWithAddr:
+		t.Entries[slot] = TimestampEntry{Addr: ip.To4(), Time: ms}
+	case TimestampPrespecific:
+		// only the host named in the next slot may record
+		if !t.Entries[slot].Addr.Equal(ip) {
+			return
+		}
+		t.Entries[slot].Time = ms
+	}
+	t.Pointer += uint8(t.entrySize())
+}
+
+// encodes back to a raw option
+func (t *TimestampOption) Option() IPv4Option {
+	size := t.entrySize()
+	data := make([]byte, 2+size*len(t.Entries))
+	data[0] = t.Pointer
+	data[1] = t.Overflow<<4 | t.Flag&0x0F
+	for i, e := range t.Entries {
+		off := 2 + size*i
+		if size == 8 {
+			copy(data[off:off+4], e.Addr.To4())
+			off += 4
+		}
+		binary.BigEndian.PutUint32(data[off:off+4], e.Time)
+	}
+	return IPv4Option{Type: IPv4OptionTimestamp, Data: data}
+}
+
+func (t *TimestampOption) String() string {
+	used := min((int(t.Pointer)-5)/t.entrySize(), len(t.Entries))
+	return fmt.Sprintf("TS(flag=%d, %d/%d, overflow=%d)", t.Flag, used, len(t.Entries), t.Overflow)
+}
+
+// creates a Router Alert option (RFC 2113), value 0 means "examine packet"
+func NewRouterAlertOption(value uint16) IPv4Option {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return IPv4Option{Type: IPv4OptionRouterAlert, Data: data}
+}
+
+// decodes the Router Alert value
+func (o IPv4Option) RouterAlert() (uint16, error) {
+	if o.Type != IPv4OptionRouterAlert || len(o.Data) != 2 {
+		return 0, fmt.Errorf("malformed router alert option")
+	}
+	return binary.BigEndian.Uint16(o.Data), nil
+}
@@ -0,0 +1,86 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// fixed size of the IPv6 header, options live in extension headers (RFC 8200 3)
+const IPv6HeaderLen = 40
+
+// every link carrying IPv6 must take packets of this size (RFC 8200 5)
+const IPv6MinMTU = 1280
+
+// IPv6Header structure (40 bytes)
+type IPv6Header struct {
+	Version       uint8
+	TrafficClass  uint8
+	FlowLabel     uint32 // 20 bits
+	PayloadLength uint16 // everything after the fixed header, extension headers included
+	NextHeader    uint8  // first extension header or the upper-layer protocol
+	HopLimit      uint8
+	SrcIP         net.IP
+	DstIP         net.IP
+	Payload       []byte // extension headers + L4 data, trimmed to PayloadLength
+}
+
+func ParseIPv6(data []byte) (*IPv6Header, error) {
+	if len(data) < IPv6HeaderLen {
+		return nil, fmt.Errorf("packet too short for IPv6: %d bytes", len(data))
+	}
+	if version := data[0] >> 4; version != 6 {
+		return nil, fmt.Errorf("invalid IPv6 version: %d", version)
+	}
+
+	// frames may carry Ethernet padding after the packet, so trust PayloadLength
+	// (a zero length means a jumbogram, which needs a bigger link than ours)
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	if IPv6HeaderLen+payloadLen > len(data) {
+		return nil, fmt.Errorf("invalid IPv6 payload length: %d (have %d bytes)", payloadLen, len(data)-IPv6HeaderLen)
+	}
+
+	vtf := binary.BigEndian.Uint32(data[0:4])
+	return &IPv6Header{
+		Version:       data[0] >> 4,
+		TrafficClass:  uint8(vtf >> 20),
+		FlowLabel:     vtf & 0xFFFFF,
+		PayloadLength: uint16(payloadLen),
+		NextHeader:    data[6],
+		HopLimit:      data[7],
+		SrcIP:         net.IP(data[8:24]),
+		DstIP:         net.IP(data[24:40]),
+		Payload:       data[IPv6HeaderLen : IPv6HeaderLen+payloadLen],
+	}, nil
+}
+
+// encodes the fixed IPv6 header, the caller appends the payload
+func (ip *IPv6Header) Bytes() []byte {
+	buf := make([]byte, IPv6HeaderLen)
+
+	vtf := uint32(6)<<28 | uint32(ip.TrafficClass)<<20 | ip.FlowLabel&0xFFFFF
+	binary.BigEndian.PutUint32(buf[0:4], vtf)
+	binary.BigEndian.PutUint16(buf[4:6], ip.PayloadLength)
+	buf[6] = ip.NextHeader
+	buf[7] = ip.HopLimit
+	copy(buf[8:24], ip.SrcIP.To16())
+	copy(buf[24:40], ip.DstIP.To16())
+
+	return buf
+}
+
+// builds the pseudo header upper-layer checksums cover (RFC 8200 8.1)
+// structure: [Src(16)][Dst(16)][Upper-Layer Length(4)][Zero(3)][Next Header(1)]
+func IPv6PseudoHeader(src, dst net.IP, proto uint8, length int) []byte {
+	buf := make([]byte, 40)
+	copy(buf[0:16], src.To16())
+	copy(buf[16:32], dst.To16())
+	binary.BigEndian.PutUint32(buf[32:36], uint32(length))
+	buf[39] = proto
+	return buf
+}
+
+func (ip *IPv6Header) String() string {
+	return fmt.Sprintf("[IPv6] %s -> %s | Next: %s | Len: %d | Hop Limit: %d",
+		ip.SrcIP, ip.DstIP, IPv6ProtocolName(ip.NextHeader), ip.PayloadLength, ip.HopLimit)
+}
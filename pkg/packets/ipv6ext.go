@@ -0,0 +1,282 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// IPv6 extension headers and upper-layer protocols only IPv6 uses (RFC 8200 4)
+const (
+	ProtocolHopByHop = 0
+	ProtocolRouting  = 43
+	ProtocolFragment = 44
+	ProtocolAH       = 51 // IPsec Authentication Header (RFC 4302)
+	ProtocolICMPv6   = 58
+	ProtocolNoNext   = 59
+	ProtocolDestOpts = 60
+)
+
+// IPv6 option types (RFC 8200 4.2, RFC 2711, RFC 2675)
+// the two high bits of the type say what to do when the option is unknown,
+// the third one that it may change en route
+const (
+	IPv6OptionPad1        = 0x00
+	IPv6OptionPadN        = 0x01
+	IPv6OptionRouterAlert = 0x05
+	IPv6OptionJumbo       = 0xC2
+)
+
+// Router Alert values (RFC 2711)
+const IPv6RouterAlertMLD = 0
+
+// actions for unrecognized options, from the two high bits of the type
+const (
+	IPv6OptionSkip         = 0 // skip over it
+	IPv6OptionDiscard      = 1 // discard the packet silently
+	IPv6OptionDiscardICMP  = 2 // discard and send Parameter Problem
+	IPv6OptionDiscardICMPU = 3 // discard and send Parameter Problem unless the destination was multicast
+)
+
+// routing header types (RFC 8200 4.4), type 0 is deprecated (RFC 5095)
+const (
+	IPv6RoutingType0 = 0
+	IPv6RoutingType2 = 2 // Mobile IPv6 (RFC 6275)
+)
+
+// Parameter Problem codes (RFC 4443 3.4) for errors found walking the headers
+const (
+	IPv6ProblemHeaderField = 0 // erroneous header field
+	IPv6ProblemNextHeader  = 1 // unrecognized Next Header type
+	IPv6ProblemOption      = 2 // unrecognized IPv6 option
+	IPv6ProblemHeaderChain = 3 // first fragment without the whole header chain (RFC 7112)
+)
+
+// a malformed IPv6 packet, with what a Parameter Problem about it would carry
+type IPv6HeaderError struct {
+	Code    uint8
+	Pointer int // offset of the offending byte from the start of the IPv6 header
+	Reason  string
+}
+
+func (e *IPv6HeaderError) Error() string {
+	return fmt.Sprintf("%s (offset %d)", e.Reason, e.Pointer)
+}
+
+// a single extension header
+// structure: [Next Header(1)][Hdr Ext Len(1)][Data...] (the fragment header has no length)
+type IPv6Extension struct {
+	Type       uint8 // protocol number of the header itself (ProtocolHopByHop, ...)
+	NextHeader uint8
+	Offset     int    // from the start of the IPv6 header
+	Data       []byte // the whole header, starting with its Next Header byte
+}
+
+// wire length of an extension header from its first bytes
+func extensionLen(extType uint8, data []byte) int {
+	switch extType {
+	case ProtocolFragment:
+		return 8
+	case ProtocolAH:
+		return (int(data[1]) + 2) * 4
+	}
+	return (int(data[1]) + 1) * 8
+}
+
+// reports whether proto is an extension header we know how to skip over
+func IsIPv6Extension(proto uint8) bool {
+	switch proto {
+	case ProtocolHopByHop, ProtocolRouting, ProtocolFragment, ProtocolAH, ProtocolDestOpts:
+		return true
+	}
+	return false
+}
+
+// walks the extension header chain of ip, returning the headers in order,
+// the upper-layer protocol and its data. The walk stops after a fragment header
+// that isn't the first fragment, since what follows is the middle of a datagram.
+// A first fragment has to carry the whole chain up to the upper-layer header
+func ParseIPv6Extensions(ip *IPv6Header) ([]IPv6Extension, uint8, []byte, error) {
+	var exts []IPv6Extension
+	next, data := ip.NextHeader, ip.Payload
+	offset := IPv6HeaderLen
+	nextField := 6 // where the current Next Header value lives, for errors
+	firstFragment := false
+
+	for IsIPv6Extension(next) {
+		// hop-by-hop options must come right after the IPv6 header (RFC 8200 4.1)
+		if next == ProtocolHopByHop && len(exts) > 0 {
+			return nil, 0, nil, &IPv6HeaderError{IPv6ProblemNextHeader, nextField, "hop-by-hop options not first"}
+		}
+		if len(data) < 8 || extensionLen(next, data) > len(data) {
+			if firstFragment {
+				return nil, 0, nil, &IPv6HeaderError{IPv6ProblemHeaderChain, 0, "header chain continues past the first fragment"}
+			}
+			if len(data) < 8 {
+				return nil, 0, nil, &IPv6HeaderError{IPv6ProblemHeaderField, offset, "truncated extension header"}
+			}
+			return nil, 0, nil, &IPv6HeaderError{IPv6ProblemHeaderField, offset + 1, "extension header past the end of the packet"}
+		}
+		length := extensionLen(next, data)
+
+		ext := IPv6Extension{Type: next, NextHeader: data[0], Offset: offset, Data: data[:length]}
+		exts = append(exts, ext)
+		next, data = ext.NextHeader, data[length:]
+		nextField, offset = offset, offset+length
+
+		if ext.Type == ProtocolFragment {
+			f := ext.Fragment()
+			if f.Offset != 0 {
+				break
+			}
+			firstFragment = f.More
+		}
+	}
+	if firstFragment && len(data) == 0 && next != ProtocolNoNext {
+		return nil, 0, nil, &IPv6HeaderError{IPv6ProblemHeaderChain, 0, "no upper-layer header in the first fragment"}
+	}
+	return exts, next, data, nil
+}
+
+// builds a hop-by-hop options header holding just a Router Alert, which MLD
+// messages carry so routers look at them (RFC 3810 5)
+func NewIPv6RouterAlertHeader(next uint8, value uint16) []byte {
+	buf := []byte{next, 0, IPv6OptionRouterAlert, 2, 0, 0, IPv6OptionPadN, 0}
+	binary.BigEndian.PutUint16(buf[4:6], value)
+	return buf
+}
+
+// returns the first extension header of the given type, if present
+func FindIPv6Extension(exts []IPv6Extension, extType uint8) (IPv6Extension, bool) {
+	for _, e := range exts {
+		if e.Type == extType {
+			return e, true
+		}
+	}
+	return IPv6Extension{}, false
+}
+
+// a single option of a hop-by-hop or destination options header
+type IPv6Option struct {
+	Type   uint8
+	Data   []byte
+	Offset int // from the start of the IPv6 header
+}
+
+// what to do with the packet if we don't know the option
+func (o IPv6Option) Action() uint8 {
+	return o.Type >> 6
+}
+
+// decodes the Router Alert value (RFC 2711)
+func (o IPv6Option) RouterAlert() (uint16, error) {
+	if o.Type != IPv6OptionRouterAlert || len(o.Data) != 2 {
+		return 0, fmt.Errorf("malformed router alert option")
+	}
+	return binary.BigEndian.Uint16(o.Data), nil
+}
+
+func (o IPv6Option) String() string {
+	if v, err := o.RouterAlert(); err == nil {
+		return fmt.Sprintf("RA(%d)", v)
+	}
+	return fmt.Sprintf("Opt(0x%02x, %d bytes)", o.Type, len(o.Data))
+}
+
+// splits a hop-by-hop or destination options header into its options,
+// padding is skipped
+func (e IPv6Extension) Options() ([]IPv6Option, error) {
+	if e.Type != ProtocolHopByHop && e.Type != ProtocolDestOpts {
+		return nil, fmt.Errorf("not an options header: %d", e.Type)
+	}
+
+	var opts []IPv6Option
+	data := e.Data[2:]
+	for i := 0; i < len(data); {
+		if data[i] == IPv6OptionPad1 {
+			i++
+			continue
+		}
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return nil, &IPv6HeaderError{IPv6ProblemHeaderField, e.Offset + 2 + i, "option past the end of its header"}
+		}
+		length := int(data[i+1])
+		if data[i] != IPv6OptionPadN {
+			opts = append(opts, IPv6Option{Type: data[i], Data: data[i+2 : i+2+length], Offset: e.Offset + 2 + i})
+		}
+		i += 2 + length
+	}
+	return opts, nil
+}
+
+// fixed fields of a routing header, the type specific data follows them
+type IPv6Routing struct {
+	RoutingType  uint8
+	SegmentsLeft uint8
+	Data         []byte
+}
+
+func (e IPv6Extension) Routing() IPv6Routing {
+	return IPv6Routing{RoutingType: e.Data[2], SegmentsLeft: e.Data[3], Data: e.Data[4:]}
+}
+
+// fields of a fragment header
+// structure: [Next(1)][Reserved(1)][Offset(13 bits) Res(2) M(1)][Identification(4)]
+type IPv6Fragment struct {
+	Offset         int // in bytes
+	More           bool
+	Identification uint32
+}
+
+func (e IPv6Extension) Fragment() IPv6Fragment {
+	offM := binary.BigEndian.Uint16(e.Data[2:4])
+	return IPv6Fragment{
+		Offset:         int(offM &^ 0x7), // 8 byte units in the high 13 bits
+		More:           offM&0x1 != 0,
+		Identification: binary.BigEndian.Uint32(e.Data[4:8]),
+	}
+}
+
+// serializes a fragment header carrying next
+func (f IPv6Fragment) Bytes(next uint8) []byte {
+	buf := make([]byte, 8)
+	buf[0] = next
+	offM := uint16(f.Offset) &^ 0x7
+	if f.More {
+		offM |= 0x1
+	}
+	binary.BigEndian.PutUint16(buf[2:4], offM)
+	binary.BigEndian.PutUint32(buf[4:8], f.Identification)
+	return buf
+}
+
+// reports whether the fragment header belongs to a packet that was never
+// actually split (offset 0, no more fragments), see RFC 6946
+func (f IPv6Fragment) Atomic() bool {
+	return f.Offset == 0 && !f.More
+}
+
+func IPv6ProtocolName(p uint8) string {
+	switch p {
+	case ProtocolHopByHop:
+		return "HopByHop"
+	case ProtocolRouting:
+		return "Routing"
+	case ProtocolFragment:
+		return "Fragment"
+	case ProtocolDestOpts:
+		return "DestOpts"
+	case ProtocolAH:
+		return "AH"
+	case ProtocolESP:
+		return "ESP"
+	case ProtocolICMPv6:
+		return "ICMPv6"
+	case ProtocolNoNext:
+		return "NoNext"
+	case ProtocolTCP:
+		return "TCP"
+	case ProtocolUDP:
+		return "UDP"
+	}
+	return fmt.Sprintf("%d", p)
+}
@@ -0,0 +1,156 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MLD message types, carried in ICMPv6 (RFC 2710, RFC 3810)
+const (
+	MLDListenerQuery    = 130
+	MLDv1ListenerReport = 131
+	MLDListenerDone     = 132
+	MLDv2ListenerReport = 143
+)
+
+// well known groups
+var (
+	MLDAllRouters = net.ParseIP("ff02::2")  // MLDv1 Done goes here
+	MLDv2Routers  = net.ParseIP("ff02::16") // all MLDv2-capable routers
+)
+
+// MLDMessage covers v1 messages and v2 queries, it is the body of the ICMPv6 message
+// v1 structure:    [MaxRespDelay(2)][Reserved(2)][Multicast Address(16)]
+// v2 query adds:   [Resv(4 bits)|S(1 bit)|QRV(3 bits)][QQIC(1)][NumSources(2)][Source(16)...]
+type MLDMessage struct {
+	Type         uint8
+	MaxRespCode  uint16
+	Group        net.IP
+	Version      int // 1 or 2, queries are told apart by length (RFC 3810 8.1)
+	SuppressFlag bool
+	QRV          uint8
+	QQIC         uint8
+	Sources      []net.IP
+}
+
+func ParseMLD(msg *ICMPv6Message) (*MLDMessage, error) {
+	body := msg.Body
+	if len(body) < 20 {
+		return nil, fmt.Errorf("packet too short for MLD: %d bytes", len(body))
+	}
+
+	m := &MLDMessage{
+		Type:        msg.Type,
+		MaxRespCode: binary.BigEndian.Uint16(body[0:2]),
+		Group:       net.IP(body[4:20]),
+		Version:     1,
+	}
+
+	// anything from 24 bytes on is a v2 query, 21-23 bytes is invalid
+	if m.Type == MLDListenerQuery && len(body) > 20 {
+		if len(body) < 24 {
+			return nil, fmt.Errorf("invalid MLD query length: %d bytes", len(body))
+		}
+		m.Version = 2
+		m.SuppressFlag = body[20]&0x08 != 0
+		m.QRV = body[20] & 0x07
+		m.QQIC = body[21]
+		n := int(binary.BigEndian.Uint16(body[22:24]))
+		if len(body) < 24+16*n {
+			return nil, fmt.Errorf("MLDv2 query truncated: %d sources", n)
+		}
+		for i := range n {
+			m.Sources = append(m.Sources, net.IP(body[24+16*i:40+16*i]))
+		}
+	}
+
+	return m, nil
+}
+
+// decodes the Maximum Response Code, v2 codes >= 32768 use a floating point
+// format (RFC 3810 5.1.3)
+func (m *MLDMessage) MaxRespDelay() time.Duration {
+	code := int(m.MaxRespCode)
+	if m.Version == 2 && code >= 32768 {
+		mant := code & 0x0fff
+		exp := (code >> 12) & 0x07
+		code = (mant | 0x1000) << (exp + 3)
+	}
+	return time.Duration(code) * time.Millisecond
+}
+
+// serializes a v1 message or a v2 query into an ICMPv6 body
+func (m *MLDMessage) Bytes() []byte {
+	length := 20
+	if m.Version == 2 && m.Type == MLDListenerQuery {
+		length = 24 + 16*len(m.Sources)
+	}
+	buf := make([]byte, length)
+
+	binary.BigEndian.PutUint16(buf[0:2], m.MaxRespCode)
+	copy(buf[4:20], m.Group.To16())
+
+	if length > 20 {
+		buf[20] = m.QRV & 0x07
+		if m.SuppressFlag {
+			buf[20] |= 0x08
+		}
+		buf[21] = m.QQIC
+		binary.BigEndian.PutUint16(buf[22:24], uint16(len(m.Sources)))
+		for i, src := range m.Sources {
+			copy(buf[24+16*i:], src.To16())
+		}
+	}
+	return buf
+}
+
+func (m *MLDMessage) String() string {
+	typeStr := "Unknown"
+	switch m.Type {
+	case MLDListenerQuery:
+		typeStr = fmt.Sprintf("v%d Query", m.Version)
+	case MLDv1ListenerReport:
+		typeStr = "v1 Report"
+	case MLDListenerDone:
+		typeStr = "Done"
+	}
+	return fmt.Sprintf("[MLD] %s | Group: %s | Sources: %v", typeStr, m.Group, m.Sources)
+}
+
+// a single multicast address record of an MLDv2 report
+// structure: [RecordType(1)][AuxDataLen(1)][NumSources(2)][Address(16)][Source(16)...][AuxData...]
+type MLDv2Record struct {
+	Type    uint8 // ModeIsInclude ... BlockOldSources, shared with IGMPv3
+	Group   net.IP
+	Sources []net.IP
+}
+
+// MLDv2 report, the body of the ICMPv6 message
+// structure: [Reserved(2)][NumRecords(2)][Records...]
+type MLDv2Report struct {
+	Records []MLDv2Record
+}
+
+func (r *MLDv2Report) Bytes() []byte {
+	length := 4
+	for _, rec := range r.Records {
+		length += 20 + 16*len(rec.Sources)
+	}
+	buf := make([]byte, length)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(r.Records)))
+
+	off := 4
+	for _, rec := range r.Records {
+		buf[off] = rec.Type
+		binary.BigEndian.PutUint16(buf[off+2:off+4], uint16(len(rec.Sources)))
+		copy(buf[off+4:off+20], rec.Group.To16())
+		off += 20
+		for _, src := range rec.Sources {
+			copy(buf[off:off+16], src.To16())
+			off += 16
+		}
+	}
+	return buf
+}
@@ -0,0 +1,233 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Neighbor Discovery option types (RFC 4861 4.6)
+const (
+	NDPOptionSourceLinkAddr = 1
+	NDPOptionTargetLinkAddr = 2
+	NDPOptionPrefixInfo     = 3
+	NDPOptionRedirected     = 4
+	NDPOptionMTU            = 5
+)
+
+// a single Neighbor Discovery option
+// structure: [Type(1)][Length(1), in units of 8 bytes][Data...]
+type NDPOption struct {
+	Type uint8
+	Data []byte // option body, without the type and length bytes
+}
+
+// splits the options area of a Neighbor Discovery message
+// a zero length is invalid and makes the whole message invalid (RFC 4861 4.6)
+func ParseNDPOptions(data []byte) ([]NDPOption, error) {
+	var opts []NDPOption
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated ND option")
+		}
+		length := int(data[1]) * 8
+		if length == 0 || length > len(data) {
+			return nil, fmt.Errorf("invalid ND option length: %d", length)
+		}
+		opts = append(opts, NDPOption{Type: data[0], Data: data[2:length]})
+		data = data[length:]
+	}
+	return opts, nil
+}
+
+// encodes options, each padded to a multiple of 8 bytes
+func SerializeNDPOptions(opts []NDPOption) []byte {
+	var buf []byte
+	for _, o := range opts {
+		length := (2 + len(o.Data) + 7) &^ 7
+		opt := make([]byte, length)
+		opt[0] = o.Type
+		opt[1] = uint8(length / 8)
+		copy(opt[2:], o.Data)
+		buf = append(buf, opt...)
+	}
+	return buf
+}
+
+// returns the first option of the given type, if present
+func FindNDPOption(opts []NDPOption, optType uint8) (NDPOption, bool) {
+	for _, o := range opts {
+		if o.Type == optType {
+			return o, true
+		}
+	}
+	return NDPOption{}, false
+}
+
+// builds a source or target link-layer address option for an Ethernet MAC
+func NewLinkAddrOption(optType uint8, mac net.HardwareAddr) NDPOption {
+	return NDPOption{Type: optType, Data: append([]byte(nil), mac...)}
+}
+
+// decodes a link-layer address option, Ethernet addresses only (RFC 2464 8)
+func (o NDPOption) LinkAddr() (net.HardwareAddr, bool) {
+	if (o.Type != NDPOptionSourceLinkAddr && o.Type != NDPOptionTargetLinkAddr) || len(o.Data) < 6 {
+		return nil, false
+	}
+	return net.HardwareAddr(o.Data[:6]), true
+}
+
+// Prefix Information option (RFC 4861 4.6.2)
+// structure: [Prefix Len(1)][L|A|Reserved(1)][Valid(4)][Preferred(4)][Reserved(4)][Prefix(16)]
+type PrefixInfo struct {
+	Prefix     *net.IPNet
+	OnLink     bool   // L: the prefix is on this link
+	Autonomous bool   // A: addresses may be autoconfigured from it
+	Valid      uint32 // seconds, all ones means forever
+	Preferred  uint32
+}
+
+// decodes a Prefix Information option
+func (o NDPOption) PrefixInfo() (PrefixInfo, error) {
+	if o.Type != NDPOptionPrefixInfo || len(o.Data) != 30 {
+		return PrefixInfo{}, fmt.Errorf("malformed prefix information option")
+	}
+	length := int(o.Data[0])
+	if length > 128 {
+		return PrefixInfo{}, fmt.Errorf("invalid prefix length: %d", length)
+	}
+	mask := net.CIDRMask(length, 128)
+	return PrefixInfo{
+		Prefix:     &net.IPNet{IP: net.IP(o.Data[14:30]).Mask(mask), Mask: mask},
+		OnLink:     o.Data[1]&0x80 != 0,
+		Autonomous: o.Data[1]&0x40 != 0,
+		Valid:      binary.BigEndian.Uint32(o.Data[2:6]),
+		Preferred:  binary.BigEndian.Uint32(o.Data[6:10]),
+	}, nil
+}
+
+// decodes an MTU option (RFC 4861 4.6.4)
+func (o NDPOption) MTU() (uint32, error) {
+	if o.Type != NDPOptionMTU || len(o.Data) != 6 {
+		return 0, fmt.Errorf("malformed MTU option")
+	}
+	return binary.BigEndian.Uint32(o.Data[2:6]), nil
+}
+
+// Router Solicitation body (RFC 4861 4.1)
+// structure: [Reserved(4)][Options...]
+type RouterSolicitation struct {
+	Options []NDPOption
+}
+
+func (rs *RouterSolicitation) Bytes() []byte {
+	return append(make([]byte, 4), SerializeNDPOptions(rs.Options)...)
+}
+
+// Router Advertisement body (RFC 4861 4.2)
+// structure: [Cur Hop Limit(1)][M|O|Reserved(1)][Router Lifetime(2)]
+// [Reachable Time(4)][Retrans Timer(4)][Options...]
+type RouterAdvertisement struct {
+	CurHopLimit    uint8 // 0 means unspecified
+	Managed        bool  // M: addresses are available through DHCPv6
+	Other          bool  // O: other configuration is available through DHCPv6
+	RouterLifetime uint16
+	ReachableTime  uint32 // milliseconds, 0 means unspecified
+	RetransTimer   uint32
+	Options        []NDPOption
+}
+
+func ParseRouterAdvertisement(body []byte) (*RouterAdvertisement, error) {
+	if len(body) < 12 {
+		return nil, fmt.Errorf("router advertisement too short: %d bytes", len(body))
+	}
+	opts, err := ParseNDPOptions(body[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &RouterAdvertisement{
+		CurHopLimit:    body[0],
+		Managed:        body[1]&0x80 != 0,
+		Other:          body[1]&0x40 != 0,
+		RouterLifetime: binary.BigEndian.Uint16(body[2:4]),
+		ReachableTime:  binary.BigEndian.Uint32(body[4:8]),
+		RetransTimer:   binary.BigEndian.Uint32(body[8:12]),
+		Options:        opts,
+	}, nil
+}
+
+// Neighbor Solicitation body (RFC 4861 4.3)
+// structure: [Reserved(4)][Target(16)][Options...]
+type NeighborSolicitation struct {
+	Target  net.IP
+	Options []NDPOption
+}
+
+func ParseNeighborSolicitation(body []byte) (*NeighborSolicitation, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("neighbor solicitation too short: %d bytes", len(body))
+	}
+	opts, err := ParseNDPOptions(body[20:])
+	if err != nil {
+		return nil, err
+	}
+	return &NeighborSolicitation{Target: net.IP(body[4:20]), Options: opts}, nil
+}
+
+func (ns *NeighborSolicitation) Bytes() []byte {
+	buf := make([]byte, 20)
+	copy(buf[4:20], ns.Target.To16())
+	return append(buf, SerializeNDPOptions(ns.Options)...)
+}
+
+// Neighbor Advertisement body (RFC 4861 4.4)
+// structure: [R|S|O|Reserved(4)][Target(16)][Options...]
+type NeighborAdvertisement struct {
+	Router    bool // sender is a router
+	Solicited bool // sent in response to a solicitation
+	Override  bool // should replace a cached link-layer address
+	Target    net.IP
+	Options   []NDPOption
+}
+
+func ParseNeighborAdvertisement(body []byte) (*NeighborAdvertisement, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("neighbor advertisement too short: %d bytes", len(body))
+	}
+	opts, err := ParseNDPOptions(body[20:])
+	if err != nil {
+		return nil, err
+	}
+	flags := body[0]
+	return &NeighborAdvertisement{
+		Router:    flags&0x80 != 0,
+		Solicited: flags&0x40 != 0,
+		Override:  flags&0x20 != 0,
+		Target:    net.IP(body[4:20]),
+		Options:   opts,
+	}, nil
+}
+
+func (na *NeighborAdvertisement) Bytes() []byte {
+	buf := make([]byte, 20)
+	var flags uint32
+	if na.Router {
+		flags |= 1 << 31
+	}
+	if na.Solicited {
+		flags |= 1 << 30
+	}
+	if na.Override {
+		flags |= 1 << 29
+	}
+	binary.BigEndian.PutUint32(buf[0:4], flags)
+	copy(buf[4:20], na.Target.To16())
+	return append(buf, SerializeNDPOptions(na.Options)...)
+}
+
+// returns the solicited-node multicast group of an address: ff02::1:ff
+// followed by its low 24 bits (RFC 4291 2.7.1)
+func SolicitedNodeMulticast(ip net.IP) net.IP {
+	ip6 := ip.To16()
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, ip6[13], ip6[14], ip6[15]}
+}
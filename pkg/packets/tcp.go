@@ -18,6 +18,13 @@ const (
 	TCPFlagURG = 0x20
 )
 
+// TCP option kinds
+const (
+	TCPOptionEnd = 0
+	TCPOptionNOP = 1
+	TCPOptionMSS = 2
+)
+
 // TCPHeader structure (20 bytes min)
 type TCPHeader struct {
 	SrcPort    uint16
@@ -29,6 +36,7 @@ type TCPHeader struct {
 	Window     uint16
 	Checksum   uint16
 	UrgentPtr  uint16
+	Options    []byte // raw, padded to DataOffset
 	Data       []byte
 }
 
@@ -56,16 +64,17 @@ func ParseTCP(data []byte) (*TCPHeader, error) {
 		Window:     binary.BigEndian.Uint16(data[14:16]),
 		Checksum:   binary.BigEndian.Uint16(data[16:18]),
 		UrgentPtr:  binary.BigEndian.Uint16(data[18:20]),
+		Options:    data[20:max(20, headerLen)],
 		Data:       data[headerLen:],
 	}, nil
 }
 
 // serializes the TCP packet
-// requires srcIP and dstIP for pseudo-header checksum (same as UDP)
-func (t *TCPHeader) Bytes(srcIP, dstIP net.IP) []byte {
-	// if offset is 0 (not set), default to min size (5 words = 20 bytes)
+// requires the IP version, srcIP and dstIP for pseudo-header checksum (same as UDP)
+func (t *TCPHeader) Bytes(version int, srcIP, dstIP net.IP) []byte {
+	// if offset is 0 (not set), default to min size (5 words = 20 bytes) plus options
 	if t.DataOffset == 0 {
-		t.DataOffset = 5
+		t.DataOffset = uint8(5 + (len(t.Options)+3)/4)
 	}
 
 	headerLen := int(t.DataOffset) * 4
@@ -86,24 +95,60 @@ func (t *TCPHeader) Bytes(srcIP, dstIP net.IP) []byte {
 	// checksum placeholder at 16..18
 	binary.BigEndian.PutUint16(buf[18:20], t.UrgentPtr)
 
+	// options, the zero padding reads as End of Option List
+	copy(buf[20:headerLen], t.Options)
+
 	// copy payload
 	copy(buf[headerLen:], t.Data)
 
 	// pseudo-header checksum calc
-	pseudoHeader := make([]byte, 12)
-	copy(pseudoHeader[0:4], srcIP.To4())
-	copy(pseudoHeader[4:8], dstIP.To4())
-	pseudoHeader[8] = 0
-	pseudoHeader[9] = ProtocolTCP
-	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(totalLen))
-
-	chkBuf := append(pseudoHeader, buf...)
+	chkBuf := append(PseudoHeader(version, srcIP, dstIP, ProtocolTCP, totalLen), buf...)
 	csum := utils.Checksum(chkBuf)
 	binary.BigEndian.PutUint16(buf[16:18], csum)
 
 	return buf
 }
 
+// checks the checksum of a received segment, seg being the whole TCP packet
+func VerifyTCP(version int, seg []byte, srcIP, dstIP net.IP) bool {
+	return len(seg) >= 20 && utils.Checksum(append(PseudoHeader(version, srcIP, dstIP, ProtocolTCP, len(seg)), seg...)) == 0
+}
+
+// returns the Maximum Segment Size option (RFC 9293 3.7.1), false if there's none
+func (t *TCPHeader) MSS() (uint16, bool) {
+	opts := t.Options
+	for len(opts) > 0 {
+		switch opts[0] {
+		case TCPOptionEnd:
+			return 0, false
+		case TCPOptionNOP:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return 0, false
+		}
+		if opts[0] == TCPOptionMSS && opts[1] == 4 {
+			return binary.BigEndian.Uint16(opts[2:4]), true
+		}
+		opts = opts[opts[1]:]
+	}
+	return 0, false
+}
+
+// builds a Maximum Segment Size option
+func NewTCPMSSOption(mss uint16) []byte {
+	return []byte{TCPOptionMSS, 4, byte(mss >> 8), byte(mss)}
+}
+
+// rewrites the ports of a serialized segment in place and patches its checksum
+// for the new ports and pseudo header addresses (RFC 1624), used by NAT
+func RewriteTCP(seg []byte, oldSrc, oldDst, newSrc, newDst net.IP, srcPort, dstPort uint16) {
+	if csum, ok := rewriteTransport(seg, 16, oldSrc, oldDst, newSrc, newDst, srcPort, dstPort); ok {
+		binary.BigEndian.PutUint16(seg[16:18], csum)
+	}
+}
+
 func (t *TCPHeader) String() string {
 	var flags []string
 	if t.Flags&TCPFlagSYN != 0 {
@@ -34,8 +34,8 @@ func ParseUDP(data []byte) (*UDPPacket, error) {
 
 // serializes the UDP packet
 // IMPORTANT: UDP checksum requires the "IP Pseudo Header" to be calculated
-// need to pass srcIP and dstIP here to build that context
-func (u *UDPPacket) Bytes(srcIP, dstIP net.IP) []byte {
+// need to pass the IP version, srcIP and dstIP here to build that context
+func (u *UDPPacket) Bytes(version int, srcIP, dstIP net.IP) []byte {
 	totalLen := 8 + len(u.Data)
 	buf := make([]byte, totalLen)
 
@@ -49,18 +49,10 @@ func (u *UDPPacket) Bytes(srcIP, dstIP net.IP) []byte {
 
 	// pseudo header checksum calc
 	// to calc the checksum correctly, we must sum:
-	// 1 - IP pseudo header (SrcIP, DstIP, Proto, Len)
+	// 1 - IP pseudo header (SrcIP, DstIP, Proto, Len) of the given IP version
 	// 2 - UDP header itself
 	// 3 - the data
-	pseudoHeader := make([]byte, 12)
-	copy(pseudoHeader[0:4], srcIP.To4())
-	copy(pseudoHeader[4:8], dstIP.To4())
-	pseudoHeader[8] = 0
-	pseudoHeader[9] = ProtocolUDP
-	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(totalLen))
-
-	// join everything for checksum calc
-	chkBuf := append(pseudoHeader, buf...)
+	chkBuf := append(PseudoHeader(version, srcIP, dstIP, ProtocolUDP, totalLen), buf...)
 	csum := utils.Checksum(chkBuf)
 
 	// UDP checksum of 0 means "no checksum", so if result is 0, use 0xFFFF
@@ -73,6 +65,36 @@ func (u *UDPPacket) Bytes(srcIP, dstIP net.IP) []byte {
 	return buf
 }
 
+// checks the checksum of a received datagram, seg being the whole UDP packet
+// a zero checksum means the sender didn't compute one, which only IPv4
+// allows (RFC 8200 8.1)
+func VerifyUDP(version int, seg []byte, srcIP, dstIP net.IP) bool {
+	if len(seg) < 8 {
+		return false
+	}
+	if binary.BigEndian.Uint16(seg[6:8]) == 0 {
+		return version == 4
+	}
+	return utils.Checksum(append(PseudoHeader(version, srcIP, dstIP, ProtocolUDP, len(seg)), seg...)) == 0
+}
+
+// rewrites the ports of a serialized datagram in place and patches its checksum
+// for the new ports and pseudo header addresses (RFC 1624), used by NAT
+// a zero checksum means the sender didn't compute one and stays zero (RFC 768)
+func RewriteUDP(seg []byte, oldSrc, oldDst, newSrc, newDst net.IP, srcPort, dstPort uint16) {
+	if len(seg) >= 8 && binary.BigEndian.Uint16(seg[6:8]) == 0 {
+		binary.BigEndian.PutUint16(seg[0:2], srcPort)
+		binary.BigEndian.PutUint16(seg[2:4], dstPort)
+		return
+	}
+	if csum, ok := rewriteTransport(seg, 6, oldSrc, oldDst, newSrc, newDst, srcPort, dstPort); ok {
+		if csum == 0 {
+			csum = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(seg[6:8], csum)
+	}
+}
+
 func (u *UDPPacket) String() string {
 	return fmt.Sprintf("[UDP] Port %d -> %d | Len: %d | Sum: 0x%04x",
 		u.SrcPort, u.DstPort, u.Length, u.Checksum)
@@ -0,0 +1,151 @@
+package pmtu
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	MinMTU         = 68               // every IPv4 link carries this much (RFC 791)
+	MinMTU6        = 1280             // and every IPv6 link this much (RFC 8200 5)
+	MinPMTU        = 552              // floor for learned values, smaller claims are likely forged (Linux min_pmtu)
+	DefaultTimeout = 10 * time.Minute // RFC 1191 6.3
+)
+
+// common MTUs of RFC 1191 7.1, used when a router doesn't say its next-hop MTU
+var plateaus = []int{65535, 32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, MinMTU}
+
+// returns the largest plateau below size
+func NextPlateau(size int) int {
+	for _, p := range plateaus {
+		if p < size {
+			return p
+		}
+	}
+	return MinMTU
+}
+
+// returns the path MTU a Fragmentation Needed message tells us about: the
+// next-hop MTU, or for old routers that leave it zero (RFC 1191 5) the plateau
+// below the length of the packet that didn't fit
+func FromFragNeeded(nextHopMTU, quotedLen int) int {
+	if nextHopMTU >= MinMTU && nextHopMTU < quotedLen {
+		return nextHopMTU
+	}
+	return NextPlateau(quotedLen)
+}
+
+// what we know about the path to a destination
+type Entry struct {
+	Dst     net.IP
+	MTU     int
+	Expires time.Time
+	Locked  bool // clamped to MinPMTU, DF must be cleared so routers can fragment
+	Probed  bool // confirmed by probing rather than learned from ICMP
+}
+
+// per-destination path MTUs, safe for concurrent use
+// entries age out so a path that got better is found again (RFC 1191 6.3)
+// IPv4 and IPv6 destinations share the cache, keyed by their 16 byte form
+type Cache struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	entries map[[16]byte]*Entry
+}
+
+func NewCache(timeout time.Duration) *Cache {
+	return &Cache{timeout: timeout, entries: make(map[[16]byte]*Entry)}
+}
+
+func key(dst net.IP) [16]byte {
+	return [16]byte(dst.To16())
+}
+
+// the address as entries show it, IPv4 ones in 4 byte form
+func canonical(dst net.IP) net.IP {
+	if v4 := dst.To4(); v4 != nil {
+		return v4
+	}
+	return dst.To16()
+}
+
+// lowers the path MTU of dst after a Fragmentation Needed or Packet Too Big,
+// values above what we have are ignored. Returns the new value and whether it changed
+func (c *Cache) Reduce(dst net.IP, mtu int, now time.Time) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	locked := false
+	if dst.To4() == nil {
+		// nothing below the IPv6 minimum, no matter what a Packet Too Big says (RFC 8201 4)
+		mtu = max(mtu, MinMTU6)
+	} else if mtu < MinPMTU {
+		mtu, locked = MinPMTU, true
+	}
+
+	k := key(dst)
+	if e, ok := c.entries[k]; ok && e.MTU <= mtu {
+		return e.MTU, false
+	}
+	c.entries[k] = &Entry{Dst: canonical(dst), MTU: mtu, Expires: now.Add(c.timeout), Locked: locked}
+	return mtu, true
+}
+
+// records a path MTU confirmed by probing, which may raise it
+func (c *Cache) Set(dst net.IP, mtu int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key(dst)] = &Entry{Dst: canonical(dst), MTU: mtu, Expires: now.Add(c.timeout), Probed: true}
+}
+
+// returns the path MTU towards dst on a link of linkMTU, and whether DF may be set
+func (c *Cache) Lookup(dst net.IP, linkMTU int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key(dst)]; ok {
+		return min(e.MTU, linkMTU), !e.Locked
+	}
+	return linkMTU, true
+}
+
+// forgets aged entries and returns them, must be called periodically
+func (c *Cache) Expire(now time.Time) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expired []Entry
+	for key, e := range c.entries {
+		if !now.Before(e.Expires) {
+			delete(c.entries, key)
+			expired = append(expired, *e)
+		}
+	}
+	return expired
+}
+
+// forgets everything, returns how many entries went away
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	clear(c.entries)
+	return n
+}
+
+// returns a snapshot of every entry, sorted by destination
+func (c *Cache) Entries() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := make([]Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		list = append(list, *e)
+	}
+	slices.SortFunc(list, func(a, b Entry) int { return slices.Compare(a.Dst, b.Dst) })
+	return list
+}
@@ -0,0 +1,51 @@
+package pmtu
+
+// times a probe size is tried before it's considered too big (RFC 8899 MAX_PROBES)
+const MaxProbes = 3
+
+// packetization layer PMTU discovery (RFC 4821, RFC 8899): a binary search for
+// the largest probe that makes it to the destination, which also finds black
+// holes where Fragmentation Needed messages never arrive
+type Search struct {
+	low    int // largest size known to get through
+	high   int // smallest size known not to, or one past the link MTU
+	size   int // size being probed
+	probes int // failed probes of size
+}
+
+// starts a search between low (assumed to work) and the link MTU
+func NewSearch(low, linkMTU int) *Search {
+	s := &Search{low: low, high: linkMTU + 1}
+	// the link MTU itself is the most likely answer, try it first
+	s.size = linkMTU
+	return s
+}
+
+// returns the next size to probe, false once the search is over
+func (s *Search) Next() (int, bool) {
+	if s.low+1 >= s.high {
+		return 0, false
+	}
+	return s.size, true
+}
+
+// records the outcome of a probe of the current size
+func (s *Search) Result(ok bool) {
+	if ok {
+		s.low = s.size
+	} else {
+		// a lost probe may be plain packet loss, only give up on the size
+		// after MaxProbes of them
+		if s.probes++; s.probes < MaxProbes {
+			return
+		}
+		s.high = s.size
+	}
+	s.probes = 0
+	s.size = (s.low + s.high) / 2
+}
+
+// returns the largest size confirmed so far
+func (s *Search) PMTU() int {
+	return s.low
+}
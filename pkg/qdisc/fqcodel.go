@@ -0,0 +1,200 @@
+package qdisc
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"time"
+)
+
+// FQ-CoDel defaults (RFC 8290)
+const (
+	DefaultFlows    = 1024
+	DefaultQuantum  = 1514 // one full Ethernet frame
+	DefaultTarget   = 5 * time.Millisecond
+	DefaultInterval = 100 * time.Millisecond
+	DefaultFQLimit  = 10240
+)
+
+// a flow queue of FQ-CoDel with its CoDel state (RFC 8289)
+type flow struct {
+	queue   fifo
+	deficit int
+	active  bool // on the new or old list
+
+	firstAbove time.Time // when the sojourn time will have been above target for an interval
+	dropNext   time.Time
+	count      int
+	lastCount  int
+	dropping   bool
+}
+
+// flow queueing with CoDel (RFC 8290): packets are hashed into flows served
+// round robin a quantum of bytes at a time, new flows first, and each flow
+// drops packets that waited longer than target for a whole interval
+type FQCoDel struct {
+	limit     int
+	quantum   int
+	target    time.Duration
+	interval  time.Duration
+	maxPacket int // largest packet seen, a queue this small is no standing queue
+
+	seed     maphash.Seed
+	flows    []flow
+	newFlows []*flow
+	oldFlows []*flow
+	stats    Stats
+}
+
+func NewFQCoDel(limit, flows, quantum int, target, interval time.Duration) *FQCoDel {
+	return &FQCoDel{
+		limit:    limit,
+		quantum:  quantum,
+		target:   target,
+		interval: interval,
+		seed:     maphash.MakeSeed(),
+		flows:    make([]flow, flows),
+	}
+}
+
+func (q *FQCoDel) Enqueue(p *Packet, now time.Time) bool {
+	f := &q.flows[maphash.Bytes(q.seed, p.flowKey())%uint64(len(q.flows))]
+
+	p.enqueued = now
+	q.maxPacket = max(q.maxPacket, p.Len())
+	f.queue.push(p)
+	q.stats.enqueue(p)
+	if !f.active {
+		f.active = true
+		f.deficit = q.quantum
+		q.newFlows = append(q.newFlows, f)
+	}
+
+	if q.stats.Backlog > q.limit {
+		// over the limit, make room at the expense of the fattest flow
+		fattest := f
+		for i := range q.flows {
+			if q.flows[i].queue.bytes > fattest.queue.bytes {
+				fattest = &q.flows[i]
+			}
+		}
+		dropped := fattest.queue.pop()
+		q.stats.drop(dropped)
+		return dropped != p
+	}
+	return true
+}
+
+func (q *FQCoDel) Dequeue(now time.Time) (*Packet, time.Duration) {
+	for {
+		list := &q.newFlows
+		if len(*list) == 0 {
+			list = &q.oldFlows
+		}
+		if len(*list) == 0 {
+			return nil, 0
+		}
+		f := (*list)[0]
+
+		if f.deficit <= 0 {
+			f.deficit += q.quantum
+			*list = (*list)[1:]
+			q.oldFlows = append(q.oldFlows, f)
+			continue
+		}
+
+		p := q.codelDequeue(f, now)
+		if p == nil {
+			*list = (*list)[1:]
+			// an emptied new flow goes through the old list once so it can't
+			// jump the queue again right away
+			if list == &q.newFlows && len(q.oldFlows) > 0 {
+				q.oldFlows = append(q.oldFlows, f)
+			} else {
+				f.active = false
+			}
+			continue
+		}
+
+		f.deficit -= p.Len()
+		q.stats.dequeue(p)
+		return p, 0
+	}
+}
+
+// pops the head of a flow, dropping packets while CoDel says the flow has
+// a standing queue
+func (q *FQCoDel) codelDequeue(f *flow, now time.Time) *Packet {
+	p, okToDrop := q.codelPop(f, now)
+	if p == nil {
+		f.dropping = false
+		return nil
+	}
+
+	if f.dropping {
+		if !okToDrop {
+			f.dropping = false
+		}
+		for f.dropping && !now.Before(f.dropNext) {
+			q.stats.drop(p)
+			f.count++
+			if p, okToDrop = q.codelPop(f, now); p == nil || !okToDrop {
+				f.dropping = false
+			} else {
+				f.dropNext = q.controlLaw(f.dropNext, f.count)
+			}
+		}
+		return p
+	}
+
+	if okToDrop {
+		q.stats.drop(p)
+		p, _ = q.codelPop(f, now)
+		f.dropping = true
+
+		// start near the drop rate of the last dropping spell if it was recent
+		delta := f.count - f.lastCount
+		if delta > 1 && now.Sub(f.dropNext) < 16*q.interval {
+			f.count = delta
+		} else {
+			f.count = 1
+		}
+		f.lastCount = f.count
+		f.dropNext = q.controlLaw(now, f.count)
+	}
+	return p
+}
+
+// pops the head of a flow and reports whether CoDel would drop it
+func (q *FQCoDel) codelPop(f *flow, now time.Time) (*Packet, bool) {
+	p := f.queue.pop()
+	if p == nil {
+		f.firstAbove = time.Time{}
+		return nil, false
+	}
+
+	// a queue of at most one frame is not a standing queue
+	if now.Sub(p.enqueued) < q.target || f.queue.bytes <= q.maxPacket {
+		f.firstAbove = time.Time{}
+		return p, false
+	}
+	if f.firstAbove.IsZero() {
+		f.firstAbove = now.Add(q.interval)
+		return p, false
+	}
+	return p, !now.Before(f.firstAbove)
+}
+
+// next drop time: drops get closer together with the square root of their count
+func (q *FQCoDel) controlLaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(q.interval) / math.Sqrt(float64(count))))
+}
+
+func (q *FQCoDel) Stats() Stats {
+	return q.stats
+}
+
+func (q *FQCoDel) String() string {
+	return fmt.Sprintf("fq_codel limit %d flows %d quantum %d target %s interval %s",
+		q.limit, len(q.flows), q.quantum, q.target, q.interval)
+}
@@ -0,0 +1,176 @@
+package qdisc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builds a qdisc from a tc-like description:
+//
+//	pfifo [limit PACKETS]
+//	prio [limit PACKETS]
+//	tbf rate RATE burst SIZE [limit SIZE]
+//	fq_codel [limit PACKETS] [flows N] [quantum BYTES] [target DURATION] [interval DURATION]
+//
+// rates take tc units (bit, kbit, mbit, gbit, bps, kbps, mbps), sizes b, k and m
+func Parse(args []string) (Qdisc, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing qdisc kind")
+	}
+	kind := args[0]
+
+	params := make(map[string]string)
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %q", args[i])
+		}
+		params[args[i]] = args[i+1]
+	}
+	p := parser{params: params}
+
+	var q Qdisc
+	switch kind {
+	case "pfifo":
+		q = NewPFIFO(p.count("limit", DefaultLimit))
+	case "prio":
+		q = NewPrio(p.count("limit", DefaultLimit))
+	case "tbf":
+		rate := p.rate("rate")
+		burst := p.size("burst", 0)
+		if rate == 0 || burst == 0 {
+			return nil, fmt.Errorf("tbf needs a rate and a burst")
+		}
+		q = NewTBF(rate, burst, p.size("limit", 10*burst))
+	case "fq_codel":
+		q = NewFQCoDel(p.count("limit", DefaultFQLimit), p.count("flows", DefaultFlows), p.count("quantum", DefaultQuantum),
+			p.duration("target", DefaultTarget), p.duration("interval", DefaultInterval))
+	default:
+		return nil, fmt.Errorf("unknown qdisc %q", kind)
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	for key := range params {
+		return nil, fmt.Errorf("%s has no parameter %q", kind, key)
+	}
+	return q, nil
+}
+
+// consumes parameters, keeping the first error
+type parser struct {
+	params map[string]string
+	err    error
+}
+
+// removes and returns a parameter
+func (p *parser) take(key string) (string, bool) {
+	v, ok := p.params[key]
+	delete(p.params, key)
+	return v, ok
+}
+
+func (p *parser) fail(key, v string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q", key, v)
+	}
+}
+
+func (p *parser) count(key string, def int) int {
+	v, ok := p.take(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		p.fail(key, v)
+	}
+	return n
+}
+
+func (p *parser) duration(key string, def time.Duration) time.Duration {
+	v, ok := p.take(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		p.fail(key, v)
+	}
+	return d
+}
+
+// units of rates, in bytes per second
+var rateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	// longest suffixes first so "kbit" isn't read as "bit"
+	{"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8}, {"bit", 1.0 / 8},
+	{"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1},
+}
+
+// returns a rate in bytes per second, 0 if it's missing
+func (p *parser) rate(key string) uint64 {
+	v, ok := p.take(key)
+	if !ok {
+		return 0
+	}
+	for _, u := range rateUnits {
+		if num, found := strings.CutSuffix(v, u.suffix); found {
+			f, err := strconv.ParseFloat(num, 64)
+			if err != nil || f <= 0 || f*u.scale < 1 {
+				break
+			}
+			return uint64(f * u.scale)
+		}
+	}
+	p.fail(key, v)
+	return 0
+}
+
+func (p *parser) size(key string, def int) int {
+	v, ok := p.take(key)
+	if !ok {
+		return def
+	}
+	scale := 1
+	switch {
+	case strings.HasSuffix(v, "k"):
+		scale, v = 1024, strings.TrimSuffix(v, "k")
+	case strings.HasSuffix(v, "m"):
+		scale, v = 1024*1024, strings.TrimSuffix(v, "m")
+	default:
+		v = strings.TrimSuffix(v, "b")
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		p.fail(key, v)
+	}
+	return n * scale
+}
+
+func formatRate(bytesPerSec uint64) string {
+	bits := bytesPerSec * 8
+	switch {
+	case bits >= 1e9 && bits%1e9 == 0:
+		return fmt.Sprintf("%dgbit", bits/1e9)
+	case bits >= 1e6 && bits%1e6 == 0:
+		return fmt.Sprintf("%dmbit", bits/1e6)
+	case bits >= 1e3 && bits%1e3 == 0:
+		return fmt.Sprintf("%dkbit", bits/1e3)
+	}
+	return fmt.Sprintf("%dbit", bits)
+}
+
+func formatSize(bytes int) string {
+	switch {
+	case bytes >= 1024*1024 && bytes%(1024*1024) == 0:
+		return fmt.Sprintf("%dm", bytes/(1024*1024))
+	case bytes >= 1024 && bytes%1024 == 0:
+		return fmt.Sprintf("%dk", bytes/1024)
+	}
+	return fmt.Sprintf("%db", bytes)
+}
@@ -0,0 +1,77 @@
+package qdisc
+
+import (
+	"fmt"
+	"time"
+)
+
+// a packet FIFO, the building block of the other disciplines
+type fifo struct {
+	packets []*Packet
+	bytes   int
+}
+
+func (f *fifo) push(p *Packet) {
+	f.packets = append(f.packets, p)
+	f.bytes += p.Len()
+}
+
+func (f *fifo) peek() *Packet {
+	if len(f.packets) == 0 {
+		return nil
+	}
+	return f.packets[0]
+}
+
+func (f *fifo) pop() *Packet {
+	if len(f.packets) == 0 {
+		return nil
+	}
+	p := f.packets[0]
+	f.packets[0] = nil
+	f.packets = f.packets[1:]
+	f.bytes -= p.Len()
+	return p
+}
+
+func (f *fifo) len() int {
+	return len(f.packets)
+}
+
+// first in, first out with tail drop once limit packets are queued
+type PFIFO struct {
+	limit int
+	queue fifo
+	stats Stats
+}
+
+func NewPFIFO(limit int) *PFIFO {
+	return &PFIFO{limit: limit}
+}
+
+func (q *PFIFO) Enqueue(p *Packet, now time.Time) bool {
+	if q.queue.len() >= q.limit {
+		q.stats.Drops++
+		return false
+	}
+	p.enqueued = now
+	q.queue.push(p)
+	q.stats.enqueue(p)
+	return true
+}
+
+func (q *PFIFO) Dequeue(now time.Time) (*Packet, time.Duration) {
+	p := q.queue.pop()
+	if p != nil {
+		q.stats.dequeue(p)
+	}
+	return p, 0
+}
+
+func (q *PFIFO) Stats() Stats {
+	return q.stats
+}
+
+func (q *PFIFO) String() string {
+	return fmt.Sprintf("pfifo limit %d", q.limit)
+}
@@ -0,0 +1,64 @@
+package qdisc
+
+import (
+	"fmt"
+	"time"
+)
+
+// number of bands of Prio
+const PrioBands = 3
+
+// strict priority between three FIFO bands picked by DSCP: band 0 is always
+// emptied before band 1, band 1 before band 2. Each band holds up to limit packets
+type Prio struct {
+	limit int
+	bands [PrioBands]fifo
+	stats Stats
+}
+
+func NewPrio(limit int) *Prio {
+	return &Prio{limit: limit}
+}
+
+// returns the band of a DSCP value: network control and expedited forwarding
+// (CS5 and above, RFC 4594) go first, lower effort (LE, RFC 8622, and CS1)
+// last, everything else in between
+func Band(dscp uint8) int {
+	switch {
+	case dscp >= 40:
+		return 0
+	case dscp == 1 || dscp == 8:
+		return 2
+	}
+	return 1
+}
+
+func (q *Prio) Enqueue(p *Packet, now time.Time) bool {
+	band := &q.bands[Band(p.DSCP())]
+	if band.len() >= q.limit {
+		q.stats.Drops++
+		return false
+	}
+	p.enqueued = now
+	band.push(p)
+	q.stats.enqueue(p)
+	return true
+}
+
+func (q *Prio) Dequeue(now time.Time) (*Packet, time.Duration) {
+	for i := range q.bands {
+		if p := q.bands[i].pop(); p != nil {
+			q.stats.dequeue(p)
+			return p, 0
+		}
+	}
+	return nil, 0
+}
+
+func (q *Prio) Stats() Stats {
+	return q.stats
+}
+
+func (q *Prio) String() string {
+	return fmt.Sprintf("prio limit %d", q.limit)
+}
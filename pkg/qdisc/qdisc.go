@@ -0,0 +1,154 @@
+package qdisc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// returned by Scheduler.Send when the qdisc refuses a frame
+var ErrDropped = errors.New("dropped by qdisc")
+
+// a frame waiting on the egress queue of a NIC
+type Packet struct {
+	Frame    []byte // serialized Ethernet frame
+	enqueued time.Time
+}
+
+func (p *Packet) Len() int {
+	return len(p.Frame)
+}
+
+// EtherTypes the qdiscs look into
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+)
+
+// returns the IP packet of the frame and its version, nil for anything else
+func (p *Packet) ip() ([]byte, int) {
+	if len(p.Frame) < 14 {
+		return nil, 0
+	}
+	switch binary.BigEndian.Uint16(p.Frame[12:14]) {
+	case etherTypeIPv4:
+		if len(p.Frame) >= 14+20 {
+			return p.Frame[14:], 4
+		}
+	case etherTypeIPv6:
+		if len(p.Frame) >= 14+40 {
+			return p.Frame[14:], 6
+		}
+	}
+	return nil, 0
+}
+
+// returns the DSCP of an IP frame (the upper 6 bits of the IPv4 TOS or the
+// IPv6 Traffic Class), 0 for anything else
+func (p *Packet) DSCP() uint8 {
+	switch ip, version := p.ip(); version {
+	case 4:
+		return ip[1] >> 2
+	case 6:
+		return (ip[0]<<4 | ip[1]>>4) >> 2
+	}
+	return 0
+}
+
+// returns the bytes identifying the flow of the frame: protocol, addresses and
+// ports of IPv4 packets (ports only for unfragmented TCP and UDP), the same
+// plus the flow label for IPv6, the EtherType and destination MAC of anything else
+func (p *Packet) flowKey() []byte {
+	ip, version := p.ip()
+	switch version {
+	case 4:
+		key := make([]byte, 0, 13)
+		key = append(key, ip[9])
+		key = append(key, ip[12:20]...)
+
+		headerLen := int(ip[0]&0x0F) * 4
+		fragmented := binary.BigEndian.Uint16(ip[6:8])&0x3FFF != 0
+		if (ip[9] == 6 || ip[9] == 17) && !fragmented && len(ip) >= headerLen+4 {
+			key = append(key, ip[headerLen:headerLen+4]...)
+		}
+		return key
+	case 6:
+		next, off := ip6Transport(ip)
+		key := make([]byte, 0, 40)
+		key = append(key, next)
+		key = append(key, ip[8:40]...)
+		key = append(key, ip[1]&0x0F, ip[2], ip[3])
+		if (next == 6 || next == 17) && len(ip) >= off+4 {
+			key = append(key, ip[off:off+4]...)
+		}
+		return key
+	}
+	return append(p.Frame[12:14:14], p.Frame[0:6]...)
+}
+
+// skips the hop-by-hop, routing and destination options headers of an IPv6
+// packet, returns the header that follows and its offset. A fragment header
+// is returned as is, later fragments carry no ports
+func ip6Transport(ip []byte) (uint8, int) {
+	next, off := ip[6], 40
+	for (next == 0 || next == 43 || next == 60) && len(ip) >= off+2 {
+		next, off = ip[off], off+(int(ip[off+1])+1)*8
+	}
+	return next, off
+}
+
+// counters of a qdisc, shaped like `tc -s qdisc`
+type Stats struct {
+	Packets      uint64 // sent
+	Bytes        uint64
+	Drops        uint64
+	Overlimits   uint64 // times a packet had to wait for the rate limit
+	Backlog      int    // packets queued right now
+	BacklogBytes int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("sent %d bytes %d pkt (dropped %d, overlimits %d) backlog %db %dp",
+		s.Bytes, s.Packets, s.Drops, s.Overlimits, s.BacklogBytes, s.Backlog)
+}
+
+func (s *Stats) enqueue(p *Packet) {
+	s.Backlog++
+	s.BacklogBytes += p.Len()
+}
+
+func (s *Stats) dequeue(p *Packet) {
+	s.Backlog--
+	s.BacklogBytes -= p.Len()
+	s.Packets++
+	s.Bytes += uint64(p.Len())
+}
+
+// counts a queued packet that got dropped
+func (s *Stats) drop(p *Packet) {
+	s.Backlog--
+	s.BacklogBytes -= p.Len()
+	s.Drops++
+}
+
+// a queueing discipline: decides which queued frame goes out next, and when
+// implementations are not safe for concurrent use, the Scheduler serializes them
+type Qdisc interface {
+	// queues a packet, false if it was dropped instead
+	Enqueue(p *Packet, now time.Time) bool
+	// returns the next packet to send, or nil and how long to wait before
+	// asking again (0 means until something is queued)
+	Dequeue(now time.Time) (*Packet, time.Duration)
+	Stats() Stats
+	// the discipline and its parameters, in Parse syntax
+	String() string
+}
+
+// the qdisc of new NICs, a three band prio like Linux's pfifo_fast
+func Default() Qdisc {
+	return NewPrio(DefaultLimit)
+}
+
+// default queue length in packets (Linux txqueuelen)
+const DefaultLimit = 1000
@@ -0,0 +1,167 @@
+package qdisc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/maphash"
+	"slices"
+	"testing"
+	"time"
+)
+
+const frameLen = 100
+
+// builds a 100 byte Ethernet frame carrying a UDP datagram over IPv4
+func frame4(dscp uint8, srcPort, dstPort uint16) []byte {
+	f := make([]byte, frameLen)
+	binary.BigEndian.PutUint16(f[12:14], etherTypeIPv4)
+	ip := f[14:]
+	ip[0] = 0x45
+	ip[1] = dscp << 2
+	ip[9] = 17
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(ip[20:22], srcPort)
+	binary.BigEndian.PutUint16(ip[22:24], dstPort)
+	return f
+}
+
+// the same over IPv6, with a flow label and optionally a hop-by-hop header
+// in front of UDP
+func frame6(dscp uint8, label uint32, srcPort, dstPort uint16, hopByHop bool) []byte {
+	f := make([]byte, frameLen)
+	binary.BigEndian.PutUint16(f[12:14], etherTypeIPv6)
+	ip := f[14:]
+	binary.BigEndian.PutUint32(ip[0:4], 6<<28|uint32(dscp)<<22|label)
+	ip[6] = 17
+	ip[8], ip[23] = 0x20, 1
+	ip[24], ip[39] = 0x20, 2
+	l4 := ip[40:]
+	if hopByHop {
+		ip[6] = 0
+		l4[0] = 17
+		l4 = l4[8:]
+	}
+	binary.BigEndian.PutUint16(l4[0:2], srcPort)
+	binary.BigEndian.PutUint16(l4[2:4], dstPort)
+	return f
+}
+
+func TestDSCP(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint8
+	}{
+		{"ipv4 best effort", frame4(0, 1, 2), 0},
+		{"ipv4 EF", frame4(46, 1, 2), 46},
+		{"ipv6 EF", frame6(46, 0, 1, 2, false), 46},
+		{"ipv6 CS1", frame6(8, 0xfffff, 1, 2, false), 8},
+		{"arp", append([]byte{12: 0x08, 13: 0x06}, make([]byte, 28)...), 0},
+	}
+	for _, tt := range tests {
+		if got := (&Packet{Frame: tt.frame}).DSCP(); got != tt.want {
+			t.Errorf("%s: DSCP = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFlowKey(t *testing.T) {
+	key := func(f []byte) []byte { return (&Packet{Frame: f}).flowKey() }
+	tests := []struct {
+		name string
+		a, b []byte
+		same bool
+	}{
+		{"ipv4 same flow", frame4(0, 1, 2), frame4(46, 1, 2), true},
+		{"ipv4 ports", frame4(0, 1, 2), frame4(0, 1, 3), false},
+		{"ipv6 same flow", frame6(0, 5, 1, 2, false), frame6(46, 5, 1, 2, false), true},
+		{"ipv6 ports", frame6(0, 5, 1, 2, false), frame6(0, 5, 1, 3, false), false},
+		{"ipv6 flow label", frame6(0, 5, 1, 2, false), frame6(0, 6, 1, 2, false), false},
+		{"ipv6 ports behind hop-by-hop", frame6(0, 5, 1, 2, true), frame6(0, 5, 1, 3, true), false},
+	}
+	for _, tt := range tests {
+		if same := bytes.Equal(key(tt.a), key(tt.b)); same != tt.same {
+			t.Errorf("%s: same flow = %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+// enqueues the frames at the same instant and returns the order they leave in
+func drain(q Qdisc, frames ...[]byte) []int {
+	now := time.Now()
+	index := make(map[*Packet]int)
+	for i, f := range frames {
+		p := &Packet{Frame: f}
+		index[p] = i
+		q.Enqueue(p, now)
+	}
+
+	var order []int
+	for {
+		p, wait := q.Dequeue(now)
+		if p == nil {
+			if wait == 0 {
+				return order
+			}
+			now = now.Add(wait)
+			continue
+		}
+		order = append(order, index[p])
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	// two IPv6 flows to the same next hop, the first one with a backlog
+	flowA, flowB := frame6(0, 0, 1000, 80, false), frame6(0, 0, 1001, 80, false)
+	fq := NewFQCoDel(DefaultFQLimit, DefaultFlows, frameLen, DefaultTarget, DefaultInterval)
+	bucket := func(f []byte) uint64 {
+		return maphash.Bytes(fq.seed, (&Packet{Frame: f}).flowKey()) % uint64(len(fq.flows))
+	}
+	for bucket(flowA) == bucket(flowB) {
+		fq.seed = maphash.MakeSeed()
+	}
+
+	tests := []struct {
+		name   string
+		q      Qdisc
+		frames [][]byte
+		want   []int
+	}{
+		{"pfifo", NewPFIFO(DefaultLimit), [][]byte{frame4(46, 1, 2), frame4(0, 1, 2), frame6(8, 0, 1, 2, false)}, []int{0, 1, 2}},
+		{"pfifo tail drop", NewPFIFO(2), [][]byte{frame4(0, 1, 2), frame4(0, 1, 2), frame4(0, 1, 2)}, []int{0, 1}},
+		{
+			"prio",
+			NewPrio(DefaultLimit),
+			[][]byte{frame4(8, 1, 2), frame6(0, 0, 1, 2, false), frame6(46, 0, 1, 2, false), frame4(0, 1, 2), frame4(48, 1, 2)},
+			[]int{2, 4, 1, 3, 0},
+		},
+		{"fq_codel", fq, [][]byte{flowA, flowA, flowA, flowB}, []int{0, 3, 1, 2}},
+		{"tbf", NewTBF(1000, frameLen, 10*frameLen), [][]byte{frame4(0, 1, 2), frame4(46, 1, 2), frame4(0, 1, 2)}, []int{0, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		if got := drain(tt.q, tt.frames...); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: order %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTBFRate(t *testing.T) {
+	q := NewTBF(1000, frameLen, 10*frameLen)
+	now := time.Now()
+	q.Enqueue(&Packet{Frame: frame4(0, 1, 2)}, now)
+	q.Enqueue(&Packet{Frame: frame4(0, 1, 2)}, now)
+
+	if p, _ := q.Dequeue(now); p == nil {
+		t.Fatal("burst held back")
+	}
+	// 100 bytes at 1000 bytes/s
+	p, wait := q.Dequeue(now)
+	if p != nil || wait != 100*time.Millisecond {
+		t.Fatalf("second frame: %v after %s", p, wait)
+	}
+	if p, _ := q.Dequeue(now.Add(wait)); p == nil {
+		t.Fatal("frame not sent once the bucket refilled")
+	}
+}
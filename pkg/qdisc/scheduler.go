@@ -0,0 +1,82 @@
+package qdisc
+
+import (
+	"sync"
+	"time"
+)
+
+// drives the qdisc of a NIC: senders enqueue frames, Run dequeues them onto
+// the link when the qdisc lets them go. Safe for concurrent use
+type Scheduler struct {
+	mu    sync.Mutex
+	q     Qdisc
+	write func(frame []byte) error
+	wake  chan struct{}
+}
+
+func NewScheduler(q Qdisc, write func(frame []byte) error) *Scheduler {
+	return &Scheduler{q: q, write: write, wake: make(chan struct{}, 1)}
+}
+
+// queues a frame for transmission, fails with ErrDropped if the qdisc refused it
+func (s *Scheduler) Send(frame []byte) error {
+	s.mu.Lock()
+	ok := s.q.Enqueue(&Packet{Frame: frame}, time.Now())
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrDropped
+	}
+	s.kick()
+	return nil
+}
+
+func (s *Scheduler) kick() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sends queued frames, never returns. Write errors are ignored, the frame is
+// lost like on a real link
+func (s *Scheduler) Run() {
+	for {
+		s.mu.Lock()
+		p, wait := s.q.Dequeue(time.Now())
+		s.mu.Unlock()
+
+		if p != nil {
+			s.write(p.Frame)
+			continue
+		}
+
+		if wait <= 0 {
+			<-s.wake
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// swaps the qdisc, frames queued on the old one are dropped (like tc qdisc replace)
+func (s *Scheduler) Replace(q Qdisc) {
+	s.mu.Lock()
+	s.q = q
+	s.mu.Unlock()
+
+	s.kick()
+}
+
+// returns the current qdisc and its counters
+func (s *Scheduler) Qdisc() (Qdisc, Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.q, s.q.Stats()
+}
@@ -0,0 +1,66 @@
+package qdisc
+
+import (
+	"fmt"
+	"time"
+)
+
+// token bucket filter: shapes traffic to rate bytes per second, letting bursts
+// of up to burst bytes through at line speed. At most limit bytes wait in the
+// queue, the rest is dropped
+type TBF struct {
+	rate   uint64 // bytes per second
+	burst  int
+	limit  int
+	tokens float64 // bytes we may send right now, at most burst
+	last   time.Time
+	queue  fifo
+	stats  Stats
+}
+
+func NewTBF(rate uint64, burst, limit int) *TBF {
+	return &TBF{rate: rate, burst: burst, limit: limit, tokens: float64(burst)}
+}
+
+func (q *TBF) Enqueue(p *Packet, now time.Time) bool {
+	// a frame bigger than the bucket could never leave
+	if p.Len() > q.burst || q.queue.bytes+p.Len() > q.limit {
+		q.stats.Drops++
+		return false
+	}
+	p.enqueued = now
+	q.queue.push(p)
+	q.stats.enqueue(p)
+	return true
+}
+
+func (q *TBF) Dequeue(now time.Time) (*Packet, time.Duration) {
+	p := q.queue.peek()
+	if p == nil {
+		return nil, 0
+	}
+
+	if !q.last.IsZero() {
+		q.tokens += now.Sub(q.last).Seconds() * float64(q.rate)
+		q.tokens = min(q.tokens, float64(q.burst))
+	}
+	q.last = now
+
+	if missing := float64(p.Len()) - q.tokens; missing > 0 {
+		q.stats.Overlimits++
+		return nil, time.Duration(missing / float64(q.rate) * float64(time.Second))
+	}
+
+	q.tokens -= float64(p.Len())
+	q.queue.pop()
+	q.stats.dequeue(p)
+	return p, 0
+}
+
+func (q *TBF) Stats() Stats {
+	return q.stats
+}
+
+func (q *TBF) String() string {
+	return fmt.Sprintf("tbf rate %s burst %s limit %s", formatRate(q.rate), formatSize(q.burst), formatSize(q.limit))
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// how many destinations are tracked before idle ones are pruned
+const maxKeys = 4096
+
+// per-destination token buckets, like Linux's icmp_ratelimit: every destination
+// may get burst messages at once, then one per interval. Safe for concurrent use
+type Limiter struct {
+	mu       sync.Mutex
+	interval time.Duration // 0 lets everything through
+	burst    int
+	buckets  map[string]*bucket
+}
+
+// tokens are kept as time, one message costs interval
+type bucket struct {
+	tokens time.Duration
+	last   time.Time
+}
+
+func New(interval time.Duration, burst int) *Limiter {
+	return &Limiter{interval: interval, burst: burst, buckets: make(map[string]*bucket)}
+}
+
+// reports whether a message to dst may be sent now, taking a token if so
+func (l *Limiter) Allow(dst net.IP, now time.Time) bool {
+	if l.interval <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := time.Duration(l.burst) * l.interval
+	key := string(dst.To16())
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxKeys {
+			l.prune(now, full)
+		}
+		// every bucket is busy, someone is spraying us from many addresses
+		if len(l.buckets) >= maxKeys {
+			return false
+		}
+		b = &bucket{tokens: full, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(b.tokens+now.Sub(b.last), full)
+	b.last = now
+	if b.tokens < l.interval {
+		return false
+	}
+	b.tokens -= l.interval
+	return true
+}
+
+// forgets destinations whose bucket filled up again, they behave the same as
+// new ones. Caller holds the lock
+func (l *Limiter) prune(now time.Time, full time.Duration) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+)
+
+// reverse path filtering (RFC 3704), same modes as net.ipv4.conf.*.rp_filter
+type RPFilterMode int
+
+const (
+	RPFilterOff    RPFilterMode = iota
+	RPFilterStrict              // the route back to the source must use the incoming interface
+	RPFilterLoose               // the source must be reachable through any interface
+)
+
+var rpFilterNames = []string{"off", "strict", "loose"}
+
+func (m RPFilterMode) String() string {
+	if m < 0 || int(m) >= len(rpFilterNames) {
+		return "unknown"
+	}
+	return rpFilterNames[m]
+}
+
+func ParseRPFilterMode(s string) (RPFilterMode, error) {
+	for m, name := range rpFilterNames {
+		if name == s {
+			return RPFilterMode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rp_filter mode %q, want off, strict or loose", s)
+}
+
+// reports whether a packet from src arriving on iface passes reverse path filtering
+func (t *Table) ValidSource(src net.IP, iface string, mode RPFilterMode) bool {
+	if mode == RPFilterOff {
+		return true
+	}
+	r, ok := t.Lookup(src)
+	if !ok {
+		return false
+	}
+	return mode == RPFilterLoose || r.Interface == iface
+}
+
+// why a packet is considered bogus or spoofed (a martian, RFC 1812 5.3.7)
+type Martian int
+
+const (
+	NotMartian         Martian = iota
+	MartianZeroNet             // in 0.0.0.0/8
+	MartianLoopback            // in 127.0.0.0/8, which never shows up on a wire
+	MartianMulticast           // multicast source
+	MartianBroadcast           // limited or directed broadcast source
+	MartianReserved            // in 240.0.0.0/4
+	MartianLocalSource         // one of our own addresses as source
+	MartianReversePath         // failed reverse path filtering
+	NumMartians
+)
+
+var martianNames = [NumMartians]string{"none", "zeronet", "loopback", "multicast", "broadcast", "reserved", "local-source", "rp-filter"}
+
+func (m Martian) String() string {
+	if m < 0 || m >= NumMartians {
+		return "unknown"
+	}
+	return martianNames[m]
+}
+
+var (
+	zeroNet     = &net.IPNet{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
+	loopbackNet = &net.IPNet{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
+	reservedNet = &net.IPNet{IP: net.IPv4(240, 0, 0, 0).To4(), Mask: net.CIDRMask(4, 32)}
+)
+
+// checks a source address on its own, without knowing our addresses or routes
+func MartianSource(src net.IP) Martian {
+	switch {
+	case zeroNet.Contains(src):
+		return MartianZeroNet
+	case loopbackNet.Contains(src):
+		return MartianLoopback
+	case src.IsMulticast():
+		return MartianMulticast
+	case src.Equal(net.IPv4bcast):
+		return MartianBroadcast
+	case reservedNet.Contains(src):
+		return MartianReserved
+	}
+	return NotMartian
+}
+
+// checks a destination address on its own, the limited broadcast is fine
+func MartianDestination(dst net.IP) Martian {
+	switch {
+	case zeroNet.Contains(dst):
+		return MartianZeroNet
+	case loopbackNet.Contains(dst):
+		return MartianLoopback
+	case reservedNet.Contains(dst) && !dst.Equal(net.IPv4bcast):
+		return MartianReserved
+	}
+	return NotMartian
+}
@@ -0,0 +1,223 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// single entry of the routing table (like `ip route`)
+type Route struct {
+	Dst       *net.IPNet // destination prefix
+	Gateway   net.IP     // next hop, nil for directly connected networks
+	Interface string     // outgoing interface
+	Metric    int        // lower wins between routes with the same prefix
+	Src       net.IP     // preferred source address, may be nil
+}
+
+// returns the address a packet to dst must be sent to on the link
+func (r Route) NextHop(dst net.IP) net.IP {
+	if r.Gateway != nil {
+		return r.Gateway
+	}
+	return dst
+}
+
+func (r Route) String() string {
+	dst := r.Dst.String()
+	if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+		dst = "default"
+	}
+
+	str := dst
+	if r.Gateway != nil {
+		str += " via " + r.Gateway.String()
+	}
+	str += " dev " + r.Interface
+	if r.Src != nil {
+		str += " src " + r.Src.String()
+	}
+	if r.Metric != 0 {
+		str += fmt.Sprintf(" metric %d", r.Metric)
+	}
+	return str
+}
+
+// builds the route to the network an interface address lives in
+func Connected(addr *net.IPNet, iface string) Route {
+	return Route{
+		Dst:       &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask},
+		Interface: iface,
+		Src:       addr.IP,
+	}
+}
+
+// builds a default route through gw
+func Default(gw net.IP, iface string) Route {
+	return Route{
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Gateway:   gw,
+		Interface: iface,
+	}
+}
+
+// parses the `ip route` style syntax:
+// PREFIX|default [via GATEWAY] [dev IFACE] [metric N] [src ADDR]
+// dev falls back to defaultIface when omitted
+func ParseRoute(s string, defaultIface string) (Route, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Route{}, fmt.Errorf("empty route")
+	}
+
+	r := Route{Interface: defaultIface}
+	if fields[0] == "default" {
+		r.Dst = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	} else {
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return Route{}, fmt.Errorf("invalid prefix %q: %v", fields[0], err)
+		}
+		if dst.IP.To4() == nil {
+			return Route{}, fmt.Errorf("not an IPv4 prefix: %s", dst)
+		}
+		r.Dst = dst
+	}
+
+	for i := 1; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return Route{}, fmt.Errorf("missing value for %q", fields[i])
+		}
+		val := fields[i+1]
+
+		switch fields[i] {
+		case "via":
+			if r.Gateway = net.ParseIP(val).To4(); r.Gateway == nil {
+				return Route{}, fmt.Errorf("invalid gateway %q", val)
+			}
+		case "dev":
+			r.Interface = val
+		case "metric":
+			metric, err := strconv.Atoi(val)
+			if err != nil {
+				return Route{}, fmt.Errorf("invalid metric %q", val)
+			}
+			r.Metric = metric
+		case "src":
+			if r.Src = net.ParseIP(val).To4(); r.Src == nil {
+				return Route{}, fmt.Errorf("invalid source %q", val)
+			}
+		default:
+			return Route{}, fmt.Errorf("unknown route keyword %q", fields[i])
+		}
+	}
+
+	return r, nil
+}
+
+// routing table of one address family, safe for concurrent use
+// routes are kept sorted by prefix length (longest first) then metric,
+// so the first match of a linear scan is the longest-prefix match
+type Table struct {
+	mu     sync.RWMutex
+	routes []Route
+}
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+func sameRoute(a, b Route) bool {
+	return a.Dst.String() == b.Dst.String() && a.Gateway.Equal(b.Gateway) && a.Interface == b.Interface
+}
+
+// inserts a route, an identical destination/gateway/interface can only exist once
+func (t *Table) Add(r Route) error {
+	if r.Dst == nil {
+		return fmt.Errorf("route needs a destination")
+	}
+	dst := r.Dst.IP.To4()
+	if dst == nil {
+		dst = r.Dst.IP.To16()
+	}
+	r.Dst = &net.IPNet{IP: dst.Mask(r.Dst.Mask), Mask: r.Dst.Mask}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, existing := range t.routes {
+		if sameRoute(existing, r) {
+			return fmt.Errorf("route already exists: %s", existing)
+		}
+	}
+
+	t.routes = append(t.routes, r)
+	slices.SortStableFunc(t.routes, func(a, b Route) int {
+		aLen, _ := a.Dst.Mask.Size()
+		bLen, _ := b.Dst.Mask.Size()
+		if aLen != bLen {
+			return bLen - aLen
+		}
+		return a.Metric - b.Metric
+	})
+	return nil
+}
+
+// removes the route(s) for dst, optionally narrowed by gateway and interface
+func (t *Table) Delete(dst *net.IPNet, gw net.IP, iface string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	kept := t.routes[:0]
+	removed := 0
+	for _, r := range t.routes {
+		match := r.Dst.String() == dst.String() &&
+			(gw == nil || r.Gateway.Equal(gw)) &&
+			(iface == "" || r.Interface == iface)
+		if match {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	t.routes = kept
+
+	if removed == 0 {
+		return fmt.Errorf("no route to %s", dst)
+	}
+	return nil
+}
+
+// removes every route through an interface (e.g. when it goes away)
+func (t *Table) DeleteInterface(iface string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.routes = slices.DeleteFunc(t.routes, func(r Route) bool {
+		return r.Interface == iface
+	})
+}
+
+// longest-prefix match, ties broken by the lowest metric
+func (t *Table) Lookup(dst net.IP) (Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, r := range t.routes {
+		if r.Dst.Contains(dst) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// returns a copy of every route, in lookup order
+func (t *Table) Routes() []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return slices.Clone(t.routes)
+}
@@ -0,0 +1,133 @@
+package slaac
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// how interface identifiers are generated (Linux addr_gen_mode)
+type Mode int
+
+const (
+	EUI64         Mode = iota // derived from the MAC (RFC 4291 appendix A)
+	StablePrivacy             // stable per prefix but opaque (RFC 7217)
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "eui64":
+		return EUI64, nil
+	case "stable-privacy":
+		return StablePrivacy, nil
+	}
+	return 0, fmt.Errorf("unknown address generation mode %q (want eui64 or stable-privacy)", s)
+}
+
+func (m Mode) String() string {
+	if m == StablePrivacy {
+		return "stable-privacy"
+	}
+	return "eui64"
+}
+
+// host timers and limits (RFC 4861 10, RFC 7217 6, RFC 8981 3.8)
+const (
+	MaxRtrSolicitations     = 3
+	RtrSolicitationInterval = 4 * time.Second
+	MaxRtrSolicitationDelay = time.Second
+	IDGenRetries            = 3 // new stable identifiers tried after DAD failures
+	TempValidLifetime       = 48 * time.Hour
+	TempPreferredLifetime   = 24 * time.Hour
+	RegenAdvance            = 5 * time.Second // new temporary address this long before the old one is deprecated
+	MaxDesyncFactor         = 10 * time.Minute
+)
+
+// the prefix length SLAAC works with on Ethernet (RFC 4862 5.5.3 (d), RFC 2464 4)
+const PrefixLen = 64
+
+// a lifetime of all ones means forever (RFC 4861 4.6.2)
+const Infinity = 0xffffffff
+
+// the link-local prefix every interface configures an address in
+var LinkLocalPrefix = &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(PrefixLen, 128)}
+
+// returns the modified EUI-64 identifier of a MAC: ff:fe in the middle and
+// the universal/local bit flipped
+func EUI64ID(mac net.HardwareAddr) []byte {
+	return []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+}
+
+// returns the RFC 7217 identifier for prefix on an interface:
+// F(Prefix, Net_Iface, Network_ID, DAD_Counter, secret_key), with SHA-256 as F
+// and no Network_ID. dadCounter is bumped after each DAD failure
+func StableID(prefix *net.IPNet, iface string, dadCounter int, secret []byte) []byte {
+	h := sha256.New()
+	h.Write(prefix.IP.To16()[:8])
+	h.Write([]byte(iface))
+	h.Write([]byte{byte(dadCounter)})
+	h.Write(secret)
+	id := h.Sum(nil)[:8]
+	// a reserved value is astronomically unlikely, nudge it out of the way
+	if reservedID(id) {
+		id[7] ^= 0x01
+	}
+	return id
+}
+
+// returns a random identifier for a temporary address (RFC 8981 3.3.1)
+func TemporaryID() []byte {
+	id := make([]byte, 8)
+	for {
+		rand.Read(id)
+		if !reservedID(id) {
+			return id
+		}
+	}
+}
+
+// identifiers IANA reserves (RFC 5453): subnet-router anycast, the subnet
+// anycast range and the Proxy Mobile IPv6 one
+func reservedID(id []byte) bool {
+	v := binary.BigEndian.Uint64(id)
+	return v == 0 || v&^0x7f == 0xfdffffffffffff80 || v == 0x02005efffe005213
+}
+
+// builds the address of a /64 prefix with an interface identifier
+func Address(prefix *net.IPNet, id []byte) *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:8])
+	copy(ip[8:], id)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(PrefixLen, 128)}
+}
+
+// converts an advertised lifetime in seconds to an expiry time, zero for infinity
+func Expiry(now time.Time, lifetime uint32) time.Time {
+	if lifetime == Infinity {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(lifetime) * time.Second)
+}
+
+// the valid lifetime an autoconfigured address gets from an advertisement, given
+// when it would expire otherwise (RFC 4862 5.5.3 (e)): anything over two hours
+// or longer than what's left is taken, but an unauthenticated advertisement
+// can't cut the address short to less than two hours
+func ValidExpiry(now, current time.Time, advertised uint32) time.Time {
+	const twoHours = 2 * time.Hour
+
+	next := Expiry(now, advertised)
+	if advertised == Infinity || time.Duration(advertised)*time.Second > twoHours {
+		return next
+	}
+	if !current.IsZero() && next.After(current) {
+		return next
+	}
+	if !current.IsZero() && current.Sub(now) <= twoHours {
+		return current
+	}
+	return now.Add(twoHours)
+}
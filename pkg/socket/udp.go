@@ -0,0 +1,369 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hexhaust/mini-netstack/pkg/multicast"
+)
+
+var (
+	ErrAddrInUse = errors.New("address already in use")
+	ErrNoPorts   = errors.New("no ephemeral ports available")
+	ErrClosed    = errors.New("socket closed")
+	ErrFamily    = errors.New("address family not supported by socket")
+)
+
+// ephemeral port range (same as the Linux default ip_local_port_range)
+const (
+	EphemeralMin = 32768
+	EphemeralMax = 60999
+)
+
+// a received UDP datagram, dual-stack sockets get IPv4 addresses in their
+// v4-mapped form (::ffff:a.b.c.d, RFC 4291 2.5.5.2)
+type Datagram struct {
+	SrcIP   net.IP
+	DstIP   net.IP
+	SrcPort uint16
+	DstPort uint16
+	NIC     string // interface it arrived on, the zone of link-local addresses
+	Data    []byte
+}
+
+// called for every datagram delivered to a socket, on the stack's receive goroutine
+type Handler func(s *UDPSocket, d *Datagram)
+
+// sends a datagram on behalf of a socket, provided by the stack
+// a nil src lets the stack pick the source address, zone names the NIC
+// link-local and multicast IPv6 destinations are reached through
+type OutputFunc func(src, dst net.IP, srcPort, dstPort uint16, zone string, data []byte) error
+
+// changes the source filter of a socket for a group on a NIC, provided by the stack
+// an Include filter with no sources leaves the group
+type GroupFunc func(s *UDPSocket, group net.IP, nic string, f multicast.Filter) error
+
+// a group joined on a given NIC
+type membership struct {
+	group string
+	nic   string
+}
+
+// a UDP endpoint bound to a local address and port
+// LocalIP nil means any local address of either family (an IPv6 socket with
+// IPV6_V6ONLY off), 0.0.0.0 any IPv4 address and :: any IPv6 address only
+type UDPSocket struct {
+	LocalIP   net.IP
+	LocalPort uint16
+	Reuse     bool // several sockets may share the port (SO_REUSEADDR)
+
+	table   *UDPTable
+	handler Handler
+	closed  bool
+	groups  map[membership]multicast.Filter
+}
+
+// sends data to dst:port from the socket's address, a v4-mapped dst goes
+// out as IPv4
+func (s *UDPSocket) SendTo(dst net.IP, port uint16, data []byte) error {
+	return s.SendToZone(dst, "", port, data)
+}
+
+// same as SendTo for link-local and multicast IPv6 destinations, which need
+// the NIC they're reached through (the zone of fe80::1%tap0)
+func (s *UDPSocket) SendToZone(dst net.IP, zone string, port uint16, data []byte) error {
+	s.table.mu.RLock()
+	closed := s.closed
+	s.table.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	if !s.handles(dst) {
+		return fmt.Errorf("send to %s: %w", dst, ErrFamily)
+	}
+
+	var src net.IP
+	if !isAny(s.LocalIP) {
+		src = s.LocalIP
+	}
+	return s.table.output(src, dst, s.LocalPort, port, zone, data)
+}
+
+// answers a unicast datagram the socket received, from the address it was sent
+// to and through the NIC it came in on (like IP_PKTINFO on a wildcard socket)
+func (s *UDPSocket) Reply(d *Datagram, data []byte) error {
+	s.table.mu.RLock()
+	closed := s.closed
+	s.table.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	return s.table.output(d.DstIP, d.SrcIP, s.LocalPort, d.SrcPort, d.NIC, data)
+}
+
+// reports whether the socket's family covers ip
+func (s *UDPSocket) handles(ip net.IP) bool {
+	return s.LocalIP == nil || (s.LocalIP.To4() != nil) == (ip.To4() != nil)
+}
+
+// joins a multicast group on a NIC, receiving from any source
+// (IP_ADD_MEMBERSHIP, or IPV6_JOIN_GROUP for an IPv6 group)
+func (s *UDPSocket) JoinGroup(group net.IP, nic string) error {
+	return s.SetSourceFilter(group, nic, multicast.Filter{Mode: multicast.Exclude})
+}
+
+// leaves a multicast group on a NIC (IP_DROP_MEMBERSHIP, IPV6_LEAVE_GROUP)
+func (s *UDPSocket) LeaveGroup(group net.IP, nic string) error {
+	return s.SetSourceFilter(group, nic, multicast.Filter{Mode: multicast.Include})
+}
+
+// sets the full source filter for a group on a NIC (RFC 3678 setsourcefilter)
+// e.g. Include{S1,S2} only receives from S1 and S2, Exclude{S1} from everyone but S1
+// IPv4 groups are managed with IGMP, IPv6 ones with MLD
+func (s *UDPSocket) SetSourceFilter(group net.IP, nic string, f multicast.Filter) error {
+	if !group.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast group", group)
+	}
+	if !s.handles(group) {
+		return fmt.Errorf("join %s: %w", group, ErrFamily)
+	}
+	for _, src := range f.Sources {
+		if (src.To4() == nil) != (group.To4() == nil) {
+			return fmt.Errorf("source %s and group %s are of different families", src, group)
+		}
+	}
+
+	s.table.mu.Lock()
+	if s.closed {
+		s.table.mu.Unlock()
+		return ErrClosed
+	}
+	key := membership{group: string(group.To16()), nic: nic}
+	prev, joined := s.groups[key]
+	if !joined && !f.Member() {
+		s.table.mu.Unlock()
+		return fmt.Errorf("%s not joined on %s", group, nic)
+	}
+	if f.Member() {
+		s.groups[key] = f
+	} else {
+		delete(s.groups, key)
+	}
+	s.table.mu.Unlock()
+
+	if s.table.groups == nil {
+		return nil
+	}
+	err := s.table.groups(s, group, nic, f)
+	if err == nil {
+		return nil
+	}
+
+	// the stack refused (unknown NIC, ...), the socket keeps what it had so it
+	// neither receives nor leaves a group that was never joined
+	s.table.mu.Lock()
+	if !s.closed {
+		if joined {
+			s.groups[key] = prev
+		} else {
+			delete(s.groups, key)
+		}
+	}
+	s.table.mu.Unlock()
+	return err
+}
+
+// reports whether the socket wants a multicast datagram, caller holds the lock
+func (s *UDPSocket) wants(d *Datagram) bool {
+	f, ok := s.groups[membership{group: string(d.DstIP.To16()), nic: d.NIC}]
+	return ok && f.Allows(d.SrcIP)
+}
+
+// releases the port and leaves every group
+func (s *UDPSocket) Close() {
+	s.table.mu.Lock()
+	if s.closed {
+		s.table.mu.Unlock()
+		return
+	}
+	s.closed = true
+	socks := s.table.ports[s.LocalPort]
+	for i, other := range socks {
+		if other == s {
+			s.table.ports[s.LocalPort] = append(socks[:i:i], socks[i+1:]...)
+			break
+		}
+	}
+	if len(s.table.ports[s.LocalPort]) == 0 {
+		delete(s.table.ports, s.LocalPort)
+	}
+	groups := s.groups
+	s.groups = nil
+	s.table.mu.Unlock()
+
+	if s.table.groups == nil {
+		return
+	}
+	for m := range groups {
+		s.table.groups(s, net.IP(m.group), m.nic, multicast.Filter{Mode: multicast.Include})
+	}
+}
+
+func (s *UDPSocket) String() string {
+	addr := "*"
+	if s.LocalIP != nil {
+		addr = s.LocalIP.String()
+	}
+	return fmt.Sprintf("udp %s:%d", addr, s.LocalPort)
+}
+
+// UDP port table used to demultiplex incoming datagrams, safe for concurrent use
+type UDPTable struct {
+	mu     sync.RWMutex
+	ports  map[uint16][]*UDPSocket
+	output OutputFunc
+	groups GroupFunc
+	next   uint16
+}
+
+func NewUDPTable(output OutputFunc, groups GroupFunc) *UDPTable {
+	return &UDPTable{
+		ports:  make(map[uint16][]*UDPSocket),
+		output: output,
+		groups: groups,
+		next:   EphemeralMin,
+	}
+}
+
+func isAny(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
+
+// reports whether a socket bound to local takes datagrams sent to dst
+func matches(local, dst net.IP) bool {
+	if isAny(local) {
+		return local == nil || (local.To4() != nil) == (dst.To4() != nil)
+	}
+	return local.Equal(dst)
+}
+
+// reports whether sockets bound to a and b would take some of the same datagrams
+func overlaps(a, b net.IP) bool {
+	if isAny(a) && isAny(b) {
+		return a == nil || b == nil || (a.To4() != nil) == (b.To4() != nil)
+	}
+	if isAny(b) {
+		a, b = b, a
+	}
+	return matches(a, b)
+}
+
+// binds a socket to ip:port, port 0 picks an ephemeral port. A nil ip makes
+// a dual-stack socket, 0.0.0.0 and :: wildcard sockets of a single family,
+// and a v4-mapped address binds its IPv4 address. Two sockets may only share
+// a port if both ask for reuse or their addresses don't overlap
+func (t *UDPTable) Bind(ip net.IP, port uint16, reuse bool, h Handler) (*UDPSocket, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if port == 0 {
+		p, err := t.ephemeral()
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	}
+
+	for _, other := range t.ports[port] {
+		if overlaps(other.LocalIP, ip) && !(reuse && other.Reuse) {
+			return nil, fmt.Errorf("bind %v:%d: %w", ip, port, ErrAddrInUse)
+		}
+	}
+
+	s := &UDPSocket{LocalIP: ip, LocalPort: port, Reuse: reuse, table: t, handler: h, groups: make(map[membership]multicast.Filter)}
+	t.ports[port] = append(t.ports[port], s)
+	return s, nil
+}
+
+// finds a free port, caller holds the lock
+func (t *UDPTable) ephemeral() (uint16, error) {
+	for range EphemeralMax - EphemeralMin + 1 {
+		port := t.next
+		if t.next++; t.next > EphemeralMax {
+			t.next = EphemeralMin
+		}
+		if len(t.ports[port]) == 0 {
+			return port, nil
+		}
+	}
+	return 0, ErrNoPorts
+}
+
+// hands a datagram to the matching sockets and returns how many got it
+// unicast goes to the most specific socket (exact address beats wildcard),
+// broadcast goes to every wildcard socket on the port and those bound to
+// the broadcast address itself, multicast to every socket on the port that
+// joined the group on the arrival NIC and whose filter allows the source
+func (t *UDPTable) Deliver(d *Datagram, broadcast bool) int {
+	mcast := d.DstIP.IsMulticast()
+
+	t.mu.RLock()
+	var targets []*UDPSocket
+	for _, s := range t.ports[d.DstPort] {
+		if !matches(s.LocalIP, d.DstIP) {
+			continue
+		}
+		switch {
+		case mcast:
+			if s.wants(d) {
+				targets = append(targets, s)
+			}
+		case broadcast:
+			targets = append(targets, s)
+		case !isAny(s.LocalIP):
+			targets = []*UDPSocket{s}
+		case len(targets) == 0:
+			targets = append(targets, s)
+		}
+	}
+	t.mu.RUnlock()
+
+	// IPv4 datagrams reach dual-stack sockets through v4-mapped addresses
+	var mapped *Datagram
+	if d.SrcIP.To4() != nil {
+		copied := *d
+		copied.SrcIP, copied.DstIP = d.SrcIP.To16(), d.DstIP.To16()
+		mapped = &copied
+	}
+
+	// handlers run without the lock so they can send or close
+	for _, s := range targets {
+		if s.handler == nil {
+			continue
+		}
+		if s.LocalIP == nil && mapped != nil {
+			s.handler(s, mapped)
+		} else {
+			s.handler(s, d)
+		}
+	}
+	return len(targets)
+}
+
+// returns every bound socket
+func (t *UDPTable) Sockets() []*UDPSocket {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var list []*UDPSocket
+	for _, socks := range t.ports {
+		list = append(list, socks...)
+	}
+	return list
+}
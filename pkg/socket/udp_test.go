@@ -0,0 +1,72 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/multicast"
+)
+
+var errNoNIC = errors.New("no such NIC")
+
+// a stack with a single NIC, tap0, recording the filters it was asked to set
+func groupTable(set *[]multicast.Filter) *UDPTable {
+	return NewUDPTable(nil, func(s *UDPSocket, group net.IP, nic string, f multicast.Filter) error {
+		if nic != "tap0" {
+			return errNoNIC
+		}
+		*set = append(*set, f)
+		return nil
+	})
+}
+
+func TestJoinGroupRefused(t *testing.T) {
+	var set []multicast.Filter
+	table := groupTable(&set)
+	got := 0
+	s, err := table.Bind(nil, 5000, false, func(*UDPSocket, *Datagram) { got++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := net.IPv4(239, 1, 1, 1).To4()
+	deliver := func(nic string) {
+		table.Deliver(&Datagram{SrcIP: net.IPv4(192, 0, 2, 1).To4(), DstIP: group, DstPort: 5000, NIC: nic}, false)
+	}
+
+	// a join the stack refused leaves no membership behind
+	if err := s.JoinGroup(group, "nosuchdev"); !errors.Is(err, errNoNIC) {
+		t.Fatalf("join on an unknown NIC: %v", err)
+	}
+	deliver("nosuchdev")
+	if got != 0 {
+		t.Fatal("refused join still receives")
+	}
+	if err := s.LeaveGroup(group, "nosuchdev"); err == nil {
+		t.Fatal("leaving a refused join succeeded")
+	}
+
+	// a refused change keeps the filter the socket had
+	if err := s.JoinGroup(group, "tap0"); err != nil {
+		t.Fatal(err)
+	}
+	deliver("tap0")
+	if got != 1 {
+		t.Fatalf("joined socket got %d datagrams", got)
+	}
+	if err := s.JoinGroup(group, "nosuchdev"); err == nil {
+		t.Fatal("join on an unknown NIC succeeded")
+	}
+	deliver("tap0")
+	deliver("nosuchdev")
+	if got != 2 || len(set) != 1 {
+		t.Fatalf("got %d datagrams, %d filters set", got, len(set))
+	}
+
+	if err := s.LeaveGroup(group, "tap0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 2 || set[1].Member() {
+		t.Fatalf("filters set: %v", set)
+	}
+}
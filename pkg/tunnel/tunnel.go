@@ -0,0 +1,226 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+var (
+	ErrKeyMismatch = errors.New("GRE key doesn't match the tunnel")
+	ErrOutOfOrder  = errors.New("GRE sequence number out of order")
+	ErrNoSeq       = errors.New("GRE packet without sequence number on a sequenced tunnel")
+	ErrNotIPv4     = errors.New("tunnel payload isn't IPv4")
+)
+
+// encapsulation of a tunnel
+type Mode int
+
+const (
+	IPIP Mode = iota // IPv4 in IPv4 (RFC 2003)
+	GRE              // IPv4 in GRE in IPv4 (RFC 2784, keys and sequence numbers of RFC 2890)
+)
+
+func (m Mode) String() string {
+	if m == GRE {
+		return "gre"
+	}
+	return "ipip"
+}
+
+// the IP protocol of the outer packets
+func (m Mode) Protocol() uint8 {
+	if m == GRE {
+		return packets.ProtocolGRE
+	}
+	return packets.ProtocolIPIP
+}
+
+// a point-to-point tunnel to Remote, safe for concurrent use
+type Tunnel struct {
+	Name     string
+	Mode     Mode
+	Local    net.IP // outer source, nil to let the route pick it
+	Remote   net.IP // outer destination
+	TTL      uint8  // outer TTL, 0 to copy the inner packet's
+	Key      uint32 // GRE only, used when HasKey is set
+	HasKey   bool
+	Seq      bool // GRE only: number outgoing packets and drop reordered incoming ones
+	Checksum bool // GRE only: checksum outgoing packets
+
+	mu       sync.Mutex
+	sendSeq  uint32
+	recvSeq  uint32
+	received bool
+}
+
+// bytes the encapsulation adds in front of the inner packet
+func (t *Tunnel) Overhead() int {
+	if t.Mode == IPIP {
+		return 20
+	}
+	g := packets.GREHeader{Checksum: t.Checksum, HasKey: t.HasKey, HasSeq: t.Seq}
+	return 20 + g.HeaderLen()
+}
+
+// wraps an inner IPv4 packet, returns the payload of the outer packet
+func (t *Tunnel) Encapsulate(inner []byte) []byte {
+	if t.Mode == IPIP {
+		return inner
+	}
+
+	g := packets.GREHeader{
+		Checksum: t.Checksum, HasKey: t.HasKey, HasSeq: t.Seq,
+		Protocol: frames.EtherTypeIPv4, Key: t.Key, Payload: inner,
+	}
+	if t.Seq {
+		t.mu.Lock()
+		g.Seq = t.sendSeq
+		t.sendSeq++
+		t.mu.Unlock()
+	}
+	return g.Bytes()
+}
+
+// reports whether an outer packet from src to dst with the given protocol
+// belongs to this tunnel (GRE keys are checked by Decapsulate)
+func (t *Tunnel) Matches(protocol uint8, src, dst net.IP) bool {
+	return protocol == t.Mode.Protocol() && t.Remote.Equal(src) && (t.Local == nil || t.Local.Equal(dst))
+}
+
+// unwraps the payload of an outer packet, returns the inner IPv4 packet
+func (t *Tunnel) Decapsulate(payload []byte) ([]byte, error) {
+	if t.Mode == IPIP {
+		if len(payload) < 20 || payload[0]>>4 != 4 {
+			return nil, ErrNotIPv4
+		}
+		return payload, nil
+	}
+
+	g, err := packets.ParseGRE(payload)
+	if err != nil {
+		return nil, err
+	}
+	if g.Protocol != frames.EtherTypeIPv4 {
+		return nil, ErrNotIPv4
+	}
+	if g.HasKey != t.HasKey || g.Key != t.Key {
+		return nil, ErrKeyMismatch
+	}
+
+	// RFC 2890 2.2: with sequencing on, packets without a sequence number and
+	// anything not newer than the last packet are dropped (serial number
+	// arithmetic handles the wrap)
+	if t.Seq {
+		if !g.HasSeq {
+			return nil, ErrNoSeq
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.received && int32(g.Seq-t.recvSeq) <= 0 {
+			return nil, ErrOutOfOrder
+		}
+		t.recvSeq, t.received = g.Seq, true
+	}
+	return g.Payload, nil
+}
+
+func (t *Tunnel) String() string {
+	s := fmt.Sprintf("%s mode %s remote %s", t.Name, t.Mode, t.Remote)
+	if t.Local != nil {
+		s += " local " + t.Local.String()
+	}
+	if t.TTL != 0 {
+		s += fmt.Sprintf(" ttl %d", t.TTL)
+	}
+	if t.HasKey {
+		s += fmt.Sprintf(" key %d", t.Key)
+	}
+	if t.Seq {
+		s += " seq"
+	}
+	if t.Checksum {
+		s += " csum"
+	}
+	return s
+}
+
+// parses the `ip tunnel add` style syntax:
+// NAME mode ipip|gre remote ADDR [local ADDR] [ttl N] [key N] [seq] [csum]
+func Parse(s string) (*Tunnel, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing tunnel name")
+	}
+	t := &Tunnel{Name: fields[0]}
+
+	hasMode := false
+	for i := 1; i < len(fields); i++ {
+		switch fields[i] {
+		case "seq":
+			t.Seq = true
+			continue
+		case "csum":
+			t.Checksum = true
+			continue
+		}
+
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("missing value for %q", fields[i])
+		}
+		key, val := fields[i], fields[i+1]
+		i++
+
+		switch key {
+		case "mode":
+			switch val {
+			case "ipip":
+				t.Mode = IPIP
+			case "gre":
+				t.Mode = GRE
+			default:
+				return nil, fmt.Errorf("unknown mode %q, want ipip or gre", val)
+			}
+			hasMode = true
+		case "remote", "local":
+			ip := net.ParseIP(val).To4()
+			if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+				return nil, fmt.Errorf("invalid %s address %q", key, val)
+			}
+			if key == "remote" {
+				t.Remote = ip
+			} else {
+				t.Local = ip
+			}
+		case "ttl":
+			ttl, err := strconv.ParseUint(val, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ttl %q", val)
+			}
+			t.TTL = uint8(ttl)
+		case "key":
+			k, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %q", val)
+			}
+			t.Key, t.HasKey = uint32(k), true
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", key)
+		}
+	}
+
+	if !hasMode || t.Remote == nil {
+		return nil, fmt.Errorf("a tunnel needs a mode and a remote address")
+	}
+	if t.Mode == IPIP && (t.HasKey || t.Seq || t.Checksum) {
+		return nil, fmt.Errorf("key, seq and csum need mode gre")
+	}
+	return t, nil
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hexhaust/mini-netstack/pkg/frames"
+	"github.com/hexhaust/mini-netstack/pkg/packets"
+)
+
+var inner = append([]byte{0x45}, make([]byte, 19)...)
+
+func gre(key uint32, hasKey bool, seq uint32, hasSeq bool) []byte {
+	g := packets.GREHeader{HasKey: hasKey, Key: key, HasSeq: hasSeq, Seq: seq, Protocol: frames.EtherTypeIPv4, Payload: inner}
+	return g.Bytes()
+}
+
+func TestDecapsulate(t *testing.T) {
+	tun, err := Parse("gre1 mode gre remote 192.0.2.1 key 42 seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		pkt  []byte
+		err  error
+	}{
+		{"first", gre(42, true, 7, true), nil},
+		{"next", gre(42, true, 8, true), nil},
+		{"replayed", gre(42, true, 8, true), ErrOutOfOrder},
+		{"older", gre(42, true, 5, true), ErrOutOfOrder},
+		{"no sequence number", gre(42, true, 0, false), ErrNoSeq},
+		{"wrong key", gre(43, true, 9, true), ErrKeyMismatch},
+		{"no key", gre(0, false, 9, true), ErrKeyMismatch},
+		{"skipped ahead", gre(42, true, 100, true), nil},
+	}
+	for _, s := range steps {
+		got, err := tun.Decapsulate(s.pkt)
+		if !errors.Is(err, s.err) {
+			t.Fatalf("%s: err = %v, want %v", s.name, err, s.err)
+		}
+		if err == nil && len(got) != len(inner) {
+			t.Fatalf("%s: inner packet of %d bytes", s.name, len(got))
+		}
+	}
+}
+
+func TestEncapsulateRoundTrip(t *testing.T) {
+	tx, _ := Parse("gre1 mode gre remote 192.0.2.1 key 7 seq csum")
+	rx, _ := Parse("gre1 mode gre remote 192.0.2.2 key 7 seq csum")
+	for range 3 {
+		if _, err := rx.Decapsulate(tx.Encapsulate(inner)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
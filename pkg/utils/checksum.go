@@ -23,3 +23,24 @@ func Checksum(data []byte) uint16 {
 	// one's complement
 	return uint16(^sum)
 }
+
+// incrementally updates a checksum after a 16-bit word changed from old to new
+// RFC 1624 eqn. 3: HC' = ~(~HC + ~m + m')
+func UpdateChecksum(csum, old, new uint16) uint16 {
+	sum := uint32(^csum) + uint32(^old) + uint32(new)
+
+	for (sum >> 16) > 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+
+	return uint16(^sum)
+}
+
+// same as UpdateChecksum for a run of changed words (e.g. a 4 byte address)
+// old and new must have the same, even length
+func UpdateChecksumBytes(csum uint16, old, new []byte) uint16 {
+	for i := 0; i+1 < len(old); i += 2 {
+		csum = UpdateChecksum(csum, uint16(old[i])<<8|uint16(old[i+1]), uint16(new[i])<<8|uint16(new[i+1]))
+	}
+	return csum
+}